@@ -0,0 +1,132 @@
+// Package audit provides the audit trail of the user actions.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const defaultSize = 1000
+
+const (
+	ResultOK     = "ok"
+	ResultError  = "error"
+	ResultDenied = "denied"
+)
+
+// Event is a single user action.
+type Event struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	// Action is e.g. 'entry.add' or 'login'.
+	Action string `json:"action"`
+	// Target is the object of the action, e.g. an IP or a session ID.
+	Target string `json:"target,omitempty"`
+	// Result is one of: ok, error, denied.
+	Result string `json:"result"`
+	Detail string `json:"detail,omitempty"`
+	// RequestID is the ID of the HTTP request, also found in the access log.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+type config struct {
+	size     int
+	writer   io.Writer
+	timeFunc func() time.Time
+}
+
+type Option func(*config)
+
+// WithSize sets the number of the recent events kept in memory.
+func WithSize(size int) Option {
+	return func(c *config) {
+		c.size = size
+	}
+}
+
+// WithWriter sets the writer of all events, one JSON object per line.
+func WithWriter(w io.Writer) Option {
+	return func(c *config) {
+		c.writer = w
+	}
+}
+
+func WithTimeFunc(timeFunc func() time.Time) Option {
+	return func(c *config) {
+		c.timeFunc = timeFunc
+	}
+}
+
+// Trail keeps the recent events in memory and writes all events to the optional writer.
+type Trail struct {
+	mu       sync.Mutex
+	events   []Event
+	next     int
+	size     int
+	writer   io.Writer
+	timeFunc func() time.Time
+}
+
+func NewTrail(opts ...Option) *Trail {
+	cnf := config{
+		size:     defaultSize,
+		timeFunc: time.Now,
+	}
+	for _, opt := range opts {
+		opt(&cnf)
+	}
+
+	return &Trail{
+		events:   make([]Event, 0, cnf.size),
+		size:     cnf.size,
+		writer:   cnf.writer,
+		timeFunc: cnf.timeFunc,
+	}
+}
+
+// Record adds the event. The time is set when it is zero.
+func (t *Trail) Record(event Event) {
+	if event.Time.IsZero() {
+		event.Time = t.timeFunc()
+	}
+
+	log.Printf("audit: id=%v user=%q addr=%v action=%v target=%v result=%v %v",
+		event.RequestID, event.User, event.RemoteAddr, event.Action, event.Target, event.Result, event.Detail)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.events) < t.size {
+		t.events = append(t.events, event)
+	} else if t.size > 0 {
+		t.events[t.next] = event
+	}
+	if t.size > 0 {
+		t.next = (t.next + 1) % t.size
+	}
+
+	if t.writer != nil {
+		if err := json.NewEncoder(t.writer).Encode(event); err != nil {
+			log.Println(fmt.Errorf("audit: json.Encode(): %w", err))
+		}
+	}
+}
+
+// List returns the recent events, the newest first.
+func (t *Trail) List() []Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := make([]Event, 0, len(t.events))
+	for i := 0; i < len(t.events); i++ {
+		// walk back from the last written event
+		idx := (t.next - 1 - i + len(t.events)) % len(t.events)
+		list = append(list, t.events[idx])
+	}
+	return list
+}
@@ -0,0 +1,86 @@
+package audit_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/dkarczmarski/gomisc/ipfilter/audit"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTrail(t *testing.T) {
+	for _, tt := range []struct {
+		name            string
+		size            int
+		actions         []string
+		expectedActions []string
+	}{
+		{
+			name:            "empty",
+			size:            3,
+			expectedActions: []string{},
+		},
+		{
+			name:            "not full",
+			size:            3,
+			actions:         []string{"a", "b"},
+			expectedActions: []string{"b", "a"},
+		},
+		{
+			name:            "the oldest events are dropped",
+			size:            3,
+			actions:         []string{"a", "b", "c", "d", "e"},
+			expectedActions: []string{"e", "d", "c"},
+		},
+		{
+			name:            "nothing kept in memory",
+			size:            0,
+			actions:         []string{"a"},
+			expectedActions: []string{},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var fixedTime firewall.FixedTime
+			fixedTime.SetDateTime("2001-01-01 10:00:00")
+
+			var buf bytes.Buffer
+			trail := audit.NewTrail(
+				audit.WithSize(tt.size),
+				audit.WithWriter(&buf),
+				audit.WithTimeFunc(fixedTime.TimeFunc()),
+			)
+
+			for _, action := range tt.actions {
+				trail.Record(audit.Event{User: "admin", Action: action, Result: audit.ResultOK})
+			}
+
+			actual := make([]string, 0)
+			for _, event := range trail.List() {
+				actual = append(actual, event.Action)
+			}
+			if !reflect.DeepEqual(actual, tt.expectedActions) {
+				t.Errorf("actions: actual: %v expected: %v", actual, tt.expectedActions)
+			}
+
+			// all events are written
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if len(tt.actions) == 0 {
+				lines = nil
+			}
+			if len(lines) != len(tt.actions) {
+				t.Fatalf("written events: actual: %v expected: %v", len(lines), len(tt.actions))
+			}
+			for i, line := range lines {
+				var event audit.Event
+				if err := json.Unmarshal([]byte(line), &event); err != nil {
+					t.Fatal(err)
+				}
+				if event.Action != tt.actions[i] || !event.Time.Equal(firewall.MustParseDateTime("2001-01-01 10:00:00")) {
+					t.Errorf("written event %v: %+v", i, event)
+				}
+			}
+		})
+	}
+}
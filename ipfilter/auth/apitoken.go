@@ -0,0 +1,330 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APITokenPrefix starts the personal API tokens, so they are easy to recognize, e.g. by secret scanners.
+const APITokenPrefix = "ipf_"
+
+// The scopes of the personal API tokens.
+const (
+	ScopeMeRead       = "me:read"
+	ScopeMeAdd        = "me:add"
+	ScopeMeDelete     = "me:delete"
+	ScopeEntriesRead  = "entries:read"
+	ScopeEntriesWrite = "entries:write"
+	ScopeStatusRead   = "status:read"
+	// ScopeRequestsRead and ScopeRequestsWrite allow the access requests: listing, making and,
+	// for the admins, approving and rejecting them.
+	ScopeRequestsRead  = "requests:read"
+	ScopeRequestsWrite = "requests:write"
+	// ScopeAll allows everything the role of the user allows.
+	ScopeAll = "all"
+)
+
+var Scopes = []string{ScopeMeRead, ScopeMeAdd, ScopeMeDelete, ScopeEntriesRead, ScopeEntriesWrite, ScopeStatusRead,
+	ScopeRequestsRead, ScopeRequestsWrite, ScopeAll}
+
+var (
+	ErrAPITokenNotFound = errors.New("api token not found")
+	ErrAPITokenExpired  = errors.New("api token expired")
+	// ErrAPITokenUserUnknown is returned for a token of a removed user.
+	ErrAPITokenUserUnknown = errors.New("api token user unknown")
+)
+
+// APIToken describes a personal API token. The token itself is known only to its user.
+type APIToken struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	Digest    string    `json:"digest"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is zero for a token without expiry.
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// Expired reports whether the token has expired at the time.
+func (t APIToken) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+// ValidateScopes returns an error for no scope or an unknown one.
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("no scope")
+	}
+	for _, scope := range scopes {
+		if !containsString(Scopes, scope) {
+			return fmt.Errorf("unknown scope %q: expected one of: %v", scope, strings.Join(Scopes, ", "))
+		}
+	}
+	return nil
+}
+
+// HasScope reports whether the user may use the scope. Users authenticated
+// by other means than an API token have all scopes. It is false for nil.
+func (u *User) HasScope(scope string) bool {
+	if u == nil {
+		return false
+	}
+	return u.Scopes == nil || containsString(u.Scopes, ScopeAll) || containsString(u.Scopes, scope)
+}
+
+type apiTokensConfig struct {
+	file      string
+	timeFunc  func() time.Time
+	knownUser func(username string) bool
+}
+
+type APITokensOption func(*apiTokensConfig)
+
+// WithAPITokensFile sets the JSON file keeping the tokens. By default, they are kept in memory only.
+// The last use of a token is written with the next change of the tokens.
+func WithAPITokensFile(path string) APITokensOption {
+	return func(c *apiTokensConfig) {
+		c.file = path
+	}
+}
+
+func WithAPITokensTimeFunc(timeFunc func() time.Time) APITokensOption {
+	return func(c *apiTokensConfig) {
+		c.timeFunc = timeFunc
+	}
+}
+
+// WithAPITokensUserFunc sets the function checking that the user of a token still exists, e.g. Users.Exists.
+// By default, the tokens of all users are accepted.
+func WithAPITokensUserFunc(knownUser func(username string) bool) APITokensOption {
+	return func(c *apiTokensConfig) {
+		c.knownUser = knownUser
+	}
+}
+
+// APITokens keeps the personal API tokens of the users, accepted as 'Authorization: Bearer <token>'.
+// Only the digests of the tokens (see HashToken) are stored.
+type APITokens struct {
+	mu        sync.Mutex
+	file      string
+	timeFunc  func() time.Time
+	knownUser func(username string) bool
+	// tokens by the digest
+	tokens map[string]*APIToken
+}
+
+func NewAPITokens(opts ...APITokensOption) (*APITokens, error) {
+	cnf := apiTokensConfig{
+		timeFunc: time.Now,
+	}
+	for _, opt := range opts {
+		opt(&cnf)
+	}
+
+	t := &APITokens{
+		file:      cnf.file,
+		timeFunc:  cnf.timeFunc,
+		knownUser: cnf.knownUser,
+		tokens:    make(map[string]*APIToken),
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Create creates a token of the user. A zero ttl creates a token without expiry.
+// The returned token cannot be retrieved later.
+func (t *APITokens) Create(username, name string, scopes []string, ttl time.Duration) (string, APIToken, error) {
+	if err := ValidateScopes(scopes); err != nil {
+		return "", APIToken{}, err
+	}
+
+	token := APITokenPrefix + base64.RawURLEncoding.EncodeToString(randomBytes(32))
+	now := t.timeFunc()
+
+	apiToken := &APIToken{
+		ID:        hex.EncodeToString(randomBytes(8)),
+		Username:  username,
+		Name:      name,
+		Scopes:    scopes,
+		Digest:    HashToken(token),
+		CreatedAt: now,
+	}
+	if ttl > 0 {
+		apiToken.ExpiresAt = now.Add(ttl)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.tokens[apiToken.Digest] = apiToken
+	if err := t.save(); err != nil {
+		delete(t.tokens, apiToken.Digest)
+		return "", APIToken{}, err
+	}
+
+	return token, *apiToken, nil
+}
+
+// Get returns the token with the ID.
+func (t *APITokens) Get(id string) (APIToken, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, apiToken := range t.tokens {
+		if apiToken.ID == id {
+			return *apiToken, nil
+		}
+	}
+	return APIToken{}, fmt.Errorf("token %v: %w", id, ErrAPITokenNotFound)
+}
+
+// List returns the tokens of the user, or of all users for an empty username, ordered by the creation time.
+func (t *APITokens) List(username string) []APIToken {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := make([]APIToken, 0)
+	for _, apiToken := range t.tokens {
+		if len(username) == 0 || apiToken.Username == username {
+			list = append(list, *apiToken)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+
+	return list
+}
+
+// Revoke deletes the token with the ID.
+func (t *APITokens) Revoke(id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for digest, apiToken := range t.tokens {
+		if apiToken.ID == id {
+			delete(t.tokens, digest)
+			if err := t.save(); err != nil {
+				t.tokens[digest] = apiToken
+				return err
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("token %v: %w", id, ErrAPITokenNotFound)
+}
+
+// RevokeUser deletes all tokens of the user, e.g. after the user is removed. It returns the number of them.
+func (t *APITokens) RevokeUser(username string) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	revoked := make(map[string]*APIToken)
+	for digest, apiToken := range t.tokens {
+		if apiToken.Username == username {
+			revoked[digest] = apiToken
+			delete(t.tokens, digest)
+		}
+	}
+	if len(revoked) == 0 {
+		return 0, nil
+	}
+	if err := t.save(); err != nil {
+		for digest, apiToken := range revoked {
+			t.tokens[digest] = apiToken
+		}
+		return 0, err
+	}
+
+	return len(revoked), nil
+}
+
+// Authenticate returns the user of the token with the scopes of the token.
+// Other bearer tokens are reported as ErrNoCredentials, so e.g. the static tokens can be tried.
+func (t *APITokens) Authenticate(r *http.Request) (*User, error) {
+	token, ok := bearerToken(r)
+	if !ok || !strings.HasPrefix(token, APITokenPrefix) {
+		return nil, ErrNoCredentials
+	}
+
+	now := t.timeFunc()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	apiToken, ok := t.tokens[HashToken(token)]
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	if apiToken.Expired(now) {
+		return nil, fmt.Errorf("token %v: %w: %w", apiToken.ID, ErrIncorrectCredentials, ErrAPITokenExpired)
+	}
+	if t.knownUser != nil && !t.knownUser(apiToken.Username) {
+		return nil, fmt.Errorf("token %v: %w: %w", apiToken.ID, ErrIncorrectCredentials, ErrAPITokenUserUnknown)
+	}
+	apiToken.LastUsedAt = now
+
+	return &User{Username: apiToken.Username, Scopes: apiToken.Scopes, BearerToken: true}, nil
+}
+
+func (t *APITokens) load() error {
+	if len(t.file) == 0 {
+		return nil
+	}
+
+	data, err := os.ReadFile(t.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("os.ReadFile(): %w", err)
+	}
+
+	var list []*APIToken
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("json.Unmarshal(): %v: %w", t.file, err)
+	}
+	for _, apiToken := range list {
+		t.tokens[apiToken.Digest] = apiToken
+	}
+
+	return nil
+}
+
+func (t *APITokens) save() error {
+	if len(t.file) == 0 {
+		return nil
+	}
+
+	list := make([]*APIToken, 0, len(t.tokens))
+	for _, apiToken := range t.tokens {
+		list = append(list, apiToken)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent(): %w", err)
+	}
+
+	return writeFileAtomic(t.file, data)
+}
@@ -0,0 +1,181 @@
+package auth_test
+
+import (
+	"errors"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPITokens(t *testing.T) {
+	fixedTime := &firewall.FixedTime{}
+	fixedTime.SetDateTime("2001-01-01 10:00:00")
+
+	file := filepath.Join(t.TempDir(), "tokens.json")
+	apiTokens, err := auth.NewAPITokens(auth.WithAPITokensFile(file), auth.WithAPITokensTimeFunc(fixedTime.TimeFunc()))
+	noError(t, err)
+
+	if _, _, err := apiTokens.Create("alice", "ci", []string{"me:write"}, 0); err == nil {
+		t.Fatalf("expected error for an unknown scope")
+	}
+	if _, _, err := apiTokens.Create("alice", "ci", nil, 0); err == nil {
+		t.Fatalf("expected error for no scope")
+	}
+
+	ciToken, ci, err := apiTokens.Create("alice", "ci", []string{auth.ScopeMeAdd}, 24*time.Hour)
+	noError(t, err)
+	if !strings.HasPrefix(ciToken, auth.APITokenPrefix) || strings.Contains(ci.Digest, ciToken) {
+		t.Fatalf("unexpected token: %v digest: %v", ciToken, ci.Digest)
+	}
+	laptopToken, _, err := apiTokens.Create("bob", "laptop", []string{auth.ScopeAll}, 0)
+	noError(t, err)
+
+	// the steps share the state of the tokens
+	for _, tt := range []struct {
+		name           string
+		at             string
+		header         string
+		expectedErr    error
+		expectedUser   *auth.User
+		expectedScopes map[string]bool
+	}{
+		{
+			name:        "no header",
+			at:          "2001-01-01 10:00:00",
+			expectedErr: auth.ErrNoCredentials,
+		},
+		{
+			name:        "other bearer token",
+			at:          "2001-01-01 10:00:00",
+			header:      "Bearer static-token",
+			expectedErr: auth.ErrNoCredentials,
+		},
+		{
+			name:        "unknown api token",
+			at:          "2001-01-01 10:00:00",
+			header:      "Bearer " + auth.APITokenPrefix + "unknown",
+			expectedErr: auth.ErrNoCredentials,
+		},
+		{
+			name:           "scoped token",
+			at:             "2001-01-01 10:00:00",
+			header:         "Bearer " + ciToken,
+			expectedUser:   &auth.User{Username: "alice", Scopes: []string{auth.ScopeMeAdd}, BearerToken: true},
+			expectedScopes: map[string]bool{auth.ScopeMeAdd: true, auth.ScopeMeDelete: false, auth.ScopeEntriesRead: false},
+		},
+		{
+			name:           "token with all scopes",
+			at:             "2001-01-01 10:00:00",
+			header:         "bearer " + laptopToken,
+			expectedUser:   &auth.User{Username: "bob", Scopes: []string{auth.ScopeAll}, BearerToken: true},
+			expectedScopes: map[string]bool{auth.ScopeMeAdd: true, auth.ScopeEntriesWrite: true},
+		},
+		{
+			name:        "expired token",
+			at:          "2001-01-02 10:00:00",
+			header:      "Bearer " + ciToken,
+			expectedErr: auth.ErrAPITokenExpired,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fixedTime.SetDateTime(tt.at)
+
+			r := httptest.NewRequest("POST", "/api/me/add", nil)
+			if len(tt.header) > 0 {
+				r.Header.Set("Authorization", tt.header)
+			}
+
+			user, err := apiTokens.Authenticate(r)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("error: actual: %v expected: %v", err, tt.expectedErr)
+			}
+			if tt.expectedUser == nil {
+				return
+			}
+			if !reflect.DeepEqual(user, tt.expectedUser) {
+				t.Errorf("user: actual: %+v expected: %+v", user, tt.expectedUser)
+			}
+			for scope, expected := range tt.expectedScopes {
+				if user.HasScope(scope) != expected {
+					t.Errorf("scope %v: actual: %v expected: %v", scope, !expected, expected)
+				}
+			}
+		})
+	}
+
+	if len(apiTokens.List("alice")) != 1 || len(apiTokens.List("")) != 2 {
+		t.Fatalf("unexpected list: %+v", apiTokens.List(""))
+	}
+	if lastUsedAt := apiTokens.List("bob")[0].LastUsedAt; !lastUsedAt.Equal(firewall.MustParseDateTime("2001-01-01 10:00:00")) {
+		t.Errorf("last used at: %v", lastUsedAt)
+	}
+
+	noError(t, apiTokens.Revoke(ci.ID))
+	if err := apiTokens.Revoke(ci.ID); !errors.Is(err, auth.ErrAPITokenNotFound) {
+		t.Fatalf("revoke: actual: %v expected: %v", err, auth.ErrAPITokenNotFound)
+	}
+
+	// the tokens are kept in the file
+	reloaded, err := auth.NewAPITokens(auth.WithAPITokensFile(file), auth.WithAPITokensTimeFunc(fixedTime.TimeFunc()))
+	noError(t, err)
+	if list := reloaded.List(""); len(list) != 1 || list[0].Name != "laptop" {
+		t.Fatalf("unexpected reloaded list: %+v", list)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/me", nil)
+	r.Header.Set("Authorization", "Bearer "+laptopToken)
+	if user, err := reloaded.Authenticate(r); err != nil || user.Username != "bob" {
+		t.Errorf("reloaded token: user: %+v error: %v", user, err)
+	}
+}
+
+func TestAPITokens_RemovedUser(t *testing.T) {
+	users := auth.NewUsers([]auth.User{{Username: "alice"}, {Username: "bob"}})
+	apiTokens, err := auth.NewAPITokens(auth.WithAPITokensUserFunc(users.Exists))
+	noError(t, err)
+
+	aliceToken, _, err := apiTokens.Create("alice", "ci", []string{auth.ScopeAll}, 0)
+	noError(t, err)
+	_, _, err = apiTokens.Create("bob", "ci", []string{auth.ScopeAll}, 0)
+	noError(t, err)
+
+	users.Set([]auth.User{{Username: "bob"}})
+
+	r := httptest.NewRequest("GET", "/api/v1/me", nil)
+	r.Header.Set("Authorization", "Bearer "+aliceToken)
+	if _, err := apiTokens.Authenticate(r); !errors.Is(err, auth.ErrAPITokenUserUnknown) ||
+		!errors.Is(err, auth.ErrIncorrectCredentials) {
+		t.Fatalf("error: actual: %v expected: %v", err, auth.ErrAPITokenUserUnknown)
+	}
+
+	revoked, err := apiTokens.RevokeUser("alice")
+	noError(t, err)
+	if list := apiTokens.List(""); revoked != 1 || len(list) != 1 || list[0].Username != "bob" {
+		t.Errorf("revoked: %v list: %+v", revoked, list)
+	}
+}
+
+func TestUser_HasScope(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		user     *auth.User
+		expected bool
+	}{
+		{name: "nil user", user: nil, expected: false},
+		{name: "user without token", user: &auth.User{Username: "alice"}, expected: true},
+		{name: "token with scope", user: &auth.User{Username: "alice", Scopes: []string{auth.ScopeMeRead, auth.ScopeMeAdd}}, expected: true},
+		{name: "token without scope", user: &auth.User{Username: "alice", Scopes: []string{auth.ScopeMeRead}}, expected: false},
+		{name: "token with all scopes", user: &auth.User{Username: "alice", Scopes: []string{auth.ScopeAll}}, expected: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := tt.user.HasScope(auth.ScopeMeAdd); actual != tt.expected {
+				t.Errorf("actual: %v expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+var (
+	// ErrNoCredentials means that the request has no credentials for the authenticator,
+	// so the next authenticator in a chain can be tried.
+	ErrNoCredentials        = errors.New("no credentials")
+	ErrInvalidAuthHeader    = errors.New("invalid authorization header")
+	ErrIncorrectCredentials = errors.New("incorrect credentials")
+)
+
+// Authenticator identifies the user of a request.
+type Authenticator interface {
+	// Authenticate returns the user or ErrNoCredentials when the request has
+	// no credentials handled by this authenticator.
+	Authenticate(r *http.Request) (*User, error)
+}
+
+// AuthenticatorFunc is an adapter to use ordinary functions as authenticators.
+type AuthenticatorFunc func(r *http.Request) (*User, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*User, error) {
+	return f(r)
+}
+
+// Chain tries the authenticators in order until one of them finds credentials in the request.
+func Chain(authenticators ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (*User, error) {
+		for _, a := range authenticators {
+			user, err := a.Authenticate(r)
+			if errors.Is(err, ErrNoCredentials) {
+				continue
+			}
+			return user, err
+		}
+		return nil, ErrNoCredentials
+	})
+}
+
+type contextKey struct{}
+
+// WithUser returns a copy of ctx carrying user.
+func WithUser(ctx context.Context, user *User) context.Context {
+	return context.WithValue(ctx, contextKey{}, user)
+}
+
+// UserFromContext returns the user attached by Middleware or nil.
+func UserFromContext(ctx context.Context) *User {
+	user, _ := ctx.Value(contextKey{}).(*User)
+	return user
+}
+
+// Middleware authenticates requests and attaches the user to the request context.
+// When authentication fails then unauthorized is called instead of the next handler.
+func Middleware(authenticator Authenticator, unauthorized func(w http.ResponseWriter, r *http.Request, err error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, err := authenticator.Authenticate(r)
+			if err != nil {
+				unauthorized(w, r, err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+		})
+	}
+}
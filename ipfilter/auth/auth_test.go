@@ -0,0 +1,209 @@
+package auth_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/htpasswd"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newRequest(remoteAddr string, headers map[string]string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = remoteAddr
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	return r
+}
+
+func withClientCert(r *http.Request, subject pkix.Name) *http.Request {
+	r.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: subject}}},
+	}
+	return r
+}
+
+func TestChain(t *testing.T) {
+	users := auth.NewUsers([]auth.User{{Username: "admin", Password: "123"}})
+
+	authenticator := auth.Chain(
+		auth.NewClientCertAuthenticator(map[string]string{
+			"CN=alice,O=dev": "alice",
+			"bob":            "bob",
+		}),
+		auth.NewProxyHeaderAuthenticator("X-Forwarded-User", []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.1/32"),
+			netip.MustParsePrefix("fd00::/64"),
+		}),
+		auth.NewBearerAuthenticator([]auth.Token{
+			{Username: "ci", SHA256: auth.HashToken("secret-token")},
+		}),
+		auth.NewBasicAuthenticator(users.Authenticate),
+	)
+
+	for _, tt := range []struct {
+		name         string
+		request      *http.Request
+		expectedUser string
+		expectedErr  error
+	}{
+		{
+			name:        "no credentials",
+			request:     newRequest("192.0.2.1:1234", nil),
+			expectedErr: auth.ErrNoCredentials,
+		},
+		{
+			name: "basic auth",
+			request: newRequest("192.0.2.1:1234", map[string]string{
+				"Authorization": "Basic YWRtaW46MTIz", // admin:123
+			}),
+			expectedUser: "admin",
+		},
+		{
+			name: "basic auth with incorrect password",
+			request: newRequest("192.0.2.1:1234", map[string]string{
+				"Authorization": "Basic YWRtaW46MTI0", // admin:124
+			}),
+			expectedErr: auth.ErrIncorrectCredentials,
+		},
+		{
+			name: "invalid basic auth",
+			request: newRequest("192.0.2.1:1234", map[string]string{
+				"Authorization": "Basic !!!",
+			}),
+			expectedErr: auth.ErrInvalidAuthHeader,
+		},
+		{
+			name: "bearer token",
+			request: newRequest("192.0.2.1:1234", map[string]string{
+				"Authorization": "Bearer secret-token",
+			}),
+			expectedUser: "ci",
+		},
+		{
+			name: "incorrect bearer token",
+			request: newRequest("192.0.2.1:1234", map[string]string{
+				"Authorization": "Bearer other-token",
+			}),
+			expectedErr: auth.ErrIncorrectCredentials,
+		},
+		{
+			name: "unknown scheme",
+			request: newRequest("192.0.2.1:1234", map[string]string{
+				"Authorization": "Digest username=admin",
+			}),
+			expectedErr: auth.ErrNoCredentials,
+		},
+		{
+			name: "proxy header from trusted proxy",
+			request: newRequest("10.0.0.1:1234", map[string]string{
+				"X-Forwarded-User": "carol",
+			}),
+			expectedUser: "carol",
+		},
+		{
+			name: "proxy header from trusted ipv6 proxy",
+			request: newRequest("[fd00::5]:1234", map[string]string{
+				"X-Forwarded-User": "carol",
+			}),
+			expectedUser: "carol",
+		},
+		{
+			name: "proxy header from untrusted address is ignored",
+			request: newRequest("10.0.0.2:1234", map[string]string{
+				"X-Forwarded-User": "carol",
+				"Authorization":    "Basic YWRtaW46MTIz",
+			}),
+			expectedUser: "admin",
+		},
+		{
+			name: "proxy header only from untrusted address",
+			request: newRequest("10.0.0.2:1234", map[string]string{
+				"X-Forwarded-User": "carol",
+			}),
+			expectedErr: auth.ErrNoCredentials,
+		},
+		{
+			name:         "client certificate by subject",
+			request:      withClientCert(newRequest("192.0.2.1:1234", nil), pkix.Name{CommonName: "alice", Organization: []string{"dev"}}),
+			expectedUser: "alice",
+		},
+		{
+			name:         "client certificate by common name",
+			request:      withClientCert(newRequest("192.0.2.1:1234", nil), pkix.Name{CommonName: "bob", Organization: []string{"ops"}}),
+			expectedUser: "bob",
+		},
+		{
+			name:        "unknown client certificate",
+			request:     withClientCert(newRequest("192.0.2.1:1234", nil), pkix.Name{CommonName: "mallory"}),
+			expectedErr: auth.ErrIncorrectCredentials,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := authenticator.Authenticate(tt.request)
+
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("error: actual: %v expected: %v", err, tt.expectedErr)
+			}
+			if err != nil {
+				return
+			}
+			if user.Username != tt.expectedUser {
+				t.Errorf("user: actual: %v expected: %v", user.Username, tt.expectedUser)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	authenticator := auth.NewBearerAuthenticator([]auth.Token{
+		{Username: "ci", SHA256: auth.HashToken("secret-token")},
+	})
+
+	var unauthorizedErr error
+	handler := auth.Middleware(authenticator, func(w http.ResponseWriter, _ *http.Request, err error) {
+		unauthorizedErr = err
+		w.WriteHeader(http.StatusUnauthorized)
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(auth.UserFromContext(r.Context()).Username))
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest("192.0.2.1:1234", map[string]string{"Authorization": "Bearer secret-token"}))
+	if w.Code != http.StatusOK || w.Body.String() != "ci" {
+		t.Errorf("authorized: actual: %v %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest("192.0.2.1:1234", nil))
+	if w.Code != http.StatusUnauthorized || !errors.Is(unauthorizedErr, auth.ErrNoCredentials) {
+		t.Errorf("unauthorized: actual: %v %v", w.Code, unauthorizedErr)
+	}
+}
+
+func TestUsers_UnknownUserTiming(t *testing.T) {
+	hash, err := htpasswd.HashBcrypt("alice-secret", 10)
+	noError(t, err)
+	users := auth.NewUsers([]auth.User{{Username: "alice", PasswordHash: hash}})
+
+	elapsed := func(username string) time.Duration {
+		start := time.Now()
+		if user := users.Authenticate(username, "wrong"); user != nil {
+			t.Fatalf("unexpected user: %+v", user)
+		}
+		return time.Since(start)
+	}
+
+	// an unknown user is not rejected faster than a known one with a wrong password
+	known, unknown := elapsed("alice"), elapsed("bob")
+	if unknown < known/4 {
+		t.Errorf("unknown user: %v, known user: %v", unknown, known)
+	}
+}
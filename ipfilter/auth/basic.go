@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// BasicAuthenticator authenticates requests with the basic authorization header.
+type BasicAuthenticator struct {
+	authFunc func(username, password string) *User
+	lockout  *Lockout
+	totp     *TOTP
+}
+
+type BasicOption func(*BasicAuthenticator)
+
+// WithLockout sets the tracking of the failed attempts. Locked out requests fail with ErrLockedOut.
+func WithLockout(lockout *Lockout) BasicOption {
+	return func(a *BasicAuthenticator) {
+		a.lockout = lockout
+	}
+}
+
+// WithTOTP requires the TOTP code in the X-TOTP-Code header of the state-changing requests
+// of the users with a second factor.
+func WithTOTP(totp *TOTP) BasicOption {
+	return func(a *BasicAuthenticator) {
+		a.totp = totp
+	}
+}
+
+func NewBasicAuthenticator(authFunc func(username, password string) *User, opts ...BasicOption) *BasicAuthenticator {
+	a := &BasicAuthenticator{
+		authFunc: authFunc,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+func (a *BasicAuthenticator) Authenticate(r *http.Request) (*User, error) {
+	value := r.Header.Get("Authorization")
+	if len(value) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	valueParts := strings.SplitN(value, " ", 2)
+	if len(valueParts) != 2 {
+		return nil, ErrInvalidAuthHeader
+	}
+	if valueParts[0] != "Basic" {
+		// another scheme, e.g. Bearer
+		return nil, ErrNoCredentials
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(valueParts[1])
+	if err != nil {
+		return nil, ErrInvalidAuthHeader
+	}
+
+	payloadParts := strings.SplitN(string(payload), ":", 2)
+	if len(payloadParts) != 2 {
+		return nil, ErrInvalidAuthHeader
+	}
+
+	username, password := payloadParts[0], payloadParts[1]
+	ip := remoteHost(r)
+	if err := a.lockout.Check(username, ip); err != nil {
+		return nil, err
+	}
+
+	user := a.authFunc(username, password)
+	if user == nil {
+		a.lockout.Failure(username, ip)
+		return nil, ErrIncorrectCredentials
+	}
+	if !isSafeMethod(r.Method) {
+		if err := a.totp.Verify(username, r.Header.Get(TOTPHeaderName)); err != nil {
+			if !errors.Is(err, ErrTOTPRequired) {
+				a.lockout.Failure(username, ip)
+			}
+			return nil, err
+		}
+	}
+	a.lockout.Success(username)
+
+	return user, nil
+}
+
+// isSafeMethod reports whether the request method does not change the state.
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Token is a static API token of a user. Only the SHA-256 digest of the token is kept.
+type Token struct {
+	Username string
+	// SHA256 is the hex encoded SHA-256 digest of the token.
+	SHA256 string
+}
+
+// HashToken returns the hex encoded SHA-256 digest of token.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// BearerAuthenticator authenticates requests with the 'Authorization: Bearer <token>' header.
+type BearerAuthenticator struct {
+	tokens map[string]string
+}
+
+func NewBearerAuthenticator(tokens []Token) *BearerAuthenticator {
+	a := &BearerAuthenticator{
+		tokens: make(map[string]string, len(tokens)),
+	}
+	for _, t := range tokens {
+		a.tokens[strings.ToLower(t.SHA256)] = t.Username
+	}
+	return a
+}
+
+func (a *BearerAuthenticator) Authenticate(r *http.Request) (*User, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	// the lookup is done by the digest, so its timing does not reveal the token
+	username, ok := a.tokens[HashToken(token)]
+	if !ok {
+		return nil, ErrIncorrectCredentials
+	}
+
+	return &User{Username: username, BearerToken: true}, nil
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || len(token) == 0 {
+		return "", false
+	}
+	return token, true
+}
@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"net/http"
+)
+
+// ClientCertAuthenticator maps the subject of a verified TLS client certificate to a user.
+// A subject is matched either as the whole distinguished name (e.g. 'CN=alice,O=dev')
+// or as the common name only.
+type ClientCertAuthenticator struct {
+	subjects map[string]string
+}
+
+// NewClientCertAuthenticator creates an authenticator for the subject to username mapping.
+func NewClientCertAuthenticator(subjects map[string]string) *ClientCertAuthenticator {
+	return &ClientCertAuthenticator{
+		subjects: subjects,
+	}
+}
+
+func (a *ClientCertAuthenticator) Authenticate(r *http.Request) (*User, error) {
+	// only the certificates verified against the configured CA are taken into account
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if username, ok := a.subjects[subject.String()]; ok {
+		return &User{Username: username}, nil
+	}
+	if username, ok := a.subjects[subject.CommonName]; ok && len(subject.CommonName) > 0 {
+		return &User{Username: username}, nil
+	}
+
+	return nil, ErrIncorrectCredentials
+}
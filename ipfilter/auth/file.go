@@ -0,0 +1,29 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces the file by a temporary one written next to it, readable only by the owner.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp(): %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("tmp.Write(): %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("tmp.Close(): %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("os.Rename(): %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,296 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/realip"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxFailures    = 5
+	defaultBanDuration    = time.Minute
+	defaultMaxBanDuration = time.Hour
+)
+
+var (
+	ErrLockedOut       = errors.New("too many failed attempts")
+	ErrLockoutNotFound = errors.New("no failed attempts")
+)
+
+const (
+	LockoutUser = "user"
+	LockoutIP   = "ip"
+)
+
+// LockedOutError is returned for a locked out username or source IP.
+type LockedOutError struct {
+	Kind  string
+	Key   string
+	Until time.Time
+}
+
+func (e *LockedOutError) Error() string {
+	return fmt.Sprintf("%v %v: %v, locked until %v", e.Kind, e.Key, ErrLockedOut, e.Until.Format(time.RFC3339))
+}
+
+func (e *LockedOutError) Unwrap() error {
+	return ErrLockedOut
+}
+
+// LockoutEntry is the failure state of a username or a source IP.
+type LockoutEntry struct {
+	Kind        string
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+type lockoutKey struct {
+	kind string
+	key  string
+}
+
+type lockoutConfig struct {
+	maxFailures    int
+	banDuration    time.Duration
+	maxBanDuration time.Duration
+	timeFunc       func() time.Time
+	onLock         func(entry LockoutEntry)
+	onFailure      func(username, ip string)
+}
+
+type LockoutOption func(*lockoutConfig)
+
+// WithMaxFailures sets the number of failures after which the username or the IP is locked out.
+// Zero disables the lockout.
+func WithMaxFailures(n int) LockoutOption {
+	return func(c *lockoutConfig) {
+		c.maxFailures = n
+	}
+}
+
+// WithBanDuration sets the duration of the first ban. Every next failure doubles it up to maxBanDuration.
+// The failures are forgotten after maxBanDuration without a failure or a ban.
+func WithBanDuration(banDuration, maxBanDuration time.Duration) LockoutOption {
+	return func(c *lockoutConfig) {
+		c.banDuration = banDuration
+		c.maxBanDuration = maxBanDuration
+	}
+}
+
+func WithLockoutTimeFunc(timeFunc func() time.Time) LockoutOption {
+	return func(c *lockoutConfig) {
+		c.timeFunc = timeFunc
+	}
+}
+
+// WithLockFunc sets the function called when a username or an IP gets locked out, e.g. to audit it.
+func WithLockFunc(onLock func(entry LockoutEntry)) LockoutOption {
+	return func(c *lockoutConfig) {
+		c.onLock = onLock
+	}
+}
+
+// WithFailureFunc sets the function called for every failed attempt, e.g. to count them.
+// It is called even when the lockout is disabled.
+func WithFailureFunc(onFailure func(username, ip string)) LockoutOption {
+	return func(c *lockoutConfig) {
+		c.onFailure = onFailure
+	}
+}
+
+// Lockout tracks failed password attempts per username and per source IP
+// and locks them out with an exponentially growing ban.
+type Lockout struct {
+	mu             sync.Mutex
+	maxFailures    int
+	banDuration    time.Duration
+	maxBanDuration time.Duration
+	timeFunc       func() time.Time
+	onLock         func(entry LockoutEntry)
+	onFailure      func(username, ip string)
+	entries        map[lockoutKey]*LockoutEntry
+	lastCleanup    time.Time
+}
+
+func NewLockout(opts ...LockoutOption) *Lockout {
+	cnf := lockoutConfig{
+		maxFailures:    defaultMaxFailures,
+		banDuration:    defaultBanDuration,
+		maxBanDuration: defaultMaxBanDuration,
+		timeFunc:       time.Now,
+	}
+	for _, opt := range opts {
+		opt(&cnf)
+	}
+
+	return &Lockout{
+		maxFailures:    cnf.maxFailures,
+		banDuration:    cnf.banDuration,
+		maxBanDuration: cnf.maxBanDuration,
+		timeFunc:       cnf.timeFunc,
+		onLock:         cnf.onLock,
+		onFailure:      cnf.onFailure,
+		entries:        make(map[lockoutKey]*LockoutEntry),
+	}
+}
+
+// Check returns a *LockedOutError when the username or the IP is locked out.
+func (l *Lockout) Check(username, ip string) error {
+	if l == nil || l.maxFailures <= 0 {
+		return nil
+	}
+
+	now := l.timeFunc()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range lockoutKeys(username, ip) {
+		if entry, ok := l.entries[key]; ok && now.Before(entry.LockedUntil) {
+			return &LockedOutError{Kind: key.kind, Key: key.key, Until: entry.LockedUntil}
+		}
+	}
+
+	return nil
+}
+
+// Failure records a failed attempt.
+func (l *Lockout) Failure(username, ip string) {
+	if l == nil {
+		return
+	}
+	if l.onFailure != nil {
+		l.onFailure(username, ip)
+	}
+	if l.maxFailures <= 0 {
+		return
+	}
+
+	now := l.timeFunc()
+
+	var locked []LockoutEntry
+
+	l.mu.Lock()
+	l.cleanup(now)
+	for _, key := range lockoutKeys(username, ip) {
+		entry, ok := l.entries[key]
+		if !ok || entry.stale(now, l.maxBanDuration) {
+			entry = &LockoutEntry{Kind: key.kind, Key: key.key}
+			l.entries[key] = entry
+		}
+
+		entry.Failures++
+		entry.LastFailure = now
+		if entry.Failures >= l.maxFailures {
+			entry.LockedUntil = now.Add(l.ban(entry.Failures))
+			locked = append(locked, *entry)
+		}
+	}
+	l.mu.Unlock()
+
+	if l.onLock != nil {
+		for _, entry := range locked {
+			l.onLock(entry)
+		}
+	}
+}
+
+// Success forgets the failures of the username. The failures of the IP are kept,
+// so a valid account cannot be used to reset them.
+func (l *Lockout) Success(username string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.entries, lockoutKey{LockoutUser, username})
+}
+
+// Unlock forgets the failures of the username (kind 'user') or the IP (kind 'ip').
+func (l *Lockout) Unlock(kind, key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	k := lockoutKey{kind, key}
+	if _, ok := l.entries[k]; !ok {
+		return fmt.Errorf("%v %v: %w", kind, key, ErrLockoutNotFound)
+	}
+	delete(l.entries, k)
+
+	return nil
+}
+
+// List returns the usernames and IPs which are locked out, the latest locked first.
+func (l *Lockout) List() []LockoutEntry {
+	now := l.timeFunc()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	list := make([]LockoutEntry, 0)
+	for _, entry := range l.entries {
+		if now.Before(entry.LockedUntil) {
+			list = append(list, *entry)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LockedUntil.After(list[j].LockedUntil)
+	})
+
+	return list
+}
+
+// lockoutKeys returns the keys of the attempt. A request without the client IP, e.g. over the unix socket,
+// is tracked only by the username, so its callers do not lock each other out.
+func lockoutKeys(username, ip string) []lockoutKey {
+	if _, err := netip.ParseAddr(ip); err != nil {
+		return []lockoutKey{{LockoutUser, username}}
+	}
+	return []lockoutKey{{LockoutUser, username}, {LockoutIP, ip}}
+}
+
+// ban returns the ban duration for the number of failures: doubled with every failure over the limit.
+func (l *Lockout) ban(failures int) time.Duration {
+	ban := l.banDuration
+	for i := l.maxFailures; i < failures && ban < l.maxBanDuration; i++ {
+		ban *= 2
+	}
+	return min(ban, l.maxBanDuration)
+}
+
+// cleanup forgets the stale failures, at most once a minute.
+func (l *Lockout) cleanup(now time.Time) {
+	if now.Sub(l.lastCleanup) < time.Minute {
+		return
+	}
+	l.lastCleanup = now
+
+	for key, entry := range l.entries {
+		if entry.stale(now, l.maxBanDuration) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// stale reports whether the entry is neither locked nor failed for the duration.
+func (e *LockoutEntry) stale(now time.Time, d time.Duration) bool {
+	last := e.LastFailure
+	if e.LockedUntil.After(last) {
+		last = e.LockedUntil
+	}
+	return now.Sub(last) > d
+}
+
+// remoteHost returns the IP of the request's client, which can come through trusted proxies.
+func remoteHost(r *http.Request) string {
+	return realip.FromRequest(r)
+}
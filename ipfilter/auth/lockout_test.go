@@ -0,0 +1,270 @@
+package auth_test
+
+import (
+	"errors"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	type step struct {
+		at       string
+		username string
+		ip       string
+		// fail records a failure, otherwise a success
+		fail bool
+	}
+
+	for _, tt := range []struct {
+		name          string
+		steps         []step
+		checkAt       string
+		checkUsername string
+		checkIP       string
+		expectedErr   error
+		expectedUntil string
+	}{
+		{
+			name: "below the limit",
+			steps: []step{
+				{at: "2001-01-01 10:00:00", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:00:01", username: "alice", ip: "10.0.0.1", fail: true},
+			},
+			checkAt:       "2001-01-01 10:00:02",
+			checkUsername: "alice",
+			checkIP:       "10.0.0.1",
+		},
+		{
+			name: "username locked out",
+			steps: []step{
+				{at: "2001-01-01 10:00:00", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:00:01", username: "alice", ip: "10.0.0.2", fail: true},
+				{at: "2001-01-01 10:00:02", username: "alice", ip: "10.0.0.3", fail: true},
+			},
+			checkAt:       "2001-01-01 10:00:03",
+			checkUsername: "alice",
+			checkIP:       "10.0.0.4",
+			expectedErr:   auth.ErrLockedOut,
+			expectedUntil: "2001-01-01 10:01:02",
+		},
+		{
+			name: "ip locked out",
+			steps: []step{
+				{at: "2001-01-01 10:00:00", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:00:01", username: "bob", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:00:02", username: "carol", ip: "10.0.0.1", fail: true},
+			},
+			checkAt:       "2001-01-01 10:00:03",
+			checkUsername: "dave",
+			checkIP:       "10.0.0.1",
+			expectedErr:   auth.ErrLockedOut,
+			expectedUntil: "2001-01-01 10:01:02",
+		},
+		{
+			name: "ban expires",
+			steps: []step{
+				{at: "2001-01-01 10:00:00", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:00:01", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:00:02", username: "alice", ip: "10.0.0.1", fail: true},
+			},
+			checkAt:       "2001-01-01 10:01:02",
+			checkUsername: "alice",
+			checkIP:       "10.0.0.1",
+		},
+		{
+			name: "next failures double the ban",
+			steps: []step{
+				{at: "2001-01-01 10:00:00", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:00:01", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:00:02", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:01:02", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:03:02", username: "alice", ip: "10.0.0.1", fail: true},
+			},
+			checkAt:       "2001-01-01 10:03:03",
+			checkUsername: "alice",
+			checkIP:       "10.0.0.1",
+			expectedErr:   auth.ErrLockedOut,
+			expectedUntil: "2001-01-01 10:07:02",
+		},
+		{
+			name: "ban is limited",
+			steps: []step{
+				{at: "2001-01-01 10:00:00", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:00:00", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:00:00", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:00:00", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:00:00", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:00:00", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:00:00", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:00:00", username: "alice", ip: "10.0.0.1", fail: true},
+			},
+			checkAt:       "2001-01-01 10:00:01",
+			checkUsername: "alice",
+			checkIP:       "10.0.0.1",
+			expectedErr:   auth.ErrLockedOut,
+			expectedUntil: "2001-01-01 10:10:00",
+		},
+		{
+			name: "failures are forgotten",
+			steps: []step{
+				{at: "2001-01-01 10:00:00", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:00:01", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:11:00", username: "alice", ip: "10.0.0.1", fail: true},
+			},
+			checkAt:       "2001-01-01 10:11:01",
+			checkUsername: "alice",
+			checkIP:       "10.0.0.1",
+		},
+		{
+			name: "success resets the username but not the ip",
+			steps: []step{
+				{at: "2001-01-01 10:00:00", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:00:01", username: "alice", ip: "10.0.0.1", fail: true},
+				{at: "2001-01-01 10:00:02", username: "alice", ip: "10.0.0.1"},
+				{at: "2001-01-01 10:00:03", username: "alice", ip: "10.0.0.1", fail: true},
+			},
+			checkAt:       "2001-01-01 10:00:04",
+			checkUsername: "alice",
+			checkIP:       "10.0.0.1",
+			expectedErr:   auth.ErrLockedOut,
+			expectedUntil: "2001-01-01 10:01:03",
+		},
+		{
+			name: "unknown ip is not shared",
+			steps: []step{
+				{at: "2001-01-01 10:00:00", username: "alice", ip: "@", fail: true},
+				{at: "2001-01-01 10:00:01", username: "bob", ip: "@", fail: true},
+				{at: "2001-01-01 10:00:02", username: "carol", ip: "@", fail: true},
+			},
+			checkAt:       "2001-01-01 10:00:03",
+			checkUsername: "dave",
+			checkIP:       "@",
+		},
+		{
+			name: "username locked out without an ip",
+			steps: []step{
+				{at: "2001-01-01 10:00:00", username: "alice", ip: "", fail: true},
+				{at: "2001-01-01 10:00:01", username: "alice", ip: "", fail: true},
+				{at: "2001-01-01 10:00:02", username: "alice", ip: "", fail: true},
+			},
+			checkAt:       "2001-01-01 10:00:03",
+			checkUsername: "alice",
+			checkIP:       "",
+			expectedErr:   auth.ErrLockedOut,
+			expectedUntil: "2001-01-01 10:01:02",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var fixedTime firewall.FixedTime
+			lockout := auth.NewLockout(
+				auth.WithMaxFailures(3),
+				auth.WithBanDuration(time.Minute, 10*time.Minute),
+				auth.WithLockoutTimeFunc(fixedTime.TimeFunc()),
+			)
+
+			for _, s := range tt.steps {
+				fixedTime.SetDateTime(s.at)
+				if s.fail {
+					lockout.Failure(s.username, s.ip)
+				} else {
+					lockout.Success(s.username)
+				}
+			}
+
+			fixedTime.SetDateTime(tt.checkAt)
+			err := lockout.Check(tt.checkUsername, tt.checkIP)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("error: actual: %v expected: %v", err, tt.expectedErr)
+			}
+
+			var lockedOutErr *auth.LockedOutError
+			if errors.As(err, &lockedOutErr) {
+				if expected := firewall.MustParseDateTime(tt.expectedUntil); !lockedOutErr.Until.Equal(expected) {
+					t.Errorf("until: actual: %v expected: %v", lockedOutErr.Until, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestLockout_Unlock(t *testing.T) {
+	var fixedTime firewall.FixedTime
+	fixedTime.SetDateTime("2001-01-01 10:00:00")
+
+	var locked []auth.LockoutEntry
+	lockout := auth.NewLockout(
+		auth.WithMaxFailures(1),
+		auth.WithLockoutTimeFunc(fixedTime.TimeFunc()),
+		auth.WithLockFunc(func(entry auth.LockoutEntry) {
+			locked = append(locked, entry)
+		}),
+	)
+
+	lockout.Failure("alice", "10.0.0.1")
+	if len(locked) != 2 || len(lockout.List()) != 2 {
+		t.Fatalf("locked: actual: %v list: %v expected: 2", len(locked), len(lockout.List()))
+	}
+
+	noError(t, lockout.Unlock(auth.LockoutUser, "alice"))
+	if err := lockout.Check("alice", "10.0.0.2"); err != nil {
+		t.Errorf("unlocked user: %v", err)
+	}
+	if err := lockout.Check("bob", "10.0.0.1"); !errors.Is(err, auth.ErrLockedOut) {
+		t.Errorf("still locked ip: actual: %v expected: %v", err, auth.ErrLockedOut)
+	}
+
+	if err := lockout.Unlock(auth.LockoutUser, "alice"); !errors.Is(err, auth.ErrLockoutNotFound) {
+		t.Errorf("unlock again: actual: %v expected: %v", err, auth.ErrLockoutNotFound)
+	}
+}
+
+func TestLockout_FailureFunc(t *testing.T) {
+	for _, maxFailures := range []int{3, 0} {
+		var failures []string
+		lockout := auth.NewLockout(
+			auth.WithMaxFailures(maxFailures),
+			auth.WithFailureFunc(func(username, ip string) {
+				failures = append(failures, username+" "+ip)
+			}),
+		)
+
+		lockout.Failure("alice", "10.0.0.1")
+		lockout.Failure("bob", "10.0.0.2")
+
+		// called also with the lockout disabled
+		if expected := []string{"alice 10.0.0.1", "bob 10.0.0.2"}; !reflect.DeepEqual(failures, expected) {
+			t.Errorf("max failures %v: actual: %v expected: %v", maxFailures, failures, expected)
+		}
+	}
+}
+
+func TestBasicAuthenticator_Lockout(t *testing.T) {
+	users := auth.NewUsers([]auth.User{{Username: "admin", Password: "123"}})
+	authenticator := auth.NewBasicAuthenticator(users.Authenticate,
+		auth.WithLockout(auth.NewLockout(auth.WithMaxFailures(2))))
+
+	request := func(password string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.SetBasicAuth("admin", password)
+		return r
+	}
+
+	for _, tt := range []struct {
+		password    string
+		expectedErr error
+	}{
+		{password: "bad", expectedErr: auth.ErrIncorrectCredentials},
+		{password: "bad", expectedErr: auth.ErrIncorrectCredentials},
+		// the correct password is rejected as well
+		{password: "123", expectedErr: auth.ErrLockedOut},
+	} {
+		if _, err := authenticator.Authenticate(request(tt.password)); !errors.Is(err, tt.expectedErr) {
+			t.Errorf("password %v: actual: %v expected: %v", tt.password, err, tt.expectedErr)
+		}
+	}
+}
@@ -0,0 +1,506 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcStateTTL     = 10 * time.Minute
+	oidcClockSkew    = time.Minute
+	oidcKeysMinFetch = time.Minute
+	// oidcMaxPending limits the started logins, which anyone can start without an account.
+	oidcMaxPending = 1000
+	// oidcUsernamePrefix separates the users of the identity provider from the local users.
+	oidcUsernamePrefix = "oidc:"
+)
+
+var (
+	ErrOIDCState     = errors.New("invalid or expired oidc state")
+	ErrOIDCNotMember = errors.New("user is not a member of the allowed groups")
+)
+
+type oidcConfig struct {
+	scopes        []string
+	usernameClaim string
+	groupsClaim   string
+	groupRoles    map[string]Role
+	allowedGroups []string
+	httpClient    *http.Client
+	timeFunc      func() time.Time
+}
+
+type OIDCOption func(*oidcConfig)
+
+// WithOIDCScopes sets the requested scopes. By default, 'openid profile email' is requested.
+func WithOIDCScopes(scopes []string) OIDCOption {
+	return func(c *oidcConfig) {
+		c.scopes = scopes
+	}
+}
+
+// WithOIDCUsernameClaim sets the ID token claim with the username. By default, the immutable 'sub' is used.
+// The claim should not be one the users can change, e.g. 'preferred_username' at some providers.
+func WithOIDCUsernameClaim(claim string) OIDCOption {
+	return func(c *oidcConfig) {
+		c.usernameClaim = claim
+	}
+}
+
+// WithOIDCGroupsClaim sets the ID token claim with the groups of the user. By default, 'groups' is used.
+func WithOIDCGroupsClaim(claim string) OIDCOption {
+	return func(c *oidcConfig) {
+		c.groupsClaim = claim
+	}
+}
+
+// WithOIDCGroupRoles maps the groups to roles. The user gets the highest role of the groups.
+// Users without a mapped group get no role, which the caller sets to the default one.
+func WithOIDCGroupRoles(groupRoles map[string]Role) OIDCOption {
+	return func(c *oidcConfig) {
+		c.groupRoles = groupRoles
+	}
+}
+
+// WithOIDCAllowedGroups limits the login to the members of the groups.
+func WithOIDCAllowedGroups(groups []string) OIDCOption {
+	return func(c *oidcConfig) {
+		c.allowedGroups = groups
+	}
+}
+
+func WithOIDCHTTPClient(httpClient *http.Client) OIDCOption {
+	return func(c *oidcConfig) {
+		c.httpClient = httpClient
+	}
+}
+
+func WithOIDCTimeFunc(timeFunc func() time.Time) OIDCOption {
+	return func(c *oidcConfig) {
+		c.timeFunc = timeFunc
+	}
+}
+
+// OIDC logs users in with the OpenID Connect authorization code flow with PKCE.
+// Only RS256 signed ID tokens are accepted.
+type OIDC struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	oidcConfig
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+	keysAt    time.Time
+	// pending logins by state
+	pending map[string]oidcPending
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcPending struct {
+	verifier  string
+	nonce     string
+	remember  bool
+	createdAt time.Time
+}
+
+// NewOIDC creates the client of the issuer. The redirect URL is the callback
+// of the authorization code, registered at the identity provider.
+func NewOIDC(issuer, clientID, clientSecret, redirectURL string, opts ...OIDCOption) *OIDC {
+	cnf := oidcConfig{
+		scopes:        []string{"openid", "profile", "email"},
+		usernameClaim: "sub",
+		groupsClaim:   "groups",
+		httpClient:    &http.Client{Timeout: 10 * time.Second},
+		timeFunc:      time.Now,
+	}
+	for _, opt := range opts {
+		opt(&cnf)
+	}
+
+	return &OIDC{
+		issuer:       issuer,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		oidcConfig:   cnf,
+		pending:      make(map[string]oidcPending),
+	}
+}
+
+// AuthURL starts a login and returns the URL of the identity provider and the state,
+// which should be bound to the browser, e.g. by a cookie.
+func (o *OIDC) AuthURL(ctx context.Context, remember bool) (string, string, error) {
+	discovery, err := o.discover(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	state := base64.RawURLEncoding.EncodeToString(randomBytes(16))
+	pending := oidcPending{
+		verifier:  base64.RawURLEncoding.EncodeToString(randomBytes(32)),
+		nonce:     base64.RawURLEncoding.EncodeToString(randomBytes(16)),
+		remember:  remember,
+		createdAt: o.timeFunc(),
+	}
+
+	o.mu.Lock()
+	for s, p := range o.pending {
+		if pending.createdAt.Sub(p.createdAt) > oidcStateTTL {
+			delete(o.pending, s)
+		}
+	}
+	if len(o.pending) >= oidcMaxPending {
+		o.deleteOldestPending()
+	}
+	o.pending[state] = pending
+	o.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(pending.verifier))
+
+	authURL, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", "", fmt.Errorf("url.Parse(): %w", err)
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", o.clientID)
+	query.Set("redirect_uri", o.redirectURL)
+	query.Set("scope", strings.Join(o.scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", pending.nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+
+	return authURL.String(), state, nil
+}
+
+// deleteOldestPending makes room for a new login. It must be called with o.mu locked.
+func (o *OIDC) deleteOldestPending() {
+	var oldest string
+	for s, p := range o.pending {
+		if len(oldest) == 0 || p.createdAt.Before(o.pending[oldest].createdAt) {
+			oldest = s
+		}
+	}
+	delete(o.pending, oldest)
+}
+
+// Exchange completes the login: it redeems the authorization code and verifies the ID token.
+// It returns the user, with the username prefixed by 'oidc:' and the role of the groups, if any,
+// and the "remember me" choice of AuthURL.
+func (o *OIDC) Exchange(ctx context.Context, state, code string) (*User, bool, error) {
+	o.mu.Lock()
+	pending, ok := o.pending[state]
+	delete(o.pending, state)
+	o.mu.Unlock()
+
+	if !ok || o.timeFunc().Sub(pending.createdAt) > oidcStateTTL {
+		return nil, false, ErrOIDCState
+	}
+
+	discovery, err := o.discover(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", o.redirectURL)
+	form.Set("client_id", o.clientID)
+	form.Set("code_verifier", pending.verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, false, fmt.Errorf("http.NewRequestWithContext(): %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if len(o.clientSecret) > 0 {
+		req.SetBasicAuth(url.QueryEscape(o.clientID), url.QueryEscape(o.clientSecret))
+	}
+
+	var tokenResp struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := o.doJSON(req, &tokenResp); err != nil {
+		if len(tokenResp.Error) > 0 {
+			return nil, false, fmt.Errorf("token endpoint: %v: %v", tokenResp.Error, tokenResp.ErrorDescription)
+		}
+		return nil, false, err
+	}
+	if len(tokenResp.IDToken) == 0 {
+		return nil, false, errors.New("token endpoint: no id_token")
+	}
+
+	claims, err := o.verify(ctx, tokenResp.IDToken, pending.nonce)
+	if err != nil {
+		return nil, false, err
+	}
+
+	user, err := o.user(claims)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return user, pending.remember, nil
+}
+
+// verify checks the signature and the claims of the ID token.
+func (o *OIDC) verify(ctx context.Context, idToken, nonce string) (map[string]any, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id_token: malformed")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("id_token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("id_token: unsupported algorithm: %v", header.Alg)
+	}
+
+	key, err := o.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("id_token signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("id_token: %w", err)
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("id_token claims: %w", err)
+	}
+
+	if iss, _ := claims["iss"].(string); iss != o.issuer {
+		return nil, fmt.Errorf("id_token: unexpected issuer: %v", iss)
+	}
+	if !containsString(claimStrings(claims["aud"]), o.clientID) {
+		return nil, fmt.Errorf("id_token: unexpected audience: %v", claims["aud"])
+	}
+	exp, _ := claims["exp"].(float64)
+	if now := o.timeFunc(); !now.Before(time.Unix(int64(exp), 0).Add(oidcClockSkew)) {
+		return nil, errors.New("id_token: expired")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("id_token: unexpected nonce")
+	}
+
+	return claims, nil
+}
+
+// user maps the claims to the user.
+func (o *OIDC) user(claims map[string]any) (*User, error) {
+	username, _ := claims[o.usernameClaim].(string)
+	if len(username) == 0 {
+		return nil, fmt.Errorf("id_token: no claim: %v", o.usernameClaim)
+	}
+
+	groups := claimStrings(claims[o.groupsClaim])
+
+	if len(o.allowedGroups) > 0 {
+		allowed := false
+		for _, group := range o.allowedGroups {
+			allowed = allowed || containsString(groups, group)
+		}
+		if !allowed {
+			return nil, fmt.Errorf("user %v: %w", username, ErrOIDCNotMember)
+		}
+	}
+
+	user := &User{Username: oidcUsernamePrefix + username}
+	for _, group := range groups {
+		if role, ok := o.groupRoles[group]; ok && !user.Role.Includes(role) {
+			user.Role = role
+		}
+	}
+
+	return user, nil
+}
+
+// discover fetches the provider metadata once.
+func (o *OIDC) discover(ctx context.Context) (*oidcDiscovery, error) {
+	o.mu.Lock()
+	discovery := o.discovery
+	o.mu.Unlock()
+	if discovery != nil {
+		return discovery, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(o.issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext(): %w", err)
+	}
+
+	discovery = &oidcDiscovery{}
+	if err := o.doJSON(req, discovery); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if discovery.Issuer != o.issuer {
+		return nil, fmt.Errorf("oidc discovery: unexpected issuer: %v", discovery.Issuer)
+	}
+
+	o.mu.Lock()
+	o.discovery = discovery
+	o.mu.Unlock()
+
+	return discovery, nil
+}
+
+// key returns the signing key. The keys are fetched again for an unknown key ID, at most once a minute.
+func (o *OIDC) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	o.mu.Lock()
+	key, ok := o.keys[kid]
+	fetch := !ok && o.timeFunc().Sub(o.keysAt) >= oidcKeysMinFetch
+	o.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !fetch {
+		return nil, fmt.Errorf("id_token: unknown key: %v", kid)
+	}
+
+	discovery, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discovery.JWKSURI, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext(): %w", err)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := o.doJSON(req, &jwks); err != nil {
+		return nil, fmt.Errorf("oidc jwks: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (len(k.Use) > 0 && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	o.mu.Lock()
+	o.keys = keys
+	o.keysAt = o.timeFunc()
+	o.mu.Unlock()
+
+	key, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("id_token: unknown key: %v", kid)
+	}
+	return key, nil
+}
+
+// doJSON sends the request and decodes the JSON response, also the body of an error response.
+func (o *OIDC) doJSON(req *http.Request, v any) error {
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("httpClient.Do(): %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("io.ReadAll(): %w", err)
+	}
+	decodeErr := json.Unmarshal(data, v)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v %v: unexpected status: %v", req.Method, req.URL, resp.Status)
+	}
+	if decodeErr != nil {
+		return fmt.Errorf("json.Unmarshal(): %w", decodeErr)
+	}
+
+	return nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// claimStrings returns the values of a string or an array claim.
+func claimStrings(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth/oidctest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestOIDC(t *testing.T) {
+	issuer, err := oidctest.NewIssuer("ipfilter", "secret")
+	noError(t, err)
+	defer issuer.Close()
+
+	for _, tt := range []struct {
+		name            string
+		clientSecret    string
+		claims          map[string]any
+		state           func(state string) string
+		expectedUser    *auth.User
+		expectedErr     error
+		expectedFailure bool
+	}{
+		{
+			name:         "admin group",
+			claims:       map[string]any{"sub": "alice", "groups": []string{"dev", "ipfilter-admins"}},
+			expectedUser: &auth.User{Username: "oidc:alice", Role: auth.RoleAdmin},
+		},
+		{
+			name:         "highest role of the groups",
+			claims:       map[string]any{"sub": "alice", "groups": []string{"ipfilter-admins", "ipfilter-ops"}},
+			expectedUser: &auth.User{Username: "oidc:alice", Role: auth.RoleAdmin},
+		},
+		{
+			name:         "no mapped group",
+			claims:       map[string]any{"sub": "bob", "groups": "dev"},
+			expectedUser: &auth.User{Username: "oidc:bob"},
+		},
+		{
+			name:         "mutable claim is not the username",
+			claims:       map[string]any{"sub": "bob", "preferred_username": "admin", "groups": "dev"},
+			expectedUser: &auth.User{Username: "oidc:bob"},
+		},
+		{
+			name:        "not allowed group",
+			claims:      map[string]any{"sub": "eve", "groups": []string{"guests"}},
+			expectedErr: auth.ErrOIDCNotMember,
+		},
+		{
+			name:            "no username",
+			claims:          map[string]any{"sub": "", "groups": []string{"dev"}},
+			expectedFailure: true,
+		},
+		{
+			name:            "another audience",
+			claims:          map[string]any{"sub": "alice", "groups": "dev", "aud": "other"},
+			expectedFailure: true,
+		},
+		{
+			name:            "another issuer",
+			claims:          map[string]any{"sub": "alice", "groups": "dev", "iss": "https://evil.example.com"},
+			expectedFailure: true,
+		},
+		{
+			name:            "expired token",
+			claims:          map[string]any{"sub": "alice", "groups": "dev", "exp": time.Now().Add(-time.Hour).Unix()},
+			expectedFailure: true,
+		},
+		{
+			name:            "replayed nonce",
+			claims:          map[string]any{"sub": "alice", "groups": "dev", "nonce": "abc"},
+			expectedFailure: true,
+		},
+		{
+			name:            "incorrect client secret",
+			clientSecret:    "bad",
+			claims:          map[string]any{"sub": "alice", "groups": "dev"},
+			expectedFailure: true,
+		},
+		{
+			name:        "unknown state",
+			claims:      map[string]any{"sub": "alice", "groups": "dev"},
+			state:       func(string) string { return "forged" },
+			expectedErr: auth.ErrOIDCState,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clientSecret := issuer.ClientSecret
+			if len(tt.clientSecret) > 0 {
+				clientSecret = tt.clientSecret
+			}
+			oidc := auth.NewOIDC(issuer.URL, issuer.ClientID, clientSecret, "https://ipfilter.example.com/login/oidc/callback",
+				auth.WithOIDCGroupRoles(map[string]auth.Role{
+					"ipfilter-ops":    auth.RoleOperator,
+					"ipfilter-admins": auth.RoleAdmin,
+				}),
+				auth.WithOIDCAllowedGroups([]string{"dev", "ipfilter-admins"}),
+			)
+
+			ctx := context.Background()
+			authURL, state, err := oidc.AuthURL(ctx, true)
+			noError(t, err)
+
+			callbackURL, err := issuer.Authorize(authURL, tt.claims)
+			noError(t, err)
+			callback, err := url.Parse(callbackURL)
+			noError(t, err)
+			if callback.Query().Get("state") != state {
+				t.Fatalf("state: actual: %v expected: %v", callback.Query().Get("state"), state)
+			}
+			if tt.state != nil {
+				state = tt.state(state)
+			}
+
+			user, remember, err := oidc.Exchange(ctx, state, callback.Query().Get("code"))
+			switch {
+			case tt.expectedErr != nil:
+				if !errors.Is(err, tt.expectedErr) {
+					t.Fatalf("error: actual: %v expected: %v", err, tt.expectedErr)
+				}
+				return
+			case tt.expectedFailure:
+				if err == nil {
+					t.Fatalf("error expected, user: %+v", user)
+				}
+				return
+			}
+			noError(t, err)
+
+			if user.Username != tt.expectedUser.Username || user.Role != tt.expectedUser.Role || !remember {
+				t.Errorf("user: actual: %+v %v expected: %+v true", user, remember, tt.expectedUser)
+			}
+		})
+	}
+}
+
+func TestOIDC_MaxPending(t *testing.T) {
+	issuer, err := oidctest.NewIssuer("ipfilter", "secret")
+	noError(t, err)
+	defer issuer.Close()
+
+	// every login is started a millisecond after the previous one
+	now := time.Now()
+	oidc := auth.NewOIDC(issuer.URL, issuer.ClientID, issuer.ClientSecret, "https://ipfilter.example.com/login/oidc/callback",
+		auth.WithOIDCTimeFunc(func() time.Time {
+			now = now.Add(time.Millisecond)
+			return now
+		}),
+	)
+
+	ctx := context.Background()
+	var authURLs []string
+	var states []string
+	for range 1001 {
+		authURL, state, err := oidc.AuthURL(ctx, false)
+		noError(t, err)
+		authURLs = append(authURLs, authURL)
+		states = append(states, state)
+	}
+
+	exchange := func(i int) error {
+		callbackURL, err := issuer.Authorize(authURLs[i], map[string]any{"sub": "alice"})
+		noError(t, err)
+		callback, err := url.Parse(callbackURL)
+		noError(t, err)
+		_, _, err = oidc.Exchange(ctx, states[i], callback.Query().Get("code"))
+		return err
+	}
+
+	// the oldest login is dropped for the last one
+	if err := exchange(0); !errors.Is(err, auth.ErrOIDCState) {
+		t.Errorf("oldest login: actual: %v expected: %v", err, auth.ErrOIDCState)
+	}
+	noError(t, exchange(1000))
+}
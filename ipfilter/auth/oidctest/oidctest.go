@@ -0,0 +1,226 @@
+// Package oidctest provides an in-process OpenID Connect issuer for tests.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const keyID = "test-key"
+
+// Issuer serves the discovery document, the JWKS and the token endpoint.
+// The authorization endpoint is simulated by Authorize, which logs the user in without a page.
+type Issuer struct {
+	URL          string
+	ClientID     string
+	ClientSecret string
+
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]authorization
+}
+
+type authorization struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	claims      map[string]any
+}
+
+// NewIssuer starts the issuer. It should be closed by Close.
+func NewIssuer(clientID, clientSecret string) (*Issuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("rsa.GenerateKey(): %w", err)
+	}
+
+	issuer := &Issuer{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		key:          key,
+		codes:        make(map[string]authorization),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", issuer.handleDiscovery)
+	mux.HandleFunc("GET /jwks", issuer.handleJWKS)
+	mux.HandleFunc("POST /token", issuer.handleToken)
+
+	issuer.server = httptest.NewServer(mux)
+	issuer.URL = issuer.server.URL
+
+	return issuer, nil
+}
+
+func (i *Issuer) Close() {
+	i.server.Close()
+}
+
+// Authorize simulates the login of a user at the authorization endpoint. It returns the URL
+// of the redirect back to the client. The claims are added to the ID token and can
+// override the standard ones (iss, aud, exp, nonce).
+func (i *Issuer) Authorize(authURL string, claims map[string]any) (string, error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", fmt.Errorf("url.Parse(): %w", err)
+	}
+	query := u.Query()
+
+	if query.Get("response_type") != "code" {
+		return "", errors.New("unsupported response_type")
+	}
+	if query.Get("code_challenge_method") != "S256" || len(query.Get("code_challenge")) == 0 {
+		return "", errors.New("missing PKCE challenge")
+	}
+
+	code := randomString()
+
+	i.mu.Lock()
+	i.codes[code] = authorization{
+		clientID:    query.Get("client_id"),
+		redirectURI: query.Get("redirect_uri"),
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+		claims:      claims,
+	}
+	i.mu.Unlock()
+
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		return "", fmt.Errorf("url.Parse(): %w", err)
+	}
+	redirectQuery := redirect.Query()
+	redirectQuery.Set("code", code)
+	redirectQuery.Set("state", query.Get("state"))
+	redirect.RawQuery = redirectQuery.Encode()
+
+	return redirect.String(), nil
+}
+
+func (i *Issuer) handleDiscovery(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                 i.URL,
+		"authorization_endpoint": i.URL + "/authorize",
+		"token_endpoint":         i.URL + "/token",
+		"jwks_uri":               i.URL + "/jwks",
+	})
+}
+
+func (i *Issuer) handleJWKS(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]any{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(i.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(i.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (i *Issuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, _ := r.BasicAuth()
+	clientID, _ = url.QueryUnescape(clientID)
+	clientSecret, _ = url.QueryUnescape(clientSecret)
+	if clientID != i.ClientID || clientSecret != i.ClientSecret {
+		tokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	if r.FormValue("grant_type") != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	code := r.FormValue("code")
+
+	i.mu.Lock()
+	authz, ok := i.codes[code]
+	delete(i.codes, code)
+	i.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	switch {
+	case !ok, authz.clientID != clientID, authz.redirectURI != r.FormValue("redirect_uri"),
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != authz.challenge:
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]any{
+		"iss":   i.URL,
+		"sub":   randomString(),
+		"aud":   clientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": authz.nonce,
+	}
+	for name, value := range authz.claims {
+		claims[name] = value
+	}
+
+	idToken, err := i.sign(claims)
+	if err != nil {
+		tokenError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (i *Issuer) sign(claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func tokenError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+	"net/netip"
+)
+
+// ProxyHeaderAuthenticator trusts the user name set in a header (e.g. X-Forwarded-User
+// set by oauth2-proxy) by a reverse proxy. The header is honoured only for requests
+// coming directly from the trusted proxy addresses.
+type ProxyHeaderAuthenticator struct {
+	header         string
+	trustedProxies []netip.Prefix
+}
+
+func NewProxyHeaderAuthenticator(header string, trustedProxies []netip.Prefix) *ProxyHeaderAuthenticator {
+	return &ProxyHeaderAuthenticator{
+		header:         header,
+		trustedProxies: trustedProxies,
+	}
+}
+
+func (a *ProxyHeaderAuthenticator) Authenticate(r *http.Request) (*User, error) {
+	username := r.Header.Get(a.header)
+	if len(username) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	if !a.trusted(r.RemoteAddr) {
+		log.Printf("auth: ignoring %v header from untrusted address %v", a.header, r.RemoteAddr)
+		return nil, ErrNoCredentials
+	}
+
+	return &User{Username: username}, nil
+}
+
+func (a *ProxyHeaderAuthenticator) trusted(remoteAddr string) bool {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+
+	addr := addrPort.Addr().Unmap()
+	for _, prefix := range a.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
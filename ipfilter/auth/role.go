@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Role is a set of permissions of a user. Each role includes the permissions of the previous one.
+type Role string
+
+const (
+	// RoleRequester can only request access for an IP, which is added when an admin approves it.
+	RoleRequester Role = "requester"
+	// RoleSelfService can manage only the caller's IP (/api/me/*) and the user's own entries.
+	RoleSelfService Role = "self-service"
+	// RoleOperator can manage any IP allowed by the policy.
+	RoleOperator Role = "operator"
+	// RoleAdmin can additionally manage users, sessions and read the audit trail.
+	RoleAdmin Role = "admin"
+)
+
+var roleRanks = map[Role]int{
+	RoleRequester:   1,
+	RoleSelfService: 2,
+	RoleOperator:    3,
+	RoleAdmin:       4,
+}
+
+// ParseRole returns an error for an unknown role.
+func ParseRole(s string) (Role, error) {
+	role := Role(s)
+	if _, ok := roleRanks[role]; !ok {
+		return "", fmt.Errorf("unknown role %q: expected requester, self-service, operator or admin", s)
+	}
+	return role, nil
+}
+
+// Includes reports whether the role has the permissions of the other role.
+func (r Role) Includes(other Role) bool {
+	return roleRanks[r] >= roleRanks[other] && roleRanks[r] > 0
+}
+
+// HasRole reports whether the user has the permissions of the role. It is false for nil.
+func (u *User) HasRole(role Role) bool {
+	return u != nil && u.Role.Includes(role)
+}
+
+// Roles assigns roles to users by their usernames, whichever authenticator was used.
+// The roles can be replaced at runtime.
+type Roles struct {
+	mu          sync.RWMutex
+	roles       map[string]Role
+	defaultRole Role
+}
+
+// NewRoles creates the roles with the role of the users missing in the roles map.
+func NewRoles(roles map[string]Role, defaultRole Role) *Roles {
+	return &Roles{
+		roles:       roles,
+		defaultRole: defaultRole,
+	}
+}
+
+// Set replaces all roles, e.g. after the configuration is reloaded.
+func (r *Roles) Set(roles map[string]Role, defaultRole Role) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.roles = roles
+	r.defaultRole = defaultRole
+}
+
+// Role returns the role of the user.
+func (r *Roles) Role(username string) Role {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if role, ok := r.roles[username]; ok {
+		return role
+	}
+	return r.defaultRole
+}
+
+// Default returns the role of the users missing in the roles map.
+func (r *Roles) Default() Role {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.defaultRole
+}
+
+// Authenticator returns an authenticator setting the role of the users authenticated by a.
+// A role already set by a (e.g. from the OIDC groups of a session) is kept.
+func (r *Roles) Authenticator(a Authenticator) Authenticator {
+	return AuthenticatorFunc(func(req *http.Request) (*User, error) {
+		user, err := a.Authenticate(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(user.Role) == 0 {
+			user.Role = r.Role(user.Username)
+		}
+		return user, nil
+	})
+}
@@ -0,0 +1,301 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/realip"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SessionCookieName = "ipfilter_session"
+
+const (
+	defaultSessionTTL  = 12 * time.Hour
+	defaultRememberTTL = 30 * 24 * time.Hour
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is a login session of a user.
+type Session struct {
+	// ID identifies the session in listings. It is not the cookie value.
+	ID       string
+	Username string
+	// Role is the role assigned at the login, e.g. from the OIDC groups. Empty when it is assigned by Roles.
+	Role       Role
+	RemoteAddr string
+	UserAgent  string
+	Remember   bool
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
+
+type sessionConfig struct {
+	ttl         time.Duration
+	rememberTTL time.Duration
+	key         []byte
+	timeFunc    func() time.Time
+}
+
+type SessionOption func(*sessionConfig)
+
+// WithSessionTTL sets the lifetime of a session.
+func WithSessionTTL(ttl time.Duration) SessionOption {
+	return func(c *sessionConfig) {
+		c.ttl = ttl
+	}
+}
+
+// WithRememberTTL sets the lifetime of a session created with "remember me".
+func WithRememberTTL(ttl time.Duration) SessionOption {
+	return func(c *sessionConfig) {
+		c.rememberTTL = ttl
+	}
+}
+
+// WithSessionKey sets the key signing the session cookies. By default, a random key is used.
+func WithSessionKey(key []byte) SessionOption {
+	return func(c *sessionConfig) {
+		c.key = key
+	}
+}
+
+func WithSessionTimeFunc(timeFunc func() time.Time) SessionOption {
+	return func(c *sessionConfig) {
+		c.timeFunc = timeFunc
+	}
+}
+
+// Sessions keeps the login sessions in memory. The cookie carries a random
+// token signed with HMAC-SHA256; only the digest of the token (see HashToken) is stored.
+type Sessions struct {
+	mu          sync.Mutex
+	ttl         time.Duration
+	rememberTTL time.Duration
+	key         []byte
+	timeFunc    func() time.Time
+	// sessions by the digest of the token
+	sessions map[string]*Session
+}
+
+func NewSessions(opts ...SessionOption) *Sessions {
+	cnf := sessionConfig{
+		ttl:         defaultSessionTTL,
+		rememberTTL: defaultRememberTTL,
+		timeFunc:    time.Now,
+	}
+	for _, opt := range opts {
+		opt(&cnf)
+	}
+	if len(cnf.key) == 0 {
+		cnf.key = randomBytes(32)
+	}
+
+	return &Sessions{
+		ttl:         cnf.ttl,
+		rememberTTL: cnf.rememberTTL,
+		key:         cnf.key,
+		timeFunc:    cnf.timeFunc,
+		sessions:    make(map[string]*Session),
+	}
+}
+
+// Create starts a session of the user and sets the session cookie.
+// A "remember me" session has a longer lifetime and a persistent cookie.
+func (s *Sessions) Create(w http.ResponseWriter, r *http.Request, user *User, remember bool) Session {
+	token := base64.RawURLEncoding.EncodeToString(randomBytes(32))
+
+	now := s.timeFunc()
+	ttl := s.ttl
+	if remember {
+		ttl = s.rememberTTL
+	}
+
+	session := &Session{
+		ID:         hex.EncodeToString(randomBytes(8)),
+		Username:   user.Username,
+		Role:       user.Role,
+		RemoteAddr: realip.FromRequest(r),
+		UserAgent:  r.UserAgent(),
+		Remember:   remember,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+
+	s.mu.Lock()
+	s.deleteExpired(now)
+	s.sessions[HashToken(token)] = session
+	s.mu.Unlock()
+
+	cookie := &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    token + "." + s.sign(token),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if remember {
+		cookie.Expires = session.ExpiresAt
+	}
+	http.SetCookie(w, cookie)
+
+	return *session
+}
+
+// Authenticate returns the user of the session cookie.
+// A missing, forged or expired session is reported as ErrNoCredentials, so other authenticators can be tried.
+func (s *Sessions) Authenticate(r *http.Request) (*User, error) {
+	token, ok := s.token(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	now := s.timeFunc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[HashToken(token)]
+	if !ok || !now.Before(session.ExpiresAt) {
+		return nil, ErrNoCredentials
+	}
+	session.LastSeenAt = now
+
+	return &User{Username: session.Username, Role: session.Role}, nil
+}
+
+// Destroy ends the session of the request and clears the cookie.
+func (s *Sessions) Destroy(w http.ResponseWriter, r *http.Request) {
+	if token, ok := s.token(r); ok {
+		s.mu.Lock()
+		delete(s.sessions, HashToken(token))
+		s.mu.Unlock()
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Current returns the session of the request.
+func (s *Sessions) Current(r *http.Request) (Session, bool) {
+	token, ok := s.token(r)
+	if !ok {
+		return Session{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[HashToken(token)]
+	if !ok || !s.timeFunc().Before(session.ExpiresAt) {
+		return Session{}, false
+	}
+	return *session, true
+}
+
+// List returns the active sessions ordered by the creation time.
+func (s *Sessions) List() []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteExpired(s.timeFunc())
+
+	list := make([]Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		list = append(list, *session)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+
+	return list
+}
+
+// Revoke ends the session with the given ID.
+func (s *Sessions) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for digest, session := range s.sessions {
+		if session.ID == id {
+			delete(s.sessions, digest)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("session %v: %w", id, ErrSessionNotFound)
+}
+
+// RevokeUser ends all sessions of the user, e.g. after the user is removed. It returns the number of them.
+func (s *Sessions) RevokeUser(username string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	revoked := 0
+	for digest, session := range s.sessions {
+		if session.Username == username {
+			delete(s.sessions, digest)
+			revoked++
+		}
+	}
+
+	return revoked
+}
+
+func (s *Sessions) deleteExpired(now time.Time) {
+	for digest, session := range s.sessions {
+		if !now.Before(session.ExpiresAt) {
+			delete(s.sessions, digest)
+		}
+	}
+}
+
+// token returns the token of the session cookie when its signature is valid.
+func (s *Sessions) token(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return "", false
+	}
+
+	token, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(token))) {
+		return "", false
+	}
+	return token, true
+}
+
+func (s *Sessions) sign(token string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("rand.Read(): %w", err))
+	}
+	return b
+}
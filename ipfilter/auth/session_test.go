@@ -0,0 +1,148 @@
+package auth_test
+
+import (
+	"errors"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func createSession(t *testing.T, sessions *auth.Sessions, username string, remember bool) *http.Cookie {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	sessions.Create(w, httptest.NewRequest(http.MethodPost, "/login", nil), &auth.User{Username: username}, remember)
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != auth.SessionCookieName {
+		t.Fatalf("unexpected cookies: %v", cookies)
+	}
+	return cookies[0]
+}
+
+func requestWithCookie(cookie *http.Cookie) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	return r
+}
+
+func TestSessions(t *testing.T) {
+	fixedTime := &firewall.FixedTime{}
+
+	for _, tt := range []struct {
+		name        string
+		remember    bool
+		action      func(t *testing.T, sessions *auth.Sessions, cookie *http.Cookie) *http.Cookie
+		expectedErr error
+	}{
+		{
+			name: "valid session",
+			action: func(_ *testing.T, _ *auth.Sessions, cookie *http.Cookie) *http.Cookie {
+				fixedTime.SetDateTime("2001-01-01 21:59:59")
+				return cookie
+			},
+		},
+		{
+			name: "expired session",
+			action: func(_ *testing.T, _ *auth.Sessions, cookie *http.Cookie) *http.Cookie {
+				fixedTime.SetDateTime("2001-01-01 22:00:00")
+				return cookie
+			},
+			expectedErr: auth.ErrNoCredentials,
+		},
+		{
+			name:     "remembered session",
+			remember: true,
+			action: func(_ *testing.T, _ *auth.Sessions, cookie *http.Cookie) *http.Cookie {
+				fixedTime.SetDateTime("2001-01-05 10:00:00")
+				return cookie
+			},
+		},
+		{
+			name: "forged cookie",
+			action: func(_ *testing.T, _ *auth.Sessions, cookie *http.Cookie) *http.Cookie {
+				forged := *cookie
+				forged.Value = "x" + cookie.Value
+				return &forged
+			},
+			expectedErr: auth.ErrNoCredentials,
+		},
+		{
+			name: "revoked session",
+			action: func(t *testing.T, sessions *auth.Sessions, cookie *http.Cookie) *http.Cookie {
+				list := sessions.List()
+				if len(list) != 1 {
+					t.Fatalf("sessions: actual: %v expected: 1", len(list))
+				}
+				noError(t, sessions.Revoke(list[0].ID))
+				return cookie
+			},
+			expectedErr: auth.ErrNoCredentials,
+		},
+		{
+			name: "revoked user",
+			action: func(t *testing.T, sessions *auth.Sessions, cookie *http.Cookie) *http.Cookie {
+				createSession(t, sessions, "alice", false)
+				if revoked := sessions.RevokeUser("admin"); revoked != 1 {
+					t.Errorf("revoked: actual: %v expected: 1", revoked)
+				}
+				if list := sessions.List(); len(list) != 1 || list[0].Username != "alice" {
+					t.Errorf("sessions: actual: %v expected: alice", list)
+				}
+				return cookie
+			},
+			expectedErr: auth.ErrNoCredentials,
+		},
+		{
+			name: "destroyed session",
+			action: func(_ *testing.T, sessions *auth.Sessions, cookie *http.Cookie) *http.Cookie {
+				sessions.Destroy(httptest.NewRecorder(), requestWithCookie(cookie))
+				return cookie
+			},
+			expectedErr: auth.ErrNoCredentials,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fixedTime.SetDateTime("2001-01-01 10:00:00")
+			sessions := auth.NewSessions(
+				auth.WithSessionTTL(12*time.Hour),
+				auth.WithRememberTTL(7*24*time.Hour),
+				auth.WithSessionTimeFunc(fixedTime.TimeFunc()),
+			)
+
+			cookie := createSession(t, sessions, "admin", tt.remember)
+			if tt.remember == cookie.Expires.IsZero() {
+				t.Errorf("persistent cookie: actual: %v expected: %v", !cookie.Expires.IsZero(), tt.remember)
+			}
+
+			cookie = tt.action(t, sessions, cookie)
+
+			user, err := sessions.Authenticate(requestWithCookie(cookie))
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("error: actual: %v expected: %v", err, tt.expectedErr)
+			}
+			if err == nil && user.Username != "admin" {
+				t.Errorf("user: actual: %v expected: admin", user.Username)
+			}
+		})
+	}
+}
+
+func TestSessions_RevokeUnknown(t *testing.T) {
+	sessions := auth.NewSessions()
+
+	if err := sessions.Revoke("unknown"); !errors.Is(err, auth.ErrSessionNotFound) {
+		t.Errorf("error: actual: %v expected: %v", err, auth.ErrSessionNotFound)
+	}
+}
+
+func noError(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
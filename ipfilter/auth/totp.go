@@ -0,0 +1,383 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TOTPHeaderName is the header carrying the TOTP code of the state-changing API calls made with basic auth.
+const TOTPHeaderName = "X-TOTP-Code"
+
+const (
+	totpDigits        = 6
+	totpPeriod        = 30
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrTOTPRequired    = errors.New("totp code required")
+	ErrIncorrectTOTP   = errors.New("incorrect totp code")
+	ErrTOTPNotEnrolled = errors.New("totp not enrolled")
+	ErrTOTPEnrolled    = errors.New("totp already enrolled")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrollment is a pending enrollment, active after a code generated from the secret is confirmed.
+type TOTPEnrollment struct {
+	Username string
+	Secret   string
+	// URI is the otpauth:// provisioning URI, usually shown as a QR code.
+	URI string
+}
+
+type totpUser struct {
+	Secret string `json:"secret"`
+	// RecoveryCodes are the digests (see HashToken) of the unused recovery codes.
+	RecoveryCodes []string `json:"recovery_codes"`
+	// LastStep is the time step of the last accepted code, so a code cannot be used twice.
+	LastStep int64 `json:"last_step"`
+}
+
+type totpConfig struct {
+	file     string
+	issuer   string
+	timeFunc func() time.Time
+}
+
+type TOTPOption func(*totpConfig)
+
+// WithTOTPFile sets the JSON file keeping the enrollments. By default, they are kept in memory only.
+func WithTOTPFile(path string) TOTPOption {
+	return func(c *totpConfig) {
+		c.file = path
+	}
+}
+
+// WithTOTPIssuer sets the issuer shown by the authenticator apps.
+func WithTOTPIssuer(issuer string) TOTPOption {
+	return func(c *totpConfig) {
+		c.issuer = issuer
+	}
+}
+
+func WithTOTPTimeFunc(timeFunc func() time.Time) TOTPOption {
+	return func(c *totpConfig) {
+		c.timeFunc = timeFunc
+	}
+}
+
+// TOTP keeps the TOTP (RFC 6238) second factors of the users and their recovery codes.
+type TOTP struct {
+	mu       sync.Mutex
+	file     string
+	issuer   string
+	timeFunc func() time.Time
+	users    map[string]*totpUser
+	// pending secrets by username
+	pending map[string]string
+}
+
+func NewTOTP(opts ...TOTPOption) (*TOTP, error) {
+	cnf := totpConfig{
+		issuer:   "ipfilter",
+		timeFunc: time.Now,
+	}
+	for _, opt := range opts {
+		opt(&cnf)
+	}
+
+	t := &TOTP{
+		file:     cnf.file,
+		issuer:   cnf.issuer,
+		timeFunc: cnf.timeFunc,
+		users:    make(map[string]*totpUser),
+		pending:  make(map[string]string),
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Enabled reports whether the user has a confirmed second factor.
+func (t *TOTP) Enabled(username string) bool {
+	if t == nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, ok := t.users[username]
+	return ok
+}
+
+// RecoveryCodesLeft returns the number of unused recovery codes of the user.
+func (t *TOTP) RecoveryCodesLeft(username string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if user, ok := t.users[username]; ok {
+		return len(user.RecoveryCodes)
+	}
+	return 0
+}
+
+// Enroll starts the enrollment of the user with a new secret.
+func (t *TOTP) Enroll(username string) (TOTPEnrollment, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.users[username]; ok {
+		return TOTPEnrollment{}, fmt.Errorf("user %v: %w", username, ErrTOTPEnrolled)
+	}
+
+	secret := totpEncoding.EncodeToString(randomBytes(20))
+	t.pending[username] = secret
+
+	return TOTPEnrollment{
+		Username: username,
+		Secret:   secret,
+		URI:      t.uri(username, secret),
+	}, nil
+}
+
+// Pending returns the pending enrollment of the user.
+func (t *TOTP) Pending(username string) (TOTPEnrollment, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	secret, ok := t.pending[username]
+	if !ok {
+		return TOTPEnrollment{}, false
+	}
+	return TOTPEnrollment{
+		Username: username,
+		Secret:   secret,
+		URI:      t.uri(username, secret),
+	}, true
+}
+
+// Confirm activates the pending enrollment when the code matches its secret.
+// It returns the recovery codes, which are stored only as digests and cannot be shown again.
+func (t *TOTP) Confirm(username, code string) ([]string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	secret, ok := t.pending[username]
+	if !ok {
+		return nil, fmt.Errorf("user %v: %w", username, ErrTOTPNotEnrolled)
+	}
+
+	step, ok := t.validate(secret, code, 0)
+	if !ok {
+		return nil, fmt.Errorf("user %v: %w", username, ErrIncorrectTOTP)
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	user := &totpUser{
+		Secret:        secret,
+		RecoveryCodes: make([]string, recoveryCodeCount),
+		LastStep:      step,
+	}
+	for i := range codes {
+		codes[i] = newRecoveryCode()
+		user.RecoveryCodes[i] = HashToken(normalizeRecoveryCode(codes[i]))
+	}
+
+	t.users[username] = user
+	if err := t.save(); err != nil {
+		delete(t.users, username)
+		return nil, err
+	}
+	delete(t.pending, username)
+
+	return codes, nil
+}
+
+// Verify checks the TOTP code or a recovery code of the user. A used recovery code is removed.
+// It returns nil for a user without a second factor.
+func (t *TOTP) Verify(username, code string) error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	user, ok := t.users[username]
+	if !ok {
+		return nil
+	}
+	if len(code) == 0 {
+		return ErrTOTPRequired
+	}
+
+	if step, ok := t.validate(user.Secret, code, user.LastStep); ok {
+		user.LastStep = step
+		return t.save()
+	}
+
+	digest := HashToken(normalizeRecoveryCode(code))
+	for i, recoveryCode := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(recoveryCode), []byte(digest)) == 1 {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i], user.RecoveryCodes[i+1:]...)
+			return t.save()
+		}
+	}
+
+	return fmt.Errorf("user %v: %w", username, ErrIncorrectTOTP)
+}
+
+// Disable removes the second factor of the user.
+func (t *TOTP) Disable(username string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	user, ok := t.users[username]
+	if !ok {
+		return fmt.Errorf("user %v: %w", username, ErrTOTPNotEnrolled)
+	}
+
+	delete(t.users, username)
+	if err := t.save(); err != nil {
+		t.users[username] = user
+		return err
+	}
+
+	return nil
+}
+
+// Users returns the usernames with a second factor.
+func (t *TOTP) Users() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	usernames := make([]string, 0, len(t.users))
+	for username := range t.users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	return usernames
+}
+
+// validate checks the code within one time step of clock skew. Only the steps after lastStep are accepted.
+func (t *TOTP) validate(secret, code string, lastStep int64) (int64, bool) {
+	step := t.timeFunc().Unix() / totpPeriod
+	for _, s := range []int64{step, step - 1, step + 1} {
+		if s <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, s)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+func (t *TOTP) uri(username, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", t.issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + t.issuer + ":" + username,
+		RawQuery: query.Encode(),
+	}).String()
+}
+
+func (t *TOTP) load() error {
+	if len(t.file) == 0 {
+		return nil
+	}
+
+	data, err := os.ReadFile(t.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("os.ReadFile(): %w", err)
+	}
+
+	if err := json.Unmarshal(data, &t.users); err != nil {
+		return fmt.Errorf("json.Unmarshal(): %v: %w", t.file, err)
+	}
+	if t.users == nil {
+		t.users = make(map[string]*totpUser)
+	}
+
+	return nil
+}
+
+// save writes the enrollments to the file, replacing it atomically.
+func (t *TOTP) save() error {
+	if len(t.file) == 0 {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(t.users, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent(): %w", err)
+	}
+
+	return writeFileAtomic(t.file, data)
+}
+
+// TOTPCode returns the code of the base32 encoded secret at the time
+// (HMAC-SHA1, 6 digits, 30 seconds step).
+func TOTPCode(secret string, at time.Time) (string, error) {
+	return totpCode(secret, at.Unix()/totpPeriod)
+}
+
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", fmt.Errorf("base32.DecodeString(): %w", err)
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// newRecoveryCode returns a random code formatted as 'xxxx-xxxx-xxxx-xxxx'.
+func newRecoveryCode() string {
+	code := strings.ToLower(totpEncoding.EncodeToString(randomBytes(10)))
+	return code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16]
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
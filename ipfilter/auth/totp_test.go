@@ -0,0 +1,152 @@
+package auth_test
+
+import (
+	"errors"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// the SHA1 test vectors of RFC 6238, truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	for _, tt := range []struct {
+		unix     int64
+		expected string
+	}{
+		{unix: 59, expected: "287082"},
+		{unix: 1111111109, expected: "081804"},
+		{unix: 1111111111, expected: "050471"},
+		{unix: 1234567890, expected: "005924"},
+		{unix: 2000000000, expected: "279037"},
+	} {
+		code, err := auth.TOTPCode(secret, time.Unix(tt.unix, 0))
+		noError(t, err)
+		if code != tt.expected {
+			t.Errorf("%v: actual: %v expected: %v", tt.unix, code, tt.expected)
+		}
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	fixedTime := &firewall.FixedTime{}
+	fixedTime.SetDateTime("2001-01-01 10:00:00")
+
+	file := filepath.Join(t.TempDir(), "totp.json")
+	totp, err := auth.NewTOTP(auth.WithTOTPFile(file), auth.WithTOTPTimeFunc(fixedTime.TimeFunc()))
+	noError(t, err)
+
+	enrollment, err := totp.Enroll("alice")
+	noError(t, err)
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/ipfilter:alice?") ||
+		!strings.Contains(enrollment.URI, "secret="+enrollment.Secret) {
+		t.Errorf("unexpected uri: %v", enrollment.URI)
+	}
+	if totp.Enabled("alice") {
+		t.Fatalf("enabled before confirmation")
+	}
+
+	code := func() string {
+		code, err := auth.TOTPCode(enrollment.Secret, fixedTime.TimeFunc()())
+		noError(t, err)
+		return code
+	}
+
+	if _, err := totp.Confirm("alice", "000000"); !errors.Is(err, auth.ErrIncorrectTOTP) {
+		t.Fatalf("confirm: actual: %v expected: %v", err, auth.ErrIncorrectTOTP)
+	}
+	recoveryCodes, err := totp.Confirm("alice", code())
+	noError(t, err)
+	if len(recoveryCodes) != 10 || !totp.Enabled("alice") {
+		t.Fatalf("recovery codes: %v enabled: %v", recoveryCodes, totp.Enabled("alice"))
+	}
+
+	// the steps share the state of the enrollment
+	for _, tt := range []struct {
+		name        string
+		at          string
+		username    string
+		code        func() string
+		expectedErr error
+	}{
+		{
+			name:     "user without second factor",
+			at:       "2001-01-01 10:00:30",
+			username: "bob",
+			code:     func() string { return "" },
+		},
+		{
+			name:        "missing code",
+			at:          "2001-01-01 10:00:30",
+			username:    "alice",
+			code:        func() string { return "" },
+			expectedErr: auth.ErrTOTPRequired,
+		},
+		{
+			name:        "incorrect code",
+			at:          "2001-01-01 10:00:30",
+			username:    "alice",
+			code:        func() string { return "000000" },
+			expectedErr: auth.ErrIncorrectTOTP,
+		},
+		{
+			name:     "valid code",
+			at:       "2001-01-01 10:00:30",
+			username: "alice",
+			code:     code,
+		},
+		{
+			name:        "reused code",
+			at:          "2001-01-01 10:00:40",
+			username:    "alice",
+			code:        code,
+			expectedErr: auth.ErrIncorrectTOTP,
+		},
+		{
+			name:     "recovery code",
+			at:       "2001-01-01 10:00:40",
+			username: "alice",
+			code:     func() string { return strings.ToUpper(recoveryCodes[0]) },
+		},
+		{
+			name:        "reused recovery code",
+			at:          "2001-01-01 10:00:40",
+			username:    "alice",
+			code:        func() string { return recoveryCodes[0] },
+			expectedErr: auth.ErrIncorrectTOTP,
+		},
+		{
+			name:        "expired code",
+			at:          "2001-01-01 10:02:00",
+			username:    "alice",
+			code:        func() string { c := code(); fixedTime.SetDateTime("2001-01-01 10:03:00"); return c },
+			expectedErr: auth.ErrIncorrectTOTP,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fixedTime.SetDateTime(tt.at)
+			if err := totp.Verify(tt.username, tt.code()); !errors.Is(err, tt.expectedErr) {
+				t.Errorf("error: actual: %v expected: %v", err, tt.expectedErr)
+			}
+		})
+	}
+
+	if left := totp.RecoveryCodesLeft("alice"); left != 9 {
+		t.Errorf("recovery codes left: actual: %v expected: 9", left)
+	}
+
+	reloaded, err := auth.NewTOTP(auth.WithTOTPFile(file))
+	noError(t, err)
+	if !reloaded.Enabled("alice") || reloaded.RecoveryCodesLeft("alice") != 9 {
+		t.Errorf("enrollment not saved")
+	}
+
+	noError(t, totp.Disable("alice"))
+	if err := totp.Disable("alice"); !errors.Is(err, auth.ErrTOTPNotEnrolled) {
+		t.Errorf("disable again: actual: %v expected: %v", err, auth.ErrTOTPNotEnrolled)
+	}
+}
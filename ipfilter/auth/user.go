@@ -0,0 +1,125 @@
+// Package auth provides authentication of HTTP requests.
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"github.com/dkarczmarski/gomisc/ipfilter/htpasswd"
+	"log"
+	"slices"
+	"sync"
+)
+
+type User struct {
+	Username string
+	// Password is a plaintext password. It is used only when PasswordHash is empty.
+	Password string
+	// PasswordHash is a bcrypt or argon2id hash of the password.
+	PasswordHash string
+	// Role is set for authenticated users by Roles, unless the authenticator has set it.
+	Role Role
+	// Scopes limit the requests of a user authenticated by a personal API token. Nil allows all.
+	Scopes []string
+	// BearerToken is set for a user authenticated by a personal API token or a static token,
+	// which a browser never sends by itself.
+	BearerToken bool
+}
+
+// Users is the set of users allowed to log in. It can be replaced at runtime.
+// The users from an htpasswd file are checked after the configured ones.
+type Users struct {
+	mu    sync.RWMutex
+	users []User
+	file  *htpasswd.File
+}
+
+func NewUsers(users []User) *Users {
+	return &Users{
+		users: users,
+	}
+}
+
+// Set replaces all users, e.g. after the configuration is reloaded.
+func (u *Users) Set(users []User) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.users = users
+}
+
+// SetHtpasswd sets the htpasswd file with additional users.
+func (u *Users) SetHtpasswd(file *htpasswd.File) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.file = file
+}
+
+// Authenticate returns the user matching the credentials or nil.
+// The returned user has no password fields set.
+func (u *Users) Authenticate(username, password string) *User {
+	u.mu.RLock()
+	users, file := u.users, u.file
+	u.mu.RUnlock()
+
+	if user := createAuthFunc(users)(username, password); user != nil {
+		return user
+	}
+
+	if file != nil && file.Verify(username, password) {
+		return &User{Username: username}
+	}
+
+	return nil
+}
+
+// Exists reports whether the user is configured or in the htpasswd file.
+func (u *Users) Exists(username string) bool {
+	u.mu.RLock()
+	users, file := u.users, u.file
+	u.mu.RUnlock()
+
+	for _, user := range users {
+		if user.Username == username {
+			return true
+		}
+	}
+
+	return file != nil && slices.Contains(file.Usernames(), username)
+}
+
+func createAuthFunc(users []User) func(username, password string) *User {
+	return func(username, password string) *User {
+		known := false
+		for _, u := range users {
+			if u.Username != username {
+				continue
+			}
+			known = true
+			if verifyPassword(u, password) {
+				return &User{Username: u.Username}
+			}
+		}
+		// the response time does not reveal which usernames are valid
+		if !known {
+			htpasswd.VerifyUnknown(password)
+		}
+		return nil
+	}
+}
+
+func verifyPassword(user User, password string) bool {
+	if len(user.PasswordHash) > 0 {
+		match, err := htpasswd.VerifyHash(user.PasswordHash, password)
+		if err != nil {
+			log.Printf("user %v: %v", user.Username, err)
+			return false
+		}
+		return match
+	}
+
+	// compare digests, as ConstantTimeCompare leaks the length of the compared values
+	expected := sha256.Sum256([]byte(user.Password))
+	actual := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(expected[:], actual[:]) == 1
+}
@@ -0,0 +1,340 @@
+// Package client provides a typed client for the ipfilter JSON API
+// described by the OpenAPI document served at /api/openapi.json.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Entry is a firewall entry.
+type Entry struct {
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	TTLSeconds int64     `json:"ttl_seconds,omitempty"`
+	Owner      string    `json:"owner,omitempty"`
+	Label      string    `json:"label,omitempty"`
+}
+
+// Me describes the caller's address as seen by the server.
+// Entry is nil when the address is not in the registry.
+type Me struct {
+	IP    string `json:"ip"`
+	Entry *Entry `json:"entry"`
+}
+
+// Status is the state of the server returned by /status.
+type Status struct {
+	Ready bool `json:"ready"`
+	// Checks holds "ok" or the error of every readiness check.
+	Checks        map[string]string `json:"checks"`
+	StartedAt     time.Time         `json:"started_at"`
+	UptimeSeconds int64             `json:"uptime_seconds"`
+	Entries       struct {
+		Total   int            `json:"total"`
+		ByOwner map[string]int `json:"by_owner"`
+	} `json:"entries"`
+	Scheduler struct {
+		LastCleanup    *time.Time `json:"last_cleanup,omitempty"`
+		LastReconcile  *time.Time `json:"last_reconcile,omitempty"`
+		ReconcileError string     `json:"reconcile_error,omitempty"`
+	} `json:"scheduler"`
+	Backend struct {
+		Errors      int        `json:"errors"`
+		LastError   string     `json:"last_error,omitempty"`
+		LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	} `json:"backend"`
+}
+
+// APIError is returned when the server responds with an error status.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("ipfilter api: %v %v: %v", e.StatusCode, e.Code, e.Message)
+}
+
+// IsNotFound reports whether err is an API error for an unknown ip.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsUnknownCallerIP reports whether err is an API error for a request without the caller's IP,
+// which the server cannot tell on the unix socket.
+func IsUnknownCallerIP(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code == "unknown_caller_ip"
+}
+
+type config struct {
+	httpClient *http.Client
+	tlsConfig  *tls.Config
+	username   string
+	password   string
+	token      string
+	totpCode   string
+}
+
+// Option configures the client.
+type Option func(*config)
+
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *config) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithUnixSocket makes the client connect to the server listening on a unix socket.
+// The host of the base URL is ignored then, e.g. 'http://unix' can be used.
+func WithUnixSocket(path string) Option {
+	return func(c *config) {
+		var dialer net.Dialer
+		c.httpClient = &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", path)
+				},
+			},
+		}
+	}
+}
+
+// WithTLSConfig sets the TLS configuration of the connections, e.g. with the CA of a self-signed
+// server certificate or a client certificate. It applies to the transport of WithHTTPClient too,
+// when it is an *http.Transport.
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(c *config) {
+		c.tlsConfig = tlsConfig
+	}
+}
+
+func WithBasicAuth(username, password string) Option {
+	return func(c *config) {
+		c.username = username
+		c.password = password
+	}
+}
+
+// WithBearerToken authenticates the requests with an API token instead of basic auth.
+func WithBearerToken(token string) Option {
+	return func(c *config) {
+		c.token = token
+	}
+}
+
+// WithTOTPCode sets the TOTP code sent with the state-changing requests of a user with a second factor.
+// A code can be used only once.
+func WithTOTPCode(code string) Option {
+	return func(c *config) {
+		c.totpCode = code
+	}
+}
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	username   string
+	password   string
+	token      string
+	totpCode   string
+}
+
+// New creates a client for the server at baseURL, e.g. 'http://127.0.0.1:8080'.
+func New(baseURL string, opts ...Option) *Client {
+	cnf := config{
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, ops := range opts {
+		ops(&cnf)
+	}
+	if cnf.tlsConfig != nil {
+		cnf.httpClient = withTLSConfig(cnf.httpClient, cnf.tlsConfig)
+	}
+
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: cnf.httpClient,
+		username:   cnf.username,
+		password:   cnf.password,
+		token:      cnf.token,
+		totpCode:   cnf.totpCode,
+	}
+}
+
+// withTLSConfig returns a copy of the client with the TLS configuration set on its transport.
+func withTLSConfig(httpClient *http.Client, tlsConfig *tls.Config) *http.Client {
+	var transport *http.Transport
+	switch t := httpClient.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return httpClient
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	withTLS := *httpClient
+	withTLS.Transport = transport
+	return &withTLS
+}
+
+func (c *Client) List(ctx context.Context) ([]Entry, error) {
+	var resp struct {
+		Entries []Entry `json:"entries"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/entries", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Entries, nil
+}
+
+// Add adds ip or refreshes it when it has been already added.
+func (c *Client) Add(ctx context.Context, ip string) (Entry, error) {
+	return c.AddWithTTL(ctx, ip, 0)
+}
+
+// AddWithTTL is like Add but sets the entry's own time-to-live.
+// The server default is used when ttl is 0.
+func (c *Client) AddWithTTL(ctx context.Context, ip string, ttl time.Duration) (Entry, error) {
+	req := struct {
+		IP         string `json:"ip"`
+		TTLSeconds int64  `json:"ttl_seconds,omitempty"`
+	}{
+		IP:         ip,
+		TTLSeconds: int64(ttl / time.Second),
+	}
+
+	var entry Entry
+	err := c.do(ctx, http.MethodPost, "/api/v1/entries", req, &entry)
+	return entry, err
+}
+
+func (c *Client) Delete(ctx context.Context, ip string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/entries/"+url.PathEscape(ip), nil, nil)
+}
+
+// Renew refreshes an already added ip. It fails with a not found error for an unknown ip.
+func (c *Client) Renew(ctx context.Context, ip string) (Entry, error) {
+	var entry Entry
+	err := c.do(ctx, http.MethodPost, "/api/v1/entries/"+url.PathEscape(ip)+"/renew", nil, &entry)
+	return entry, err
+}
+
+func (c *Client) Me(ctx context.Context) (Me, error) {
+	var me Me
+	err := c.do(ctx, http.MethodGet, "/api/v1/me", nil, &me)
+	return me, err
+}
+
+func (c *Client) AddMe(ctx context.Context) (Entry, error) {
+	return c.AddMeWithTTL(ctx, 0)
+}
+
+func (c *Client) AddMeWithTTL(ctx context.Context, ttl time.Duration) (Entry, error) {
+	req := struct {
+		TTLSeconds int64 `json:"ttl_seconds,omitempty"`
+	}{
+		TTLSeconds: int64(ttl / time.Second),
+	}
+
+	var entry Entry
+	err := c.do(ctx, http.MethodPost, "/api/v1/me", req, &entry)
+	return entry, err
+}
+
+func (c *Client) DeleteMe(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/me", nil, nil)
+}
+
+// Status returns the state of the server. It requires the operator role.
+func (c *Client) Status(ctx context.Context) (Status, error) {
+	var status Status
+	err := c.do(ctx, http.MethodGet, "/status", nil, &status)
+	return status, err
+}
+
+func (c *Client) do(ctx context.Context, method, path string, reqBody, respBody any) error {
+	var body io.Reader
+	if reqBody != nil {
+		data, err := json.Marshal(reqBody)
+		if err != nil {
+			return fmt.Errorf("json.Marshal(): %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext(): %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(c.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if len(c.username) > 0 {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	if len(c.totpCode) > 0 && method != http.MethodGet {
+		req.Header.Set("X-TOTP-Code", c.totpCode)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("httpClient.Do(): %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return decodeError(resp)
+	}
+
+	if respBody == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(respBody); err != nil {
+		return fmt.Errorf("json.Decode(): %w", err)
+	}
+
+	return nil
+}
+
+func decodeError(resp *http.Response) error {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+	}
+
+	var errResp struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+		return apiErr
+	}
+
+	apiErr.Code = errResp.Error.Code
+	apiErr.Message = errResp.Error.Message
+	return apiErr
+}
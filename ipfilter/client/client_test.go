@@ -0,0 +1,286 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/client"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/htserver"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type nopBackend struct{}
+
+func (nopBackend) Allow(_ context.Context, _ string) error  { return nil }
+func (nopBackend) Revoke(_ context.Context, _ string) error { return nil }
+
+func newTestServer(t *testing.T) (*httptest.Server, *firewall.FixedTime) {
+	t.Helper()
+
+	fixedTime := &firewall.FixedTime{}
+	fixedTime.SetDateTime("2001-01-01 10:00:00")
+
+	service := firewall.NewService(
+		firewall.WithTimeFunc(fixedTime.TimeFunc()),
+		firewall.WithBackend(nopBackend{}),
+	)
+
+	users := auth.NewUsers([]auth.User{{Username: "admin", Password: "123"}})
+	server := httptest.NewServer(htserver.NewServeMux(service, htserver.WithUsers(users), htserver.WithRoles(auth.NewRoles(nil, auth.RoleAdmin))))
+	t.Cleanup(server.Close)
+
+	return server, fixedTime
+}
+
+func entry(ip, createdAt, updatedAt, expiresAt string) client.Entry {
+	return client.Entry{
+		IP:        ip,
+		CreatedAt: firewall.MustParseDateTime(createdAt),
+		UpdatedAt: firewall.MustParseDateTime(updatedAt),
+		ExpiresAt: firewall.MustParseDateTime(expiresAt),
+		Owner:     "admin",
+	}
+}
+
+func TestClient(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		testFunc     func(c *client.Client, fixedTime *firewall.FixedTime) (any, error)
+		expectedErr  func(err error) bool
+		expectedResp any
+	}{
+		{
+			name: "list empty",
+			testFunc: func(c *client.Client, _ *firewall.FixedTime) (any, error) {
+				return c.List(context.Background())
+			},
+			expectedErr:  noError,
+			expectedResp: []client.Entry{},
+		},
+		{
+			name: "add and list",
+			testFunc: func(c *client.Client, fixedTime *firewall.FixedTime) (any, error) {
+				if _, err := c.Add(context.Background(), "1.2.3.4"); err != nil {
+					return nil, err
+				}
+				fixedTime.SetDateTime("2001-01-01 10:01:00")
+				if _, err := c.Add(context.Background(), "2.2.8.8"); err != nil {
+					return nil, err
+				}
+				return c.List(context.Background())
+			},
+			expectedErr: noError,
+			expectedResp: []client.Entry{
+				entry("1.2.3.4", "2001-01-01 10:00:00", "2001-01-01 10:00:00", "2001-01-01 10:00:15"),
+				entry("2.2.8.8", "2001-01-01 10:01:00", "2001-01-01 10:01:00", "2001-01-01 10:01:15"),
+			},
+		},
+		{
+			name: "add with ttl",
+			testFunc: func(c *client.Client, _ *firewall.FixedTime) (any, error) {
+				return c.AddWithTTL(context.Background(), "1.2.3.4", time.Hour)
+			},
+			expectedErr: noError,
+			expectedResp: client.Entry{
+				IP:         "1.2.3.4",
+				CreatedAt:  firewall.MustParseDateTime("2001-01-01 10:00:00"),
+				UpdatedAt:  firewall.MustParseDateTime("2001-01-01 10:00:00"),
+				ExpiresAt:  firewall.MustParseDateTime("2001-01-01 11:00:00"),
+				TTLSeconds: 3600,
+				Owner:      "admin",
+			},
+		},
+		{
+			name: "add incorrect ip",
+			testFunc: func(c *client.Client, _ *firewall.FixedTime) (any, error) {
+				return c.Add(context.Background(), "1.2.3,,4")
+			},
+			expectedErr: apiError(http.StatusBadRequest, "incorrect_ip"),
+		},
+		{
+			name: "renew",
+			testFunc: func(c *client.Client, fixedTime *firewall.FixedTime) (any, error) {
+				if _, err := c.Add(context.Background(), "1.2.3.4"); err != nil {
+					return nil, err
+				}
+				fixedTime.SetDateTime("2001-01-01 10:05:00")
+				return c.Renew(context.Background(), "1.2.3.4")
+			},
+			expectedErr:  noError,
+			expectedResp: entry("1.2.3.4", "2001-01-01 10:00:00", "2001-01-01 10:05:00", "2001-01-01 10:05:15"),
+		},
+		{
+			name: "renew unknown ip",
+			testFunc: func(c *client.Client, _ *firewall.FixedTime) (any, error) {
+				return c.Renew(context.Background(), "1.2.3.4")
+			},
+			expectedErr: client.IsNotFound,
+		},
+		{
+			name: "delete",
+			testFunc: func(c *client.Client, _ *firewall.FixedTime) (any, error) {
+				if _, err := c.Add(context.Background(), "1.2.3.4"); err != nil {
+					return nil, err
+				}
+				if err := c.Delete(context.Background(), "1.2.3.4"); err != nil {
+					return nil, err
+				}
+				return c.List(context.Background())
+			},
+			expectedErr:  noError,
+			expectedResp: []client.Entry{},
+		},
+		{
+			name: "delete unknown ip",
+			testFunc: func(c *client.Client, _ *firewall.FixedTime) (any, error) {
+				return nil, c.Delete(context.Background(), "1.2.3.4")
+			},
+			expectedErr: apiError(http.StatusNotFound, "ip_not_found"),
+		},
+		{
+			name: "add me",
+			testFunc: func(c *client.Client, _ *firewall.FixedTime) (any, error) {
+				if _, err := c.AddMe(context.Background()); err != nil {
+					return nil, err
+				}
+				return c.Me(context.Background())
+			},
+			expectedErr: noError,
+			expectedResp: client.Me{
+				IP:    "127.0.0.1",
+				Entry: ptr(entry("127.0.0.1", "2001-01-01 10:00:00", "2001-01-01 10:00:00", "2001-01-01 10:00:15")),
+			},
+		},
+		{
+			name: "delete me",
+			testFunc: func(c *client.Client, _ *firewall.FixedTime) (any, error) {
+				if _, err := c.AddMe(context.Background()); err != nil {
+					return nil, err
+				}
+				if err := c.DeleteMe(context.Background()); err != nil {
+					return nil, err
+				}
+				return c.Me(context.Background())
+			},
+			expectedErr:  noError,
+			expectedResp: client.Me{IP: "127.0.0.1"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, fixedTime := newTestServer(t)
+			c := client.New(server.URL, client.WithBasicAuth("admin", "123"))
+
+			resp, err := tt.testFunc(c, fixedTime)
+			if !tt.expectedErr(err) {
+				t.Fatalf("expected error is not satisfied: %v", err)
+			}
+			if err == nil && !reflect.DeepEqual(resp, tt.expectedResp) {
+				t.Errorf("response\nactual:   %+v\nexpected: %+v", resp, tt.expectedResp)
+			}
+		})
+	}
+}
+
+func TestClient_Unauthorized(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	for _, c := range []*client.Client{
+		client.New(server.URL),
+		client.New(server.URL, client.WithBasicAuth("admin", "wrong")),
+	} {
+		if _, err := c.List(context.Background()); !apiError(http.StatusUnauthorized, "unauthorized")(err) {
+			t.Errorf("expected unauthorized error, got: %v", err)
+		}
+	}
+}
+
+func TestClient_Status(t *testing.T) {
+	server, _ := newTestServer(t)
+	c := client.New(server.URL, client.WithBasicAuth("admin", "123"))
+
+	_, err := c.Add(context.Background(), "1.2.3.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := c.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the scheduler is not run by the test server
+	if status.Ready || status.Checks["scheduler"] != "not started" || status.Checks["backend"] != "ok" {
+		t.Errorf("unexpected checks: %v %+v", status.Ready, status.Checks)
+	}
+	if status.Entries.Total != 1 || status.Entries.ByOwner["admin"] != 1 {
+		t.Errorf("unexpected entries: %+v", status.Entries)
+	}
+}
+
+func TestClient_UnixSocket(t *testing.T) {
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(nopBackend{}),
+	)
+	users := auth.NewUsers([]auth.User{{Username: "admin", Password: "123"}})
+
+	path := filepath.Join(t.TempDir(), "ipfilter.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(htserver.NewServeMux(service, htserver.WithUsers(users), htserver.WithRoles(auth.NewRoles(nil, auth.RoleAdmin))))
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	c := client.New("http://unix", client.WithUnixSocket(path), client.WithBasicAuth("admin", "123"))
+
+	// the caller's IP is unknown on the socket, so it must be passed explicitly
+	_, err = c.Me(context.Background())
+	if !apiError(http.StatusBadRequest, "unknown_caller_ip")(err) || !client.IsUnknownCallerIP(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := c.Add(context.Background(), "1.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+	if !service.Contains("1.2.3.4") {
+		t.Error("ip not added")
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	resp, err := http.Get(server.URL + "/api/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected response: %v %v", resp.Status, resp.Header.Get("Content-Type"))
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func apiError(status int, code string) func(err error) bool {
+	return func(err error) bool {
+		var apiErr *client.APIError
+		return errors.As(err, &apiErr) && apiErr.StatusCode == status && apiErr.Code == code
+	}
+}
+
+func noError(err error) bool {
+	return err == nil
+}
@@ -1,43 +1,81 @@
 package main
 
 import (
-	"context"
 	"errors"
-	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
-	"github.com/dkarczmarski/gomisc/ipfilter/htserver"
-	"log"
-	"net/http"
+	"flag"
+	"fmt"
 	"os"
-	"os/signal"
-	"sync"
-	"time"
+	"strings"
 )
 
-func main() {
-	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt)
-
-	// todo: concurrent
-	service := firewall.NewService(
-		firewall.WithTimeFunc(time.Now),
-		firewall.WithSudoWrapper(),
-	)
+const usage = `usage: ipfilter <command> [flags] [args]
 
-	mux := htserver.NewServeMux(service)
+commands:
+  serve                      start the server (default when no command is given)
+  add <ip> [-ttl duration]   add or refresh an entry
+  renew <ip>                 refresh an existing entry
+  delete <ip>                delete an entry
+  list                       list entries
+  me [add|delete] [-ttl d]   show, add or delete the caller's entry
+  status                     show server status
+  passwd <username>          add or update a user in the htpasswd file
 
-	var wg sync.WaitGroup
+Run 'ipfilter <command> -h' for the command flags.
+`
 
-	firewall.RunDeleteOutOfDateTask(ctx, &wg, service)
-
-	server := &http.Server{
-		Addr:    "127.0.0.1:8080",
-		Handler: mux,
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "ipfilter: %v\n", err)
+		}
+		os.Exit(1)
 	}
+}
 
-	htserver.RunShutdownListenerTask(ctx, &wg, server)
+func run(args []string) error {
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
 
-	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Fatal(err)
+	switch command {
+	case "serve":
+		return runServe(args)
+	case "add":
+		return runAdd(args)
+	case "renew":
+		return runRenew(args)
+	case "delete":
+		return runDelete(args)
+	case "list":
+		return runList(args)
+	case "me":
+		return runMe(args)
+	case "status":
+		return runStatus(args)
+	case "passwd":
+		return runPasswd(args)
+	case "help":
+		fmt.Print(usage)
+		return nil
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command: %v", command)
 	}
+}
 
-	wg.Wait()
+// parseInterspersed parses flags placed before and after positional arguments,
+// e.g. 'add 1.2.3.4 -ttl 1h', and returns the positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
 }
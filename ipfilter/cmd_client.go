@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/client"
+	"github.com/dkarczmarski/gomisc/ipfilter/tlscert"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+type clientFlags struct {
+	server   string
+	socket   string
+	user     string
+	password string
+	token    string
+	totpCode string
+	caFile   string
+	certFile string
+	keyFile  string
+	output   string
+}
+
+func newClientFlagSet(name string, flags *clientFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&flags.server, "server", getenv("IPFILTER_SERVER", "http://127.0.0.1:8080"), "server URL (env IPFILTER_SERVER)")
+	fs.StringVar(&flags.socket, "socket", os.Getenv("IPFILTER_SOCKET"), "connect to the server unix socket instead of -server (env IPFILTER_SOCKET)")
+	fs.StringVar(&flags.user, "user", os.Getenv("IPFILTER_USER"), "username (env IPFILTER_USER)")
+	fs.StringVar(&flags.password, "password", os.Getenv("IPFILTER_PASSWORD"), "password (env IPFILTER_PASSWORD)")
+	fs.StringVar(&flags.token, "token", os.Getenv("IPFILTER_TOKEN"), "API token used instead of -user (env IPFILTER_TOKEN)")
+	fs.StringVar(&flags.totpCode, "totp", os.Getenv("IPFILTER_TOTP"), "TOTP code of a user with a second factor (env IPFILTER_TOTP)")
+	fs.StringVar(&flags.caFile, "ca", os.Getenv("IPFILTER_CA"), "PEM CA verifying the server certificate, e.g. a self-signed one (env IPFILTER_CA)")
+	fs.StringVar(&flags.certFile, "cert", os.Getenv("IPFILTER_CERT"), "PEM client certificate (env IPFILTER_CERT)")
+	fs.StringVar(&flags.keyFile, "key", os.Getenv("IPFILTER_KEY"), "PEM private key of -cert (env IPFILTER_KEY)")
+	fs.StringVar(&flags.output, "o", "table", "output format: table or json")
+	return fs
+}
+
+func (flags *clientFlags) newClient() (*client.Client, error) {
+	if flags.output != "table" && flags.output != "json" {
+		return nil, fmt.Errorf("unknown output format: %v", flags.output)
+	}
+
+	baseURL := flags.server
+	var opts []client.Option
+	if len(flags.socket) > 0 {
+		baseURL = "http://unix"
+		opts = append(opts, client.WithUnixSocket(flags.socket))
+	}
+	if len(flags.user) > 0 {
+		opts = append(opts, client.WithBasicAuth(flags.user, flags.password))
+	}
+	if len(flags.token) > 0 {
+		opts = append(opts, client.WithBearerToken(flags.token))
+	}
+	if len(flags.totpCode) > 0 {
+		opts = append(opts, client.WithTOTPCode(flags.totpCode))
+	}
+	if len(flags.caFile) > 0 || len(flags.certFile) > 0 {
+		tlsConfig, err := flags.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, client.WithTLSConfig(tlsConfig))
+	}
+
+	return client.New(baseURL, opts...), nil
+}
+
+func (flags *clientFlags) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if len(flags.caFile) > 0 {
+		pool, err := tlscert.LoadCertPool(flags.caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(flags.certFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(flags.certFile, flags.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls.LoadX509KeyPair(): %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// parseClientArgs parses the command flags and checks the number of positional arguments.
+func parseClientArgs(fs *flag.FlagSet, args []string, argNames ...string) ([]string, error) {
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(positional) != len(argNames) {
+		return nil, fmt.Errorf("%v: expected arguments: %v", fs.Name(), argNames)
+	}
+	return positional, nil
+}
+
+func runAdd(args []string) error {
+	var flags clientFlags
+	fs := newClientFlagSet("add", &flags)
+	ttl := fs.Duration("ttl", 0, "entry time-to-live (server default when 0)")
+	positional, err := parseClientArgs(fs, args, "ip")
+	if err != nil {
+		return err
+	}
+
+	c, err := flags.newClient()
+	if err != nil {
+		return err
+	}
+
+	entry, err := c.AddWithTTL(context.Background(), positional[0], *ttl)
+	if err != nil {
+		return err
+	}
+
+	return printEntry(os.Stdout, flags.output, entry)
+}
+
+func runRenew(args []string) error {
+	var flags clientFlags
+	fs := newClientFlagSet("renew", &flags)
+	positional, err := parseClientArgs(fs, args, "ip")
+	if err != nil {
+		return err
+	}
+
+	c, err := flags.newClient()
+	if err != nil {
+		return err
+	}
+
+	entry, err := c.Renew(context.Background(), positional[0])
+	if err != nil {
+		return err
+	}
+
+	return printEntry(os.Stdout, flags.output, entry)
+}
+
+func runDelete(args []string) error {
+	var flags clientFlags
+	fs := newClientFlagSet("delete", &flags)
+	positional, err := parseClientArgs(fs, args, "ip")
+	if err != nil {
+		return err
+	}
+
+	c, err := flags.newClient()
+	if err != nil {
+		return err
+	}
+
+	return c.Delete(context.Background(), positional[0])
+}
+
+func runList(args []string) error {
+	var flags clientFlags
+	fs := newClientFlagSet("list", &flags)
+	if _, err := parseClientArgs(fs, args); err != nil {
+		return err
+	}
+
+	c, err := flags.newClient()
+	if err != nil {
+		return err
+	}
+
+	entries, err := c.List(context.Background())
+	if err != nil {
+		return err
+	}
+
+	return printEntries(os.Stdout, flags.output, entries)
+}
+
+func runMe(args []string) error {
+	var flags clientFlags
+	fs := newClientFlagSet("me", &flags)
+	ttl := fs.Duration("ttl", 0, "entry time-to-live for 'me add' (server default when 0)")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+
+	action := "show"
+	if len(positional) > 0 {
+		action = positional[0]
+	}
+	if len(positional) > 1 {
+		return errors.New("me: too many arguments")
+	}
+
+	c, err := flags.newClient()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	switch action {
+	case "show":
+	case "add":
+		if _, err := c.AddMeWithTTL(ctx, *ttl); err != nil {
+			return meError(err)
+		}
+	case "delete":
+		if err := c.DeleteMe(ctx); err != nil {
+			return meError(err)
+		}
+	default:
+		return fmt.Errorf("me: unknown action: %v", action)
+	}
+
+	me, err := c.Me(ctx)
+	if err != nil {
+		return meError(err)
+	}
+
+	if flags.output == "json" {
+		return printJSON(os.Stdout, me)
+	}
+
+	fmt.Printf("IP: %v\n", me.IP)
+	if me.Entry == nil {
+		fmt.Println("not allowed")
+		return nil
+	}
+	return printEntry(os.Stdout, flags.output, *me.Entry)
+}
+
+// meError explains that the server does not know the caller's IP on the unix socket.
+func meError(err error) error {
+	if client.IsUnknownCallerIP(err) {
+		return fmt.Errorf("%w (use 'ipfilter add <ip>' over the socket)", err)
+	}
+	return err
+}
+
+// Status is the output of the status command.
+type Status struct {
+	Server    string     `json:"server"`
+	Reachable bool       `json:"reachable"`
+	Error     string     `json:"error,omitempty"`
+	Entries   int        `json:"entries"`
+	Me        *client.Me `json:"me,omitempty"`
+	// Health is shown to the operators only.
+	Health *client.Status `json:"health,omitempty"`
+}
+
+func runStatus(args []string) error {
+	var flags clientFlags
+	fs := newClientFlagSet("status", &flags)
+	if _, err := parseClientArgs(fs, args); err != nil {
+		return err
+	}
+
+	c, err := flags.newClient()
+	if err != nil {
+		return err
+	}
+
+	status := Status{
+		Server: flags.server,
+	}
+	if len(flags.socket) > 0 {
+		status.Server = "unix:" + flags.socket
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	entries, err := c.List(ctx)
+	if err != nil {
+		var apiErr *client.APIError
+		status.Reachable = errors.As(err, &apiErr)
+		status.Error = err.Error()
+	} else {
+		status.Reachable = true
+		status.Entries = len(entries)
+
+		if me, err := c.Me(ctx); err == nil {
+			status.Me = &me
+		}
+		if health, err := c.Status(ctx); err == nil {
+			status.Health = &health
+		}
+	}
+
+	if flags.output == "json" {
+		if err := printJSON(os.Stdout, status); err != nil {
+			return err
+		}
+	} else {
+		printStatus(os.Stdout, status)
+	}
+
+	if len(status.Error) > 0 {
+		return errors.New("server is not healthy")
+	}
+	if status.Health != nil && !status.Health.Ready {
+		return errors.New("server is not ready")
+	}
+	return nil
+}
+
+func printStatus(w io.Writer, status Status) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "server:\t%v\n", status.Server)
+	fmt.Fprintf(tw, "reachable:\t%v\n", status.Reachable)
+	if len(status.Error) > 0 {
+		fmt.Fprintf(tw, "error:\t%v\n", status.Error)
+	}
+	if len(status.Error) == 0 {
+		fmt.Fprintf(tw, "entries:\t%v\n", status.Entries)
+	}
+	if status.Me != nil {
+		fmt.Fprintf(tw, "my ip:\t%v\n", status.Me.IP)
+		fmt.Fprintf(tw, "my ip allowed:\t%v\n", status.Me.Entry != nil)
+	}
+	if health := status.Health; health != nil {
+		fmt.Fprintf(tw, "ready:\t%v\n", health.Ready)
+		for _, name := range slices.Sorted(maps.Keys(health.Checks)) {
+			if result := health.Checks[name]; result != "ok" {
+				fmt.Fprintf(tw, "%v:\t%v\n", name, result)
+			}
+		}
+		fmt.Fprintf(tw, "uptime:\t%v\n", time.Duration(health.UptimeSeconds)*time.Second)
+		if health.Scheduler.LastCleanup != nil {
+			fmt.Fprintf(tw, "last cleanup:\t%v\n", health.Scheduler.LastCleanup.Local().Format(time.DateTime))
+		}
+		if health.Scheduler.LastReconcile != nil {
+			fmt.Fprintf(tw, "last reconcile:\t%v\n", health.Scheduler.LastReconcile.Local().Format(time.DateTime))
+		}
+		fmt.Fprintf(tw, "backend errors:\t%v\n", health.Backend.Errors)
+	}
+	_ = tw.Flush()
+}
+
+func printEntry(w io.Writer, output string, entry client.Entry) error {
+	if output == "json" {
+		return printJSON(w, entry)
+	}
+	return printEntries(w, output, []client.Entry{entry})
+}
+
+func printEntries(w io.Writer, output string, entries []client.Entry) error {
+	if output == "json" {
+		if entries == nil {
+			entries = []client.Entry{}
+		}
+		return printJSON(w, entries)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "IP\tCREATED\tUPDATED\tEXPIRES\tTTL\tOWNER")
+	for _, entry := range entries {
+		ttl := "default"
+		if entry.TTLSeconds > 0 {
+			ttl = (time.Duration(entry.TTLSeconds) * time.Second).String()
+		}
+		owner := entry.Owner
+		if len(owner) == 0 {
+			owner = "-"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			entry.IP,
+			entry.CreatedAt.Local().Format(time.DateTime),
+			entry.UpdatedAt.Local().Format(time.DateTime),
+			entry.ExpiresAt.Local().Format(time.DateTime),
+			ttl,
+			owner,
+		)
+	}
+	return tw.Flush()
+}
+
+func printJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func getenv(key, defaultValue string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/config"
+	"github.com/dkarczmarski/gomisc/ipfilter/htpasswd"
+	"golang.org/x/term"
+	"os"
+	"strings"
+)
+
+func runPasswd(args []string) error {
+	fs := flag.NewFlagSet("passwd", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("IPFILTER_CONFIG"), "YAML configuration file with auth.htpasswd_file (env IPFILTER_CONFIG)")
+	file := fs.String("file", "", "htpasswd file (auth.htpasswd_file from the configuration when empty)")
+	algo := fs.String("algo", "bcrypt", "hash algorithm: bcrypt or argon2id")
+	cost := fs.Int("cost", 12, "bcrypt cost")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("passwd: expected arguments: [username]")
+	}
+	username := positional[0]
+
+	path := *file
+	if len(path) == 0 {
+		cnf, err := config.Load(*configPath)
+		if err != nil {
+			return err
+		}
+		path = cnf.Auth.HtpasswdFile
+	}
+	if len(path) == 0 {
+		return errors.New("passwd: no htpasswd file: use -file or auth.htpasswd_file")
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	var hash string
+	switch *algo {
+	case "bcrypt":
+		hash, err = htpasswd.HashBcrypt(password, *cost)
+	case "argon2id":
+		hash, err = htpasswd.HashArgon2id(password, htpasswd.DefaultArgon2idParams)
+	default:
+		return fmt.Errorf("passwd: unknown algorithm: %v", *algo)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := htpasswd.SetUser(path, username, hash); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "password of %v has been set in %v\n", username, path)
+	return nil
+}
+
+// readPassword reads the password from the terminal without echo, asking twice,
+// or reads the first line from the standard input when it is not a terminal.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && len(line) == 0 {
+			return "", fmt.Errorf("read password: %w", err)
+		}
+		password := strings.TrimRight(line, "\r\n")
+		if len(password) == 0 {
+			return "", errors.New("empty password")
+		}
+		return password, nil
+	}
+
+	fmt.Fprint(os.Stderr, "New password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("term.ReadPassword(): %w", err)
+	}
+
+	fmt.Fprint(os.Stderr, "Re-type new password: ")
+	retyped, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("term.ReadPassword(): %w", err)
+	}
+
+	if string(password) != string(retyped) {
+		return "", errors.New("passwords do not match")
+	}
+	if len(password) == 0 {
+		return "", errors.New("empty password")
+	}
+
+	return string(password), nil
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/audit"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/config"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/htpasswd"
+	"github.com/dkarczmarski/gomisc/ipfilter/htserver"
+	"github.com/dkarczmarski/gomisc/ipfilter/httpbackend"
+	"github.com/dkarczmarski/gomisc/ipfilter/metrics"
+	"github.com/dkarczmarski/gomisc/ipfilter/notify"
+	"github.com/dkarczmarski/gomisc/ipfilter/proxy"
+	"github.com/dkarczmarski/gomisc/ipfilter/realip"
+	"github.com/dkarczmarski/gomisc/ipfilter/tlscert"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func runServe(args []string) error {
+	var (
+		configPath  string
+		httpBackend string
+		proxyRules  []config.ProxyRuleConfig
+	)
+
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.StringVar(&configPath, "config", os.Getenv("IPFILTER_CONFIG"), "YAML configuration file (env IPFILTER_CONFIG)")
+	listen := fs.String("listen", "", "HTTP listen address (server.listen)")
+	socket := fs.String("socket", "", "additionally listen on this unix socket (server.socket)")
+	tlsCert := fs.String("tls-cert", "", "serve HTTPS with this PEM certificate (server.tls.cert_file)")
+	tlsKey := fs.String("tls-key", "", "PEM private key of -tls-cert (server.tls.key_file)")
+	tlsSelfSigned := fs.Bool("tls-self-signed", false, "generate a self-signed certificate into -tls-cert and -tls-key when missing (server.tls.self_signed)")
+	devAssets := fs.String("dev-assets", "", "read the templates and static files from this directory on every request, e.g. ./htserver (server.dev_assets_dir)")
+	mode := fs.String("mode", "", "filtering mode: firewall (ufw rules), http (external firewall API) or proxy (TCP gatekeeper) (firewall.mode)")
+	ttl := fs.Duration("ttl", 0, "default time-to-live of entries (firewall.ttl)")
+	applyRules := fs.Bool("apply-rules", false, "run the ufw commands in the firewall mode, they are only logged otherwise (firewall.apply_rules)")
+	proxyDrop := fs.Bool("proxy-drop-on-revoke", false, "close established proxy connections when their entry expires or is deleted (proxy.drop_on_revoke)")
+	fs.StringVar(&httpBackend, "http-backend", "", "JSON file with the http backend endpoints (http_backend)")
+	fs.Func("proxy-rule", "proxy rule listen=backend, e.g. :15432=127.0.0.1:5432 (repeatable, proxy.rules)", func(value string) error {
+		rule, err := proxy.ParseRule(value)
+		if err != nil {
+			return err
+		}
+		proxyRules = append(proxyRules, config.ProxyRuleConfig{Listen: rule.Listen, Backend: rule.Backend})
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// the flags explicitly set on the command line override the configuration file
+	setFlags := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	flagOverrides := func(cnf *config.Config) error {
+		if setFlags["listen"] {
+			cnf.Server.Listen = *listen
+		}
+		if setFlags["socket"] {
+			cnf.Server.Socket = *socket
+		}
+		if setFlags["tls-cert"] {
+			cnf.Server.TLS.CertFile = *tlsCert
+		}
+		if setFlags["tls-key"] {
+			cnf.Server.TLS.KeyFile = *tlsKey
+		}
+		if setFlags["tls-self-signed"] {
+			cnf.Server.TLS.SelfSigned = *tlsSelfSigned
+		}
+		if setFlags["dev-assets"] {
+			cnf.Server.DevAssetsDir = *devAssets
+		}
+		if setFlags["mode"] {
+			cnf.Firewall.Mode = *mode
+		}
+		if setFlags["ttl"] {
+			cnf.Firewall.TTL = *ttl
+		}
+		if setFlags["apply-rules"] {
+			cnf.Firewall.ApplyRules = *applyRules
+		}
+		if setFlags["proxy-drop-on-revoke"] {
+			cnf.Proxy.DropOnRevoke = *proxyDrop
+		}
+		if setFlags["proxy-rule"] {
+			cnf.Proxy.Rules = proxyRules
+		}
+		if setFlags["http-backend"] {
+			backendCnf, err := readHTTPBackendConfig(httpBackend)
+			if err != nil {
+				return err
+			}
+			cnf.HTTPBackend = backendCnf
+		}
+		return nil
+	}
+
+	cnf, err := config.Load(configPath, flagOverrides)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	registry := metrics.NewRegistry()
+
+	gatekeeper, service, err := newService(cnf, registry)
+	if err != nil {
+		return err
+	}
+
+	users := auth.NewUsers(newUsers(cnf))
+	sessions := auth.NewSessions(
+		auth.WithSessionTTL(cnf.Auth.Session.TTL),
+		auth.WithRememberTTL(cnf.Auth.Session.RememberTTL),
+	)
+	roles := auth.NewRoles(cnf.UserRoles(), auth.Role(cnf.Roles.Default))
+
+	trail, err := newAuditTrail(cnf)
+	if err != nil {
+		return err
+	}
+
+	lockout := auth.NewLockout(
+		auth.WithMaxFailures(cnf.Auth.Lockout.MaxFailures),
+		auth.WithBanDuration(cnf.Auth.Lockout.BanDuration, cnf.Auth.Lockout.MaxBanDuration),
+		auth.WithLockFunc(htserver.RecordLockout(trail)),
+		auth.WithFailureFunc(htserver.CountLoginFailures(registry)),
+	)
+
+	totp, err := newTOTP(cnf)
+	if err != nil {
+		return err
+	}
+
+	apiTokens, err := auth.NewAPITokens(
+		auth.WithAPITokensFile(cnf.Auth.APITokens.File),
+		auth.WithAPITokensUserFunc(knownUserFunc(cnf, users)),
+	)
+	if err != nil {
+		return err
+	}
+
+	templates, err := htserver.NewTemplates(cnf.Server.DevAssetsDir)
+	if err != nil {
+		return err
+	}
+	if len(cnf.Server.DevAssetsDir) > 0 {
+		log.Printf("serving the templates and static files from %v", cnf.Server.DevAssetsDir)
+	}
+
+	// the links in the notifications need the public URL of the web UI
+	var links *htserver.ApprovalLinks
+	if len(cnf.Approval.BaseURL) > 0 {
+		links = htserver.NewApprovalLinks(cnf.Approval.BaseURL)
+	}
+
+	mux := htserver.NewServeMux(service,
+		htserver.WithUsers(users),
+		htserver.WithSessions(sessions),
+		htserver.WithAuthenticator(newAuthenticator(cnf, users, lockout, totp)),
+		htserver.WithRoles(roles),
+		htserver.WithLockout(lockout),
+		htserver.WithTOTP(totp),
+		htserver.WithOIDC(newOIDC(cnf)),
+		htserver.WithAPITokens(apiTokens),
+		htserver.WithRealIP(realip.NewResolver(cnf.ServerTrustedProxies(),
+			realip.WithHeader(cnf.Server.ClientIPHeader),
+			realip.WithTrustUnixSocket(cnf.Server.TrustSocket),
+		)),
+		htserver.WithTemplates(templates),
+		htserver.WithAuditTrail(trail),
+		htserver.WithMetrics(registry),
+		htserver.WithApprovalLinks(links),
+	)
+
+	var wg sync.WaitGroup
+
+	if len(cnf.Auth.HtpasswdFile) > 0 {
+		file, err := htpasswd.Load(cnf.Auth.HtpasswdFile)
+		if err != nil {
+			return err
+		}
+		users.SetHtpasswd(file)
+		htpasswd.RunWatchTask(ctx, &wg, file, 2*time.Second, func(username string) {
+			revokeRemovedUser(users, sessions, apiTokens, username)
+		})
+	}
+
+	firewall.RunDeleteOutOfDateTask(ctx, &wg, service)
+
+	// a failed listener or proxy stops the server, so the tasks are stopped too
+	serveErrs := make(chan error, 3)
+
+	if gatekeeper != nil {
+		proxy.RunGatekeeperTask(ctx, &wg, gatekeeper, service, serveErrs)
+	}
+
+	if len(cnf.Notifications.Channels) > 0 {
+		notify.RunTask(ctx, &wg, newNotifier(cnf, links), service)
+	}
+
+	currentCnf := cnf
+	runReloadTask(ctx, &wg, func() {
+		newCnf, err := config.Load(configPath, flagOverrides)
+		if err != nil {
+			log.Printf("reload: %v", err)
+			return
+		}
+
+		reloadConfig(currentCnf, newCnf, service, users, roles, sessions, apiTokens)
+		currentCnf = newCnf
+	})
+
+	server := &http.Server{
+		Addr:              cnf.Server.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: cnf.Server.Timeouts.ReadHeader,
+		ReadTimeout:       cnf.Server.Timeouts.Read,
+		WriteTimeout:      cnf.Server.Timeouts.Write,
+		IdleTimeout:       cnf.Server.Timeouts.Idle,
+	}
+
+	if len(cnf.Server.TLS.CertFile) > 0 {
+		tlsConfig, err := newTLSConfig(ctx, &wg, cnf)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	htserver.RunShutdownListenerTask(ctx, &wg, server)
+
+	serve := func(addr string, serve func() error) {
+		go func() {
+			if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serveErrs <- fmt.Errorf("serve on %v: %w", addr, err)
+			}
+		}()
+	}
+
+	if len(cnf.Server.Socket) > 0 {
+		listener, err := listenUnix(cnf.Server.Socket)
+		if err != nil {
+			return err
+		}
+
+		serve(cnf.Server.Socket, func() error {
+			return server.Serve(listener)
+		})
+	}
+
+	listenAndServe := server.ListenAndServe
+	if server.TLSConfig != nil {
+		// the certificate is served by TLSConfig.GetCertificate
+		listenAndServe = func() error {
+			return server.ListenAndServeTLS("", "")
+		}
+	}
+	serve(cnf.Server.Listen, listenAndServe)
+
+	var serveErr error
+	select {
+	case serveErr = <-serveErrs:
+		stop()
+	case <-ctx.Done():
+	}
+
+	wg.Wait()
+
+	return serveErr
+}
+
+// newService creates the firewall service for the configured mode.
+// The gatekeeper is returned only in the proxy mode.
+func newService(cnf *config.Config, registry *metrics.Registry) (*proxy.Gatekeeper, *firewall.Service, error) {
+	switch cnf.Firewall.Mode {
+	case "http":
+		backend, err := httpbackend.NewFromConfig(*cnf.HTTPBackend)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, firewall.NewService(
+			firewall.WithTimeFunc(time.Now),
+			firewall.WithDefaultTTL(cnf.Firewall.TTL),
+			firewall.WithPolicy(newPolicy(cnf)),
+			firewall.WithApprovalTimeout(cnf.Approval.Timeout),
+			firewall.WithMetrics(registry),
+			firewall.WithBackend(backend),
+		), nil
+	case "proxy":
+		gatekeeper := newGatekeeper(cnf)
+		return gatekeeper, firewall.NewService(
+			firewall.WithTimeFunc(time.Now),
+			firewall.WithDefaultTTL(cnf.Firewall.TTL),
+			firewall.WithPolicy(newPolicy(cnf)),
+			firewall.WithApprovalTimeout(cnf.Approval.Timeout),
+			firewall.WithMetrics(registry),
+			firewall.WithBackend(gatekeeper),
+		), nil
+	default:
+		return nil, firewall.NewService(
+			firewall.WithTimeFunc(time.Now),
+			firewall.WithDefaultTTL(cnf.Firewall.TTL),
+			firewall.WithPolicy(newPolicy(cnf)),
+			firewall.WithApprovalTimeout(cnf.Approval.Timeout),
+			firewall.WithMetrics(registry),
+			firewall.WithWrapper(cnf.Firewall.Wrapper),
+			firewall.WithApplyRules(cnf.Firewall.ApplyRules),
+			firewall.WithPort(cnf.Firewall.Port),
+		), nil
+	}
+}
+
+// newNotifier creates the notifier of the configured channels. The links of the access requests are added when they are set.
+func newNotifier(cnf *config.Config, links *htserver.ApprovalLinks) *notify.Notifier {
+	channels := make([]notify.Channel, len(cnf.Notifications.Channels))
+	for i, channel := range cnf.Notifications.Channels {
+		var sender notify.Sender
+		switch channel.Type {
+		case "slack":
+			sender = notify.NewSlack(channel.URL)
+		case "ntfy":
+			sender = notify.NewNtfy(channel.URL, channel.Token)
+		default:
+			sender = notify.NewWebhook(channel.URL, channel.Secret)
+		}
+
+		events := make([]firewall.EventType, 0, len(channel.NotifiedEvents()))
+		for _, event := range channel.NotifiedEvents() {
+			events = append(events, firewall.EventType(event))
+		}
+
+		channels[i] = notify.Channel{
+			Name:   channel.Name,
+			Sender: sender,
+			Filter: notify.Filter{
+				Events: events,
+				Owners: channel.Owners,
+			},
+		}
+	}
+
+	opts := []notify.Option{notify.WithRetries(cnf.Notifications.Retries, cnf.Notifications.Backoff)}
+	if links != nil {
+		opts = append(opts, notify.WithLinks(links.URL))
+	}
+	return notify.New(channels, opts...)
+}
+
+func newGatekeeper(cnf *config.Config) *proxy.Gatekeeper {
+	rules := make([]proxy.Rule, len(cnf.Proxy.Rules))
+	for i, rule := range cnf.Proxy.Rules {
+		rules[i] = proxy.Rule{
+			Listen:  rule.Listen,
+			Backend: rule.Backend,
+		}
+	}
+
+	if cnf.Proxy.DropOnRevoke {
+		return proxy.NewGatekeeper(rules, proxy.WithDropOnRevoke())
+	}
+	return proxy.NewGatekeeper(rules)
+}
+
+// runReloadTask calls reload every time SIGHUP is received.
+func runReloadTask(ctx context.Context, wg *sync.WaitGroup, reload func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer signal.Stop(hup)
+
+		for {
+			select {
+			case <-hup:
+				log.Println("reloading configuration")
+				reload()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// reloadConfig applies the parts of the configuration which are safe to change
+// at runtime: users, roles, policy, TTLs and the approval timeout. The active entries and requests are kept,
+// the sessions and the API tokens of the removed users are revoked.
+func reloadConfig(oldCnf, newCnf *config.Config, service *firewall.Service, users *auth.Users, roles *auth.Roles,
+	sessions *auth.Sessions, apiTokens *auth.APITokens,
+) {
+	users.Set(newUsers(newCnf))
+	for _, user := range oldCnf.Users {
+		revokeRemovedUser(users, sessions, apiTokens, user.Username)
+	}
+	roles.Set(newCnf.UserRoles(), auth.Role(newCnf.Roles.Default))
+	service.SetDefaultTTL(newCnf.Firewall.TTL)
+	service.SetPolicy(newPolicy(newCnf))
+	service.SetApprovalTimeout(newCnf.Approval.Timeout)
+
+	if !reflect.DeepEqual(oldCnf.Server, newCnf.Server) ||
+		!reflect.DeepEqual(oldCnf.Auth, newCnf.Auth) ||
+		oldCnf.Audit != newCnf.Audit ||
+		!reflect.DeepEqual(oldCnf.Notifications, newCnf.Notifications) ||
+		oldCnf.Approval.BaseURL != newCnf.Approval.BaseURL ||
+		oldCnf.Firewall.Mode != newCnf.Firewall.Mode ||
+		oldCnf.Firewall.Wrapper != newCnf.Firewall.Wrapper ||
+		oldCnf.Firewall.ApplyRules != newCnf.Firewall.ApplyRules ||
+		oldCnf.Firewall.Port != newCnf.Firewall.Port {
+		log.Println("reload: server, auth, audit, notifications, approval base URL and firewall mode changes require a restart")
+	}
+
+	log.Printf("configuration reloaded: %d users, default ttl %v", len(newCnf.Users), newCnf.Firewall.TTL)
+}
+
+// revokeRemovedUser revokes the sessions and the API tokens of a user removed from the configuration
+// or from the htpasswd file, unless the user is still defined in the other one.
+func revokeRemovedUser(users *auth.Users, sessions *auth.Sessions, apiTokens *auth.APITokens, username string) {
+	if users.Exists(username) {
+		return
+	}
+	tokens, err := apiTokens.RevokeUser(username)
+	if err != nil {
+		log.Printf("user %v: %v", username, err)
+	}
+	log.Printf("user %v removed, %d sessions and %d api tokens revoked",
+		username, sessions.RevokeUser(username), tokens)
+}
+
+// knownUserFunc returns the check of the users of the API tokens. The users of the identity provider and
+// of the proxy header are not listed anywhere, so the tokens are not checked when these are enabled.
+func knownUserFunc(cnf *config.Config, users *auth.Users) func(username string) bool {
+	if len(cnf.Auth.OIDC.Issuer) > 0 || len(cnf.Auth.ProxyHeader.Header) > 0 {
+		return nil
+	}
+
+	certUsers := make(map[string]bool, len(cnf.Auth.ClientCerts))
+	for _, cert := range cnf.Auth.ClientCerts {
+		certUsers[cert.Username] = true
+	}
+	return func(username string) bool {
+		return certUsers[username] || users.Exists(username)
+	}
+}
+
+func newUsers(cnf *config.Config) []auth.User {
+	users := make([]auth.User, len(cnf.Users))
+	for i, u := range cnf.Users {
+		users[i] = auth.User{
+			Username:     u.Username,
+			Password:     u.Password,
+			PasswordHash: u.PasswordHash,
+		}
+	}
+	return users
+}
+
+// newAuthenticator creates the chain of the configured auth methods. Basic auth is always enabled.
+func newAuthenticator(cnf *config.Config, users *auth.Users, lockout *auth.Lockout, totp *auth.TOTP) auth.Authenticator {
+	var authenticators []auth.Authenticator
+
+	if len(cnf.Auth.ClientCerts) > 0 {
+		subjects := make(map[string]string, len(cnf.Auth.ClientCerts))
+		for _, cert := range cnf.Auth.ClientCerts {
+			subjects[cert.Subject] = cert.Username
+		}
+		authenticators = append(authenticators, auth.NewClientCertAuthenticator(subjects))
+	}
+
+	if len(cnf.Auth.ProxyHeader.Header) > 0 {
+		authenticators = append(authenticators,
+			auth.NewProxyHeaderAuthenticator(cnf.Auth.ProxyHeader.Header, cnf.TrustedProxies()))
+	}
+
+	if len(cnf.Auth.Tokens) > 0 {
+		tokens := make([]auth.Token, len(cnf.Auth.Tokens))
+		for i, t := range cnf.Auth.Tokens {
+			tokens[i] = auth.Token{Username: t.Username, SHA256: t.TokenSHA256}
+		}
+		authenticators = append(authenticators, auth.NewBearerAuthenticator(tokens))
+	}
+
+	authenticators = append(authenticators, auth.NewBasicAuthenticator(users.Authenticate,
+		auth.WithLockout(lockout), auth.WithTOTP(totp)))
+
+	return auth.Chain(authenticators...)
+}
+
+// newOIDC creates the client of the OpenID Connect identity provider when auth.oidc.issuer is set.
+func newOIDC(cnf *config.Config) *auth.OIDC {
+	oidc := cnf.Auth.OIDC
+	if len(oidc.Issuer) == 0 {
+		return nil
+	}
+
+	return auth.NewOIDC(oidc.Issuer, oidc.ClientID, oidc.ClientSecret, oidc.RedirectURL,
+		auth.WithOIDCScopes(oidc.Scopes),
+		auth.WithOIDCUsernameClaim(oidc.UsernameClaim),
+		auth.WithOIDCGroupsClaim(oidc.GroupsClaim),
+		auth.WithOIDCGroupRoles(cnf.OIDCGroupRoles()),
+		auth.WithOIDCAllowedGroups(oidc.AllowedGroups),
+	)
+}
+
+// newTOTP creates the store of the TOTP second factors when auth.totp.file is set.
+func newTOTP(cnf *config.Config) (*auth.TOTP, error) {
+	if len(cnf.Auth.TOTP.File) == 0 {
+		return nil, nil
+	}
+
+	return auth.NewTOTP(
+		auth.WithTOTPFile(cnf.Auth.TOTP.File),
+		auth.WithTOTPIssuer(cnf.Auth.TOTP.Issuer),
+	)
+}
+
+// newTLSConfig loads the certificate of server.tls, generating a self-signed one when enabled,
+// and reloads it when its files change.
+func newTLSConfig(ctx context.Context, wg *sync.WaitGroup, cnf *config.Config) (*tls.Config, error) {
+	tlsCnf := cnf.Server.TLS
+
+	if tlsCnf.SelfSigned {
+		created, err := tlscert.GenerateSelfSigned(tlsCnf.CertFile, tlsCnf.KeyFile, tlsCnf.Hosts, 365*24*time.Hour)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			log.Printf("tls: generated a self-signed certificate %v for %v", tlsCnf.CertFile, tlsCnf.Hosts)
+		}
+	}
+
+	cert, err := tlscert.Load(tlsCnf.CertFile, tlsCnf.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("tls: serving %v, fingerprint %v", tlsCnf.CertFile, cert.Fingerprint())
+
+	tlsConfig, err := tlscert.NewServerConfig(cert, tlsCnf.ClientCAFile, tlsCnf.RequireClientCert)
+	if err != nil {
+		return nil, err
+	}
+
+	tlscert.RunWatchTask(ctx, wg, cert, 10*time.Second)
+
+	return tlsConfig, nil
+}
+
+// newAuditTrail creates the audit trail, appending the events to audit.file when it is set.
+// The file is kept open until the process exits.
+func newAuditTrail(cnf *config.Config) (*audit.Trail, error) {
+	if len(cnf.Audit.File) == 0 {
+		return audit.NewTrail(), nil
+	}
+
+	file, err := os.OpenFile(cnf.Audit.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("os.OpenFile(): %w", err)
+	}
+
+	return audit.NewTrail(audit.WithWriter(file)), nil
+}
+
+func newPolicy(cnf *config.Config) firewall.Policy {
+	return firewall.Policy{
+		AllowedNetworks: cnf.AllowedNetworks(),
+		MaxTTL:          cnf.Policy.MaxTTL,
+	}
+}
+
+// listenUnix listens on a unix socket accessible only by the current user.
+// A socket left by a previous run is removed.
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("os.Remove(): %w", err)
+	}
+
+	// the socket is created private, so it is not open to others until the chmod. The umask is
+	// process-wide, but it only makes the files created meanwhile more private.
+	oldMask := umask(0o077)
+	listener, err := net.Listen("unix", path)
+	umask(oldMask)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %v: %w", path, err)
+	}
+
+	if err := os.Chmod(path, 0o600); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("os.Chmod(): %w", err)
+	}
+
+	return listener, nil
+}
+
+func readHTTPBackendConfig(path string) (*httpbackend.Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile(): %w", err)
+	}
+
+	var cnf httpbackend.Config
+	if err := json.Unmarshal(data, &cnf); err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	return &cnf, nil
+}
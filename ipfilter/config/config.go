@@ -0,0 +1,770 @@
+// Package config provides loading and validation of the ipfilter configuration file.
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/htpasswd"
+	"github.com/dkarczmarski/gomisc/ipfilter/httpbackend"
+	"github.com/dkarczmarski/gomisc/ipfilter/realip"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Server      ServerConfig        `yaml:"server"`
+	Firewall    FirewallConfig      `yaml:"firewall"`
+	HTTPBackend *httpbackend.Config `yaml:"http_backend"`
+	Proxy       ProxyConfig         `yaml:"proxy"`
+	Policy      PolicyConfig        `yaml:"policy"`
+	Auth        AuthConfig          `yaml:"auth"`
+	Users       []UserConfig        `yaml:"users"`
+	Roles       RolesConfig         `yaml:"roles"`
+	Audit       AuditConfig         `yaml:"audit"`
+	// Approval configures the access requests of the requester role.
+	Approval ApprovalConfig `yaml:"approval"`
+	// Notifications sends the registry changes to webhooks and chats.
+	Notifications NotificationsConfig `yaml:"notifications"`
+}
+
+type ServerConfig struct {
+	Listen string `yaml:"listen"`
+	Socket string `yaml:"socket"`
+	// TrustedProxies are the addresses or networks of the reverse proxies passing the client IP
+	// in ClientIPHeader. Empty uses the address of the connection.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// ClientIPHeader is one of: X-Forwarded-For, X-Real-IP, Forwarded.
+	ClientIPHeader string `yaml:"client_ip_header"`
+	// TrustSocket trusts ClientIPHeader of the requests over Socket, e.g. from a local proxy.
+	TrustSocket bool           `yaml:"trust_socket"`
+	TLS         TLSConfig      `yaml:"tls"`
+	Timeouts    TimeoutsConfig `yaml:"timeouts"`
+	// DevAssetsDir is the directory with the templates and static directories which are read
+	// on every request instead of the embedded ones, e.g. ./htserver. For the development of the UI.
+	DevAssetsDir string `yaml:"dev_assets_dir"`
+}
+
+// TLSConfig enables HTTPS on server.listen. The unix socket is always served without TLS.
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM files of the certificate (with its chain) and the private key.
+	// They are reloaded when they change. Empty serves plain HTTP.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// SelfSigned generates a self-signed certificate into CertFile and KeyFile when CertFile does not exist.
+	SelfSigned bool `yaml:"self_signed"`
+	// Hosts are the names and IP addresses of the self-signed certificate.
+	Hosts []string `yaml:"hosts"`
+	// ClientCAFile is the CA verifying the client certificates, e.g. for auth.client_certs.
+	ClientCAFile string `yaml:"client_ca_file"`
+	// RequireClientCert rejects the connections without a client certificate signed by the CA.
+	RequireClientCert bool `yaml:"require_client_cert"`
+}
+
+// TimeoutsConfig limits the time of the HTTP connections, see http.Server. Zero means no limit.
+type TimeoutsConfig struct {
+	ReadHeader time.Duration `yaml:"read_header"`
+	Read       time.Duration `yaml:"read"`
+	Write      time.Duration `yaml:"write"`
+	Idle       time.Duration `yaml:"idle"`
+}
+
+type FirewallConfig struct {
+	// Mode is one of: firewall, http, proxy.
+	Mode    string `yaml:"mode"`
+	Wrapper string `yaml:"wrapper"`
+	// ApplyRules makes the firewall mode run the ufw commands. They are only logged (a dry run) when it is false.
+	ApplyRules bool `yaml:"apply_rules"`
+	Port       int  `yaml:"port"`
+	// TTL is the default time-to-live of entries.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+type ProxyConfig struct {
+	DropOnRevoke bool              `yaml:"drop_on_revoke"`
+	Rules        []ProxyRuleConfig `yaml:"rules"`
+}
+
+type ProxyRuleConfig struct {
+	Listen  string `yaml:"listen"`
+	Backend string `yaml:"backend"`
+}
+
+type PolicyConfig struct {
+	AllowedNetworks []string      `yaml:"allowed_networks"`
+	MaxTTL          time.Duration `yaml:"max_ttl"`
+}
+
+type AuthConfig struct {
+	// HtpasswdFile is an Apache-style htpasswd file with additional users.
+	// It is reloaded when it changes.
+	HtpasswdFile string `yaml:"htpasswd_file"`
+	// Tokens are static API tokens accepted as 'Authorization: Bearer <token>'.
+	Tokens      []TokenConfig     `yaml:"tokens"`
+	ProxyHeader ProxyHeaderConfig `yaml:"proxy_header"`
+	// ClientCerts maps the subjects of verified TLS client certificates to users.
+	ClientCerts []ClientCertConfig `yaml:"client_certs"`
+	Session     SessionConfig      `yaml:"session"`
+	Lockout     LockoutConfig      `yaml:"lockout"`
+	TOTP        TOTPConfig         `yaml:"totp"`
+	OIDC        OIDCConfig         `yaml:"oidc"`
+	APITokens   APITokensConfig    `yaml:"api_tokens"`
+}
+
+// APITokensConfig configures the personal API tokens, which the users create in the web UI.
+type APITokensConfig struct {
+	// File keeps the tokens. Empty keeps them in memory only, so they are lost on restart.
+	File string `yaml:"file"`
+}
+
+// OIDCConfig enables the single sign-on login with an OpenID Connect identity provider.
+type OIDCConfig struct {
+	// Issuer is the URL of the identity provider. Empty disables the single sign-on.
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// RedirectURL is the callback registered at the identity provider, e.g. 'https://ipfilter.example.com/login/oidc/callback'.
+	RedirectURL string   `yaml:"redirect_url"`
+	Scopes      []string `yaml:"scopes"`
+	// UsernameClaim is the ID token claim with the username, which gets the 'oidc:' prefix. It should be a claim
+	// the users cannot change, like the default 'sub'.
+	UsernameClaim string `yaml:"username_claim"`
+	// GroupsClaim is the ID token claim with the groups (or roles) of the user.
+	GroupsClaim string `yaml:"groups_claim"`
+	// GroupRoles maps the groups to roles. Users without a mapped group get the role from roles.
+	GroupRoles map[string]string `yaml:"group_roles"`
+	// AllowedGroups limits the login to the members of the groups. Empty allows all users of the issuer.
+	AllowedGroups []string `yaml:"allowed_groups"`
+}
+
+// TOTPConfig enables the TOTP second factor, which the users enroll in the web UI.
+type TOTPConfig struct {
+	// File keeps the enrolled secrets and recovery codes. Empty disables the second factor.
+	File string `yaml:"file"`
+	// Issuer is the account issuer shown by the authenticator apps.
+	Issuer string `yaml:"issuer"`
+}
+
+// LockoutConfig configures the lockout of usernames and source IPs after failed password attempts.
+type LockoutConfig struct {
+	// MaxFailures is the number of failures after which the username or the IP is locked out. Zero disables it.
+	MaxFailures int `yaml:"max_failures"`
+	// BanDuration is the first ban. Every next failure doubles it up to MaxBanDuration.
+	BanDuration    time.Duration `yaml:"ban_duration"`
+	MaxBanDuration time.Duration `yaml:"max_ban_duration"`
+}
+
+// SessionConfig configures the cookie sessions of the login page.
+type SessionConfig struct {
+	TTL time.Duration `yaml:"ttl"`
+	// RememberTTL is the lifetime of a session created with "remember me".
+	RememberTTL time.Duration `yaml:"remember_ttl"`
+}
+
+type TokenConfig struct {
+	Username string `yaml:"username"`
+	// TokenSHA256 is the hex encoded SHA-256 digest of the token, e.g. 'printf %s "$TOKEN" | sha256sum'.
+	TokenSHA256 string `yaml:"token_sha256"`
+}
+
+// ProxyHeaderConfig enables trusting a user name header set by a reverse proxy, e.g. oauth2-proxy.
+type ProxyHeaderConfig struct {
+	// Header is the header with the user name, e.g. 'X-Forwarded-User'. Empty disables it.
+	Header string `yaml:"header"`
+	// TrustedProxies are the addresses or networks of the proxies allowed to set the header.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+type ClientCertConfig struct {
+	// Subject is the distinguished name (e.g. 'CN=alice,O=dev') or the common name of the certificate.
+	Subject  string `yaml:"subject"`
+	Username string `yaml:"username"`
+}
+
+type UserConfig struct {
+	Username string `yaml:"username"`
+	// Password is a plaintext password. PasswordHash should be preferred.
+	Password string `yaml:"password"`
+	// PasswordHash is a bcrypt or argon2id hash, e.g. created by 'ipfilter passwd'.
+	PasswordHash string `yaml:"password_hash"`
+	// Role is one of: self-service, operator, admin. When empty then roles.default is used.
+	Role string `yaml:"role"`
+}
+
+// RolesConfig assigns roles to the users from all auth methods (htpasswd, tokens, proxy header, ...).
+type RolesConfig struct {
+	// Default is the role of the users without an assigned role.
+	Default string `yaml:"default"`
+	// Users maps usernames to roles.
+	Users map[string]string `yaml:"users"`
+}
+
+type AuditConfig struct {
+	// File is appended with the audit events, one JSON object per line. Empty disables it.
+	File string `yaml:"file"`
+}
+
+type ApprovalConfig struct {
+	// Timeout is the time after which the pending access requests are rejected.
+	Timeout time.Duration `yaml:"timeout"`
+	// BaseURL is the address of the web UI, e.g. https://ipfilter.example.com. When it is set,
+	// the notifications of the access requests carry signed links approving or rejecting them.
+	BaseURL string `yaml:"base_url"`
+}
+
+type NotificationsConfig struct {
+	// Retries is the number of the retries of a failed delivery.
+	Retries int `yaml:"retries"`
+	// Backoff is the delay before the first retry, doubled for every next one up to a minute.
+	Backoff  time.Duration   `yaml:"backoff"`
+	Channels []ChannelConfig `yaml:"channels"`
+}
+
+type ChannelConfig struct {
+	// Name identifies the channel in the logs.
+	Name string `yaml:"name"`
+	// Type is one of: webhook (JSON), slack (Slack or Mattermost incoming webhook), ntfy.
+	Type string `yaml:"type"`
+	URL  string `yaml:"url"`
+	// Secret signs the webhook body with HMAC-SHA256.
+	Secret string `yaml:"secret"`
+	// Token is sent to ntfy as a bearer token.
+	Token string `yaml:"token"`
+	// Events are the notified events: add, renew, delete, expire, request, approve, reject.
+	// By default, all but renew.
+	Events []string `yaml:"events"`
+	// Owners limits the notifications to the entries of these users.
+	Owners []string `yaml:"owners"`
+}
+
+// NotifiedEvents returns the notified events of the channel.
+func (c ChannelConfig) NotifiedEvents() []string {
+	if len(c.Events) == 0 {
+		return []string{"add", "delete", "expire", "request", "approve", "reject"}
+	}
+	return c.Events
+}
+
+// Default returns the configuration used for the keys missing in the file.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Listen:         "127.0.0.1:8080",
+			ClientIPHeader: realip.HeaderXForwardedFor,
+			TLS: TLSConfig{
+				Hosts: []string{"localhost", "127.0.0.1"},
+			},
+			Timeouts: TimeoutsConfig{
+				ReadHeader: 5 * time.Second,
+				Read:       30 * time.Second,
+				Write:      time.Minute,
+				Idle:       2 * time.Minute,
+			},
+		},
+		Firewall: FirewallConfig{
+			Mode:    "firewall",
+			Wrapper: "sudo",
+			Port:    8080,
+			TTL:     15 * time.Second,
+		},
+		Roles: RolesConfig{
+			Default: "self-service",
+		},
+		Approval: ApprovalConfig{
+			Timeout: 24 * time.Hour,
+		},
+		Notifications: NotificationsConfig{
+			Retries: 5,
+			Backoff: time.Second,
+		},
+		Auth: AuthConfig{
+			Session: SessionConfig{
+				TTL:         12 * time.Hour,
+				RememberTTL: 30 * 24 * time.Hour,
+			},
+			Lockout: LockoutConfig{
+				MaxFailures:    5,
+				BanDuration:    time.Minute,
+				MaxBanDuration: time.Hour,
+			},
+			TOTP: TOTPConfig{
+				Issuer: "ipfilter",
+			},
+			OIDC: OIDCConfig{
+				Scopes:        []string{"openid", "profile", "email"},
+				UsernameClaim: "sub",
+				GroupsClaim:   "groups",
+			},
+		},
+	}
+}
+
+// FieldError is a configuration error of a single key.
+type FieldError struct {
+	// Key is the dotted path of the key, e.g. 'firewall.ttl'.
+	Key string
+	// Line is the line of the key in the file or 0 when it is unknown.
+	Line int
+	Err  error
+}
+
+func (e *FieldError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %v: %v", e.Line, e.Key, e.Err)
+	}
+	return fmt.Sprintf("%v: %v", e.Key, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Load reads the configuration file, applies the environment variable
+// overrides, then the given overrides (e.g. command line flags) and validates
+// the result. When path is empty only the defaults and the overrides are used.
+func Load(path string, overrides ...func(*Config) error) (*Config, error) {
+	cnf := Default()
+
+	var root yaml.Node
+	if len(path) > 0 {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("os.ReadFile(): %w", err)
+		}
+
+		if err := decode(data, cnf, &root); err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+	}
+
+	if err := ApplyEnv(cnf, os.LookupEnv); err != nil {
+		return nil, err
+	}
+	for _, override := range overrides {
+		if err := override(cnf); err != nil {
+			return nil, err
+		}
+	}
+
+	if errs := cnf.Validate(); len(errs) > 0 {
+		for _, fieldErr := range errs {
+			fieldErr.Line = findLine(&root, fieldErr.Key)
+		}
+		return nil, fmt.Errorf("%v: %w", displayPath(path), errors.Join(toErrors(errs)...))
+	}
+
+	return cnf, nil
+}
+
+func decode(data []byte, cnf *Config, root *yaml.Node) error {
+	if err := yaml.Unmarshal(data, root); err != nil {
+		return err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cnf); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return nil
+}
+
+// Validate returns the errors of all invalid keys.
+func (c *Config) Validate() []*FieldError {
+	var errs []*FieldError
+	add := func(key string, err error) {
+		errs = append(errs, &FieldError{Key: key, Err: err})
+	}
+
+	if _, _, err := net.SplitHostPort(c.Server.Listen); err != nil {
+		add("server.listen", err)
+	}
+	for i, proxy := range c.Server.TrustedProxies {
+		if _, err := parsePrefix(proxy); err != nil {
+			add(fmt.Sprintf("server.trusted_proxies.%d", i), err)
+		}
+	}
+	if tlsCnf := c.Server.TLS; len(tlsCnf.CertFile) > 0 || len(tlsCnf.KeyFile) > 0 {
+		if len(tlsCnf.CertFile) == 0 {
+			add("server.tls.cert_file", errors.New("required when key_file is set"))
+		}
+		if len(tlsCnf.KeyFile) == 0 {
+			add("server.tls.key_file", errors.New("required when cert_file is set"))
+		}
+	} else {
+		if tlsCnf.SelfSigned {
+			add("server.tls.self_signed", errors.New("requires cert_file and key_file to write the certificate to"))
+		}
+		if len(tlsCnf.ClientCAFile) > 0 {
+			add("server.tls.client_ca_file", errors.New("requires cert_file and key_file"))
+		}
+	}
+	if c.Server.TLS.RequireClientCert && len(c.Server.TLS.ClientCAFile) == 0 {
+		add("server.tls.require_client_cert", errors.New("requires client_ca_file"))
+	}
+	for _, timeout := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"server.timeouts.read_header", c.Server.Timeouts.ReadHeader},
+		{"server.timeouts.read", c.Server.Timeouts.Read},
+		{"server.timeouts.write", c.Server.Timeouts.Write},
+		{"server.timeouts.idle", c.Server.Timeouts.Idle},
+	} {
+		if timeout.value < 0 {
+			add(timeout.key, errors.New("must not be negative"))
+		}
+	}
+	if !containsFold(realip.Headers, c.Server.ClientIPHeader) {
+		add("server.client_ip_header", fmt.Errorf("unknown header %q: expected one of: %v",
+			c.Server.ClientIPHeader, strings.Join(realip.Headers, ", ")))
+	}
+
+	switch c.Firewall.Mode {
+	case "firewall":
+	case "http":
+		if c.HTTPBackend == nil {
+			add("http_backend", errors.New("required in http mode"))
+		} else if _, err := httpbackend.NewFromConfig(*c.HTTPBackend); err != nil {
+			add("http_backend", err)
+		}
+	case "proxy":
+		if len(c.Proxy.Rules) == 0 {
+			add("proxy.rules", errors.New("at least one rule is required in proxy mode"))
+		}
+	default:
+		add("firewall.mode", fmt.Errorf("unknown mode %q: expected firewall, http or proxy", c.Firewall.Mode))
+	}
+
+	if c.Firewall.Port < 1 || c.Firewall.Port > 65535 {
+		add("firewall.port", fmt.Errorf("invalid port %d", c.Firewall.Port))
+	}
+	if c.Firewall.TTL <= 0 {
+		add("firewall.ttl", errors.New("must be positive"))
+	}
+
+	for i, rule := range c.Proxy.Rules {
+		if _, _, err := net.SplitHostPort(rule.Listen); err != nil {
+			add(fmt.Sprintf("proxy.rules.%d.listen", i), err)
+		}
+		if _, _, err := net.SplitHostPort(rule.Backend); err != nil {
+			add(fmt.Sprintf("proxy.rules.%d.backend", i), err)
+		}
+	}
+
+	for i, network := range c.Policy.AllowedNetworks {
+		if _, err := netip.ParsePrefix(network); err != nil {
+			add(fmt.Sprintf("policy.allowed_networks.%d", i), err)
+		}
+	}
+	if c.Policy.MaxTTL < 0 {
+		add("policy.max_ttl", errors.New("must not be negative"))
+	}
+
+	if len(c.Users) == 0 && len(c.Auth.HtpasswdFile) == 0 && len(c.Auth.Tokens) == 0 &&
+		len(c.Auth.ProxyHeader.Header) == 0 && len(c.Auth.ClientCerts) == 0 && len(c.Auth.OIDC.Issuer) == 0 {
+		add("users", errors.New("at least one user or another auth method is required"))
+	}
+	usernames := make(map[string]bool, len(c.Users))
+	for i, user := range c.Users {
+		switch {
+		case len(user.Username) == 0:
+			add(fmt.Sprintf("users.%d.username", i), errors.New("required"))
+		case strings.Contains(user.Username, ":"):
+			add(fmt.Sprintf("users.%d.username", i), errors.New("must not contain ':'"))
+		case usernames[user.Username]:
+			add(fmt.Sprintf("users.%d.username", i), fmt.Errorf("duplicated user %q", user.Username))
+		}
+		usernames[user.Username] = true
+
+		if len(user.Role) > 0 {
+			if _, err := auth.ParseRole(user.Role); err != nil {
+				add(fmt.Sprintf("users.%d.role", i), err)
+			}
+		}
+
+		switch {
+		case len(user.Password) > 0 && len(user.PasswordHash) > 0:
+			add(fmt.Sprintf("users.%d.password_hash", i), errors.New("password and password_hash are mutually exclusive"))
+		case len(user.PasswordHash) > 0:
+			if _, err := htpasswd.VerifyHash(user.PasswordHash, ""); err != nil {
+				add(fmt.Sprintf("users.%d.password_hash", i), fmt.Errorf("expected bcrypt or argon2id hash: %w", err))
+			}
+		}
+	}
+
+	for i, token := range c.Auth.Tokens {
+		if len(token.Username) == 0 {
+			add(fmt.Sprintf("auth.tokens.%d.username", i), errors.New("required"))
+		}
+		if digest, err := hex.DecodeString(token.TokenSHA256); err != nil || len(digest) != sha256.Size {
+			add(fmt.Sprintf("auth.tokens.%d.token_sha256", i), errors.New("expected hex encoded SHA-256 digest"))
+		}
+	}
+
+	if len(c.Auth.ProxyHeader.Header) > 0 && len(c.Auth.ProxyHeader.TrustedProxies) == 0 {
+		add("auth.proxy_header.trusted_proxies", errors.New("required when header is set"))
+	}
+	for i, proxy := range c.Auth.ProxyHeader.TrustedProxies {
+		if _, err := parsePrefix(proxy); err != nil {
+			add(fmt.Sprintf("auth.proxy_header.trusted_proxies.%d", i), err)
+		}
+	}
+
+	for i, cert := range c.Auth.ClientCerts {
+		if len(cert.Subject) == 0 {
+			add(fmt.Sprintf("auth.client_certs.%d.subject", i), errors.New("required"))
+		}
+		if len(cert.Username) == 0 {
+			add(fmt.Sprintf("auth.client_certs.%d.username", i), errors.New("required"))
+		}
+	}
+
+	if _, err := auth.ParseRole(c.Roles.Default); err != nil {
+		add("roles.default", err)
+	}
+	roleUsers := make([]string, 0, len(c.Roles.Users))
+	for username := range c.Roles.Users {
+		roleUsers = append(roleUsers, username)
+	}
+	sort.Strings(roleUsers)
+	for _, username := range roleUsers {
+		if _, err := auth.ParseRole(c.Roles.Users[username]); err != nil {
+			add("roles.users."+username, err)
+		}
+	}
+
+	if c.Auth.Lockout.MaxFailures < 0 {
+		add("auth.lockout.max_failures", errors.New("must not be negative"))
+	}
+	if c.Auth.Lockout.BanDuration <= 0 {
+		add("auth.lockout.ban_duration", errors.New("must be positive"))
+	}
+	if c.Auth.Lockout.MaxBanDuration < c.Auth.Lockout.BanDuration {
+		add("auth.lockout.max_ban_duration", errors.New("must not be less than ban_duration"))
+	}
+
+	if len(c.Auth.TOTP.File) > 0 && len(c.Auth.TOTP.Issuer) == 0 {
+		add("auth.totp.issuer", errors.New("required"))
+	}
+
+	if oidc := c.Auth.OIDC; len(oidc.Issuer) > 0 {
+		if u, err := url.Parse(oidc.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+			add("auth.oidc.issuer", errors.New("expected http(s) URL"))
+		}
+		if len(oidc.ClientID) == 0 {
+			add("auth.oidc.client_id", errors.New("required"))
+		}
+		if u, err := url.Parse(oidc.RedirectURL); err != nil || !u.IsAbs() {
+			add("auth.oidc.redirect_url", errors.New("expected absolute URL"))
+		}
+		if len(oidc.UsernameClaim) == 0 {
+			add("auth.oidc.username_claim", errors.New("required"))
+		}
+		groups := make([]string, 0, len(oidc.GroupRoles))
+		for group := range oidc.GroupRoles {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+		for _, group := range groups {
+			if _, err := auth.ParseRole(oidc.GroupRoles[group]); err != nil {
+				add("auth.oidc.group_roles."+group, err)
+			}
+		}
+	}
+
+	if c.Auth.Session.TTL <= 0 {
+		add("auth.session.ttl", errors.New("must be positive"))
+	}
+	if c.Auth.Session.RememberTTL <= 0 {
+		add("auth.session.remember_ttl", errors.New("must be positive"))
+	}
+
+	if c.Approval.Timeout <= 0 {
+		add("approval.timeout", errors.New("must be positive"))
+	}
+	if len(c.Approval.BaseURL) > 0 {
+		if u, err := url.Parse(c.Approval.BaseURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+			add("approval.base_url", errors.New("expected http(s) URL"))
+		}
+	}
+
+	if c.Notifications.Retries < 0 {
+		add("notifications.retries", errors.New("must not be negative"))
+	}
+	if c.Notifications.Backoff <= 0 {
+		add("notifications.backoff", errors.New("must be positive"))
+	}
+	channelNames := make(map[string]bool, len(c.Notifications.Channels))
+	for i, channel := range c.Notifications.Channels {
+		key := fmt.Sprintf("notifications.channels.%d", i)
+		switch {
+		case len(channel.Name) == 0:
+			add(key+".name", errors.New("required"))
+		case channelNames[channel.Name]:
+			add(key+".name", fmt.Errorf("duplicated channel %q", channel.Name))
+		}
+		channelNames[channel.Name] = true
+
+		switch channel.Type {
+		case "webhook", "slack", "ntfy":
+		default:
+			add(key+".type", fmt.Errorf("unknown type %q: expected webhook, slack or ntfy", channel.Type))
+		}
+		if u, err := url.Parse(channel.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+			add(key+".url", errors.New("expected http(s) URL"))
+		}
+		for j, event := range channel.Events {
+			switch firewall.EventType(event) {
+			case firewall.EventAdd, firewall.EventRenew, firewall.EventDelete, firewall.EventExpire,
+				firewall.EventRequest, firewall.EventApprove, firewall.EventReject:
+			default:
+				add(fmt.Sprintf("%v.events.%d", key, j),
+					fmt.Errorf("unknown event %q: expected add, renew, delete, expire, request, approve or reject", event))
+			}
+		}
+	}
+
+	return errs
+}
+
+// UserRoles returns the roles assigned to the users by roles.users and users[].role.
+// The configuration must be valid.
+func (c *Config) UserRoles() map[string]auth.Role {
+	roles := make(map[string]auth.Role, len(c.Roles.Users)+len(c.Users))
+	for username, role := range c.Roles.Users {
+		roles[username] = auth.Role(role)
+	}
+	for _, user := range c.Users {
+		if len(user.Role) > 0 {
+			roles[user.Username] = auth.Role(user.Role)
+		}
+	}
+	return roles
+}
+
+// OIDCGroupRoles returns the parsed auth.oidc.group_roles. The configuration must be valid.
+func (c *Config) OIDCGroupRoles() map[string]auth.Role {
+	roles := make(map[string]auth.Role, len(c.Auth.OIDC.GroupRoles))
+	for group, role := range c.Auth.OIDC.GroupRoles {
+		roles[group] = auth.Role(role)
+	}
+	return roles
+}
+
+// ServerTrustedProxies returns the parsed server.trusted_proxies. The configuration must be valid.
+func (c *Config) ServerTrustedProxies() []netip.Prefix {
+	return parsePrefixes(c.Server.TrustedProxies)
+}
+
+// TrustedProxies returns the parsed auth.proxy_header.trusted_proxies. The configuration must be valid.
+func (c *Config) TrustedProxies() []netip.Prefix {
+	return parsePrefixes(c.Auth.ProxyHeader.TrustedProxies)
+}
+
+// parsePrefixes parses the valid networks or addresses.
+func parsePrefixes(values []string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		prefix, _ := parsePrefix(value)
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+func containsFold(values []string, s string) bool {
+	for _, value := range values {
+		if strings.EqualFold(value, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefix parses a network or a single address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// AllowedNetworks returns the parsed policy networks. The configuration must be valid.
+func (c *Config) AllowedNetworks() []netip.Prefix {
+	networks := make([]netip.Prefix, 0, len(c.Policy.AllowedNetworks))
+	for _, network := range c.Policy.AllowedNetworks {
+		networks = append(networks, netip.MustParsePrefix(network))
+	}
+	return networks
+}
+
+// findLine returns the line of the node at the dotted key path, e.g. 'users.0.username'.
+// When the key is missing then the line of its closest existing parent is returned.
+func findLine(root *yaml.Node, key string) int {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	if node.Kind == 0 {
+		return 0
+	}
+
+	line := node.Line
+	for _, part := range strings.Split(key, ".") {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == part {
+					line = node.Content[i].Line
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			var index int
+			if _, err := fmt.Sscanf(part, "%d", &index); err == nil && index >= 0 && index < len(node.Content) {
+				next = node.Content[index]
+				line = next.Line
+			}
+		}
+		if next == nil {
+			return line
+		}
+		node = next
+	}
+
+	return line
+}
+
+func displayPath(path string) string {
+	if len(path) == 0 {
+		return "config"
+	}
+	return path
+}
+
+func toErrors(errs []*FieldError) []error {
+	result := make([]error, len(errs))
+	for i, err := range errs {
+		result[i] = err
+	}
+	return result
+}
@@ -0,0 +1,433 @@
+package config_test
+
+import (
+	"errors"
+	"github.com/dkarczmarski/gomisc/ipfilter/config"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "ipfilter.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		content        string
+		env            map[string]string
+		expectedErrs   []string
+		expectedConfig func(cnf *config.Config)
+	}{
+		{
+			name: "minimal",
+			content: `
+users:
+  - username: admin
+    password: secret
+`,
+			expectedConfig: func(cnf *config.Config) {
+				cnf.Users = []config.UserConfig{{Username: "admin", Password: "secret"}}
+			},
+		},
+		{
+			name: "full",
+			content: `
+server:
+  listen: 0.0.0.0:9090
+  socket: /run/ipfilter.sock
+  trusted_proxies: [10.0.0.1, fd00::/8]
+  client_ip_header: Forwarded
+  trust_socket: true
+  tls:
+    cert_file: /etc/ipfilter/cert.pem
+    key_file: /etc/ipfilter/key.pem
+    self_signed: true
+    hosts: [ipfilter.lan]
+    client_ca_file: /etc/ipfilter/ca.pem
+  timeouts:
+    read_header: 10s
+    write: 0s
+firewall:
+  mode: proxy
+  ttl: 1m
+proxy:
+  drop_on_revoke: true
+  rules:
+    - listen: ":15432"
+      backend: 127.0.0.1:5432
+policy:
+  allowed_networks: [10.0.0.0/8]
+  max_ttl: 24h
+users:
+  - username: admin
+    password: secret
+`,
+			expectedConfig: func(cnf *config.Config) {
+				cnf.Server = config.ServerConfig{
+					Listen:         "0.0.0.0:9090",
+					Socket:         "/run/ipfilter.sock",
+					TrustedProxies: []string{"10.0.0.1", "fd00::/8"},
+					ClientIPHeader: "Forwarded",
+					TrustSocket:    true,
+					TLS: config.TLSConfig{
+						CertFile:     "/etc/ipfilter/cert.pem",
+						KeyFile:      "/etc/ipfilter/key.pem",
+						SelfSigned:   true,
+						Hosts:        []string{"ipfilter.lan"},
+						ClientCAFile: "/etc/ipfilter/ca.pem",
+					},
+					Timeouts: config.TimeoutsConfig{
+						ReadHeader: 10 * time.Second,
+						Read:       30 * time.Second,
+						Idle:       2 * time.Minute,
+					},
+				}
+				cnf.Firewall.Mode = "proxy"
+				cnf.Firewall.TTL = time.Minute
+				cnf.Proxy = config.ProxyConfig{
+					DropOnRevoke: true,
+					Rules:        []config.ProxyRuleConfig{{Listen: ":15432", Backend: "127.0.0.1:5432"}},
+				}
+				cnf.Policy = config.PolicyConfig{AllowedNetworks: []string{"10.0.0.0/8"}, MaxTTL: 24 * time.Hour}
+				cnf.Users = []config.UserConfig{{Username: "admin", Password: "secret"}}
+			},
+		},
+		{
+			name: "environment overrides",
+			content: `
+firewall:
+  ttl: 1m
+users:
+  - username: admin
+    password: secret
+`,
+			env: map[string]string{
+				"IPFILTER_FIREWALL_TTL":         "2m",
+				"IPFILTER_FIREWALL_PORT":        "5432",
+				"IPFILTER_SERVER_LISTEN":        ":8443",
+				"IPFILTER_FIREWALL_APPLY_RULES": "true",
+			},
+			expectedConfig: func(cnf *config.Config) {
+				cnf.Server.Listen = ":8443"
+				cnf.Firewall.TTL = 2 * time.Minute
+				cnf.Firewall.Port = 5432
+				cnf.Firewall.ApplyRules = true
+				cnf.Users = []config.UserConfig{{Username: "admin", Password: "secret"}}
+			},
+		},
+		{
+			name: "unknown key",
+			content: `
+firewall:
+  tll: 1m
+`,
+			expectedErrs: []string{"line 3: field tll not found"},
+		},
+		{
+			name: "invalid values point to the keys",
+			content: `
+firewall:
+  mode: iptables
+  ttl: 0s
+policy:
+  allowed_networks:
+    - 10.0.0.0/8
+    - 10.0.0.0
+users:
+  - username: admin
+  - username: admin
+`,
+			expectedErrs: []string{
+				"line 3: firewall.mode: unknown mode",
+				"line 4: firewall.ttl: must be positive",
+				"line 8: policy.allowed_networks.1:",
+				`line 11: users.1.username: duplicated user "admin"`,
+			},
+		},
+		{
+			name: "invalid auth methods",
+			content: `
+auth:
+  tokens:
+    - username: ci
+      token_sha256: abc
+  proxy_header:
+    header: X-Forwarded-User
+  client_certs:
+    - subject: CN=alice
+`,
+			expectedErrs: []string{
+				"line 5: auth.tokens.0.token_sha256: expected hex encoded SHA-256 digest",
+				"line 6: auth.proxy_header.trusted_proxies: required when header is set",
+				"line 9: auth.client_certs.0.username: required",
+			},
+		},
+		{
+			name: "roles",
+			content: `
+users:
+  - username: admin
+    password: secret
+    role: admin
+roles:
+  users:
+    alice: operator
+`,
+			expectedConfig: func(cnf *config.Config) {
+				cnf.Users = []config.UserConfig{{Username: "admin", Password: "secret", Role: "admin"}}
+				cnf.Roles.Users = map[string]string{"alice": "operator"}
+			},
+		},
+		{
+			name: "invalid roles",
+			content: `
+users:
+  - username: admin
+    role: root
+roles:
+  default: guest
+  users:
+    alice: superuser
+`,
+			expectedErrs: []string{
+				`line 4: users.0.role: unknown role "root"`,
+				`line 6: roles.default: unknown role "guest"`,
+				`line 8: roles.users.alice: unknown role "superuser"`,
+			},
+		},
+		{
+			name: "invalid trusted proxies",
+			content: `
+server:
+  trusted_proxies: [10.0.0.0/33]
+  client_ip_header: X-Client-IP
+users: [{username: admin, password: secret}]
+`,
+			expectedErrs: []string{
+				"line 3: server.trusted_proxies.0:",
+				`line 4: server.client_ip_header: unknown header "X-Client-IP"`,
+			},
+		},
+		{
+			name: "invalid tls",
+			content: `
+server:
+  tls:
+    key_file: /etc/ipfilter/key.pem
+    require_client_cert: true
+users: [{username: admin, password: secret}]
+`,
+			expectedErrs: []string{
+				"line 3: server.tls.cert_file: required when key_file is set",
+				"line 5: server.tls.require_client_cert: requires client_ca_file",
+			},
+		},
+		{
+			name: "negative timeout",
+			content: `
+server:
+  timeouts:
+    write: -1s
+users: [{username: admin, password: secret}]
+`,
+			expectedErrs: []string{"line 4: server.timeouts.write: must not be negative"},
+		},
+		{
+			name: "invalid lockout",
+			content: `
+users: [{username: admin, password: secret}]
+auth:
+  lockout:
+    max_failures: -1
+    ban_duration: 10m
+    max_ban_duration: 1m
+`,
+			expectedErrs: []string{
+				"line 5: auth.lockout.max_failures: must not be negative",
+				"line 7: auth.lockout.max_ban_duration: must not be less than ban_duration",
+			},
+		},
+		{
+			name: "oidc",
+			content: `
+auth:
+  oidc:
+    issuer: https://idp.example.com
+    client_id: ipfilter
+    redirect_url: https://ipfilter.example.com/login/oidc/callback
+    group_roles:
+      admins: admin
+`,
+			expectedConfig: func(cnf *config.Config) {
+				cnf.Auth.OIDC.Issuer = "https://idp.example.com"
+				cnf.Auth.OIDC.ClientID = "ipfilter"
+				cnf.Auth.OIDC.RedirectURL = "https://ipfilter.example.com/login/oidc/callback"
+				cnf.Auth.OIDC.GroupRoles = map[string]string{"admins": "admin"}
+			},
+		},
+		{
+			name: "invalid oidc",
+			content: `
+auth:
+  oidc:
+    issuer: idp.example.com
+    redirect_url: /callback
+    group_roles:
+      admins: root
+`,
+			expectedErrs: []string{
+				"line 4: auth.oidc.issuer: expected http(s) URL",
+				"line 3: auth.oidc.client_id: required",
+				"line 5: auth.oidc.redirect_url: expected absolute URL",
+				`line 7: auth.oidc.group_roles.admins: unknown role "root"`,
+			},
+		},
+		{
+			name: "notifications",
+			content: `
+notifications:
+  retries: 3
+  backoff: 2s
+  channels:
+    - name: audit
+      type: webhook
+      url: https://hooks.example.com/ipfilter
+      secret: s3cret
+      events: [add, renew, delete, expire]
+      owners: [alice]
+    - name: phone
+      type: ntfy
+      url: https://ntfy.sh/ipfilter
+users: [{username: admin, password: secret}]
+`,
+			expectedConfig: func(cnf *config.Config) {
+				cnf.Users = []config.UserConfig{{Username: "admin", Password: "secret"}}
+				cnf.Notifications.Retries = 3
+				cnf.Notifications.Backoff = 2 * time.Second
+				cnf.Notifications.Channels = []config.ChannelConfig{
+					{
+						Name:   "audit",
+						Type:   "webhook",
+						URL:    "https://hooks.example.com/ipfilter",
+						Secret: "s3cret",
+						Events: []string{"add", "renew", "delete", "expire"},
+						Owners: []string{"alice"},
+					},
+					{Name: "phone", Type: "ntfy", URL: "https://ntfy.sh/ipfilter"},
+				}
+			},
+		},
+		{
+			name: "invalid notifications",
+			content: `
+notifications:
+  retries: -1
+  backoff: 0s
+  channels:
+    - name: chat
+      type: email
+      url: mailto:admin@example.com
+      events: [add, approval]
+    - name: chat
+      type: slack
+      url: https://hooks.slack.com/services/T/B/X
+    - type: webhook
+      url: https://hooks.example.com/ipfilter
+users: [{username: admin, password: secret}]
+`,
+			expectedErrs: []string{
+				"line 3: notifications.retries: must not be negative",
+				"line 4: notifications.backoff: must be positive",
+				`line 7: notifications.channels.0.type: unknown type "email"`,
+				"line 8: notifications.channels.0.url: expected http(s) URL",
+				`line 9: notifications.channels.0.events.1: unknown event "approval"`,
+				`line 10: notifications.channels.1.name: duplicated channel "chat"`,
+				"line 13: notifications.channels.2.name: required",
+			},
+		},
+		{
+			name: "approval",
+			content: `
+approval:
+  timeout: 4h
+  base_url: https://ipfilter.example.com
+users: [{username: admin, password: secret}]
+`,
+			expectedConfig: func(cnf *config.Config) {
+				cnf.Approval = config.ApprovalConfig{Timeout: 4 * time.Hour, BaseURL: "https://ipfilter.example.com"}
+				cnf.Users = []config.UserConfig{{Username: "admin", Password: "secret"}}
+			},
+		},
+		{
+			name: "invalid approval",
+			content: `
+approval:
+  timeout: 0s
+  base_url: ipfilter.example.com
+users: [{username: admin, password: secret, role: requester}]
+`,
+			expectedErrs: []string{
+				"line 3: approval.timeout: must be positive",
+				"line 4: approval.base_url: expected http(s) URL",
+			},
+		},
+		{
+			name:         "invalid environment value",
+			content:      "users: [{username: admin}]",
+			env:          map[string]string{"IPFILTER_FIREWALL_TTL": "soon"},
+			expectedErrs: []string{"firewall.ttl: IPFILTER_FIREWALL_TTL:"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			cnf, err := config.Load(writeFile(t, tt.content))
+
+			if len(tt.expectedErrs) > 0 {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				for _, expected := range tt.expectedErrs {
+					if !strings.Contains(err.Error(), expected) {
+						t.Errorf("error %q does not contain %q", err, expected)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := config.Default()
+			tt.expectedConfig(expected)
+			if !reflect.DeepEqual(cnf, expected) {
+				t.Errorf("config\nactual:   %+v\nexpected: %+v", cnf, expected)
+			}
+		})
+	}
+}
+
+func TestLoad_FieldError(t *testing.T) {
+	_, err := config.Load(writeFile(t, "users: [{username: admin}]\nfirewall: {port: 0}\n"))
+
+	var fieldErr *config.FieldError
+	if !errors.As(err, &fieldErr) {
+		t.Fatalf("expected field error, got: %v", err)
+	}
+	if fieldErr.Key != "firewall.port" || fieldErr.Line != 2 {
+		t.Errorf("unexpected field error: %+v", fieldErr)
+	}
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix is the prefix of environment variables overriding configuration keys.
+// A key name is converted by joining its path with '_' and upper-casing it,
+// e.g. firewall.ttl can be overridden by IPFILTER_FIREWALL_TTL.
+const EnvPrefix = "IPFILTER"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// ApplyEnv overrides scalar keys (strings, numbers, booleans and durations)
+// with the values of the matching environment variables.
+func ApplyEnv(cnf *Config, lookupEnv func(key string) (string, bool)) error {
+	return applyEnv(reflect.ValueOf(cnf).Elem(), "", lookupEnv)
+}
+
+func applyEnv(v reflect.Value, path string, lookupEnv func(key string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if len(name) == 0 || name == "-" {
+			continue
+		}
+
+		key := name
+		if len(path) > 0 {
+			key = path + "." + name
+		}
+
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			if err := applyEnv(fv, key, lookupEnv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		envName := EnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+		value, ok := lookupEnv(envName)
+		if !ok {
+			continue
+		}
+
+		if err := setScalar(fv, value); err != nil {
+			return &FieldError{Key: key, Err: fmt.Errorf("%v: %w", envName, err)}
+		}
+	}
+
+	return nil
+}
+
+func setScalar(v reflect.Value, value string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("cannot be set from the environment")
+	}
+
+	return nil
+}
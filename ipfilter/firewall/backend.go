@@ -0,0 +1,65 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// Backend applies registry changes to the component that actually filters the traffic.
+type Backend interface {
+	Allow(ctx context.Context, ip string) error
+	Revoke(ctx context.Context, ip string) error
+}
+
+// CommandBackend manages ufw rules by executing ufw commands,
+// optionally through a wrapper command like sudo.
+// Unless apply is set, the commands are only echoed (a dry run).
+type CommandBackend struct {
+	wrapperCmd string
+	port       int
+	apply      bool
+}
+
+func NewCommandBackend(wrapperCmd string, port int, apply bool) *CommandBackend {
+	return &CommandBackend{
+		wrapperCmd: wrapperCmd,
+		port:       port,
+		apply:      apply,
+	}
+}
+
+func (b *CommandBackend) Allow(ctx context.Context, ip string) error {
+	return b.execute(ctx, fmt.Sprintf("ufw allow from %s to any proto tcp port %d", ip, b.port))
+}
+
+func (b *CommandBackend) Revoke(ctx context.Context, ip string) error {
+	return b.execute(ctx, fmt.Sprintf("ufw delete allow from %s to any proto tcp port %d", ip, b.port))
+}
+
+func (b *CommandBackend) execute(ctx context.Context, cmdStr string) error {
+	args := strings.Split(cmdStr, " ")
+	if len(b.wrapperCmd) > 0 {
+		args = append([]string{b.wrapperCmd}, args...)
+	}
+	if !b.apply {
+		args = append([]string{"echo"}, args...)
+	}
+
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).
+		CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("execute commmand: %w", err)
+	}
+
+	log.Println(string(out))
+
+	return nil
+}
+
+// Lister is implemented by backends able to report the addresses they currently allow.
+type Lister interface {
+	List(ctx context.Context) ([]string, error)
+}
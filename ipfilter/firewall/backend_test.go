@@ -0,0 +1,28 @@
+package firewall_test
+
+import (
+	"context"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"testing"
+)
+
+func TestCommandBackend_ApplyRules(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		apply       bool
+		expectedErr bool
+	}{
+		// the wrapper is the false command, which fails when it is run
+		{name: "dry run", apply: false, expectedErr: false},
+		{name: "apply", apply: true, expectedErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := firewall.NewCommandBackend("false", 8080, tt.apply)
+
+			err := backend.Allow(context.Background(), "1.2.3.4")
+			if (err != nil) != tt.expectedErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
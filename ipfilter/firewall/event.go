@@ -0,0 +1,80 @@
+package firewall
+
+import (
+	"log"
+)
+
+// subscriberBuffer is the number of the events waiting for a subscriber.
+const subscriberBuffer = 64
+
+type EventType string
+
+const (
+	EventAdd    EventType = "add"
+	EventRenew  EventType = "renew"
+	EventDelete EventType = "delete"
+	// EventExpire is sent for the entries deleted by DeleteOutOfDateCtx.
+	EventExpire EventType = "expire"
+	// EventRequest, EventApprove and EventReject are sent for the access requests.
+	// Their Entry is the one the request would add.
+	EventRequest EventType = "request"
+	EventApprove EventType = "approve"
+	EventReject  EventType = "reject"
+)
+
+// Event is a change of the registry or of the access requests.
+type Event struct {
+	Type  EventType
+	Entry IPEntry
+	// Request is set for the events of the access requests only.
+	Request *AccessRequest
+}
+
+// Subscribe returns the channel of the registry changes and the function ending the subscription.
+// The channel is closed when the subscriber does not keep up with the events, so it must
+// read the registry again.
+func (srv *Service) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.subscribers == nil {
+		srv.subscribers = make(map[chan Event]struct{})
+	}
+	srv.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+
+		if _, ok := srv.subscribers[ch]; ok {
+			delete(srv.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// publish sends the event to the subscribers. It must be called with srv.mu locked.
+func (srv *Service) publish(eventType EventType, entry IPEntry) {
+	srv.send(Event{Type: eventType, Entry: entry})
+}
+
+// publishRequest sends the event of the access request to the subscribers. It must be called with srv.mu locked.
+func (srv *Service) publishRequest(eventType EventType, request AccessRequest) {
+	srv.send(Event{Type: eventType, Entry: request.entry(), Request: &request})
+}
+
+func (srv *Service) send(event Event) {
+	srv.metrics.event(event.Type)
+
+	for ch := range srv.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("firewall: subscriber too slow, events dropped")
+			delete(srv.subscribers, ch)
+			close(ch)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package firewall_test
+
+import (
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestService_Subscribe(t *testing.T) {
+	var fixedTime firewall.FixedTime
+	fixedTime.SetDateTime("2001-01-01 10:00:00")
+
+	service := firewall.NewService(
+		firewall.WithTimeFunc(fixedTime.TimeFunc()),
+		firewall.WithBackend(&listerBackend{}),
+		firewall.WithDefaultTTL(time.Minute),
+	)
+
+	events, cancel := service.Subscribe()
+
+	_ = service.AddIP("1.2.3.4", firewall.WithOwner("alice"))
+	fixedTime.SetDateTime("2001-01-01 10:00:30")
+	_ = service.AddIP("1.2.3.4")
+	_ = service.AddIP("2.2.8.8")
+	_ = service.DeleteIP("2.2.8.8")
+	fixedTime.SetDateTime("2001-01-01 10:02:00")
+	_, _ = service.DeleteOutOfDate(time.Minute)
+	// a failed change is not published
+	_ = service.DeleteIP("2.2.8.8")
+
+	cancel()
+	cancel()
+
+	var actual []firewall.Event
+	for event := range events {
+		actual = append(actual, event)
+	}
+
+	alice := firewall.IPEntry{
+		IP:        "1.2.3.4",
+		CreatedAt: firewall.MustParseDateTime("2001-01-01 10:00:00"),
+		UpdatedAt: firewall.MustParseDateTime("2001-01-01 10:00:00"),
+		Owner:     "alice",
+	}
+	renewed := alice
+	renewed.UpdatedAt = firewall.MustParseDateTime("2001-01-01 10:00:30")
+	other := firewall.IPEntry{
+		IP:        "2.2.8.8",
+		CreatedAt: firewall.MustParseDateTime("2001-01-01 10:00:30"),
+		UpdatedAt: firewall.MustParseDateTime("2001-01-01 10:00:30"),
+	}
+	expected := []firewall.Event{
+		{Type: firewall.EventAdd, Entry: alice},
+		{Type: firewall.EventRenew, Entry: renewed},
+		{Type: firewall.EventAdd, Entry: other},
+		{Type: firewall.EventDelete, Entry: other},
+		{Type: firewall.EventExpire, Entry: renewed},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("events\nactual:   %+v\nexpected: %+v", actual, expected)
+	}
+}
+
+func TestService_SubscribeSlow(t *testing.T) {
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(&listerBackend{}),
+	)
+
+	events, cancel := service.Subscribe()
+	defer cancel()
+
+	// the subscriber reads nothing, so it is dropped after its buffer is full
+	for i := 0; i < 100; i++ {
+		_ = service.AddIP("1.2.3.4")
+	}
+
+	count := 0
+	for range events {
+		count++
+	}
+	if count == 0 || count >= 100 {
+		t.Errorf("unexpected number of events: %v", count)
+	}
+}
@@ -5,27 +5,95 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
-	"net"
-	"os/exec"
-	"strings"
+	"github.com/dkarczmarski/gomisc/ipfilter/metrics"
+	"net/netip"
+	"sync"
 	"time"
 )
 
 var (
-	ErrIncorrectIP = errors.New("incorrect ip")
-	ErrIPNotFound  = errors.New("ip not found")
+	ErrIncorrectIP   = errors.New("incorrect ip")
+	ErrIPNotFound    = errors.New("ip not found")
+	ErrIPNotAllowed  = errors.New("ip not allowed by policy")
+	ErrTTLNotAllowed = errors.New("ttl not allowed by policy")
 )
 
+const (
+	defaultTTL             = 15 * time.Second
+	defaultPort            = 8080
+	defaultApprovalTimeout = 24 * time.Hour
+)
+
+// Policy limits what can be added to the registry.
+type Policy struct {
+	// AllowedNetworks are the networks the added addresses must belong to.
+	// When it is empty then any address is allowed.
+	AllowedNetworks []netip.Prefix
+	// MaxTTL is the maximum entry's own TTL. When it is 0 then there is no limit.
+	MaxTTL time.Duration
+}
+
+func (p Policy) check(ip string, ttl time.Duration) error {
+	if p.MaxTTL > 0 && ttl > p.MaxTTL {
+		return fmt.Errorf("%v > %v: %w", ttl, p.MaxTTL, ErrTTLNotAllowed)
+	}
+
+	if len(p.AllowedNetworks) == 0 {
+		return nil
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return fmt.Errorf("%v: %w", ip, ErrIncorrectIP)
+	}
+	addr = addr.Unmap()
+	for _, network := range p.AllowedNetworks {
+		if network.Contains(addr) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%v: %w", ip, ErrIPNotAllowed)
+}
+
 type IPEntry struct {
 	IP        string
 	CreatedAt time.Time
 	UpdatedAt time.Time
+	// TTL overrides the default time-to-live of the entry when it is not zero.
+	TTL time.Duration
+	// Owner is the user who added the entry. It is empty for entries added without WithOwner.
+	Owner string
+	// Label is a free-form note, e.g. 'home' or 'ci runner'.
+	Label string
+}
+
+// ExpiresAt returns the time after which the entry is out-of-date.
+func (e IPEntry) ExpiresAt(defaultTTL time.Duration) time.Time {
+	if e.TTL > 0 {
+		return e.UpdatedAt.Add(e.TTL)
+	}
+	return e.UpdatedAt.Add(defaultTTL)
 }
 
 type config struct {
 	wrapperCmd string
+	port       int
+	applyRules bool
 	timeFunc   func() time.Time
+	backend    Backend
+	defaultTTL time.Duration
+	policy     Policy
+	metrics    *metrics.Registry
+	// approvalTimeout is the time after which the pending access requests are rejected.
+	approvalTimeout time.Duration
+}
+
+// WithWrapper sets the command wrapping ufw commands, e.g. sudo.
+func WithWrapper(wrapperCmd string) func(*config) {
+	return func(c *config) {
+		c.wrapperCmd = wrapperCmd
+	}
 }
 
 func WithSudoWrapper() func(*config) {
@@ -40,44 +108,204 @@ func WithEchoWrapper() func(*config) {
 	}
 }
 
+// WithApplyRules sets whether the ufw command backend changes the firewall rules.
+// By default the commands are only echoed, as a dry run.
+func WithApplyRules(apply bool) func(*config) {
+	return func(c *config) {
+		c.applyRules = apply
+	}
+}
+
 func WithTimeFunc(f func() time.Time) func(*config) {
 	return func(c *config) {
 		c.timeFunc = f
 	}
 }
 
+// WithPort sets the port opened by ufw rules.
+func WithPort(port int) func(*config) {
+	return func(c *config) {
+		c.port = port
+	}
+}
+
+func WithPolicy(policy Policy) func(*config) {
+	return func(c *config) {
+		c.policy = policy
+	}
+}
+
+// WithBackend sets the backend that applies registry changes.
+// When it is not set then the ufw command backend is used.
+func WithBackend(backend Backend) func(*config) {
+	return func(c *config) {
+		c.backend = backend
+	}
+}
+
+// WithDefaultTTL sets the time-to-live of entries added without their own TTL.
+func WithDefaultTTL(ttl time.Duration) func(*config) {
+	return func(c *config) {
+		c.defaultTTL = ttl
+	}
+}
+
+type entryConfig struct {
+	ttl   time.Duration
+	owner string
+	label string
+}
+
+// EntryOption configures an entry added by AddIPCtx.
+type EntryOption func(*entryConfig)
+
+// WithTTL sets the time-to-live of the added entry.
+func WithTTL(ttl time.Duration) EntryOption {
+	return func(c *entryConfig) {
+		c.ttl = ttl
+	}
+}
+
+// WithLabel sets the label of the added entry. The label of an existing entry is replaced when it is not empty.
+func WithLabel(label string) EntryOption {
+	return func(c *entryConfig) {
+		c.label = label
+	}
+}
+
+// WithOwner sets the owner of the added entry. The owner of an existing entry is not changed.
+func WithOwner(owner string) EntryOption {
+	return func(c *entryConfig) {
+		c.owner = owner
+	}
+}
+
 type Service struct {
-	wrapperCmd string
-	entries    []*IPEntry
-	timeFunc   func() time.Time
+	mu sync.Mutex
+	// backendMu serializes the backend calls in the order of the registry changes. They are made
+	// without mu held, so a slow backend does not block the readers of the registry.
+	backendMu   sync.Mutex
+	backend     Backend
+	entries     []*IPEntry
+	timeFunc    func() time.Time
+	defaultTTL  time.Duration
+	policy      Policy
+	subscribers map[chan Event]struct{}
+	health      Health
+	metrics     *serviceMetrics
+	// requests are the access requests waiting for an approval.
+	requests        []*AccessRequest
+	approvalTimeout time.Duration
 }
 
 func NewService(opts ...func(*config)) *Service {
-	var cnf config
+	cnf := config{
+		port:            defaultPort,
+		defaultTTL:      defaultTTL,
+		approvalTimeout: defaultApprovalTimeout,
+	}
 	for _, ops := range opts {
 		ops(&cnf)
 	}
 
-	return &Service{
-		wrapperCmd: cnf.wrapperCmd,
-		timeFunc:   cnf.timeFunc,
+	backend := cnf.backend
+	if backend == nil {
+		backend = NewCommandBackend(cnf.wrapperCmd, cnf.port, cnf.applyRules)
+	}
+
+	srv := &Service{
+		backend:         backend,
+		timeFunc:        cnf.timeFunc,
+		defaultTTL:      cnf.defaultTTL,
+		policy:          cnf.policy,
+		approvalTimeout: cnf.approvalTimeout,
 	}
+	if cnf.metrics != nil {
+		srv.metrics = newServiceMetrics(srv, cnf.metrics)
+	}
+	return srv
+}
+
+// SetDefaultTTL changes the time-to-live of entries without their own TTL.
+// It applies to the existing entries too.
+func (srv *Service) SetDefaultTTL(ttl time.Duration) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.defaultTTL = ttl
+}
+
+// SetPolicy changes the policy checked by AddIPCtx. The existing entries are kept.
+func (srv *Service) SetPolicy(policy Policy) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.policy = policy
+}
+
+// DefaultTTL returns the time-to-live of entries without their own TTL.
+func (srv *Service) DefaultTTL() time.Duration {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.defaultTTL
 }
 
 // AddIP runs firewall command to add that ip.
-// When ip has been already added by this method then the next call only update UpdatedAt field.
-func (srv *Service) AddIP(ip string) error {
-	return srv.AddIPCtx(context.Background(), ip)
+// When ip has been already added by this method then the next call only update UpdatedAt field
+// (and TTL field when WithTTL option is used).
+func (srv *Service) AddIP(ip string, opts ...EntryOption) error {
+	return srv.AddIPCtx(context.Background(), ip, opts...)
 }
 
-func (srv *Service) AddIPCtx(ctx context.Context, ip string) error {
-	if net.ParseIP(ip) == nil {
-		return fmt.Errorf("%v: %w", ip, ErrIncorrectIP)
+func (srv *Service) AddIPCtx(ctx context.Context, ip string, opts ...EntryOption) error {
+	ip, err := canonicalIP(ip)
+	if err != nil {
+		return err
+	}
+
+	var cnf entryConfig
+	for _, ops := range opts {
+		ops(&cnf)
+	}
+
+	srv.backendMu.Lock()
+	defer srv.backendMu.Unlock()
+
+	added, err := func() (bool, error) {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+
+		_, added, err := srv.addEntry(ip, cnf)
+		return added, err
+	}()
+	if err != nil || !added {
+		return err
+	}
+
+	return srv.allow(ctx, ip)
+}
+
+// addEntry adds ip to the registry, or renews its entry. It reports whether the entry is new,
+// so the backend must allow it. It must be called with srv.mu locked.
+func (srv *Service) addEntry(ip string, cnf entryConfig) (IPEntry, bool, error) {
+	if err := srv.policy.check(ip, cnf.ttl); err != nil {
+		return IPEntry{}, false, err
 	}
 
 	if _, entry := srv.findByIP(ip); entry != nil {
 		entry.UpdatedAt = srv.timeFunc()
-		return nil
+		if cnf.ttl > 0 {
+			entry.TTL = cnf.ttl
+		}
+		if len(entry.Owner) == 0 {
+			entry.Owner = cnf.owner
+		}
+		if len(cnf.label) > 0 {
+			entry.Label = cnf.label
+		}
+		srv.publish(EventRenew, *entry)
+		return *entry, false, nil
 	}
 
 	// add to registry
@@ -86,18 +314,86 @@ func (srv *Service) AddIPCtx(ctx context.Context, ip string) error {
 		IP:        ip,
 		CreatedAt: now,
 		UpdatedAt: now,
+		TTL:       cnf.ttl,
+		Owner:     cnf.owner,
+		Label:     cnf.label,
 	}
 	srv.entries = append(srv.entries, entry)
+	srv.publish(EventAdd, *entry)
+
+	return *entry, true, nil
+}
+
+// allow calls the backend for an added entry. It must be called with srv.backendMu locked and srv.mu unlocked.
+func (srv *Service) allow(ctx context.Context, ip string) error {
+	if err := srv.callBackend("allow", func() error {
+		return srv.backend.Allow(ctx, ip)
+	}); err != nil {
+		return fmt.Errorf("backend allow: %w", err)
+	}
+	return nil
+}
+
+// revoke calls the backend for a deleted entry. It must be called with srv.backendMu locked and srv.mu unlocked.
+func (srv *Service) revoke(ctx context.Context, ip string) error {
+	if err := srv.callBackend("revoke", func() error {
+		return srv.backend.Revoke(ctx, ip)
+	}); err != nil {
+		return fmt.Errorf("backend revoke: %w", err)
+	}
+	return nil
+}
 
-	// execute 'add to firewall' command
-	cmdStr := fmt.Sprintf("ufw allow from %s to any proto tcp port 8080", ip)
-	out, err := exec.CommandContext(ctx, "echo", strings.Split(cmdStr, " ")...).
-		CombinedOutput()
+// RenewIPCtx updates UpdatedAt field of an already added ip.
+// Unlike AddIPCtx it does not add unknown ip.
+func (srv *Service) RenewIPCtx(_ context.Context, ip string) error {
+	ip, err := canonicalIP(ip)
 	if err != nil {
-		return fmt.Errorf("execute commmand: %w", err)
+		return err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	_, entry := srv.findByIP(ip)
+	if entry == nil {
+		return fmt.Errorf("ip %v: %w", ip, ErrIPNotFound)
+	}
+	entry.UpdatedAt = srv.timeFunc()
+	srv.publish(EventRenew, *entry)
+
+	return nil
+}
+
+// ExtendIPCtx moves the expiry of an already added ip later by duration. The expiry of an entry
+// which is past due is counted from now. The extended time left is checked against the policy.
+func (srv *Service) ExtendIPCtx(_ context.Context, ip string, duration time.Duration) error {
+	ip, err := canonicalIP(ip)
+	if err != nil {
+		return err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	_, entry := srv.findByIP(ip)
+	if entry == nil {
+		return fmt.Errorf("ip %v: %w", ip, ErrIPNotFound)
 	}
 
-	log.Println(string(out))
+	now := srv.timeFunc()
+	expiresAt := entry.ExpiresAt(srv.defaultTTL)
+	if expiresAt.Before(now) {
+		expiresAt = now
+	}
+	ttl := expiresAt.Add(duration).Sub(now)
+	if err := srv.policy.check(ip, ttl); err != nil {
+		return err
+	}
+
+	entry.UpdatedAt = now
+	entry.TTL = ttl
+	srv.publish(EventRenew, *entry)
 
 	return nil
 }
@@ -107,26 +403,39 @@ func (srv *Service) DeleteIP(ip string) error {
 }
 
 func (srv *Service) DeleteIPCtx(ctx context.Context, ip string) error {
-	if net.ParseIP(ip) == nil {
-		return fmt.Errorf("%v: %w", ip, ErrIncorrectIP)
+	ip, err := canonicalIP(ip)
+	if err != nil {
+		return err
 	}
 
-	// remove from registry
+	srv.backendMu.Lock()
+	defer srv.backendMu.Unlock()
+
+	if _, err := srv.Find(ip); err != nil {
+		return err
+	}
+
+	// the entry is kept when the backend fails, so the rule is not left open without an entry
+	if err := srv.revoke(ctx, ip); err != nil {
+		return err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	// the entries are deleted only with srv.backendMu locked, so it cannot fail
+	_ = srv.deleteEntry(ip, EventDelete)
+	return nil
+}
+
+// deleteEntry removes ip from the registry. It must be called with srv.mu locked.
+func (srv *Service) deleteEntry(ip string, eventType EventType) error {
 	index, entry := srv.findByIP(ip)
 	if entry == nil {
 		return fmt.Errorf("ip %v: %w", ip, ErrIPNotFound)
 	}
 	srv.deleteByIndex(index)
-
-	// execute 'delete from firewall' command
-	cmdStr := fmt.Sprintf("ufw delete allow from %s to any proto tcp port 8080", ip)
-	out, err := exec.CommandContext(ctx, "echo", strings.Split(cmdStr, " ")...).
-		CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("execute commmand: %w", err)
-	}
-
-	log.Println(string(out))
+	srv.publish(eventType, *entry)
 
 	return nil
 }
@@ -135,6 +444,7 @@ func (srv *Service) deleteByIndex(index int) {
 	srv.entries = append(srv.entries[:index], srv.entries[index+1:]...)
 }
 
+// findByIP returns the entry of ip, which must be in the canonical form, as the entries are.
 func (srv *Service) findByIP(ip string) (int, *IPEntry) {
 	for i, ee := range srv.entries {
 		if ee.IP == ip {
@@ -144,7 +454,53 @@ func (srv *Service) findByIP(ip string) (int, *IPEntry) {
 	return -1, nil
 }
 
+// Find returns the registry entry for ip.
+func (srv *Service) Find(ip string) (IPEntry, error) {
+	ip, err := canonicalIP(ip)
+	if err != nil {
+		return IPEntry{}, err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	_, entry := srv.findByIP(ip)
+	if entry == nil {
+		return IPEntry{}, fmt.Errorf("ip %v: %w", ip, ErrIPNotFound)
+	}
+	return *entry, nil
+}
+
+// Contains reports whether ip is currently in the registry.
+// Addresses are compared in their canonical form, so an IPv4-mapped IPv6
+// address matches its IPv4 entry.
+func (srv *Service) Contains(ip string) bool {
+	ip, err := canonicalIP(ip)
+	if err != nil {
+		return false
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	_, entry := srv.findByIP(ip)
+	return entry != nil
+}
+
+// canonicalIP returns ip in the form the entries are stored in: an IPv4-mapped IPv6 address
+// as IPv4 and IPv6 in its RFC 5952 form, so every address has a single entry.
+func canonicalIP(ip string) (string, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || len(addr.Zone()) > 0 {
+		return "", fmt.Errorf("%v: %w", ip, ErrIncorrectIP)
+	}
+	return addr.Unmap().String(), nil
+}
+
 func (srv *Service) List() []IPEntry {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
 	entries := make([]IPEntry, len(srv.entries))
 	for i, ee := range srv.entries {
 		entries[i] = *ee
@@ -152,34 +508,122 @@ func (srv *Service) List() []IPEntry {
 	return entries
 }
 
-func (srv *Service) DeleteOutOfDate(duration time.Duration) ([]IPEntry, error) {
-	return srv.DeleteOutOfDateCtx(context.Background(), duration)
+// ReconcileCtx allows again the registry entries which are missing in the backend,
+// e.g. after the external firewall has been restarted.
+// It does nothing when the backend does not implement Lister.
+func (srv *Service) ReconcileCtx(ctx context.Context) error {
+	srv.backendMu.Lock()
+	defer srv.backendMu.Unlock()
+
+	err := srv.reconcile(ctx)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.health.LastReconcile = srv.timeFunc()
+	srv.health.ReconcileError = ""
+	if err != nil {
+		srv.health.ReconcileError = err.Error()
+	}
+
+	return err
 }
 
-func (srv *Service) DeleteOutOfDateCtx(ctx context.Context, duration time.Duration) ([]IPEntry, error) {
-	before := srv.timeFunc().Add(-duration)
+func (srv *Service) reconcile(ctx context.Context) error {
+	lister, ok := srv.backend.(Lister)
+	if !ok {
+		return nil
+	}
+
+	var ips []string
+	err := srv.callBackend("list", func() error {
+		var err error
+		ips, err = lister.List(ctx)
+		return err
+	})
+	if errors.Is(err, ErrListNotSupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("backend list: %w", err)
+	}
 
-	entriesBefore := srv.findAllBefore(before)
-	if entriesBefore == nil {
-		return []IPEntry{}, nil
+	allowed := make(map[netip.Addr]bool, len(ips))
+	for _, ip := range ips {
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			allowed[addr.Unmap()] = true
+		}
 	}
 
-	deletedEntries := make([]IPEntry, 0, len(entriesBefore))
-	for _, entry := range entriesBefore {
-		if err := srv.DeleteIPCtx(ctx, entry.IP); err != nil {
-			return deletedEntries, err
+	// the entries do not change meanwhile, as the changes wait for srv.backendMu
+	for _, ee := range srv.List() {
+		addr, err := netip.ParseAddr(ee.IP)
+		if err != nil || allowed[addr.Unmap()] {
+			continue
+		}
+
+		if err := srv.allow(ctx, ee.IP); err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
+
+// DeleteOutOfDate deletes entries not updated for their TTL,
+// or for duration when the entry has no TTL.
+func (srv *Service) DeleteOutOfDate(duration time.Duration) ([]IPEntry, error) {
+	return srv.DeleteOutOfDateCtx(context.Background(), duration)
+}
+
+// The entries the backend fails to revoke are kept in the registry, so the next call retries them.
+func (srv *Service) DeleteOutOfDateCtx(ctx context.Context, duration time.Duration) ([]IPEntry, error) {
+	srv.backendMu.Lock()
+	defer srv.backendMu.Unlock()
+
+	start := time.Now()
+	defer func() {
+		srv.metrics.sweep(time.Since(start))
+	}()
+
+	expiredEntries := func() []IPEntry {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+
+		srv.health.LastCleanup = srv.timeFunc()
+		entries := srv.findAllExpired(srv.health.LastCleanup, duration)
+		expiredEntries := make([]IPEntry, 0, len(entries))
+		for _, entry := range entries {
+			expiredEntries = append(expiredEntries, *entry)
+		}
+		return expiredEntries
+	}()
+
+	var errs []error
+	deletedEntries := make([]IPEntry, 0, len(expiredEntries))
+	for _, entry := range expiredEntries {
+		if err := srv.revoke(ctx, entry.IP); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		func() {
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
 
-		deletedEntries = append(deletedEntries, *entry)
+			// the entries are deleted only with srv.backendMu locked, so it cannot fail
+			_ = srv.deleteEntry(entry.IP, EventExpire)
+		}()
+		deletedEntries = append(deletedEntries, entry)
 	}
 
-	return deletedEntries, nil
+	return deletedEntries, errors.Join(errs...)
 }
 
-func (srv *Service) findAllBefore(before time.Time) []*IPEntry {
+func (srv *Service) findAllExpired(now time.Time, duration time.Duration) []*IPEntry {
 	var counter int
 	for _, ee := range srv.entries {
-		if ee.UpdatedAt.Before(before) {
+		if ee.ExpiresAt(duration).Before(now) {
 			counter++
 		}
 	}
@@ -189,7 +633,7 @@ func (srv *Service) findAllBefore(before time.Time) []*IPEntry {
 
 	entries := make([]*IPEntry, 0, counter)
 	for _, ee := range srv.entries {
-		if ee.UpdatedAt.Before(before) {
+		if ee.ExpiresAt(duration).Before(now) {
 			entries = append(entries, ee)
 		}
 	}
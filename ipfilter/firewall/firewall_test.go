@@ -1,8 +1,10 @@
 package firewall_test
 
 import (
+	"context"
 	"errors"
 	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"net/netip"
 	"reflect"
 	"testing"
 	"time"
@@ -40,6 +42,61 @@ func TestService_AddDeleteIP(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "add ipv4-mapped ipv6 of an added ip",
+			initBefore: func(service *firewall.Service, fixedTime *firewall.FixedTime) {
+				fixedTime.SetDateTime("2001-01-01 10:00:00")
+				_ = service.AddIP("1.2.3.4")
+			},
+			testFunc: func(service *firewall.Service, fixedTime *firewall.FixedTime) error {
+				fixedTime.SetDateTime("2001-01-01 10:01:00")
+				return service.AddIP("::ffff:1.2.3.4")
+			},
+			expectedErr: noError,
+			expectedList: []firewall.IPEntry{
+				{
+					IP:        "1.2.3.4",
+					CreatedAt: firewall.MustParseDateTime("2001-01-01 10:00:00"),
+					UpdatedAt: firewall.MustParseDateTime("2001-01-01 10:01:00"),
+				},
+			},
+		},
+		{
+			name: "add ipv6 in a non-canonical form",
+			testFunc: func(service *firewall.Service, fixedTime *firewall.FixedTime) error {
+				fixedTime.SetDateTime("2001-01-01 10:00:00")
+				return service.AddIP("2001:DB8:0:0::1")
+			},
+			expectedErr: noError,
+			expectedList: []firewall.IPEntry{
+				{
+					IP:        "2001:db8::1",
+					CreatedAt: firewall.MustParseDateTime("2001-01-01 10:00:00"),
+					UpdatedAt: firewall.MustParseDateTime("2001-01-01 10:00:00"),
+				},
+			},
+		},
+		{
+			name: "delete ipv4-mapped ipv6 of an added ip",
+			initBefore: func(service *firewall.Service, fixedTime *firewall.FixedTime) {
+				fixedTime.SetDateTime("2001-01-01 10:00:00")
+				_ = service.AddIP("1.2.3.4")
+			},
+			testFunc: func(service *firewall.Service, fixedTime *firewall.FixedTime) error {
+				return service.DeleteIP("::ffff:1.2.3.4")
+			},
+			expectedErr:  noError,
+			expectedList: []firewall.IPEntry{},
+		},
+		{
+			name: "add ip with a zone",
+			testFunc: func(service *firewall.Service, fixedTime *firewall.FixedTime) error {
+				return service.AddIP("fe80::1%eth0")
+			},
+			expectedErr: func(err error) bool {
+				return errors.Is(err, firewall.ErrIncorrectIP)
+			},
+		},
 		{
 			name: "add another ip",
 			initBefore: func(service *firewall.Service, fixedTime *firewall.FixedTime) {
@@ -64,6 +121,26 @@ func TestService_AddDeleteIP(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "add ip with owner keeps the first owner",
+			initBefore: func(service *firewall.Service, fixedTime *firewall.FixedTime) {
+				fixedTime.SetDateTime("2001-01-01 10:00:00")
+				_ = service.AddIP("1.2.3.4", firewall.WithOwner("alice"))
+			},
+			testFunc: func(service *firewall.Service, fixedTime *firewall.FixedTime) error {
+				fixedTime.SetDateTime("2001-01-01 10:01:00")
+				return service.AddIP("1.2.3.4", firewall.WithOwner("bob"))
+			},
+			expectedErr: noError,
+			expectedList: []firewall.IPEntry{
+				{
+					IP:        "1.2.3.4",
+					CreatedAt: firewall.MustParseDateTime("2001-01-01 10:00:00"),
+					UpdatedAt: firewall.MustParseDateTime("2001-01-01 10:01:00"),
+					Owner:     "alice",
+				},
+			},
+		},
 		{
 			name: "add the same ip",
 			initBefore: func(service *firewall.Service, fixedTime *firewall.FixedTime) {
@@ -122,6 +199,96 @@ func TestService_AddDeleteIP(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "add existed ip with another label",
+			initBefore: func(service *firewall.Service, fixedTime *firewall.FixedTime) {
+				fixedTime.SetDateTime("2001-01-01 10:00:00")
+				_ = service.AddIP("1.2.3.4", firewall.WithLabel("home"))
+			},
+			testFunc: func(service *firewall.Service, fixedTime *firewall.FixedTime) error {
+				fixedTime.SetDateTime("2001-01-01 10:00:10")
+				return service.AddIP("1.2.3.4", firewall.WithLabel("office"))
+			},
+			expectedErr: noError,
+			expectedList: []firewall.IPEntry{
+				{
+					IP:        "1.2.3.4",
+					CreatedAt: firewall.MustParseDateTime("2001-01-01 10:00:00"),
+					UpdatedAt: firewall.MustParseDateTime("2001-01-01 10:00:10"),
+					Label:     "office",
+				},
+			},
+		},
+		{
+			name: "add existed ip without label",
+			initBefore: func(service *firewall.Service, fixedTime *firewall.FixedTime) {
+				fixedTime.SetDateTime("2001-01-01 10:00:00")
+				_ = service.AddIP("1.2.3.4", firewall.WithLabel("home"))
+			},
+			testFunc: func(service *firewall.Service, fixedTime *firewall.FixedTime) error {
+				fixedTime.SetDateTime("2001-01-01 10:00:10")
+				return service.AddIP("1.2.3.4")
+			},
+			expectedErr: noError,
+			expectedList: []firewall.IPEntry{
+				{
+					IP:        "1.2.3.4",
+					CreatedAt: firewall.MustParseDateTime("2001-01-01 10:00:00"),
+					UpdatedAt: firewall.MustParseDateTime("2001-01-01 10:00:10"),
+					Label:     "home",
+				},
+			},
+		},
+		{
+			name: "extend not existed ip",
+			testFunc: func(service *firewall.Service, fixedTime *firewall.FixedTime) error {
+				return service.ExtendIPCtx(context.Background(), "1.2.3.4", time.Minute)
+			},
+			expectedErr: func(err error) bool {
+				return errors.Is(err, firewall.ErrIPNotFound)
+			},
+		},
+		{
+			name: "extend existed ip",
+			initBefore: func(service *firewall.Service, fixedTime *firewall.FixedTime) {
+				fixedTime.SetDateTime("2001-01-01 10:00:00")
+				_ = service.AddIP("1.2.3.4")
+			},
+			testFunc: func(service *firewall.Service, fixedTime *firewall.FixedTime) error {
+				// expires at 10:00:15
+				fixedTime.SetDateTime("2001-01-01 10:00:05")
+				return service.ExtendIPCtx(context.Background(), "1.2.3.4", 10*time.Minute)
+			},
+			expectedErr: noError,
+			expectedList: []firewall.IPEntry{
+				{
+					IP:        "1.2.3.4",
+					CreatedAt: firewall.MustParseDateTime("2001-01-01 10:00:00"),
+					UpdatedAt: firewall.MustParseDateTime("2001-01-01 10:00:05"),
+					TTL:       10*time.Minute + 10*time.Second,
+				},
+			},
+		},
+		{
+			name: "extend past due ip",
+			initBefore: func(service *firewall.Service, fixedTime *firewall.FixedTime) {
+				fixedTime.SetDateTime("2001-01-01 10:00:00")
+				_ = service.AddIP("1.2.3.4")
+			},
+			testFunc: func(service *firewall.Service, fixedTime *firewall.FixedTime) error {
+				fixedTime.SetDateTime("2001-01-01 10:01:00")
+				return service.ExtendIPCtx(context.Background(), "1.2.3.4", 10*time.Minute)
+			},
+			expectedErr: noError,
+			expectedList: []firewall.IPEntry{
+				{
+					IP:        "1.2.3.4",
+					CreatedAt: firewall.MustParseDateTime("2001-01-01 10:00:00"),
+					UpdatedAt: firewall.MustParseDateTime("2001-01-01 10:01:00"),
+					TTL:       10 * time.Minute,
+				},
+			},
+		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			var fixedTime firewall.FixedTime
@@ -212,6 +379,26 @@ func TestService_DeleteOutOfDate(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "when entry with its own TTL is out-of-date",
+			initBefore: func(service *firewall.Service, fixedTime *firewall.FixedTime) {
+				fixedTime.SetDateTime("2001-01-01 10:00:00")
+				_ = service.AddIP("1.2.3.4", firewall.WithTTL(time.Minute))
+				_ = service.AddIP("2.2.8.8")
+				_ = service.AddIP("3.3.3.3", firewall.WithTTL(time.Hour))
+			},
+			deleteAt:       "2001-01-01 10:02:00",
+			deleteDuration: 5 * time.Minute,
+			expectedErr:    noError,
+			expectedList: []firewall.IPEntry{
+				{
+					IP:        "1.2.3.4",
+					CreatedAt: firewall.MustParseDateTime("2001-01-01 10:00:00"),
+					UpdatedAt: firewall.MustParseDateTime("2001-01-01 10:00:00"),
+					TTL:       time.Minute,
+				},
+			},
+		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			var fixedTime firewall.FixedTime
@@ -237,6 +424,270 @@ func TestService_DeleteOutOfDate(t *testing.T) {
 	}
 }
 
+func TestService_Policy(t *testing.T) {
+	policy := firewall.Policy{
+		AllowedNetworks: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		MaxTTL:          time.Hour,
+	}
+
+	for _, tt := range []struct {
+		name        string
+		ip          string
+		opts        []firewall.EntryOption
+		expectedErr func(err error) bool
+	}{
+		{
+			name:        "ip within allowed network",
+			ip:          "10.1.2.3",
+			expectedErr: noError,
+		},
+		{
+			name:        "ipv4-mapped ip within allowed network",
+			ip:          "::ffff:10.1.2.3",
+			expectedErr: noError,
+		},
+		{
+			name: "ip outside allowed networks",
+			ip:   "1.2.3.4",
+			expectedErr: func(err error) bool {
+				return errors.Is(err, firewall.ErrIPNotAllowed)
+			},
+		},
+		{
+			name:        "ttl within limit",
+			ip:          "10.1.2.3",
+			opts:        []firewall.EntryOption{firewall.WithTTL(time.Hour)},
+			expectedErr: noError,
+		},
+		{
+			name: "ttl over limit",
+			ip:   "10.1.2.3",
+			opts: []firewall.EntryOption{firewall.WithTTL(2 * time.Hour)},
+			expectedErr: func(err error) bool {
+				return errors.Is(err, firewall.ErrTTLNotAllowed)
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var fixedTime firewall.FixedTime
+
+			service := firewall.NewService(
+				firewall.WithTimeFunc(fixedTime.TimeFunc()),
+				firewall.WithBackend(&listerBackend{}),
+				firewall.WithPolicy(policy),
+			)
+
+			if err := service.AddIP(tt.ip, tt.opts...); !tt.expectedErr(err) {
+				t.Errorf("expected error is not satisfied: %v", err)
+			}
+		})
+	}
+}
+
+func TestService_ExtendPolicy(t *testing.T) {
+	var fixedTime firewall.FixedTime
+	fixedTime.SetDateTime("2001-01-01 10:00:00")
+
+	service := firewall.NewService(
+		firewall.WithTimeFunc(fixedTime.TimeFunc()),
+		firewall.WithBackend(&listerBackend{}),
+		firewall.WithPolicy(firewall.Policy{MaxTTL: time.Hour}),
+	)
+	if err := service.AddIP("1.2.3.4", firewall.WithTTL(30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := service.ExtendIPCtx(context.Background(), "1.2.3.4", 30*time.Minute); err != nil {
+		t.Errorf("extend within limit: %v", err)
+	}
+	if err := service.ExtendIPCtx(context.Background(), "1.2.3.4", time.Minute); !errors.Is(err, firewall.ErrTTLNotAllowed) {
+		t.Errorf("extend over limit: %v", err)
+	}
+}
+
+func TestService_RevokeFailure(t *testing.T) {
+	var fixedTime firewall.FixedTime
+	fixedTime.SetDateTime("2001-01-01 10:00:00")
+
+	backend := &failingBackend{}
+	service := firewall.NewService(
+		firewall.WithTimeFunc(fixedTime.TimeFunc()),
+		firewall.WithBackend(backend),
+		firewall.WithDefaultTTL(time.Minute),
+	)
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+		if err := service.AddIP(ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backend.err = errors.New("ufw failed")
+	if err := service.DeleteIP("1.1.1.1"); err == nil {
+		t.Error("delete: expected error")
+	}
+	fixedTime.SetDateTime("2001-01-01 10:02:00")
+	deleted, err := service.DeleteOutOfDate(service.DefaultTTL())
+	if err == nil {
+		t.Error("sweep: expected error")
+	}
+	if len(deleted) != 0 {
+		t.Errorf("deleted: %+v", deleted)
+	}
+	// the rules are still open, so the entries are kept
+	if entries := service.List(); len(entries) != 2 {
+		t.Fatalf("entries after failure: %+v", entries)
+	}
+
+	// the next sweep retries them
+	backend.err = nil
+	deleted, err = service.DeleteOutOfDate(service.DefaultTTL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("deleted: %+v", deleted)
+	}
+	if entries := service.List(); len(entries) != 0 {
+		t.Errorf("entries after retry: %+v", entries)
+	}
+}
+
+type listerBackend struct {
+	listed  []string
+	allowed []string
+}
+
+func (b *listerBackend) Allow(_ context.Context, ip string) error {
+	b.allowed = append(b.allowed, ip)
+	return nil
+}
+
+func (b *listerBackend) Revoke(_ context.Context, _ string) error {
+	return nil
+}
+
+func (b *listerBackend) List(_ context.Context) ([]string, error) {
+	return b.listed, nil
+}
+
+func TestService_Reconcile(t *testing.T) {
+	for _, tt := range []struct {
+		name            string
+		entries         []string
+		listed          []string
+		expectedAllowed []string
+	}{
+		{
+			name:    "when backend is in sync",
+			entries: []string{"1.2.3.4"},
+			listed:  []string{"1.2.3.4"},
+		},
+		{
+			name:            "when backend lost an entry",
+			entries:         []string{"1.2.3.4", "2.2.8.8"},
+			listed:          []string{"1.2.3.4", "9.9.9.9"},
+			expectedAllowed: []string{"2.2.8.8"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var fixedTime firewall.FixedTime
+			fixedTime.SetDateTime("2001-01-01 10:00:00")
+
+			backend := &listerBackend{}
+			service := firewall.NewService(
+				firewall.WithTimeFunc(fixedTime.TimeFunc()),
+				firewall.WithBackend(backend),
+			)
+			for _, ip := range tt.entries {
+				_ = service.AddIP(ip)
+			}
+			backend.allowed = nil
+			backend.listed = tt.listed
+
+			if err := service.ReconcileCtx(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(backend.allowed, tt.expectedAllowed) {
+				t.Errorf("allowed\nactual:   %+v\nexpected: %+v", backend.allowed, tt.expectedAllowed)
+			}
+		})
+	}
+}
+
+// blockingBackend blocks the calls until release is closed.
+type blockingBackend struct {
+	called  chan string
+	release chan struct{}
+}
+
+func (b *blockingBackend) Allow(_ context.Context, ip string) error {
+	b.called <- ip
+	<-b.release
+	return nil
+}
+
+func (b *blockingBackend) Revoke(_ context.Context, ip string) error {
+	b.called <- ip
+	<-b.release
+	return nil
+}
+
+func TestService_SlowBackend(t *testing.T) {
+	var fixedTime firewall.FixedTime
+	fixedTime.SetDateTime("2001-01-01 10:00:00")
+
+	backend := &blockingBackend{
+		called:  make(chan string, 2),
+		release: make(chan struct{}),
+	}
+	service := firewall.NewService(
+		firewall.WithTimeFunc(fixedTime.TimeFunc()),
+		firewall.WithBackend(backend),
+	)
+
+	added := make(chan error, 2)
+	go func() {
+		added <- service.AddIP("1.2.3.4")
+	}()
+	<-backend.called
+
+	// the registry is read while the backend is called
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		if !service.Contains("1.2.3.4") {
+			t.Error("entry not found")
+		}
+		if entries := service.List(); len(entries) != 1 {
+			t.Errorf("entries: %+v", entries)
+		}
+		_ = service.Health()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("registry blocked by the backend call")
+	}
+
+	// the next change waits for the backend call
+	go func() {
+		added <- service.AddIP("2.2.8.8")
+	}()
+	select {
+	case ip := <-backend.called:
+		t.Fatalf("backend called for %v before the previous call ended", ip)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(backend.release)
+	for range 2 {
+		if err := <-added; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func noError(err error) bool {
 	return err == nil
 }
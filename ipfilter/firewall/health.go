@@ -0,0 +1,96 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// staleCleanup is the age of the last cleanup after which the scheduler is considered stuck.
+const staleCleanup = 30 * time.Second
+
+// ErrListNotSupported is returned by a Lister which cannot list the addresses, e.g. not configured to.
+// ReconcileCtx skips such a backend.
+var ErrListNotSupported = errors.New("backend list not supported")
+
+// Health is the state of the background work of the service and of its backend.
+type Health struct {
+	// LastCleanup is the time of the last DeleteOutOfDateCtx, usually run by the scheduler every second.
+	LastCleanup time.Time
+	// LastReconcile is the time of the last ReconcileCtx.
+	LastReconcile time.Time
+	// ReconcileError is the error of the last ReconcileCtx. It is empty when it succeeded.
+	ReconcileError string
+	// BackendErrors is the number of the failed backend calls.
+	BackendErrors int
+	// BackendError is the error of the last backend call. It is empty when it succeeded.
+	BackendError string
+	// LastBackendErrorAt is the time of the last failed backend call.
+	LastBackendErrorAt time.Time
+}
+
+// Health returns the state of the background work of the service and of its backend.
+func (srv *Service) Health() Health {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.health
+}
+
+// Checks returns the readiness checks of the service by name, nil for a passed one:
+// 'scheduler' runs the cleanup, the last 'backend' call and the last 'reconcile' succeeded.
+func (srv *Service) Checks() map[string]error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	checks := map[string]error{
+		"scheduler": nil,
+		"backend":   nil,
+		"reconcile": nil,
+	}
+
+	now := srv.timeFunc()
+	switch {
+	case srv.health.LastCleanup.IsZero():
+		checks["scheduler"] = errors.New("not started")
+	case now.Sub(srv.health.LastCleanup) > staleCleanup:
+		checks["scheduler"] = fmt.Errorf("last run %v ago", now.Sub(srv.health.LastCleanup).Truncate(time.Second))
+	}
+	if len(srv.health.BackendError) > 0 {
+		checks["backend"] = errors.New(srv.health.BackendError)
+	}
+	if len(srv.health.ReconcileError) > 0 {
+		checks["reconcile"] = errors.New(srv.health.ReconcileError)
+	}
+
+	return checks
+}
+
+// callBackend calls the backend and records the result of the operation. It must be called with srv.mu unlocked.
+func (srv *Service) callBackend(operation string, call func() error) error {
+	start := time.Now()
+	err := call()
+	if errors.Is(err, ErrListNotSupported) {
+		// not a failure of the backend
+		return err
+	}
+
+	srv.metrics.backendCall(operation, time.Since(start), err)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.recordBackend(err)
+	return err
+}
+
+// recordBackend must be called with srv.mu locked.
+func (srv *Service) recordBackend(err error) {
+	if err == nil {
+		srv.health.BackendError = ""
+		return
+	}
+	srv.health.BackendErrors++
+	srv.health.BackendError = err.Error()
+	srv.health.LastBackendErrorAt = srv.timeFunc()
+}
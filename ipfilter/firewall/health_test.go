@@ -0,0 +1,171 @@
+package firewall_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"reflect"
+	"testing"
+)
+
+// failingBackend fails the calls with err and the listing with listErr.
+type failingBackend struct {
+	err     error
+	listErr error
+}
+
+func (b *failingBackend) Allow(_ context.Context, _ string) error  { return b.err }
+func (b *failingBackend) Revoke(_ context.Context, _ string) error { return b.err }
+
+func (b *failingBackend) List(_ context.Context) ([]string, error) {
+	return nil, b.listErr
+}
+
+func checkErrors(checks map[string]error) map[string]string {
+	result := make(map[string]string, len(checks))
+	for name, err := range checks {
+		result[name] = "ok"
+		if err != nil {
+			result[name] = err.Error()
+		}
+	}
+	return result
+}
+
+func TestService_Health(t *testing.T) {
+	var fixedTime firewall.FixedTime
+	fixedTime.SetDateTime("2001-01-01 10:00:00")
+
+	backend := &failingBackend{}
+	service := firewall.NewService(
+		firewall.WithTimeFunc(fixedTime.TimeFunc()),
+		firewall.WithBackend(backend),
+	)
+
+	for _, tt := range []struct {
+		name           string
+		dateTime       string
+		action         func() error
+		expectedChecks map[string]string
+		expectedHealth firewall.Health
+	}{
+		{
+			name:   "before the scheduler",
+			action: func() error { return nil },
+			expectedChecks: map[string]string{
+				"scheduler": "not started",
+				"backend":   "ok",
+				"reconcile": "ok",
+			},
+		},
+		{
+			name: "cleanup and reconcile",
+			action: func() error {
+				if _, err := service.DeleteOutOfDate(service.DefaultTTL()); err != nil {
+					return err
+				}
+				return service.ReconcileCtx(context.Background())
+			},
+			expectedChecks: map[string]string{
+				"scheduler": "ok",
+				"backend":   "ok",
+				"reconcile": "ok",
+			},
+			expectedHealth: firewall.Health{
+				LastCleanup:   firewall.MustParseDateTime("2001-01-01 10:00:00"),
+				LastReconcile: firewall.MustParseDateTime("2001-01-01 10:00:00"),
+			},
+		},
+		{
+			name:     "backend failure",
+			dateTime: "2001-01-01 10:00:20",
+			action: func() error {
+				backend.err = errors.New("ufw failed")
+				if err := service.AddIP("1.2.3.4"); err == nil {
+					return errors.New("expected error")
+				}
+				return nil
+			},
+			expectedChecks: map[string]string{
+				"scheduler": "ok",
+				"backend":   "ufw failed",
+				"reconcile": "ok",
+			},
+			expectedHealth: firewall.Health{
+				LastCleanup:        firewall.MustParseDateTime("2001-01-01 10:00:00"),
+				LastReconcile:      firewall.MustParseDateTime("2001-01-01 10:00:00"),
+				BackendErrors:      1,
+				BackendError:       "ufw failed",
+				LastBackendErrorAt: firewall.MustParseDateTime("2001-01-01 10:00:20"),
+			},
+		},
+		{
+			name:     "stuck scheduler and reconcile failure",
+			dateTime: "2001-01-01 10:01:00",
+			action: func() error {
+				backend.listErr = errors.New("timeout")
+				if err := service.ReconcileCtx(context.Background()); err == nil {
+					return errors.New("expected error")
+				}
+				return nil
+			},
+			expectedChecks: map[string]string{
+				"scheduler": "last run 1m0s ago",
+				"backend":   "timeout",
+				"reconcile": "backend list: timeout",
+			},
+			expectedHealth: firewall.Health{
+				LastCleanup:        firewall.MustParseDateTime("2001-01-01 10:00:00"),
+				LastReconcile:      firewall.MustParseDateTime("2001-01-01 10:01:00"),
+				ReconcileError:     "backend list: timeout",
+				BackendErrors:      2,
+				BackendError:       "timeout",
+				LastBackendErrorAt: firewall.MustParseDateTime("2001-01-01 10:01:00"),
+			},
+		},
+		{
+			name:     "recovered",
+			dateTime: "2001-01-01 10:01:10",
+			action: func() error {
+				backend.err = nil
+				backend.listErr = fmt.Errorf("not configured: %w", firewall.ErrListNotSupported)
+				if _, err := service.DeleteOutOfDate(service.DefaultTTL()); err != nil {
+					return err
+				}
+				// the backend not able to list is skipped
+				if err := service.ReconcileCtx(context.Background()); err != nil {
+					return err
+				}
+				return service.AddIP("1.2.3.4")
+			},
+			expectedChecks: map[string]string{
+				"scheduler": "ok",
+				"backend":   "ok",
+				"reconcile": "ok",
+			},
+			expectedHealth: firewall.Health{
+				LastCleanup:        firewall.MustParseDateTime("2001-01-01 10:01:10"),
+				LastReconcile:      firewall.MustParseDateTime("2001-01-01 10:01:10"),
+				BackendErrors:      2,
+				LastBackendErrorAt: firewall.MustParseDateTime("2001-01-01 10:01:00"),
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.dateTime) > 0 {
+				fixedTime.SetDateTime(tt.dateTime)
+			}
+			if err := tt.action(); err != nil {
+				t.Fatal(err)
+			}
+
+			if checks := checkErrors(service.Checks()); !reflect.DeepEqual(checks, tt.expectedChecks) {
+				t.Errorf("checks\nactual:   %+v\nexpected: %+v", checks, tt.expectedChecks)
+			}
+			if health := service.Health(); !reflect.DeepEqual(health, tt.expectedHealth) {
+				t.Errorf("health\nactual:   %+v\nexpected: %+v", health, tt.expectedHealth)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package firewall
+
+import (
+	"github.com/dkarczmarski/gomisc/ipfilter/metrics"
+	"time"
+)
+
+// serviceMetrics are the metrics of the registry changes, the backend calls and the sweeps.
+type serviceMetrics struct {
+	events          map[EventType]*metrics.Counter
+	backendDuration *metrics.Histogram
+	backendFailures *metrics.Counter
+	sweepDuration   *metrics.Histogram
+}
+
+// WithMetrics registers the metrics of the service: the active entries by owner, the added, renewed, deleted
+// and expired entries, the access requests, the duration and the failures of the backend calls
+// and the duration of the sweeps.
+func WithMetrics(registry *metrics.Registry) func(*config) {
+	return func(c *config) {
+		c.metrics = registry
+	}
+}
+
+func newServiceMetrics(srv *Service, registry *metrics.Registry) *serviceMetrics {
+	registry.GaugeFunc("ipfilter_entries", "Active entries by owner, empty for the entries added without one.",
+		func(set func(value float64, labelValues ...string)) {
+			byOwner := make(map[string]int)
+			for _, entry := range srv.List() {
+				byOwner[entry.Owner]++
+			}
+			for owner, count := range byOwner {
+				set(float64(count), owner)
+			}
+		}, "owner")
+	registry.GaugeFunc("ipfilter_requests_pending", "Access requests waiting for an approval.",
+		func(set func(value float64, labelValues ...string)) {
+			set(float64(len(srv.Requests())))
+		})
+
+	return &serviceMetrics{
+		events: map[EventType]*metrics.Counter{
+			EventAdd:     registry.Counter("ipfilter_entries_added_total", "Entries added to the registry."),
+			EventRenew:   registry.Counter("ipfilter_entries_renewed_total", "Entries renewed or extended."),
+			EventDelete:  registry.Counter("ipfilter_entries_deleted_total", "Entries deleted by the users."),
+			EventExpire:  registry.Counter("ipfilter_entries_expired_total", "Entries deleted by the scheduler after their TTL."),
+			EventRequest: registry.Counter("ipfilter_requests_total", "Access requests made."),
+			EventApprove: registry.Counter("ipfilter_requests_approved_total", "Access requests approved."),
+			EventReject: registry.Counter("ipfilter_requests_rejected_total",
+				"Access requests rejected by the admins or after the approval timeout."),
+		},
+		backendDuration: registry.Histogram("ipfilter_backend_duration_seconds",
+			"Duration of the backend calls by operation: allow, revoke or list.", metrics.DefaultBuckets, "operation"),
+		backendFailures: registry.Counter("ipfilter_backend_failures_total",
+			"Failed backend calls by operation: allow, revoke or list.", "operation"),
+		sweepDuration: registry.Histogram("ipfilter_scheduler_sweep_duration_seconds",
+			"Duration of the sweeps of the out-of-date entries.", metrics.DefaultBuckets),
+	}
+}
+
+func (m *serviceMetrics) event(eventType EventType) {
+	if m == nil {
+		return
+	}
+	m.events[eventType].Inc()
+}
+
+func (m *serviceMetrics) backendCall(operation string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.backendDuration.Observe(duration.Seconds(), operation)
+	if err != nil {
+		m.backendFailures.Inc(operation)
+	}
+}
+
+func (m *serviceMetrics) sweep(duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.sweepDuration.Observe(duration.Seconds())
+}
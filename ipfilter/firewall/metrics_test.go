@@ -0,0 +1,79 @@
+package firewall_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/metrics"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestService_Metrics(t *testing.T) {
+	var fixedTime firewall.FixedTime
+	fixedTime.SetDateTime("2001-01-01 10:00:00")
+
+	backend := &failingBackend{}
+	registry := metrics.NewRegistry()
+	service := firewall.NewService(
+		firewall.WithTimeFunc(fixedTime.TimeFunc()),
+		firewall.WithBackend(backend),
+		firewall.WithDefaultTTL(time.Minute),
+		firewall.WithMetrics(registry),
+	)
+
+	for _, err := range []error{
+		service.AddIP("1.1.1.1", firewall.WithOwner("alice")),
+		service.AddIP("2.2.2.2", firewall.WithOwner("alice")),
+		service.AddIP("3.3.3.3", firewall.WithOwner("bob")),
+		service.AddIP("4.4.4.4"),
+		service.AddIP("1.1.1.1"),
+		service.ExtendIPCtx(context.Background(), "2.2.2.2", time.Hour),
+		service.DeleteIP("4.4.4.4"),
+		func() error {
+			_, err := service.RequestIPCtx(context.Background(), "5.5.5.5", "deploy", firewall.WithOwner("carol"))
+			return err
+		}(),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backend.err = errors.New("ufw failed")
+	fixedTime.SetDateTime("2001-01-01 10:02:00")
+	if _, err := service.DeleteOutOfDate(service.DefaultTTL()); err == nil {
+		t.Fatal("expected error")
+	}
+	backend.listErr = errors.New("timeout")
+	if err := service.ReconcileCtx(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+
+	var buf bytes.Buffer
+	if err := registry.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		// the expired entries are kept in the registry when the backend fails to revoke them
+		"ipfilter_entries{owner=\"alice\"} 2\nipfilter_entries{owner=\"bob\"} 1\n# HELP",
+		"ipfilter_entries_added_total 4\n",
+		"ipfilter_entries_renewed_total 2\n",
+		"ipfilter_entries_deleted_total 1\n",
+		"ipfilter_entries_expired_total 0\n",
+		"ipfilter_backend_duration_seconds_count{operation=\"allow\"} 4\n",
+		"ipfilter_backend_duration_seconds_count{operation=\"list\"} 1\n",
+		"ipfilter_backend_duration_seconds_count{operation=\"revoke\"} 3\n",
+		"ipfilter_backend_failures_total{operation=\"list\"} 1\nipfilter_backend_failures_total{operation=\"revoke\"} 2\n",
+		"ipfilter_scheduler_sweep_duration_seconds_count 1\n",
+		"ipfilter_requests_pending 1\n",
+		"ipfilter_requests_total 1\n",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("%q not found in:\n%v", expected, buf.String())
+		}
+	}
+}
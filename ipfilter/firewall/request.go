@@ -0,0 +1,214 @@
+package firewall
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrRequestNotFound = errors.New("access request not found")
+
+// AccessRequest is a request for an entry which is added only when it is approved, e.g. by an admin.
+type AccessRequest struct {
+	ID string
+	IP string
+	// Owner is the user who requested the access. The entry is owned by the user after the approval.
+	Owner  string
+	Reason string
+	// TTL is the requested time-to-live of the entry. The default TTL is used when it is 0.
+	TTL       time.Duration
+	Label     string
+	CreatedAt time.Time
+	// ExpiresAt is the time after which the request is rejected automatically.
+	ExpiresAt time.Time
+	// DecidedBy is the user who approved or rejected the request. It is empty when the request timed out.
+	DecidedBy string
+}
+
+// entry returns the entry the request would add, to be sent with its events.
+func (r AccessRequest) entry() IPEntry {
+	return IPEntry{
+		IP:        r.IP,
+		CreatedAt: r.CreatedAt,
+		UpdatedAt: r.CreatedAt,
+		TTL:       r.TTL,
+		Owner:     r.Owner,
+		Label:     r.Label,
+	}
+}
+
+// WithApprovalTimeout sets the time after which the pending access requests are rejected.
+func WithApprovalTimeout(timeout time.Duration) func(*config) {
+	return func(c *config) {
+		c.approvalTimeout = timeout
+	}
+}
+
+// SetApprovalTimeout changes the time after which the access requests are rejected.
+// It applies to the new requests only.
+func (srv *Service) SetApprovalTimeout(timeout time.Duration) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.approvalTimeout = timeout
+}
+
+// RequestIPCtx stores a request for ip, which is added by ApproveRequestCtx. The request is checked
+// against the policy now, so it is not approved in vain. The options are those of the added entry.
+func (srv *Service) RequestIPCtx(_ context.Context, ip, reason string, opts ...EntryOption) (AccessRequest, error) {
+	ip, err := canonicalIP(ip)
+	if err != nil {
+		return AccessRequest{}, err
+	}
+
+	var cnf entryConfig
+	for _, ops := range opts {
+		ops(&cnf)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if err := srv.policy.check(ip, cnf.ttl); err != nil {
+		return AccessRequest{}, err
+	}
+
+	now := srv.timeFunc()
+	request := &AccessRequest{
+		ID:        newRequestID(),
+		IP:        ip,
+		Owner:     cnf.owner,
+		Reason:    reason,
+		TTL:       cnf.ttl,
+		Label:     cnf.label,
+		CreatedAt: now,
+		ExpiresAt: now.Add(srv.approvalTimeout),
+	}
+	srv.requests = append(srv.requests, request)
+	srv.publishRequest(EventRequest, *request)
+
+	return *request, nil
+}
+
+// Requests returns the access requests waiting for an approval.
+func (srv *Service) Requests() []AccessRequest {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	requests := make([]AccessRequest, len(srv.requests))
+	for i, request := range srv.requests {
+		requests[i] = *request
+	}
+	return requests
+}
+
+// FindRequest returns the pending access request by its ID.
+func (srv *Service) FindRequest(id string) (AccessRequest, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	_, request := srv.findRequest(id)
+	if request == nil {
+		return AccessRequest{}, fmt.Errorf("request %v: %w", id, ErrRequestNotFound)
+	}
+	return *request, nil
+}
+
+// ApproveRequestCtx adds the entry of the access request. The request stays pending
+// when the policy, which could have changed since it was made, does not allow it.
+func (srv *Service) ApproveRequestCtx(ctx context.Context, id, approver string) (IPEntry, error) {
+	srv.backendMu.Lock()
+	defer srv.backendMu.Unlock()
+
+	entry, added, err := func() (IPEntry, bool, error) {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+
+		index, request := srv.findRequest(id)
+		if request == nil {
+			return IPEntry{}, false, fmt.Errorf("request %v: %w", id, ErrRequestNotFound)
+		}
+		if err := srv.policy.check(request.IP, request.TTL); err != nil {
+			return IPEntry{}, false, err
+		}
+
+		srv.deleteRequestByIndex(index)
+		request.DecidedBy = approver
+		srv.publishRequest(EventApprove, *request)
+
+		return srv.addEntry(request.IP, entryConfig{
+			ttl:   request.TTL,
+			owner: request.Owner,
+			label: request.Label,
+		})
+	}()
+	if err != nil || !added {
+		return entry, err
+	}
+
+	// the entry is in the registry even when the backend failed, it is allowed again by the reconciliation
+	return entry, srv.allow(ctx, entry.IP)
+}
+
+// RejectRequestCtx deletes the access request without adding its entry.
+func (srv *Service) RejectRequestCtx(_ context.Context, id, rejecter string) (AccessRequest, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	index, request := srv.findRequest(id)
+	if request == nil {
+		return AccessRequest{}, fmt.Errorf("request %v: %w", id, ErrRequestNotFound)
+	}
+
+	srv.deleteRequestByIndex(index)
+	request.DecidedBy = rejecter
+	srv.publishRequest(EventReject, *request)
+
+	return *request, nil
+}
+
+// RejectOutOfDateRequests rejects the access requests not decided before their ExpiresAt.
+func (srv *Service) RejectOutOfDateRequests() []AccessRequest {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	now := srv.timeFunc()
+	var rejected []AccessRequest
+	pending := srv.requests[:0]
+	for _, request := range srv.requests {
+		if request.ExpiresAt.After(now) {
+			pending = append(pending, request)
+			continue
+		}
+		rejected = append(rejected, *request)
+		srv.publishRequest(EventReject, *request)
+	}
+	clear(srv.requests[len(pending):])
+	srv.requests = pending
+
+	return rejected
+}
+
+func (srv *Service) findRequest(id string) (int, *AccessRequest) {
+	for i, request := range srv.requests {
+		if request.ID == id {
+			return i, request
+		}
+	}
+	return -1, nil
+}
+
+func (srv *Service) deleteRequestByIndex(index int) {
+	srv.requests = append(srv.requests[:index], srv.requests[index+1:]...)
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("rand.Read(): %w", err))
+	}
+	return hex.EncodeToString(b)
+}
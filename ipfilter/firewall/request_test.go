@@ -0,0 +1,192 @@
+package firewall_test
+
+import (
+	"context"
+	"errors"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestService_RequestIPCtx(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		ip          string
+		ttl         time.Duration
+		expectedErr error
+	}{
+		{name: "allowed", ip: "10.0.0.1", ttl: time.Hour},
+		{name: "incorrect ip", ip: "10.0.0", expectedErr: firewall.ErrIncorrectIP},
+		{name: "ip not allowed", ip: "192.168.0.1", expectedErr: firewall.ErrIPNotAllowed},
+		{name: "ttl not allowed", ip: "10.0.0.1", ttl: 48 * time.Hour, expectedErr: firewall.ErrTTLNotAllowed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			service := firewall.NewService(
+				firewall.WithTimeFunc(time.Now),
+				firewall.WithBackend(&listerBackend{}),
+				firewall.WithPolicy(firewall.Policy{
+					AllowedNetworks: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+					MaxTTL:          24 * time.Hour,
+				}),
+			)
+
+			_, err := service.RequestIPCtx(context.Background(), tt.ip, "deploy", firewall.WithTTL(tt.ttl))
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("actual: %v expected: %v", err, tt.expectedErr)
+			}
+
+			expectedRequests := 1
+			if tt.expectedErr != nil {
+				expectedRequests = 0
+			}
+			if len(service.Requests()) != expectedRequests {
+				t.Errorf("unexpected requests: %+v", service.Requests())
+			}
+			if len(service.List()) != 0 {
+				t.Errorf("entries added before the approval: %+v", service.List())
+			}
+		})
+	}
+}
+
+func TestService_Requests(t *testing.T) {
+	var fixedTime firewall.FixedTime
+	fixedTime.SetDateTime("2001-01-01 10:00:00")
+
+	backend := &listerBackend{}
+	service := firewall.NewService(
+		firewall.WithTimeFunc(fixedTime.TimeFunc()),
+		firewall.WithBackend(backend),
+		firewall.WithApprovalTimeout(time.Hour),
+	)
+	events, cancel := service.Subscribe()
+
+	approved, err := service.RequestIPCtx(context.Background(), "1.1.1.1", "deploy",
+		firewall.WithOwner("bob"), firewall.WithTTL(2*time.Hour), firewall.WithLabel("laptop"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected, err := service.RequestIPCtx(context.Background(), "2.2.2.2", "debugging", firewall.WithOwner("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixedTime.SetDateTime("2001-01-01 10:30:00")
+	timedOut, err := service.RequestIPCtx(context.Background(), "3.3.3.3", "backup", firewall.WithOwner("carol"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(approved.ID) != 32 || approved.ID == rejected.ID {
+		t.Errorf("unexpected IDs: %v %v", approved.ID, rejected.ID)
+	}
+	expectedRequest := firewall.AccessRequest{
+		ID:        approved.ID,
+		IP:        "1.1.1.1",
+		Owner:     "bob",
+		Reason:    "deploy",
+		TTL:       2 * time.Hour,
+		Label:     "laptop",
+		CreatedAt: firewall.MustParseDateTime("2001-01-01 10:00:00"),
+		ExpiresAt: firewall.MustParseDateTime("2001-01-01 11:00:00"),
+	}
+	if found, err := service.FindRequest(approved.ID); err != nil || found != expectedRequest {
+		t.Errorf("actual: %+v, %v expected: %+v", found, err, expectedRequest)
+	}
+
+	entry, err := service.ApproveRequestCtx(context.Background(), approved.ID, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedEntry := firewall.IPEntry{
+		IP:        "1.1.1.1",
+		CreatedAt: firewall.MustParseDateTime("2001-01-01 10:30:00"),
+		UpdatedAt: firewall.MustParseDateTime("2001-01-01 10:30:00"),
+		TTL:       2 * time.Hour,
+		Owner:     "bob",
+		Label:     "laptop",
+	}
+	if entry != expectedEntry {
+		t.Errorf("actual: %+v expected: %+v", entry, expectedEntry)
+	}
+	if !reflect.DeepEqual(backend.allowed, []string{"1.1.1.1"}) {
+		t.Errorf("unexpected allowed: %v", backend.allowed)
+	}
+
+	if _, err := service.RejectRequestCtx(context.Background(), rejected.ID, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{approved.ID, rejected.ID, "unknown"} {
+		if _, err := service.ApproveRequestCtx(context.Background(), id, "admin"); !errors.Is(err, firewall.ErrRequestNotFound) {
+			t.Errorf("approve %v: unexpected error: %v", id, err)
+		}
+		if _, err := service.RejectRequestCtx(context.Background(), id, "admin"); !errors.Is(err, firewall.ErrRequestNotFound) {
+			t.Errorf("reject %v: unexpected error: %v", id, err)
+		}
+	}
+
+	fixedTime.SetDateTime("2001-01-01 11:29:59")
+	if rejected := service.RejectOutOfDateRequests(); len(rejected) != 0 {
+		t.Errorf("rejected before the timeout: %+v", rejected)
+	}
+	fixedTime.SetDateTime("2001-01-01 11:30:00")
+	if rejected := service.RejectOutOfDateRequests(); len(rejected) != 1 || rejected[0].ID != timedOut.ID {
+		t.Errorf("unexpected rejected: %+v", rejected)
+	}
+	if requests := service.Requests(); len(requests) != 0 {
+		t.Errorf("unexpected requests: %+v", requests)
+	}
+
+	cancel()
+
+	type summary struct {
+		eventType firewall.EventType
+		ip        string
+		decidedBy string
+	}
+	var actual []summary
+	for event := range events {
+		s := summary{eventType: event.Type, ip: event.Entry.IP}
+		if event.Request != nil {
+			s.decidedBy = event.Request.DecidedBy
+		}
+		actual = append(actual, s)
+	}
+	expected := []summary{
+		{eventType: firewall.EventRequest, ip: "1.1.1.1"},
+		{eventType: firewall.EventRequest, ip: "2.2.2.2"},
+		{eventType: firewall.EventRequest, ip: "3.3.3.3"},
+		{eventType: firewall.EventApprove, ip: "1.1.1.1", decidedBy: "admin"},
+		{eventType: firewall.EventAdd, ip: "1.1.1.1"},
+		{eventType: firewall.EventReject, ip: "2.2.2.2", decidedBy: "admin"},
+		{eventType: firewall.EventReject, ip: "3.3.3.3"},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("actual: %+v expected: %+v", actual, expected)
+	}
+}
+
+func TestService_ApproveRequestCtx_Policy(t *testing.T) {
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(&listerBackend{}),
+	)
+
+	request, err := service.RequestIPCtx(context.Background(), "1.1.1.1", "deploy", firewall.WithTTL(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.SetPolicy(firewall.Policy{MaxTTL: time.Hour})
+
+	if _, err := service.ApproveRequestCtx(context.Background(), request.ID, "admin"); !errors.Is(err, firewall.ErrTTLNotAllowed) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// still pending, so it can be rejected
+	if _, err := service.FindRequest(request.ID); err != nil {
+		t.Error(err)
+	}
+	if len(service.List()) != 0 {
+		t.Errorf("unexpected entries: %+v", service.List())
+	}
+}
@@ -7,18 +7,22 @@ import (
 	"time"
 )
 
+const reconcileInterval = time.Minute
+
 func RunDeleteOutOfDateTask(ctx context.Context, wg *sync.WaitGroup, service *Service) {
 	wg.Add(1)
 	go runDeleteOutOfDateTask(ctx, wg, service)
 }
 
 func runDeleteOutOfDateTask(ctx context.Context, wg *sync.WaitGroup, service *Service) {
+	var lastReconcile time.Time
+
 loop:
 	for {
 		deleted, err := func() ([]IPEntry, error) {
 			srvCtx, srvCtxCancel := context.WithTimeout(ctx, 10*time.Second)
 			defer srvCtxCancel()
-			return service.DeleteOutOfDateCtx(srvCtx, 15*time.Second)
+			return service.DeleteOutOfDateCtx(srvCtx, service.DefaultTTL())
 		}()
 		if err != nil {
 			log.Print(err)
@@ -26,6 +30,20 @@ loop:
 		if len(deleted) > 0 {
 			log.Printf("deleted out-of-date entries: %+v", deleted)
 		}
+		if rejected := service.RejectOutOfDateRequests(); len(rejected) > 0 {
+			log.Printf("rejected out-of-date access requests: %+v", rejected)
+		}
+
+		if time.Since(lastReconcile) >= reconcileInterval {
+			lastReconcile = time.Now()
+			if err := func() error {
+				srvCtx, srvCtxCancel := context.WithTimeout(ctx, 30*time.Second)
+				defer srvCtxCancel()
+				return service.ReconcileCtx(srvCtx)
+			}(); err != nil {
+				log.Printf("reconcile: %v", err)
+			}
+		}
 
 		select {
 		case <-time.After(time.Second):
@@ -0,0 +1,119 @@
+package htpasswd
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+var ErrUnsupportedHash = errors.New("unsupported hash")
+
+// Argon2idParams are the parameters of newly created argon2id hashes.
+type Argon2idParams struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2idParams follow the RFC 9106 second recommended option.
+var DefaultArgon2idParams = Argon2idParams{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// HashBcrypt returns a bcrypt hash in the '$2y$' form used by Apache htpasswd.
+func HashBcrypt(password string, cost int) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", fmt.Errorf("bcrypt.GenerateFromPassword(): %w", err)
+	}
+
+	return "$2y$" + strings.TrimPrefix(string(hash), "$2a$"), nil
+}
+
+// HashArgon2id returns an argon2id hash in the PHC string format,
+// e.g. '$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>'.
+func HashArgon2id(password string, params Argon2idParams) (string, error) {
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("rand.Read(): %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// VerifyHash reports whether password matches hash. Supported are bcrypt
+// ('$2a$', '$2b$', '$2y$') and argon2id hashes.
+func VerifyHash(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		return verifyBcrypt(hash, password)
+	case strings.HasPrefix(hash, "$2y$"):
+		// $2y$ is the PHP/Apache name of the same algorithm
+		return verifyBcrypt("$2a$"+strings.TrimPrefix(hash, "$2y$"), password)
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2id(hash, password)
+	default:
+		return false, ErrUnsupportedHash
+	}
+}
+
+func verifyBcrypt(hash, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+		return false, nil
+	default:
+		return false, fmt.Errorf("bcrypt.CompareHashAndPassword(): %w", err)
+	}
+}
+
+func verifyArgon2id(hash, password string) (bool, error) {
+	// $argon2id$v=19$m=65536,t=3,p=4$salt$key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, fmt.Errorf("argon2id: %w", ErrUnsupportedHash)
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, fmt.Errorf("argon2id version %q: %w", parts[2], ErrUnsupportedHash)
+	}
+
+	var memory, iterations uint32
+	var parallelism uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &parallelism); err != nil {
+		return false, fmt.Errorf("argon2id params %q: %w", parts[3], ErrUnsupportedHash)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("argon2id salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("argon2id key: %w", err)
+	}
+
+	actual := argon2.IDKey([]byte(password), salt, iterations, memory, parallelism, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(actual, key) == 1, nil
+}
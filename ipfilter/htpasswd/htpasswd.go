@@ -0,0 +1,249 @@
+// Package htpasswd provides reading and writing of Apache-style htpasswd files
+// with bcrypt and argon2id password hashes.
+package htpasswd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dummyHash is verified when the user does not exist, so that the response time
+// does not reveal which usernames are valid.
+const dummyHash = "$2a$10$ssPKIled2CcVg9Wn776G7exwoz05NqA0LapA9VsEoAOLb6JcpwQt6"
+
+// File is an htpasswd file loaded into memory. It can be reloaded when the file changes.
+type File struct {
+	path string
+
+	mu      sync.RWMutex
+	hashes  map[string]string
+	modTime time.Time
+	size    int64
+}
+
+func Load(path string) (*File, error) {
+	f := &File{
+		path: path,
+	}
+	if _, err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) Path() string {
+	return f.path
+}
+
+// VerifyUnknown takes the time of a password verification. It is called for a user that does not exist.
+func VerifyUnknown(password string) {
+	_, _ = VerifyHash(dummyHash, password)
+}
+
+// Verify reports whether the password of username is correct.
+func (f *File) Verify(username, password string) bool {
+	f.mu.RLock()
+	hash, ok := f.hashes[username]
+	f.mu.RUnlock()
+
+	if !ok {
+		VerifyUnknown(password)
+		return false
+	}
+
+	match, err := VerifyHash(hash, password)
+	if err != nil {
+		log.Printf("htpasswd: user %v: %v", username, err)
+		return false
+	}
+	return match
+}
+
+// Usernames returns the sorted names of all users.
+func (f *File) Usernames() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	usernames := make([]string, 0, len(f.hashes))
+	for username := range f.hashes {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// Reload reads the file again when its modification time or size has changed.
+// It reports whether the file has been reloaded. On error the previous content is kept.
+func (f *File) Reload() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, fmt.Errorf("os.Stat(): %w", err)
+	}
+
+	f.mu.RLock()
+	unchanged := f.hashes != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size
+	f.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, fmt.Errorf("os.ReadFile(): %w", err)
+	}
+
+	hashes, err := parse(data)
+	if err != nil {
+		return false, fmt.Errorf("%v: %w", f.path, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.hashes = hashes
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+
+	return true, nil
+}
+
+func parse(data []byte) (map[string]string, error) {
+	hashes := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || len(username) == 0 || len(hash) == 0 {
+			return nil, fmt.Errorf("line %d: expected username:hash", lineNo)
+		}
+		hashes[username] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanner.Scan(): %w", err)
+	}
+
+	return hashes, nil
+}
+
+// SetUser adds username with hash to the file at path or updates the hash of an
+// existing user. The file is created when it does not exist. Comments and the
+// order of the other lines are kept.
+func SetUser(path, username, hash string) error {
+	if len(username) == 0 || strings.ContainsAny(username, ":\n") {
+		return fmt.Errorf("invalid username %q", username)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("os.ReadFile(): %w", err)
+	}
+
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	}
+
+	found := false
+	for i, line := range lines {
+		if name, _, ok := strings.Cut(strings.TrimSpace(line), ":"); ok && name == username {
+			lines[i] = username + ":" + hash
+			found = true
+		}
+	}
+	if !found {
+		lines = append(lines, username+":"+hash)
+	}
+
+	return writeFileAtomic(path, []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp(): %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o600); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("chmod: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("os.Rename(): %w", err)
+	}
+	return nil
+}
+
+// RunWatchTask reloads the file every interval when it has changed. onRemove, when not nil, is called
+// for every user removed from the file, e.g. to revoke the sessions of that user.
+func RunWatchTask(ctx context.Context, wg *sync.WaitGroup, file *File, interval time.Duration,
+	onRemove func(username string),
+) {
+	wg.Add(1)
+	go runWatchTask(ctx, wg, file, interval, onRemove)
+}
+
+func runWatchTask(ctx context.Context, wg *sync.WaitGroup, file *File, interval time.Duration,
+	onRemove func(username string),
+) {
+	defer wg.Done()
+
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+
+		usernames := file.Usernames()
+		reloaded, err := file.Reload()
+		if err != nil {
+			log.Printf("htpasswd: %v", err)
+			continue
+		}
+		if !reloaded {
+			continue
+		}
+		log.Printf("htpasswd: reloaded %v", file.Path())
+
+		if onRemove == nil {
+			continue
+		}
+		for _, username := range usernames {
+			if !file.exists(username) {
+				onRemove(username)
+			}
+		}
+	}
+}
+
+func (f *File) exists(username string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	_, ok := f.hashes[username]
+	return ok
+}
@@ -0,0 +1,207 @@
+package htpasswd_test
+
+import (
+	"context"
+	"errors"
+	"github.com/dkarczmarski/gomisc/ipfilter/htpasswd"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testArgon2idParams = htpasswd.Argon2idParams{
+	Memory:      1024,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func TestVerifyHash(t *testing.T) {
+	bcryptHash, err := htpasswd.HashBcrypt("secret", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2idHash, err := htpasswd.HashArgon2id("secret", testArgon2idParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name          string
+		hash          string
+		password      string
+		expectedMatch bool
+		expectedErr   func(err error) bool
+	}{
+		{
+			name:          "bcrypt $2y$",
+			hash:          bcryptHash,
+			password:      "secret",
+			expectedMatch: true,
+			expectedErr:   noError,
+		},
+		{
+			name:        "bcrypt $2y$ wrong password",
+			hash:        bcryptHash,
+			password:    "wrong",
+			expectedErr: noError,
+		},
+		{
+			name:          "bcrypt $2b$",
+			hash:          "$2b$" + strings.TrimPrefix(bcryptHash, "$2y$"),
+			password:      "secret",
+			expectedMatch: true,
+			expectedErr:   noError,
+		},
+		{
+			name:          "argon2id",
+			hash:          argon2idHash,
+			password:      "secret",
+			expectedMatch: true,
+			expectedErr:   noError,
+		},
+		{
+			name:        "argon2id wrong password",
+			hash:        argon2idHash,
+			password:    "wrong",
+			expectedErr: noError,
+		},
+		{
+			name:     "md5 is not supported",
+			hash:     "$apr1$k0YIdHgs$yCZPj3LxBbMWkNzUkQUBf0",
+			password: "secret",
+			expectedErr: func(err error) bool {
+				return errors.Is(err, htpasswd.ErrUnsupportedHash)
+			},
+		},
+		{
+			name:     "plaintext is not supported",
+			hash:     "secret",
+			password: "secret",
+			expectedErr: func(err error) bool {
+				return errors.Is(err, htpasswd.ErrUnsupportedHash)
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			match, err := htpasswd.VerifyHash(tt.hash, tt.password)
+			if !tt.expectedErr(err) {
+				t.Fatalf("expected error is not satisfied: %v", err)
+			}
+			if match != tt.expectedMatch {
+				t.Errorf("match: %v, expected: %v", match, tt.expectedMatch)
+			}
+		})
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+
+	aliceHash, _ := htpasswd.HashBcrypt("alice-secret", 4)
+	if err := os.WriteFile(path, []byte("# users\nalice:"+aliceHash+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := htpasswd.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !file.Verify("alice", "alice-secret") || file.Verify("alice", "wrong") || file.Verify("bob", "bob-secret") {
+		t.Fatal("unexpected verification result")
+	}
+
+	// a file without changes is not reloaded
+	if reloaded, err := file.Reload(); err != nil || reloaded {
+		t.Fatalf("unexpected reload: %v %v", reloaded, err)
+	}
+
+	bobHash, _ := htpasswd.HashArgon2id("bob-secret", testArgon2idParams)
+	if err := htpasswd.SetUser(path, "bob", bobHash); err != nil {
+		t.Fatal(err)
+	}
+	newAliceHash, _ := htpasswd.HashBcrypt("alice-new", 4)
+	if err := htpasswd.SetUser(path, "alice", newAliceHash); err != nil {
+		t.Fatal(err)
+	}
+	// make sure the modification time differs on file systems with coarse timestamps
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(path, future, future)
+
+	if reloaded, err := file.Reload(); err != nil || !reloaded {
+		t.Fatalf("expected reload: %v %v", reloaded, err)
+	}
+	if !file.Verify("bob", "bob-secret") || !file.Verify("alice", "alice-new") || file.Verify("alice", "alice-secret") {
+		t.Error("unexpected verification result after reload")
+	}
+	if usernames := file.Usernames(); !reflect.DeepEqual(usernames, []string{"alice", "bob"}) {
+		t.Errorf("unexpected usernames: %v", usernames)
+	}
+
+	data, _ := os.ReadFile(path)
+	expected := "# users\nalice:" + newAliceHash + "\nbob:" + bobHash + "\n"
+	if string(data) != expected {
+		t.Errorf("file\nactual:   %q\nexpected: %q", data, expected)
+	}
+}
+
+func TestLoad_InvalidLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte("alice\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := htpasswd.Load(path); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestRunWatchTask_RemovedUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	aliceHash, _ := htpasswd.HashBcrypt("alice-secret", 4)
+	bobHash, _ := htpasswd.HashBcrypt("bob-secret", 4)
+	if err := os.WriteFile(path, []byte("alice:"+aliceHash+"\nbob:"+bobHash+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := htpasswd.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	removed := make(chan string, 2)
+	htpasswd.RunWatchTask(ctx, &wg, file, 10*time.Millisecond, func(username string) {
+		removed <- username
+	})
+	defer wg.Wait()
+	defer cancel()
+
+	if err := os.WriteFile(path, []byte("alice:"+aliceHash+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(path, future, future)
+
+	select {
+	case username := <-removed:
+		if username != "bob" {
+			t.Errorf("removed: %v", username)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("removed user not reported")
+	}
+	if file.Verify("bob", "bob-secret") {
+		t.Error("removed user verified")
+	}
+}
+
+func noError(err error) bool {
+	return err == nil
+}
@@ -0,0 +1,400 @@
+package htserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/audit"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// EntryResponse is the JSON representation of a firewall entry.
+type EntryResponse struct {
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	TTLSeconds int64     `json:"ttl_seconds,omitempty"`
+	Owner      string    `json:"owner,omitempty"`
+	Label      string    `json:"label,omitempty"`
+}
+
+type EntriesResponse struct {
+	Entries []EntryResponse `json:"entries"`
+}
+
+type MeResponse struct {
+	IP    string         `json:"ip"`
+	Entry *EntryResponse `json:"entry"`
+}
+
+type EntryRequest struct {
+	IP         string `json:"ip"`
+	TTLSeconds int64  `json:"ttl_seconds,omitempty"`
+	Label      string `json:"label,omitempty"`
+}
+
+type MeRequest struct {
+	TTLSeconds int64  `json:"ttl_seconds,omitempty"`
+	Label      string `json:"label,omitempty"`
+}
+
+type SessionResponse struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	RemoteAddr string    `json:"remote_addr"`
+	UserAgent  string    `json:"user_agent"`
+	Remember   bool      `json:"remember"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type SessionsResponse struct {
+	Sessions []SessionResponse `json:"sessions"`
+}
+
+type LockoutResponse struct {
+	// Kind is 'user' or 'ip'.
+	Kind        string    `json:"kind"`
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+type LockoutsResponse struct {
+	Lockouts []LockoutResponse `json:"lockouts"`
+}
+
+type AuditEventsResponse struct {
+	Events []audit.Event `json:"events"`
+}
+
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func newEntryResponse(entry firewall.IPEntry, defaultTTL time.Duration) EntryResponse {
+	return EntryResponse{
+		IP:         entry.IP,
+		CreatedAt:  entry.CreatedAt,
+		UpdatedAt:  entry.UpdatedAt,
+		ExpiresAt:  entry.ExpiresAt(defaultTTL),
+		TTLSeconds: int64(entry.TTL / time.Second),
+		Owner:      entry.Owner,
+		Label:      entry.Label,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(fmt.Errorf("json.Encode(): %w", err))
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, ErrorResponse{
+		Error: ErrorBody{
+			Code:    code,
+			Message: message,
+		},
+	})
+}
+
+// writeServiceError writes the JSON error body for an error returned by the firewall service.
+func writeServiceError(w http.ResponseWriter, err error) {
+	status := errorStatus(err)
+	switch {
+	case errors.Is(err, firewall.ErrIncorrectIP):
+		writeJSONError(w, status, "incorrect_ip", err.Error())
+	case errors.Is(err, errUnknownCallerIP):
+		writeJSONError(w, status, "unknown_caller_ip", errUnknownCallerIP.Error())
+	case errors.Is(err, firewall.ErrIPNotFound):
+		writeJSONError(w, status, "ip_not_found", err.Error())
+	case errors.Is(err, firewall.ErrRequestNotFound):
+		writeJSONError(w, status, "request_not_found", err.Error())
+	case errors.Is(err, firewall.ErrIPNotAllowed):
+		writeJSONError(w, status, "ip_not_allowed", err.Error())
+	case errors.Is(err, firewall.ErrTTLNotAllowed):
+		writeJSONError(w, status, "ttl_not_allowed", err.Error())
+	case errors.Is(err, errForbidden):
+		writeJSONError(w, status, "forbidden", err.Error())
+	default:
+		log.Println(err)
+		writeJSONError(w, status, "internal_error", http.StatusText(status))
+	}
+}
+
+// apiUnauthorized reports an authentication failure as a JSON error body.
+func apiUnauthorized(w http.ResponseWriter, _ *http.Request, err error) {
+	switch {
+	case errors.Is(err, auth.ErrInvalidAuthHeader):
+		writeJSONError(w, http.StatusBadRequest, "invalid_auth_header", err.Error())
+		return
+	case errors.Is(err, auth.ErrLockedOut):
+		setRetryAfter(w, err)
+		writeJSONError(w, http.StatusTooManyRequests, "locked_out", err.Error())
+		return
+	case errors.Is(err, auth.ErrTOTPRequired):
+		writeJSONError(w, http.StatusUnauthorized, "totp_required", "totp code required in the "+auth.TOTPHeaderName+" header")
+		return
+	case errors.Is(err, auth.ErrIncorrectTOTP):
+		writeJSONError(w, http.StatusUnauthorized, "incorrect_totp", err.Error())
+		return
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+	writeJSONError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+}
+
+func HandleAPIListEntries(w http.ResponseWriter, r *http.Request, service Firewall) {
+	entries := visibleEntries(auth.UserFromContext(r.Context()), service.List())
+	defaultTTL := service.DefaultTTL()
+
+	resp := EntriesResponse{
+		Entries: make([]EntryResponse, len(entries)),
+	}
+	for i, entry := range entries {
+		resp.Entries[i] = newEntryResponse(entry, defaultTTL)
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// maxTTLSeconds is the longest ttl_seconds a time.Duration holds. A longer one would overflow,
+// e.g. to a short TTL, and pass the MaxTTL of the policy.
+const maxTTLSeconds = math.MaxInt64 / int64(time.Second)
+
+// ttlFromSeconds converts the ttl_seconds field of a request.
+func ttlFromSeconds(seconds int64) (time.Duration, error) {
+	switch {
+	case seconds < 0:
+		return 0, errors.New("negative ttl_seconds")
+	case seconds > maxTTLSeconds:
+		return 0, fmt.Errorf("ttl_seconds above %d", maxTTLSeconds)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+func HandleAPIAddEntry(w http.ResponseWriter, r *http.Request, service Firewall) {
+	var req EntryRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	if len(req.IP) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", "no field: ip")
+		return
+	}
+	ttl, err := ttlFromSeconds(req.TTLSeconds)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	if len(req.Label) > maxLabelLength {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", fmt.Sprintf("label longer than %d characters", maxLabelLength))
+		return
+	}
+
+	addEntry(w, r, service, req.IP, ttl, req.Label)
+}
+
+func HandleAPIDeleteEntry(w http.ResponseWriter, r *http.Request, service Firewall) {
+	deleteEntry(w, r, service, r.PathValue("ip"))
+}
+
+func HandleAPIRenewEntry(w http.ResponseWriter, r *http.Request, service Firewall) {
+	ip := r.PathValue("ip")
+	log.Printf("ip: %v", ip)
+
+	if err := service.RenewIPCtx(r.Context(), ip); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	entry, err := service.Find(ip)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newEntryResponse(entry, service.DefaultTTL()))
+}
+
+func HandleAPIGetMe(w http.ResponseWriter, r *http.Request, service Firewall) {
+	ip, err := remoteIP(r)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	resp := MeResponse{IP: ip}
+
+	entry, err := service.Find(ip)
+	switch {
+	case err == nil:
+		entryResp := newEntryResponse(entry, service.DefaultTTL())
+		resp.Entry = &entryResp
+	case !errors.Is(err, firewall.ErrIPNotFound):
+		writeServiceError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func HandleAPIAddMe(w http.ResponseWriter, r *http.Request, service Firewall) {
+	ip, err := remoteIP(r)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	// the body is optional
+	var req MeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	ttl, err := ttlFromSeconds(req.TTLSeconds)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	if len(req.Label) > maxLabelLength {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", fmt.Sprintf("label longer than %d characters", maxLabelLength))
+		return
+	}
+
+	addEntry(w, r, service, ip, ttl, req.Label)
+}
+
+func HandleAPIDeleteMe(w http.ResponseWriter, r *http.Request, service Firewall) {
+	ip, err := remoteIP(r)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	deleteEntry(w, r, service, ip)
+}
+
+func addEntry(w http.ResponseWriter, r *http.Request, service Firewall, ip string, ttl time.Duration, label string) {
+	log.Printf("ip: %v", ip)
+
+	_, findErr := service.Find(ip)
+
+	if err := service.AddIPCtx(r.Context(), ip, firewall.WithTTL(ttl), firewall.WithOwner(username(r)), firewall.WithLabel(label)); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	entry, err := service.Find(ip)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if errors.Is(findErr, firewall.ErrIPNotFound) {
+		status = http.StatusCreated
+	}
+
+	writeJSON(w, status, newEntryResponse(entry, service.DefaultTTL()))
+}
+
+func deleteEntry(w http.ResponseWriter, r *http.Request, service Firewall, ip string) {
+	log.Printf("ip: %v", ip)
+
+	if err := service.DeleteIPCtx(r.Context(), ip); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func HandleAPIListSessions(w http.ResponseWriter, _ *http.Request, sessions *auth.Sessions) {
+	list := sessions.List()
+
+	resp := SessionsResponse{
+		Sessions: make([]SessionResponse, 0, len(list)),
+	}
+	for _, session := range list {
+		resp.Sessions = append(resp.Sessions, SessionResponse{
+			ID:         session.ID,
+			Username:   session.Username,
+			RemoteAddr: session.RemoteAddr,
+			UserAgent:  session.UserAgent,
+			Remember:   session.Remember,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			ExpiresAt:  session.ExpiresAt,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func HandleAPIRevokeSession(w http.ResponseWriter, r *http.Request, sessions *auth.Sessions, trail *audit.Trail) {
+	id := r.PathValue("id")
+	err := sessions.Revoke(id)
+	recordEvent(trail, r, "session.revoke", id, err)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "session_not_found", err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func HandleAPIListAudit(w http.ResponseWriter, _ *http.Request, trail *audit.Trail) {
+	writeJSON(w, http.StatusOK, AuditEventsResponse{
+		Events: trail.List(),
+	})
+}
+
+func HandleAPIListLockouts(w http.ResponseWriter, _ *http.Request, lockout *auth.Lockout) {
+	list := lockout.List()
+
+	resp := LockoutsResponse{
+		Lockouts: make([]LockoutResponse, 0, len(list)),
+	}
+	for _, entry := range list {
+		resp.Lockouts = append(resp.Lockouts, LockoutResponse{
+			Kind:        entry.Kind,
+			Key:         entry.Key,
+			Failures:    entry.Failures,
+			LastFailure: entry.LastFailure,
+			LockedUntil: entry.LockedUntil,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func HandleAPIUnlock(w http.ResponseWriter, r *http.Request, lockout *auth.Lockout, trail *audit.Trail) {
+	kind, key := r.PathValue("kind"), r.PathValue("key")
+	err := lockout.Unlock(kind, key)
+	recordEvent(trail, r, "lockout.unlock", kind+":"+key, err)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "lockout_not_found", err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
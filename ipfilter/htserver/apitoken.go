@@ -0,0 +1,198 @@
+package htserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/audit"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"log"
+	"net/http"
+	"time"
+)
+
+// APITokenResponse is the JSON representation of a personal API token, without the token itself.
+type APITokenResponse struct {
+	ID         string     `json:"id"`
+	Username   string     `json:"username"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+type APITokensResponse struct {
+	Tokens []APITokenResponse `json:"tokens"`
+}
+
+type APITokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// TTLSeconds is the lifetime of the token. Zero creates a token without expiry.
+	TTLSeconds int64 `json:"ttl_seconds,omitempty"`
+}
+
+// CreatedAPITokenResponse carries the token, which is shown only once.
+type CreatedAPITokenResponse struct {
+	APITokenResponse
+	Token string `json:"token"`
+}
+
+func newAPITokenResponse(apiToken auth.APIToken) APITokenResponse {
+	resp := APITokenResponse{
+		ID:        apiToken.ID,
+		Username:  apiToken.Username,
+		Name:      apiToken.Name,
+		Scopes:    apiToken.Scopes,
+		CreatedAt: apiToken.CreatedAt,
+	}
+	if !apiToken.ExpiresAt.IsZero() {
+		resp.ExpiresAt = &apiToken.ExpiresAt
+	}
+	if !apiToken.LastUsedAt.IsZero() {
+		resp.LastUsedAt = &apiToken.LastUsedAt
+	}
+	return resp
+}
+
+// requireScope calls forbidden instead of the next handler when the user's API token has not the scope.
+func requireScope(scope string, trail *audit.Trail, forbidden func(w http.ResponseWriter, r *http.Request, err error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user := auth.UserFromContext(r.Context()); !user.HasScope(scope) {
+				err := fmt.Errorf("%v %v requires token scope %v: %w", r.Method, r.URL.Path, scope, errForbidden)
+				recordEvent(trail, r, "access", r.URL.Path, err)
+				forbidden(w, r, err)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// visibleAPITokens returns the tokens of the user, or of all users for admins.
+func visibleAPITokens(user *auth.User, apiTokens *auth.APITokens) []auth.APIToken {
+	if user.HasRole(auth.RoleAdmin) {
+		return apiTokens.List("")
+	}
+	return apiTokens.List(user.Username)
+}
+
+// revokeAPIToken revokes the token of the user. Admins can revoke the tokens of all users.
+func revokeAPIToken(r *http.Request, apiTokens *auth.APITokens, trail *audit.Trail, id string) error {
+	err := func() error {
+		apiToken, err := apiTokens.Get(id)
+		if err != nil {
+			return err
+		}
+		if user := auth.UserFromContext(r.Context()); apiToken.Username != user.Username && !user.HasRole(auth.RoleAdmin) {
+			return fmt.Errorf("token %v of %v: %w", id, apiToken.Username, errForbidden)
+		}
+		return apiTokens.Revoke(id)
+	}()
+	recordEvent(trail, r, "token.revoke", id, err)
+	return err
+}
+
+func HandleCreateAPIToken(w http.ResponseWriter, r *http.Request, apiTokens *auth.APITokens, templates *Templates, trail *audit.Trail) {
+	if err := r.ParseForm(); err != nil {
+		redirectWithFlash(w, r, flashError, "Invalid form")
+		return
+	}
+
+	var ttl time.Duration
+	if value := r.PostFormValue("ttl"); len(value) > 0 {
+		var err error
+		if ttl, err = time.ParseDuration(value); err != nil || ttl < 0 {
+			redirectWithFlash(w, r, flashError, "Incorrect expiry")
+			return
+		}
+	}
+
+	token, apiToken, err := apiTokens.Create(username(r), r.PostFormValue("name"), r.PostForm["scope"], ttl)
+	recordEvent(trail, r, "token.create", apiToken.ID, err)
+	if err != nil {
+		redirectWithFlash(w, r, flashError, err.Error())
+		return
+	}
+
+	// the token is shown only once
+	w.Header().Set("Cache-Control", "no-store")
+	templates.Render(w, http.StatusOK, "token.html", map[string]interface{}{
+		"Token":    token,
+		"APIToken": apiToken,
+	})
+}
+
+func HandleRevokeAPIToken(w http.ResponseWriter, r *http.Request, apiTokens *auth.APITokens, trail *audit.Trail) {
+	id := r.FormValue("id")
+	if len(id) == 0 {
+		log.Println("no param: id")
+		redirectWithFlash(w, r, flashError, "No token selected")
+		return
+	}
+
+	if err := revokeAPIToken(r, apiTokens, trail, id); err != nil {
+		message := errorMessage(err)
+		if errors.Is(err, auth.ErrAPITokenNotFound) {
+			message = "The token has already been revoked"
+		}
+		redirectWithFlash(w, r, flashError, message)
+		return
+	}
+
+	redirectWithFlash(w, r, flashSuccess, "Token revoked")
+}
+
+func HandleAPIListAPITokens(w http.ResponseWriter, r *http.Request, apiTokens *auth.APITokens) {
+	list := visibleAPITokens(auth.UserFromContext(r.Context()), apiTokens)
+
+	resp := APITokensResponse{
+		Tokens: make([]APITokenResponse, 0, len(list)),
+	}
+	for _, apiToken := range list {
+		resp.Tokens = append(resp.Tokens, newAPITokenResponse(apiToken))
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func HandleAPICreateAPIToken(w http.ResponseWriter, r *http.Request, apiTokens *auth.APITokens, trail *audit.Trail) {
+	var req APITokenRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	ttl, err := ttlFromSeconds(req.TTLSeconds)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+
+	token, apiToken, err := apiTokens.Create(username(r), req.Name, req.Scopes, ttl)
+	recordEvent(trail, r, "token.create", apiToken.ID, err)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, CreatedAPITokenResponse{
+		APITokenResponse: newAPITokenResponse(apiToken),
+		Token:            token,
+	})
+}
+
+func HandleAPIRevokeAPIToken(w http.ResponseWriter, r *http.Request, apiTokens *auth.APITokens, trail *audit.Trail) {
+	if err := revokeAPIToken(r, apiTokens, trail, r.PathValue("id")); err != nil {
+		if errors.Is(err, auth.ErrAPITokenNotFound) {
+			writeJSONError(w, http.StatusNotFound, "token_not_found", err.Error())
+			return
+		}
+		writeServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
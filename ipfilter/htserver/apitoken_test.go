@@ -0,0 +1,183 @@
+package htserver_test
+
+import (
+	"encoding/json"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/htserver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPITokens(t *testing.T) {
+	fixedTime := &firewall.FixedTime{}
+	fixedTime.SetDateTime("2001-01-01 10:00:00")
+
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(nopBackend{}),
+	)
+	users := auth.NewUsers([]auth.User{{Username: "alice", Password: "123"}})
+	apiTokens, err := auth.NewAPITokens(auth.WithAPITokensTimeFunc(fixedTime.TimeFunc()))
+	noError(t, err)
+
+	mux := htserver.NewServeMux(service,
+		htserver.WithUsers(users),
+		htserver.WithAPITokens(apiTokens),
+	)
+
+	// the token is created with basic auth of its user
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/tokens",
+		strings.NewReader(`{"name": "ci", "scopes": ["me:add"], "ttl_seconds": 3600}`))
+	r.SetBasicAuth("alice", "123")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status: %v body: %v", w.Code, w.Body)
+	}
+	var created htserver.CreatedAPITokenResponse
+	noError(t, json.NewDecoder(w.Body).Decode(&created))
+	if created.Username != "alice" || created.ExpiresAt == nil || !strings.HasPrefix(created.Token, auth.APITokenPrefix) {
+		t.Fatalf("unexpected token: %+v", created)
+	}
+
+	// a ttl overflowing the duration would create a token without expiry
+	r = httptest.NewRequest(http.MethodPost, "/api/v1/tokens",
+		strings.NewReader(`{"name": "ci", "scopes": ["me:add"], "ttl_seconds": 9223372036854775807}`))
+	r.SetBasicAuth("alice", "123")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("create with overflowing ttl: status: %v body: %v", w.Code, w.Body)
+	}
+
+	// the steps share the state of the token
+	for _, tt := range []struct {
+		name           string
+		at             string
+		method         string
+		path           string
+		expectedStatus int
+	}{
+		{
+			name:           "form without csrf token",
+			at:             "2001-01-01 10:00:00",
+			method:         http.MethodPost,
+			path:           "/api/me/add",
+			expectedStatus: http.StatusSeeOther,
+		},
+		{
+			name:           "api with scope",
+			at:             "2001-01-01 10:00:00",
+			method:         http.MethodPost,
+			path:           "/api/v1/me",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "api without scope",
+			at:             "2001-01-01 10:00:00",
+			method:         http.MethodGet,
+			path:           "/api/v1/entries",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "form without scope",
+			at:             "2001-01-01 10:00:00",
+			method:         http.MethodPost,
+			path:           "/api/me/delete",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "token management",
+			at:             "2001-01-01 10:00:00",
+			method:         http.MethodGet,
+			path:           "/api/v1/tokens",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "expired token",
+			at:             "2001-01-01 11:00:00",
+			method:         http.MethodPost,
+			path:           "/api/v1/me",
+			expectedStatus: http.StatusUnauthorized,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fixedTime.SetDateTime(tt.at)
+
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.Header.Set("Authorization", "Bearer "+created.Token)
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("status: actual: %v expected: %v body: %v", w.Code, tt.expectedStatus, w.Body)
+			}
+		})
+	}
+
+	// the entry is owned by the user of the token
+	if entries := service.List(); len(entries) != 1 || entries[0].Owner != "alice" {
+		t.Errorf("unexpected entries: %+v", entries)
+	}
+
+	r = httptest.NewRequest(http.MethodDelete, "/api/v1/tokens/"+created.ID, nil)
+	r.SetBasicAuth("alice", "123")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent || len(apiTokens.List("")) != 0 {
+		t.Errorf("revoke: status: %v body: %v", w.Code, w.Body)
+	}
+}
+
+func TestAPITokens_RemovedUser(t *testing.T) {
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(nopBackend{}),
+	)
+	users := auth.NewUsers([]auth.User{{Username: "alice", Password: "123"}})
+	apiTokens, err := auth.NewAPITokens(auth.WithAPITokensUserFunc(users.Exists))
+	noError(t, err)
+	token, _, err := apiTokens.Create("alice", "ci", []string{auth.ScopeAll}, 0)
+	noError(t, err)
+
+	mux := htserver.NewServeMux(service,
+		htserver.WithUsers(users),
+		htserver.WithAPITokens(apiTokens),
+	)
+
+	for _, tt := range []struct {
+		name           string
+		users          []auth.User
+		expectedStatus int
+	}{
+		{
+			name:           "existing user",
+			users:          []auth.User{{Username: "alice", Password: "123"}},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "removed user",
+			users:          []auth.User{{Username: "bob", Password: "123"}},
+			expectedStatus: http.StatusUnauthorized,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			users.Set(tt.users)
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/entries", nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("status: actual: %v expected: %v body: %v", w.Code, tt.expectedStatus, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package htserver
+
+import (
+	"context"
+	"errors"
+	"github.com/dkarczmarski/gomisc/ipfilter/audit"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/realip"
+	"net/http"
+	"time"
+)
+
+// auditedFirewall records the changes of the entries made by the users in the audit trail.
+type auditedFirewall struct {
+	Firewall
+	trail *audit.Trail
+}
+
+func (f auditedFirewall) AddIPCtx(ctx context.Context, ip string, opts ...firewall.EntryOption) error {
+	err := f.Firewall.AddIPCtx(ctx, ip, opts...)
+	f.record(ctx, "entry.add", ip, err)
+	return err
+}
+
+func (f auditedFirewall) DeleteIPCtx(ctx context.Context, ip string) error {
+	err := f.Firewall.DeleteIPCtx(ctx, ip)
+	f.record(ctx, "entry.delete", ip, err)
+	return err
+}
+
+func (f auditedFirewall) RenewIPCtx(ctx context.Context, ip string) error {
+	err := f.Firewall.RenewIPCtx(ctx, ip)
+	f.record(ctx, "entry.renew", ip, err)
+	return err
+}
+
+func (f auditedFirewall) ExtendIPCtx(ctx context.Context, ip string, duration time.Duration) error {
+	err := f.Firewall.ExtendIPCtx(ctx, ip, duration)
+	f.record(ctx, "entry.extend", ip, err)
+	return err
+}
+
+func (f auditedFirewall) RequestIPCtx(ctx context.Context, ip, reason string, opts ...firewall.EntryOption) (firewall.AccessRequest, error) {
+	request, err := f.Firewall.RequestIPCtx(ctx, ip, reason, opts...)
+	f.record(ctx, "request.create", ip, err)
+	return request, err
+}
+
+func (f auditedFirewall) ApproveRequestCtx(ctx context.Context, id, approver string) (firewall.IPEntry, error) {
+	target := f.requestTarget(id)
+	entry, err := f.Firewall.ApproveRequestCtx(ctx, id, approver)
+	f.record(ctx, "request.approve", target, err)
+	return entry, err
+}
+
+func (f auditedFirewall) RejectRequestCtx(ctx context.Context, id, rejecter string) (firewall.AccessRequest, error) {
+	target := f.requestTarget(id)
+	request, err := f.Firewall.RejectRequestCtx(ctx, id, rejecter)
+	f.record(ctx, "request.reject", target, err)
+	return request, err
+}
+
+// requestTarget returns the IP of the access request, or its ID when it is not found.
+func (f auditedFirewall) requestTarget(id string) string {
+	if request, err := f.FindRequest(id); err == nil {
+		return request.IP
+	}
+	return id
+}
+
+func (f auditedFirewall) record(ctx context.Context, action, target string, err error) {
+	event := audit.Event{
+		RemoteAddr: realip.FromContext(ctx),
+		Action:     action,
+		Target:     target,
+		Result:     audit.ResultOK,
+		RequestID:  RequestIDFromContext(ctx),
+	}
+	if user := auth.UserFromContext(ctx); user != nil {
+		event.User = user.Username
+	}
+	switch {
+	case errors.Is(err, errForbidden):
+		event.Result = audit.ResultDenied
+		event.Detail = err.Error()
+	case err != nil:
+		event.Result = audit.ResultError
+		event.Detail = err.Error()
+	}
+
+	f.trail.Record(event)
+}
+
+// recordEvent records an action of the request's user.
+func recordEvent(trail *audit.Trail, r *http.Request, action, target string, err error) {
+	event := audit.Event{
+		RemoteAddr: realip.FromRequest(r),
+		Action:     action,
+		Target:     target,
+		Result:     audit.ResultOK,
+		RequestID:  RequestIDFromContext(r.Context()),
+	}
+	if user := auth.UserFromContext(r.Context()); user != nil {
+		event.User = user.Username
+	}
+	switch {
+	case errors.Is(err, errForbidden):
+		event.Result = audit.ResultDenied
+		event.Detail = err.Error()
+	case err != nil:
+		event.Result = audit.ResultError
+		event.Detail = err.Error()
+	}
+
+	trail.Record(event)
+}
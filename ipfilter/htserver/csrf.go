@@ -0,0 +1,136 @@
+package htserver
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+const (
+	csrfCookieName = "ipfilter_csrf"
+	// CSRFFieldName is the form field with the CSRF token.
+	CSRFFieldName = "csrf_token"
+	// CSRFHeaderName can be used instead of the form field, e.g. by scripts in the page.
+	CSRFHeaderName = "X-CSRF-Token"
+
+	csrfTokenLength = 32
+)
+
+var (
+	errCrossOrigin  = errors.New("cross-origin request")
+	errInvalidToken = errors.New("missing or invalid csrf token")
+)
+
+// csrfToken returns the CSRF token of the browser, setting a new token cookie when there is none.
+// The token is double-submitted: the form field must match the cookie.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookieName); err == nil && validCSRFToken(cookie.Value) {
+		return cookie.Value
+	}
+
+	b := make([]byte, csrfTokenLength)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("rand.Read(): %w", err))
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return token
+}
+
+func validCSRFToken(token string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	return err == nil && len(b) == csrfTokenLength
+}
+
+// checkOrigin rejects requests which the browser marks as sent from another site.
+// Requests without the Origin and Sec-Fetch-Site headers (e.g. from scripts) are accepted.
+func checkOrigin(r *http.Request) error {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return errCrossOrigin
+	}
+
+	if origin := r.Header.Get("Origin"); len(origin) > 0 {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			return errCrossOrigin
+		}
+	}
+
+	return nil
+}
+
+// checkCSRFToken compares the token sent in the form field or the header with the cookie.
+func checkCSRFToken(r *http.Request) error {
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || !validCSRFToken(cookie.Value) {
+		return errInvalidToken
+	}
+
+	token := r.Header.Get(CSRFHeaderName)
+	if len(token) == 0 {
+		token = r.PostFormValue(CSRFFieldName)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+		return errInvalidToken
+	}
+
+	return nil
+}
+
+// csrfProtect protects the state-changing form routes with the origin check and the CSRF token.
+// Requests authenticated by a bearer token, e.g. scripts using an API token, are not checked.
+// A bearer header alone does not skip the check, as the session cookie can authenticate the request.
+func csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := auth.UserFromContext(r.Context()); user != nil && user.BearerToken {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		err := checkOrigin(r)
+		if err == nil {
+			err = checkCSRFToken(r)
+		}
+		if err != nil {
+			log.Printf("%v %v rejected: %v", r.Method, r.URL.Path, err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiOriginProtect rejects cross-origin state-changing API requests, which a browser
+// could send with the session cookie. Scripts do not send the checked headers.
+func apiOriginProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if err := checkOrigin(r); err != nil {
+				log.Printf("%v %v rejected: %v", r.Method, r.URL.Path, err)
+				writeJSONError(w, http.StatusForbidden, "cross_origin", err.Error())
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
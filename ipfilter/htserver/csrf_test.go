@@ -0,0 +1,233 @@
+package htserver_test
+
+import (
+	"context"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/htserver"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type nopBackend struct{}
+
+func (nopBackend) Allow(_ context.Context, _ string) error  { return nil }
+func (nopBackend) Revoke(_ context.Context, _ string) error { return nil }
+
+// a valid token: base64 of 32 bytes
+const (
+	csrfToken      = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8"
+	otherCSRFToken = "HyAhIiMkJSYnKCkqKywtLi8wMTIzNDU2Nzg5Ojs8PT4"
+)
+
+func newTestMux() *htserver.ServeMux {
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(nopBackend{}),
+	)
+	users := auth.NewUsers([]auth.User{{Username: "admin", Password: "123"}})
+
+	return htserver.NewServeMux(service, htserver.WithUsers(users), htserver.WithRoles(auth.NewRoles(nil, auth.RoleAdmin)))
+}
+
+func TestCSRF(t *testing.T) {
+	mux := newTestMux()
+
+	for _, tt := range []struct {
+		name           string
+		method         string
+		path           string
+		cookie         string
+		field          string
+		header         string
+		headers        map[string]string
+		expectedStatus int
+	}{
+		{
+			name:           "form without token",
+			path:           "/api/ip/add",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "form with token field but without cookie",
+			path:           "/api/ip/add",
+			field:          csrfToken,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "form with cookie but without token field",
+			path:           "/api/ip/add",
+			cookie:         csrfToken,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "form with mismatched token",
+			path:           "/api/ip/add",
+			cookie:         csrfToken,
+			field:          otherCSRFToken,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "form with invalid cookie value",
+			path:           "/api/ip/add",
+			cookie:         "abc",
+			field:          "abc",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "form with token",
+			path:           "/api/ip/add",
+			cookie:         csrfToken,
+			field:          csrfToken,
+			expectedStatus: http.StatusSeeOther,
+		},
+		{
+			name:           "form with token in header",
+			path:           "/api/ip/add",
+			cookie:         csrfToken,
+			header:         csrfToken,
+			expectedStatus: http.StatusSeeOther,
+		},
+		{
+			name:           "form with token from the same origin",
+			path:           "/api/ip/add",
+			cookie:         csrfToken,
+			field:          csrfToken,
+			headers:        map[string]string{"Origin": "http://ipfilter.test", "Sec-Fetch-Site": "same-origin"},
+			expectedStatus: http.StatusSeeOther,
+		},
+		{
+			name:           "form with token from another origin",
+			path:           "/api/ip/add",
+			cookie:         csrfToken,
+			field:          csrfToken,
+			headers:        map[string]string{"Origin": "http://evil.test"},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "form with token from another site",
+			path:           "/api/ip/delete",
+			cookie:         csrfToken,
+			field:          csrfToken,
+			headers:        map[string]string{"Sec-Fetch-Site": "cross-site"},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "me without token",
+			path:           "/api/me/add",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "login without token",
+			path:           "/login",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "logout without token",
+			path:           "/logout",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "session revoke without token",
+			path:           "/api/sessions/revoke",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "api without origin",
+			path:           "/api/v1/me",
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "api from another origin",
+			path:           "/api/v1/me",
+			headers:        map[string]string{"Origin": "http://evil.test"},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "api delete from another site",
+			method:         http.MethodDelete,
+			path:           "/api/v1/me",
+			headers:        map[string]string{"Sec-Fetch-Site": "same-site"},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "api read from another origin",
+			method:         http.MethodGet,
+			path:           "/api/v1/me",
+			headers:        map[string]string{"Origin": "http://evil.test"},
+			expectedStatus: http.StatusOK,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if len(method) == 0 {
+				method = http.MethodPost
+			}
+
+			var body string
+			if !strings.HasPrefix(tt.path, "/api/v1/") {
+				form := url.Values{"ip": {"10.0.0.1"}}
+				if len(tt.field) > 0 {
+					form.Set(htserver.CSRFFieldName, tt.field)
+				}
+				body = form.Encode()
+			}
+
+			r := httptest.NewRequest(method, "http://ipfilter.test"+tt.path, strings.NewReader(body))
+			if len(body) > 0 {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			r.SetBasicAuth("admin", "123")
+			if len(tt.cookie) > 0 {
+				r.AddCookie(&http.Cookie{Name: "ipfilter_csrf", Value: tt.cookie})
+			}
+			if len(tt.header) > 0 {
+				r.Header.Set(htserver.CSRFHeaderName, tt.header)
+			}
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("status: actual: %v expected: %v", w.Code, tt.expectedStatus)
+			}
+		})
+	}
+}
+
+func TestCSRF_BearerHeaderWithSession(t *testing.T) {
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(nopBackend{}),
+	)
+	sessions := auth.NewSessions()
+	mux := htserver.NewServeMux(service,
+		htserver.WithUsers(auth.NewUsers([]auth.User{{Username: "admin", Password: "123"}})),
+		htserver.WithSessions(sessions),
+	)
+
+	w := httptest.NewRecorder()
+	sessions.Create(w, httptest.NewRequest(http.MethodPost, "/login", nil), &auth.User{Username: "admin"}, false)
+
+	// the session authenticates the request, so the bearer header does not skip the check
+	r := httptest.NewRequest(http.MethodPost, "/api/ip/add", strings.NewReader(url.Values{"ip": {"10.0.0.1"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", "Bearer not-a-token")
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	if w.Code != http.StatusForbidden || service.Contains("10.0.0.1") {
+		t.Errorf("status: actual: %v expected: %v", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,92 @@
+package htserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// heartbeatInterval keeps the idle event streams open through the proxies.
+const heartbeatInterval = 30 * time.Second
+
+// HandleAPIEvents streams the changes of the entries visible to the user as Server-Sent Events.
+// The stream starts with an 'entries' event holding all of them, so a reconnecting client
+// gets in sync again. Then 'add', 'renew', 'delete' and 'expire' events hold a single entry.
+func HandleAPIEvents(w http.ResponseWriter, r *http.Request, service *firewall.Service) {
+	user := auth.UserFromContext(r.Context())
+
+	rc := http.NewResponseController(w)
+	// the stream outlives the write timeout of the server
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Println(fmt.Errorf("events: SetWriteDeadline(): %w", err))
+	}
+
+	// subscribed before the entries are listed, so no change is missed
+	events, cancel := service.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// disables the response buffering of nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	entries := visibleEntries(user, service.List())
+	defaultTTL := service.DefaultTTL()
+	resp := EntriesResponse{
+		Entries: make([]EntryResponse, len(entries)),
+	}
+	for i, entry := range entries {
+		resp.Entries[i] = newEntryResponse(entry, defaultTTL)
+	}
+	if err := writeEvent(w, "entries", resp); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				// the client was too slow, it reconnects and gets all entries again
+				return
+			}
+			// the access requests are not entries yet
+			if event.Request != nil || len(visibleEntries(user, []firewall.IPEntry{event.Entry})) == 0 {
+				continue
+			}
+			if err := writeEvent(w, string(event.Type), newEntryResponse(event.Entry, service.DefaultTTL())); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func writeEvent(w io.Writer, name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("json.Marshal(): %w", err)
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+		return fmt.Errorf("events: write: %w", err)
+	}
+	return nil
+}
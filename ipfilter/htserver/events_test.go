@@ -0,0 +1,134 @@
+package htserver_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/htserver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	name string
+	data string
+}
+
+// readEvent reads the next event of the stream, skipping the comments.
+func readEvent(t *testing.T, reader *bufio.Reader) sseEvent {
+	t.Helper()
+
+	var event sseEvent
+	for {
+		line, err := reader.ReadString('\n')
+		noError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case len(line) == 0 && len(event.name) > 0:
+			return event
+		case strings.HasPrefix(line, "event: "):
+			event.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	var fixedTime firewall.FixedTime
+	fixedTime.SetDateTime("2001-01-01 10:00:00")
+
+	service := firewall.NewService(
+		firewall.WithTimeFunc(fixedTime.TimeFunc()),
+		firewall.WithBackend(nopBackend{}),
+		firewall.WithDefaultTTL(time.Minute),
+	)
+	users := auth.NewUsers([]auth.User{
+		{Username: "alice", Password: "123"},
+		{Username: "bob", Password: "123"},
+	})
+	roles := auth.NewRoles(map[string]auth.Role{"alice": auth.RoleSelfService}, auth.RoleAdmin)
+	server := httptest.NewServer(htserver.NewServeMux(service, htserver.WithUsers(users), htserver.WithRoles(roles)))
+	// closed after the streams
+	t.Cleanup(server.Close)
+
+	noError(t, service.AddIP("1.2.3.4", firewall.WithOwner("alice")))
+	noError(t, service.AddIP("2.2.8.8", firewall.WithOwner("bob")))
+
+	subscribe := func(username string) *bufio.Reader {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/api/v1/events", nil)
+		noError(t, err)
+		req.SetBasicAuth(username, "123")
+
+		resp, err := http.DefaultClient.Do(req)
+		noError(t, err)
+		t.Cleanup(func() {
+			_ = resp.Body.Close()
+		})
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("unexpected response: %v %v", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		return bufio.NewReader(resp.Body)
+	}
+
+	alice := subscribe("alice")
+	bob := subscribe("bob")
+
+	// the stream starts with the visible entries
+	var entries htserver.EntriesResponse
+	event := readEvent(t, alice)
+	noError(t, json.Unmarshal([]byte(event.data), &entries))
+	if event.name != "entries" || len(entries.Entries) != 1 || entries.Entries[0].IP != "1.2.3.4" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	event = readEvent(t, bob)
+	noError(t, json.Unmarshal([]byte(event.data), &entries))
+	if event.name != "entries" || len(entries.Entries) != 2 {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+
+	noError(t, service.AddIP("3.3.3.3", firewall.WithOwner("bob")))
+	fixedTime.SetDateTime("2001-01-01 10:00:30")
+	noError(t, service.RenewIPCtx(context.Background(), "1.2.3.4"))
+	noError(t, service.DeleteIP("3.3.3.3"))
+	fixedTime.SetDateTime("2001-01-01 10:01:40")
+	_, err := service.DeleteOutOfDate(time.Minute)
+	noError(t, err)
+
+	for _, tt := range []struct {
+		reader         *bufio.Reader
+		expectedEvents []string
+	}{
+		{
+			// alice does not see the entries of bob
+			reader:         alice,
+			expectedEvents: []string{"renew 1.2.3.4 2001-01-01T10:01:30Z", "expire 1.2.3.4 2001-01-01T10:01:30Z"},
+		},
+		{
+			reader: bob,
+			expectedEvents: []string{
+				"add 3.3.3.3 2001-01-01T10:01:00Z",
+				"renew 1.2.3.4 2001-01-01T10:01:30Z",
+				"delete 3.3.3.3 2001-01-01T10:01:00Z",
+				"expire 1.2.3.4 2001-01-01T10:01:30Z",
+				"expire 2.2.8.8 2001-01-01T10:01:00Z",
+			},
+		},
+	} {
+		for _, expected := range tt.expectedEvents {
+			event := readEvent(t, tt.reader)
+
+			var entry htserver.EntryResponse
+			noError(t, json.Unmarshal([]byte(event.data), &entry))
+			if actual := event.name + " " + entry.IP + " " + entry.ExpiresAt.Format(time.RFC3339); actual != expected {
+				t.Errorf("event: actual: %v expected: %v", actual, expected)
+			}
+		}
+	}
+}
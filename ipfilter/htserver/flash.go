@@ -0,0 +1,67 @@
+package htserver
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+const flashCookieName = "ipfilter_flash"
+
+const (
+	flashSuccess = "success"
+	flashError   = "error"
+)
+
+// flash is a message shown once on the page the user is redirected to.
+type flash struct {
+	// Kind is one of: success, error.
+	Kind    string
+	Message string
+}
+
+// setFlash sets the message shown by the next page.
+func setFlash(w http.ResponseWriter, r *http.Request, kind, message string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(kind + ":" + message)),
+		Path:     "/",
+		MaxAge:   60,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// popFlash returns the message set by setFlash and removes it.
+func popFlash(w http.ResponseWriter, r *http.Request) *flash {
+	cookie, err := r.Cookie(flashCookieName)
+	if err != nil {
+		return nil
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	value, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return nil
+	}
+	kind, message, ok := strings.Cut(string(value), ":")
+	if !ok || kind != flashSuccess && kind != flashError {
+		return nil
+	}
+	return &flash{Kind: kind, Message: message}
+}
+
+// redirectWithFlash sends the browser back to the index page with the message.
+func redirectWithFlash(w http.ResponseWriter, r *http.Request, kind, message string) {
+	setFlash(w, r, kind, message)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -3,91 +3,213 @@ package htserver
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/realip"
 	"log"
-	"net"
 	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Firewall interface {
-	AddIPCtx(ctx context.Context, ip string) error
+	AddIPCtx(ctx context.Context, ip string, opts ...firewall.EntryOption) error
 	DeleteIPCtx(ctx context.Context, ip string) error
+	RenewIPCtx(ctx context.Context, ip string) error
+	ExtendIPCtx(ctx context.Context, ip string, duration time.Duration) error
+	Find(ip string) (firewall.IPEntry, error)
+	List() []firewall.IPEntry
+	DefaultTTL() time.Duration
+	RequestIPCtx(ctx context.Context, ip, reason string, opts ...firewall.EntryOption) (firewall.AccessRequest, error)
+	ApproveRequestCtx(ctx context.Context, id, approver string) (firewall.IPEntry, error)
+	RejectRequestCtx(ctx context.Context, id, rejecter string) (firewall.AccessRequest, error)
+	FindRequest(id string) (firewall.AccessRequest, error)
+	Requests() []firewall.AccessRequest
+}
+
+// errorStatus maps service errors to HTTP status codes.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, firewall.ErrIncorrectIP), errors.Is(err, firewall.ErrTTLNotAllowed),
+		errors.Is(err, errUnknownCallerIP):
+		return http.StatusBadRequest
+	case errors.Is(err, firewall.ErrIPNotAllowed), errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, firewall.ErrIPNotFound), errors.Is(err, firewall.ErrRequestNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// errUnknownCallerIP is returned for a request without the caller's IP, e.g. over the unix socket.
+var errUnknownCallerIP = errors.New("caller IP unknown on the unix socket, pass the ip explicitly")
+
+// remoteIP returns the IP of the request's client, which can come through trusted proxies.
+func remoteIP(r *http.Request) (string, error) {
+	ip := realip.FromRequest(r)
+	if _, err := netip.ParseAddr(ip); err != nil {
+		return "", fmt.Errorf("remote address %q: %w", ip, errUnknownCallerIP)
+	}
+	return ip, nil
+}
+
+// maxLabelLength limits the label of an entry.
+const maxLabelLength = 64
+
+// maxExtendMinutes limits a single extension of an entry to a week.
+const maxExtendMinutes = 7 * 24 * 60
+
+// errorMessage returns the message shown to the user. The internal errors are only logged.
+func errorMessage(err error) string {
+	if errorStatus(err) == http.StatusInternalServerError {
+		return "Internal error, see the server log"
+	}
+	return err.Error()
+}
+
+// formLabel returns the label field of the form.
+func formLabel(r *http.Request) (string, error) {
+	label := strings.TrimSpace(r.FormValue("label"))
+	if len(label) > maxLabelLength {
+		return "", fmt.Errorf("label longer than %d characters", maxLabelLength)
+	}
+	return label, nil
 }
 
 func HandleAddMe(w http.ResponseWriter, r *http.Request, service Firewall) {
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	ip, err := remoteIP(r)
 	if err != nil {
-		log.Println(fmt.Errorf("net.SplitHostPort(): %w", err))
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		redirectWithFlash(w, r, flashError, "Your IP address cannot be determined")
 		return
 	}
 
-	ip := host
 	log.Printf("ip: %v", ip)
 
-	if err := service.AddIPCtx(r.Context(), ip); err != nil {
+	label, err := formLabel(r)
+	if err != nil {
+		redirectWithFlash(w, r, flashError, err.Error())
+		return
+	}
+
+	if err := service.AddIPCtx(r.Context(), ip, firewall.WithOwner(username(r)), firewall.WithLabel(label)); err != nil {
 		log.Println(fmt.Errorf("service.AddIPCtx(): %w", err))
-		w.WriteHeader(http.StatusInternalServerError)
+		redirectWithFlash(w, r, flashError, errorMessage(err))
 		return
 	}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	redirectWithFlash(w, r, flashSuccess, ip+" added")
 }
 
 func HandleDeleteMe(w http.ResponseWriter, r *http.Request, service Firewall) {
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	ip, err := remoteIP(r)
 	if err != nil {
-		log.Println(fmt.Errorf("net.SplitHostPort(): %w", err))
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		redirectWithFlash(w, r, flashError, "Your IP address cannot be determined")
 		return
 	}
 
-	ip := host
 	log.Printf("ip: %v", ip)
 
 	if err := service.DeleteIPCtx(r.Context(), ip); err != nil {
 		log.Println(fmt.Errorf("service.DeleteIPCtx(): %w", err))
-		w.WriteHeader(http.StatusInternalServerError)
+		redirectWithFlash(w, r, flashError, errorMessage(err))
 		return
 	}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	redirectWithFlash(w, r, flashSuccess, ip+" deleted")
 }
 
 func HandleAddIP(w http.ResponseWriter, r *http.Request, service Firewall) {
-	ip := r.FormValue("ip")
+	ip := strings.TrimSpace(r.FormValue("ip"))
 	if len(ip) == 0 {
 		log.Println("no param: ip")
-		w.WriteHeader(http.StatusBadRequest)
+		redirectWithFlash(w, r, flashError, "Enter an IP address")
 		return
 	}
 
 	log.Printf("ip: %v", ip)
 
-	if err := service.AddIPCtx(r.Context(), ip); err != nil {
+	label, err := formLabel(r)
+	if err != nil {
+		redirectWithFlash(w, r, flashError, err.Error())
+		return
+	}
+
+	if err := service.AddIPCtx(r.Context(), ip, firewall.WithOwner(username(r)), firewall.WithLabel(label)); err != nil {
 		log.Println(fmt.Errorf("service.AddIPCtx(): %w", err))
-		w.WriteHeader(http.StatusInternalServerError)
+		redirectWithFlash(w, r, flashError, errorMessage(err))
 		return
 	}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	redirectWithFlash(w, r, flashSuccess, ip+" added")
 }
 
+// HandleDeleteIP deletes the selected entries, one or more 'ip' fields.
 func HandleDeleteIP(w http.ResponseWriter, r *http.Request, service Firewall) {
-	ip := r.FormValue("ip")
-	if len(ip) == 0 {
-		log.Println("no param: ip")
-		w.WriteHeader(http.StatusBadRequest)
+	forEachIP(w, r, "deleted", func(ip string) error {
+		if err := service.DeleteIPCtx(r.Context(), ip); err != nil {
+			return fmt.Errorf("service.DeleteIPCtx(): %w", err)
+		}
+		return nil
+	})
+}
+
+// HandleExtendIP moves the expiry of the selected entries later by the 'minutes' field.
+func HandleExtendIP(w http.ResponseWriter, r *http.Request, service Firewall) {
+	minutes, err := strconv.Atoi(r.FormValue("minutes"))
+	if err != nil || minutes < 1 || minutes > maxExtendMinutes {
+		redirectWithFlash(w, r, flashError, fmt.Sprintf("Enter from 1 to %d minutes", maxExtendMinutes))
 		return
 	}
 
-	log.Printf("ip: %v", ip)
+	forEachIP(w, r, "extended", func(ip string) error {
+		if err := service.ExtendIPCtx(r.Context(), ip, time.Duration(minutes)*time.Minute); err != nil {
+			return fmt.Errorf("service.ExtendIPCtx(): %w", err)
+		}
+		return nil
+	})
+}
 
-	if err := service.DeleteIPCtx(r.Context(), ip); err != nil {
-		log.Println(fmt.Errorf("service.DeleteIPCtx(): %w", err))
-		w.WriteHeader(http.StatusInternalServerError)
+// forEachIP runs the action for the IPs selected in the form and reports the result in a flash message.
+func forEachIP(w http.ResponseWriter, r *http.Request, done string, action func(ip string) error) {
+	if err := r.ParseForm(); err != nil {
+		redirectWithFlash(w, r, flashError, "Invalid form")
+		return
+	}
+	ips := r.Form["ip"]
+	if len(ips) == 0 {
+		log.Println("no param: ip")
+		redirectWithFlash(w, r, flashError, "No IP address selected")
 		return
 	}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	var failures []string
+	for _, ip := range ips {
+		log.Printf("ip: %v", ip)
+
+		if err := action(ip); err != nil {
+			log.Println(err)
+			failures = append(failures, errorMessage(err))
+		}
+	}
+
+	switch {
+	case len(failures) == 0 && len(ips) == 1:
+		redirectWithFlash(w, r, flashSuccess, ips[0]+" "+done)
+	case len(failures) == 0:
+		redirectWithFlash(w, r, flashSuccess, fmt.Sprintf("%d entries %v", len(ips), done))
+	default:
+		succeeded := len(ips) - len(failures)
+		// the message is kept short enough for the cookie
+		if len(failures) > 3 {
+			failures = append(failures[:3], "...")
+		}
+		redirectWithFlash(w, r, flashError, fmt.Sprintf("%d of %d entries %v. Failed: %v",
+			succeeded, len(ips), done, strings.Join(failures, "; ")))
+	}
 }
@@ -0,0 +1,273 @@
+package htserver_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/htserver"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForms(t *testing.T) {
+	var fixedTime firewall.FixedTime
+	fixedTime.SetDateTime("2001-01-01 10:00:00")
+
+	service := firewall.NewService(
+		firewall.WithTimeFunc(fixedTime.TimeFunc()),
+		firewall.WithBackend(nopBackend{}),
+		firewall.WithDefaultTTL(time.Hour),
+	)
+	users := auth.NewUsers([]auth.User{{Username: "admin", Password: "123"}})
+	mux := htserver.NewServeMux(service, htserver.WithUsers(users), htserver.WithRoles(auth.NewRoles(nil, auth.RoleAdmin)))
+
+	for _, tt := range []struct {
+		name            string
+		path            string
+		form            url.Values
+		expectedFlash   string
+		expectedEntries []string
+	}{
+		{
+			name:            "add with label",
+			path:            "/api/ip/add",
+			form:            url.Values{"ip": {"1.1.1.1"}, "label": {"home"}},
+			expectedFlash:   `<p class="flash flash-success" role="status">1.1.1.1 added</p>`,
+			expectedEntries: []string{"1.1.1.1 home 2001-01-01T11:00:00Z"},
+		},
+		{
+			name:            "add incorrect ip",
+			path:            "/api/ip/add",
+			form:            url.Values{"ip": {"1.1.1"}},
+			expectedFlash:   "incorrect ip",
+			expectedEntries: []string{"1.1.1.1 home 2001-01-01T11:00:00Z"},
+		},
+		{
+			name:            "add too long label",
+			path:            "/api/ip/add",
+			form:            url.Values{"ip": {"2.2.2.2"}, "label": {strings.Repeat("x", 65)}},
+			expectedFlash:   "label longer than 64 characters",
+			expectedEntries: []string{"1.1.1.1 home 2001-01-01T11:00:00Z"},
+		},
+		{
+			name:          "add without label keeps the label",
+			path:          "/api/ip/add",
+			form:          url.Values{"ip": {"1.1.1.1"}},
+			expectedFlash: "1.1.1.1 added",
+			expectedEntries: []string{
+				"1.1.1.1 home 2001-01-01T11:00:00Z",
+			},
+		},
+		{
+			name:          "add another",
+			path:          "/api/ip/add",
+			form:          url.Values{"ip": {"2.2.2.2"}, "label": {"office"}},
+			expectedFlash: "2.2.2.2 added",
+			expectedEntries: []string{
+				"1.1.1.1 home 2001-01-01T11:00:00Z",
+				"2.2.2.2 office 2001-01-01T11:00:00Z",
+			},
+		},
+		{
+			name:          "extend",
+			path:          "/api/ip/extend",
+			form:          url.Values{"ip": {"1.1.1.1"}, "minutes": {"30"}},
+			expectedFlash: "1.1.1.1 extended",
+			expectedEntries: []string{
+				"1.1.1.1 home 2001-01-01T11:30:00Z",
+				"2.2.2.2 office 2001-01-01T11:00:00Z",
+			},
+		},
+		{
+			name:          "extend selected",
+			path:          "/api/ip/extend",
+			form:          url.Values{"ip": {"1.1.1.1", "2.2.2.2"}, "minutes": {"15"}},
+			expectedFlash: "2 entries extended",
+			expectedEntries: []string{
+				"1.1.1.1 home 2001-01-01T11:45:00Z",
+				"2.2.2.2 office 2001-01-01T11:15:00Z",
+			},
+		},
+		{
+			name:          "extend by incorrect minutes",
+			path:          "/api/ip/extend",
+			form:          url.Values{"ip": {"1.1.1.1"}, "minutes": {"0"}},
+			expectedFlash: "Enter from 1 to 10080 minutes",
+			expectedEntries: []string{
+				"1.1.1.1 home 2001-01-01T11:45:00Z",
+				"2.2.2.2 office 2001-01-01T11:15:00Z",
+			},
+		},
+		{
+			name:          "delete selected with a missing entry",
+			path:          "/api/ip/delete",
+			form:          url.Values{"ip": {"1.1.1.1", "3.3.3.3"}},
+			expectedFlash: "1 of 2 entries deleted. Failed:",
+			expectedEntries: []string{
+				"2.2.2.2 office 2001-01-01T11:15:00Z",
+			},
+		},
+		{
+			name:            "delete without selection",
+			path:            "/api/ip/delete",
+			form:            url.Values{},
+			expectedFlash:   "No IP address selected",
+			expectedEntries: []string{"2.2.2.2 office 2001-01-01T11:15:00Z"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{htserver.CSRFFieldName: {csrfToken}}
+			for key, values := range tt.form {
+				form[key] = values
+			}
+
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.SetBasicAuth("admin", "123")
+			r.AddCookie(&http.Cookie{Name: "ipfilter_csrf", Value: csrfToken})
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+				t.Fatalf("unexpected response: %v %v", w.Code, w.Header().Get("Location"))
+			}
+
+			// the message is shown once by the page the browser is redirected to
+			r = httptest.NewRequest(http.MethodGet, "/", nil)
+			r.SetBasicAuth("admin", "123")
+			for _, cookie := range w.Result().Cookies() {
+				r.AddCookie(cookie)
+			}
+
+			w = httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if body := html.UnescapeString(w.Body.String()); !strings.Contains(body, tt.expectedFlash) {
+				t.Errorf("flash message %q not found: %v", tt.expectedFlash, body)
+			}
+			var cleared bool
+			for _, cookie := range w.Result().Cookies() {
+				cleared = cleared || cookie.Name == "ipfilter_flash" && cookie.MaxAge < 0
+			}
+			if !cleared {
+				t.Errorf("flash cookie not cleared: %v", w.Header().Values("Set-Cookie"))
+			}
+
+			var actualEntries []string
+			for _, entry := range service.List() {
+				actualEntries = append(actualEntries, entry.IP+" "+entry.Label+" "+entry.ExpiresAt(service.DefaultTTL()).Format(time.RFC3339))
+			}
+			if strings.Join(actualEntries, "\n") != strings.Join(tt.expectedEntries, "\n") {
+				t.Errorf("entries: actual: %v expected: %v", actualEntries, tt.expectedEntries)
+			}
+		})
+	}
+}
+
+func TestAPITTLSeconds(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		path           string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "ttl",
+			path:           "/api/v1/entries",
+			body:           `{"ip": "1.2.3.4", "ttl_seconds": 3600}`,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "negative ttl",
+			path:           "/api/v1/entries",
+			body:           `{"ip": "1.2.3.4", "ttl_seconds": -1}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			// it would overflow to less than a second
+			name:           "overflowing ttl",
+			path:           "/api/v1/entries",
+			body:           `{"ip": "1.2.3.4", "ttl_seconds": 18446744074}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "overflowing ttl of my ip",
+			path:           "/api/v1/me",
+			body:           `{"ttl_seconds": 9223372036854775807}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := newTestMux()
+
+			r := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewBufferString(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			r.SetBasicAuth("admin", "123")
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("status: actual: %v expected: %v: %v", w.Code, tt.expectedStatus, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAPILabel(t *testing.T) {
+	mux := newTestMux()
+
+	for _, tt := range []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedLabel  string
+	}{
+		{
+			name:           "with label",
+			body:           `{"ip": "1.2.3.4", "label": "ci runner"}`,
+			expectedStatus: http.StatusCreated,
+			expectedLabel:  "ci runner",
+		},
+		{
+			name:           "without label",
+			body:           `{"ip": "1.2.3.4"}`,
+			expectedStatus: http.StatusOK,
+			expectedLabel:  "ci runner",
+		},
+		{
+			name:           "too long label",
+			body:           `{"ip": "1.2.3.4", "label": "` + strings.Repeat("x", 65) + `"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/entries", bytes.NewBufferString(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			r.SetBasicAuth("admin", "123")
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("status: actual: %v expected: %v: %v", w.Code, tt.expectedStatus, w.Body.String())
+			}
+			if w.Code >= http.StatusBadRequest {
+				return
+			}
+
+			var entry htserver.EntryResponse
+			noError(t, json.Unmarshal(w.Body.Bytes(), &entry))
+			if entry.Label != tt.expectedLabel {
+				t.Errorf("label: actual: %v expected: %v", entry.Label, tt.expectedLabel)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package htserver
+
+import (
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"io"
+	"net/http"
+	"time"
+)
+
+const checkOK = "ok"
+
+// ReadyResponse is the result of the readiness checks. The errors are not shown to the unauthenticated callers.
+type ReadyResponse struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// StatusResponse is the state of the server shown to the operators.
+type StatusResponse struct {
+	Ready bool `json:"ready"`
+	// Checks holds "ok" or the error of every readiness check.
+	Checks        map[string]string `json:"checks"`
+	StartedAt     time.Time         `json:"started_at"`
+	UptimeSeconds int64             `json:"uptime_seconds"`
+	Entries       EntryCounts       `json:"entries"`
+	Scheduler     SchedulerStatus   `json:"scheduler"`
+	Backend       BackendStatus     `json:"backend"`
+}
+
+type EntryCounts struct {
+	Total int `json:"total"`
+	// ByOwner counts the entries of every owner. The entries without an owner are only in Total.
+	ByOwner map[string]int `json:"by_owner"`
+}
+
+type SchedulerStatus struct {
+	LastCleanup    *time.Time `json:"last_cleanup,omitempty"`
+	LastReconcile  *time.Time `json:"last_reconcile,omitempty"`
+	ReconcileError string     `json:"reconcile_error,omitempty"`
+}
+
+type BackendStatus struct {
+	Errors      int        `json:"errors"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// HandleHealthz reports that the process is alive.
+func HandleHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = io.WriteString(w, "ok\n")
+}
+
+// HandleReadyz reports whether the service is ready, with 503 Service Unavailable when it is not.
+func HandleReadyz(w http.ResponseWriter, _ *http.Request, service *firewall.Service) {
+	ready, checks := readiness(service)
+
+	resp := ReadyResponse{
+		Ready:  ready,
+		Checks: make(map[string]string, len(checks)),
+	}
+	for name, err := range checks {
+		resp.Checks[name] = checkOK
+		if err != nil {
+			resp.Checks[name] = "failed"
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if !ready {
+		writeJSON(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// HandleAPIStatus shows the entry counts, the scheduler and backend state and the uptime.
+func HandleAPIStatus(w http.ResponseWriter, _ *http.Request, service *firewall.Service, startedAt time.Time) {
+	ready, checks := readiness(service)
+	health := service.Health()
+
+	resp := StatusResponse{
+		Ready:         ready,
+		Checks:        make(map[string]string, len(checks)),
+		StartedAt:     startedAt,
+		UptimeSeconds: int64(time.Since(startedAt) / time.Second),
+		Entries: EntryCounts{
+			ByOwner: make(map[string]int),
+		},
+		Scheduler: SchedulerStatus{
+			LastCleanup:    timeOrNil(health.LastCleanup),
+			LastReconcile:  timeOrNil(health.LastReconcile),
+			ReconcileError: health.ReconcileError,
+		},
+		Backend: BackendStatus{
+			Errors:      health.BackendErrors,
+			LastError:   health.BackendError,
+			LastErrorAt: timeOrNil(health.LastBackendErrorAt),
+		},
+	}
+	for name, err := range checks {
+		resp.Checks[name] = checkOK
+		if err != nil {
+			resp.Checks[name] = err.Error()
+		}
+	}
+	for _, entry := range service.List() {
+		resp.Entries.Total++
+		if len(entry.Owner) > 0 {
+			resp.Entries.ByOwner[entry.Owner]++
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func readiness(service *firewall.Service) (bool, map[string]error) {
+	checks := service.Checks()
+
+	ready := true
+	for _, err := range checks {
+		if err != nil {
+			ready = false
+		}
+	}
+	return ready, checks
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
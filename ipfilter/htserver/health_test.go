@@ -0,0 +1,144 @@
+package htserver_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/htserver"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type errorBackend struct {
+	err error
+}
+
+func (b *errorBackend) Allow(_ context.Context, _ string) error  { return b.err }
+func (b *errorBackend) Revoke(_ context.Context, _ string) error { return b.err }
+
+func TestHealth(t *testing.T) {
+	var fixedTime firewall.FixedTime
+	fixedTime.SetDateTime("2001-01-01 10:00:00")
+
+	backend := &errorBackend{}
+	service := firewall.NewService(
+		firewall.WithTimeFunc(fixedTime.TimeFunc()),
+		firewall.WithBackend(backend),
+		firewall.WithDefaultTTL(time.Hour),
+	)
+	users := auth.NewUsers([]auth.User{
+		{Username: "op", Password: "123"},
+		{Username: "alice", Password: "123"},
+	})
+	roles := auth.NewRoles(map[string]auth.Role{"op": auth.RoleOperator}, auth.RoleSelfService)
+	mux := htserver.NewServeMux(service, htserver.WithUsers(users), htserver.WithRoles(roles))
+
+	get := func(path, username string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if len(username) > 0 {
+			r.SetBasicAuth(username, "123")
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	// the steps share the state of the service
+	for _, tt := range []struct {
+		name           string
+		action         func()
+		expectedStatus int
+		expectedChecks map[string]string
+	}{
+		{
+			name:           "before the scheduler",
+			action:         func() {},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedChecks: map[string]string{"scheduler": "failed", "backend": "ok", "reconcile": "ok"},
+		},
+		{
+			name: "ready",
+			action: func() {
+				_, err := service.DeleteOutOfDate(service.DefaultTTL())
+				noError(t, err)
+				noError(t, service.AddIP("1.2.3.4", firewall.WithOwner("alice")))
+			},
+			expectedStatus: http.StatusOK,
+			expectedChecks: map[string]string{"scheduler": "ok", "backend": "ok", "reconcile": "ok"},
+		},
+		{
+			name: "backend failure",
+			action: func() {
+				backend.err = errors.New("ufw: permission denied")
+				if err := service.AddIP("2.2.8.8"); err == nil {
+					t.Fatal("expected error")
+				}
+			},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedChecks: map[string]string{"scheduler": "ok", "backend": "failed", "reconcile": "ok"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.action()
+
+			w := get("/healthz", "")
+			if w.Code != http.StatusOK || w.Body.String() != "ok\n" {
+				t.Fatalf("unexpected healthz response: %v %q", w.Code, w.Body.String())
+			}
+
+			w = get("/readyz", "")
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("status: actual: %v expected: %v", w.Code, tt.expectedStatus)
+			}
+			// the errors are not shown without authentication
+			if strings.Contains(w.Body.String(), "ufw") {
+				t.Errorf("error shown: %v", w.Body.String())
+			}
+
+			var resp htserver.ReadyResponse
+			noError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			if resp.Ready != (tt.expectedStatus == http.StatusOK) || !reflect.DeepEqual(resp.Checks, tt.expectedChecks) {
+				t.Errorf("unexpected response: %+v", resp)
+			}
+		})
+	}
+
+	for _, tt := range []struct {
+		username       string
+		expectedStatus int
+	}{
+		{username: "", expectedStatus: http.StatusUnauthorized},
+		{username: "alice", expectedStatus: http.StatusForbidden},
+		{username: "op", expectedStatus: http.StatusOK},
+	} {
+		if w := get("/status", tt.username); w.Code != tt.expectedStatus {
+			t.Errorf("status of %q: actual: %v expected: %v", tt.username, w.Code, tt.expectedStatus)
+		}
+	}
+
+	var status htserver.StatusResponse
+	noError(t, json.Unmarshal(get("/status", "op").Body.Bytes(), &status))
+
+	if status.Ready || status.Checks["backend"] != "ufw: permission denied" {
+		t.Errorf("unexpected checks: %v %+v", status.Ready, status.Checks)
+	}
+	if status.Entries.Total != 2 || !reflect.DeepEqual(status.Entries.ByOwner, map[string]int{"alice": 1}) {
+		t.Errorf("unexpected entries: %+v", status.Entries)
+	}
+	if status.Scheduler.LastCleanup == nil || !status.Scheduler.LastCleanup.Equal(firewall.MustParseDateTime("2001-01-01 10:00:00")) ||
+		status.Scheduler.LastReconcile != nil {
+		t.Errorf("unexpected scheduler: %+v", status.Scheduler)
+	}
+	if status.Backend.Errors != 1 || status.Backend.LastError != "ufw: permission denied" || status.Backend.LastErrorAt == nil {
+		t.Errorf("unexpected backend: %+v", status.Backend)
+	}
+	if status.StartedAt.IsZero() || status.UptimeSeconds < 0 {
+		t.Errorf("unexpected uptime: %v %v", status.StartedAt, status.UptimeSeconds)
+	}
+}
@@ -0,0 +1,52 @@
+package htserver
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/audit"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RecordLockout returns the function recording the lockouts in the audit trail (see auth.WithLockFunc).
+func RecordLockout(trail *audit.Trail) func(entry auth.LockoutEntry) {
+	return func(entry auth.LockoutEntry) {
+		trail.Record(audit.Event{
+			Action: "lockout",
+			Target: entry.Kind + ":" + entry.Key,
+			Result: audit.ResultDenied,
+			Detail: fmt.Sprintf("%d failed attempts, locked until %v", entry.Failures, entry.LockedUntil.Format(time.RFC3339)),
+		})
+	}
+}
+
+// setRetryAfter sets the Retry-After header for a lockout error.
+func setRetryAfter(w http.ResponseWriter, err error) {
+	var lockedOutErr *auth.LockedOutError
+	if errors.As(err, &lockedOutErr) {
+		seconds := math.Ceil(time.Until(lockedOutErr.Until).Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(max(int(seconds), 1)))
+	}
+}
+
+func HandleUnlock(w http.ResponseWriter, r *http.Request, lockout *auth.Lockout, trail *audit.Trail) {
+	kind, key := r.FormValue("kind"), r.FormValue("key")
+	if len(kind) == 0 || len(key) == 0 {
+		log.Println("no param: kind or key")
+		redirectWithFlash(w, r, flashError, "No lockout selected")
+		return
+	}
+
+	err := lockout.Unlock(kind, key)
+	recordEvent(trail, r, "lockout.unlock", kind+":"+key, err)
+	if err != nil {
+		redirectWithFlash(w, r, flashError, "The lockout has already ended")
+		return
+	}
+
+	redirectWithFlash(w, r, flashSuccess, key+" unlocked")
+}
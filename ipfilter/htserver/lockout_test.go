@@ -0,0 +1,131 @@
+package htserver_test
+
+import (
+	"encoding/json"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/htserver"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(nopBackend{}),
+	)
+	users := auth.NewUsers([]auth.User{
+		{Username: "admin", Password: "123"},
+		{Username: "alice", Password: "123"},
+	})
+
+	mux := htserver.NewServeMux(service,
+		htserver.WithUsers(users),
+		htserver.WithRoles(auth.NewRoles(nil, auth.RoleAdmin)),
+		htserver.WithLockout(auth.NewLockout(auth.WithMaxFailures(2))),
+	)
+
+	// the steps share the state of the lockout
+	for _, tt := range []struct {
+		name             string
+		user             string
+		password         string
+		remoteAddr       string
+		method           string
+		path             string
+		expectedStatus   int
+		expectedLockouts int
+	}{
+		{
+			name:           "first failure",
+			user:           "alice",
+			password:       "bad",
+			remoteAddr:     "10.0.0.1:1234",
+			method:         http.MethodGet,
+			path:           "/api/v1/me",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "second failure from another ip",
+			user:           "alice",
+			password:       "bad",
+			remoteAddr:     "10.0.0.2:1234",
+			method:         http.MethodGet,
+			path:           "/api/v1/me",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "locked out user with the correct password",
+			user:           "alice",
+			password:       "123",
+			remoteAddr:     "10.0.0.3:1234",
+			method:         http.MethodGet,
+			path:           "/api/v1/me",
+			expectedStatus: http.StatusTooManyRequests,
+		},
+		{
+			name:             "admin lists lockouts",
+			user:             "admin",
+			password:         "123",
+			remoteAddr:       "10.0.0.4:1234",
+			method:           http.MethodGet,
+			path:             "/api/v1/lockouts",
+			expectedStatus:   http.StatusOK,
+			expectedLockouts: 1,
+		},
+		{
+			name:           "admin unlocks the user",
+			user:           "admin",
+			password:       "123",
+			remoteAddr:     "10.0.0.4:1234",
+			method:         http.MethodDelete,
+			path:           "/api/v1/lockouts/user/alice",
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "unlocked user",
+			user:           "alice",
+			password:       "123",
+			remoteAddr:     "10.0.0.3:1234",
+			method:         http.MethodGet,
+			path:           "/api/v1/me",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "unlock unknown",
+			user:           "admin",
+			password:       "123",
+			remoteAddr:     "10.0.0.4:1234",
+			method:         http.MethodDelete,
+			path:           "/api/v1/lockouts/user/alice",
+			expectedStatus: http.StatusNotFound,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.SetBasicAuth(tt.user, tt.password)
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("status: actual: %v expected: %v body: %v", w.Code, tt.expectedStatus, w.Body)
+			}
+			if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+				t.Errorf("missing Retry-After header")
+			}
+
+			if tt.expectedLockouts > 0 {
+				var resp htserver.LockoutsResponse
+				noError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+				if len(resp.Lockouts) != tt.expectedLockouts {
+					t.Errorf("lockouts: actual: %+v expected: %v", resp.Lockouts, tt.expectedLockouts)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package htserver
+
+import (
+	"errors"
+	"github.com/dkarczmarski/gomisc/ipfilter/audit"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/realip"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const oidcStateCookieName = "ipfilter_oidc_state"
+
+// loginHandler serves the login page and the single sign-on callback.
+type loginHandler struct {
+	users     *auth.Users
+	roles     *auth.Roles
+	sessions  *auth.Sessions
+	lockout   *auth.Lockout
+	totp      *auth.TOTP
+	oidc      *auth.OIDC
+	templates *Templates
+	trail     *audit.Trail
+}
+
+// loginNext returns the local page requested before the login, or the index page.
+func loginNext(r *http.Request) string {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func (h *loginHandler) handleForm(w http.ResponseWriter, r *http.Request) {
+	h.render(w, r, http.StatusOK, "")
+}
+
+func (h *loginHandler) handleLogin(w http.ResponseWriter, r *http.Request) {
+	username := r.FormValue("username")
+	password := r.FormValue("password")
+
+	ip, _ := remoteIP(r)
+	if err := h.lockout.Check(username, ip); err != nil {
+		h.denied(r, username, err.Error())
+		setRetryAfter(w, err)
+		h.render(w, r, http.StatusTooManyRequests, "Too many failed attempts. Try again later")
+		return
+	}
+
+	user := h.users.Authenticate(username, password)
+	if user == nil {
+		h.lockout.Failure(username, ip)
+		h.denied(r, username, "incorrect credentials")
+		h.render(w, r, http.StatusUnauthorized, "Incorrect username or password")
+		return
+	}
+
+	if message, err := verifyLoginTOTP(h.totp, user.Username, r.FormValue("code")); err != nil {
+		if !errors.Is(err, auth.ErrTOTPRequired) {
+			h.lockout.Failure(username, ip)
+		}
+		h.denied(r, username, err.Error())
+		h.render(w, r, http.StatusUnauthorized, message)
+		return
+	}
+
+	h.lockout.Success(user.Username)
+
+	h.createSession(w, r, user, r.FormValue("remember") == "on", "", loginNext(r))
+}
+
+// handleOIDC sends the browser to the identity provider. The state is bound to the browser by a cookie.
+func (h *loginHandler) handleOIDC(w http.ResponseWriter, r *http.Request) {
+	authURL, state, err := h.oidc.AuthURL(r.Context(), r.FormValue("remember") == "on")
+	if err != nil {
+		log.Println(err)
+		h.render(w, r, http.StatusBadGateway, "Single sign-on is not available")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/login/oidc",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		// the callback is a cross-site top-level navigation
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (h *loginHandler) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    "",
+		Path:     "/login/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	if errCode := r.FormValue("error"); len(errCode) > 0 {
+		h.denied(r, "", "oidc: "+errCode+": "+r.FormValue("error_description"))
+		h.render(w, r, http.StatusUnauthorized, "Single sign-on failed")
+		return
+	}
+
+	state := r.FormValue("state")
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil || len(state) == 0 || cookie.Value != state {
+		h.denied(r, "", "oidc: "+auth.ErrOIDCState.Error())
+		h.render(w, r, http.StatusBadRequest, "Single sign-on has expired. Try again")
+		return
+	}
+
+	user, remember, err := h.oidc.Exchange(r.Context(), state, r.FormValue("code"))
+	if err != nil {
+		log.Println(err)
+		h.denied(r, "", "oidc: "+err.Error())
+		if errors.Is(err, auth.ErrOIDCNotMember) {
+			h.render(w, r, http.StatusForbidden, "The user is not allowed to log in")
+			return
+		}
+		h.render(w, r, http.StatusUnauthorized, "Single sign-on failed")
+		return
+	}
+
+	// the role comes only from the groups, as the username may match one in the roles of the local users
+	if len(user.Role) == 0 {
+		user.Role = h.roles.Default()
+	}
+	h.createSession(w, r, user, remember, "oidc", "/")
+}
+
+func (h *loginHandler) createSession(w http.ResponseWriter, r *http.Request, user *auth.User, remember bool, detail, next string) {
+	session := h.sessions.Create(w, r, user, remember)
+	h.trail.Record(audit.Event{
+		User:       user.Username,
+		RemoteAddr: realip.FromRequest(r),
+		Action:     "login",
+		Target:     session.ID,
+		Result:     audit.ResultOK,
+		Detail:     detail,
+		RequestID:  RequestIDFromContext(r.Context()),
+	})
+
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func (h *loginHandler) denied(r *http.Request, username, detail string) {
+	h.trail.Record(audit.Event{
+		User:       username,
+		RemoteAddr: realip.FromRequest(r),
+		Action:     "login",
+		Result:     audit.ResultDenied,
+		Detail:     detail,
+		RequestID:  RequestIDFromContext(r.Context()),
+	})
+}
+
+func (h *loginHandler) render(w http.ResponseWriter, r *http.Request, status int, message string) {
+	h.templates.Render(w, status, "login.html", map[string]interface{}{
+		"Error":     message,
+		"TOTP":      h.totp != nil,
+		"OIDC":      h.oidc != nil,
+		"Next":      loginNext(r),
+		"CSRFToken": csrfToken(w, r),
+	})
+}
+
+func HandleLogout(w http.ResponseWriter, r *http.Request, sessions *auth.Sessions, trail *audit.Trail) {
+	if session, ok := sessions.Current(r); ok {
+		trail.Record(audit.Event{
+			User:       session.Username,
+			RemoteAddr: realip.FromRequest(r),
+			Action:     "logout",
+			Target:     session.ID,
+			Result:     audit.ResultOK,
+			RequestID:  RequestIDFromContext(r.Context()),
+		})
+	}
+	sessions.Destroy(w, r)
+
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func HandleRevokeSession(w http.ResponseWriter, r *http.Request, sessions *auth.Sessions, trail *audit.Trail) {
+	id := r.FormValue("id")
+	if len(id) == 0 {
+		log.Println("no param: id")
+		redirectWithFlash(w, r, flashError, "No session selected")
+		return
+	}
+
+	err := sessions.Revoke(id)
+	recordEvent(trail, r, "session.revoke", id, err)
+	if err != nil {
+		redirectWithFlash(w, r, flashError, "The session has already ended")
+		return
+	}
+
+	redirectWithFlash(w, r, flashSuccess, "Session revoked")
+}
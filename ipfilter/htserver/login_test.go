@@ -0,0 +1,94 @@
+package htserver_test
+
+import (
+	"github.com/dkarczmarski/gomisc/ipfilter/audit"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/htserver"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogout(t *testing.T) {
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(nopBackend{}),
+	)
+	sessions := auth.NewSessions()
+	trail := audit.NewTrail()
+	mux := htserver.NewServeMux(service,
+		htserver.WithSessions(sessions),
+		htserver.WithAuditTrail(trail),
+	)
+
+	w := httptest.NewRecorder()
+	session := sessions.Create(w, httptest.NewRequest(http.MethodPost, "/login", nil), &auth.User{Username: "alice"}, false)
+
+	r := httptest.NewRequest(http.MethodPost, "/logout", strings.NewReader(url.Values{htserver.CSRFFieldName: {csrfToken}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: "ipfilter_csrf", Value: csrfToken})
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	if w.Code != http.StatusSeeOther || len(sessions.List()) != 0 {
+		t.Fatalf("status: %v sessions: %v", w.Code, sessions.List())
+	}
+
+	events := trail.List()
+	if len(events) != 1 {
+		t.Fatalf("audit events: actual: %v expected: 1", len(events))
+	}
+	if event := events[0]; event.Action != "logout" || event.User != "alice" || event.Target != session.ID ||
+		event.Result != audit.ResultOK {
+		t.Errorf("unexpected audit event: %+v", event)
+	}
+}
+
+func TestLoginNext(t *testing.T) {
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(nopBackend{}),
+	)
+	mux := htserver.NewServeMux(service,
+		htserver.WithUsers(auth.NewUsers([]auth.User{{Username: "alice", Password: "123"}})),
+	)
+
+	for _, tt := range []struct {
+		name             string
+		next             string
+		expectedLocation string
+	}{
+		{name: "no next", expectedLocation: "/"},
+		{name: "local page", next: "/requests/abc/approve?sig=x", expectedLocation: "/requests/abc/approve?sig=x"},
+		{name: "another host", next: "//evil.test/", expectedLocation: "/"},
+		{name: "backslash", next: "/\\evil.test/", expectedLocation: "/"},
+		{name: "absolute url", next: "http://evil.test/", expectedLocation: "/"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{
+				htserver.CSRFFieldName: {csrfToken},
+				"username":             {"alice"},
+				"password":             {"123"},
+				"next":                 {tt.next},
+			}
+			r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.AddCookie(&http.Cookie{Name: "ipfilter_csrf", Value: csrfToken})
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != http.StatusSeeOther || w.Header().Get("Location") != tt.expectedLocation {
+				t.Errorf("actual: %v %v expected: %v", w.Code, w.Header().Get("Location"), tt.expectedLocation)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+package htserver
+
+import (
+	"github.com/dkarczmarski/gomisc/ipfilter/metrics"
+)
+
+// CountLoginFailures registers the counter of the failed logins and returns the function
+// counting them (see auth.WithFailureFunc).
+func CountLoginFailures(registry *metrics.Registry) func(username, ip string) {
+	failures := registry.Counter("ipfilter_login_failures_total",
+		"Failed login attempts: wrong passwords and TOTP codes of the login form and basic auth.")
+	return func(_, _ string) {
+		failures.Inc()
+	}
+}
@@ -0,0 +1,73 @@
+package htserver_test
+
+import (
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/htserver"
+	"github.com/dkarczmarski/gomisc/ipfilter/metrics"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(nopBackend{}),
+		firewall.WithMetrics(registry),
+	)
+	users := auth.NewUsers([]auth.User{
+		{Username: "op", Password: "123"},
+		{Username: "alice", Password: "123"},
+	})
+	roles := auth.NewRoles(map[string]auth.Role{"op": auth.RoleOperator}, auth.RoleSelfService)
+	mux := htserver.NewServeMux(service,
+		htserver.WithUsers(users),
+		htserver.WithRoles(roles),
+		htserver.WithMetrics(registry),
+	)
+
+	request := func(method, path, username, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if len(username) > 0 {
+			r.SetBasicAuth(username, password)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	request(http.MethodPost, "/api/v1/me", "alice", "123")
+	request(http.MethodGet, "/api/v1/me", "alice", "wrong")
+	request(http.MethodGet, "/api/v1/me", "bob", "wrong")
+
+	for _, tt := range []struct {
+		username       string
+		expectedStatus int
+	}{
+		{username: "", expectedStatus: http.StatusUnauthorized},
+		{username: "alice", expectedStatus: http.StatusForbidden},
+		{username: "op", expectedStatus: http.StatusOK},
+	} {
+		if w := request(http.MethodGet, "/metrics", tt.username, "123"); w.Code != tt.expectedStatus {
+			t.Errorf("metrics of %q: actual: %v expected: %v", tt.username, w.Code, tt.expectedStatus)
+		}
+	}
+
+	w := request(http.MethodGet, "/metrics", "op", "123")
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected Content-Type: %v", w.Header().Get("Content-Type"))
+	}
+	for _, expected := range []string{
+		"ipfilter_entries{owner=\"alice\"} 1\n",
+		"ipfilter_entries_added_total 1\n",
+		"ipfilter_login_failures_total 2\n",
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("%q not found in:\n%v", expected, w.Body.String())
+		}
+	}
+}
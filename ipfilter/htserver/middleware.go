@@ -0,0 +1,189 @@
+package htserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/realip"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+const (
+	requestIDHeader    = "X-Request-ID"
+	maxRequestIDLength = 64
+)
+
+// contentSecurityPolicy allows only the resources of the server. The pages have no inline scripts or styles.
+const contentSecurityPolicy = "default-src 'self'; frame-ancestors 'none'; base-uri 'none'; object-src 'none'"
+
+type requestInfoKey struct{}
+
+// requestInfo is shared by the middlewares of a request. The user is set by the authenticator
+// deeper in the chain, so it can be logged by accessLog.
+type requestInfo struct {
+	id   string
+	user string
+}
+
+// RequestIDFromContext returns the ID of the request or an empty string.
+func RequestIDFromContext(ctx context.Context) string {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+// requestID takes the ID of the request from the X-Request-ID header, e.g. set by a reverse proxy,
+// or generates one. The ID is sent back in the response header.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, &requestInfo{id: id})))
+	})
+}
+
+// validRequestID accepts only the IDs which are safe to be logged.
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("rand.Read(): %w", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// recordUser remembers the authenticated user for the access log.
+func recordUser(authenticator auth.Authenticator) auth.Authenticator {
+	return auth.AuthenticatorFunc(func(r *http.Request) (*auth.User, error) {
+		user, err := authenticator.Authenticate(r)
+		if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok && err == nil {
+			info.user = user.Username
+		}
+		return user, err
+	})
+}
+
+// responseRecorder records the status and the size of the response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.size += n
+	return n, err
+}
+
+// Unwrap gives http.ResponseController access to the original writer, e.g. to flush it.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// accessLog logs every request with its user, client IP, route, status and duration.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		var info requestInfo
+		if v, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+			info = *v
+		}
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		// the pattern is set by http.ServeMux, e.g. 'DELETE /api/v1/entries/{ip}'
+		route := r.Pattern
+		if len(route) == 0 {
+			route = "-"
+		}
+
+		log.Printf("http: id=%v user=%q addr=%v method=%v path=%q route=%q status=%v size=%v duration=%v",
+			info.id, info.user, realip.FromRequest(r), r.Method, r.URL.Path, route, status, rec.size,
+			time.Since(start).Round(time.Microsecond))
+	})
+}
+
+// recoverPanic logs a panic of a handler with its stack and sends the error page
+// instead of dropping the connection.
+func recoverPanic(templates *Templates) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec, ok := w.(*responseRecorder)
+			if !ok {
+				rec = &responseRecorder{ResponseWriter: w}
+			}
+
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				if err == http.ErrAbortHandler {
+					// the handler aborts the response on purpose
+					panic(err)
+				}
+
+				log.Printf("http: id=%v panic: %v\n%s", RequestIDFromContext(r.Context()), err, debug.Stack())
+				if rec.status == 0 {
+					templates.renderError(rec, http.StatusInternalServerError)
+				}
+			}()
+
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
+
+// securityHeaders forbids framing the pages and loading resources of other origins.
+// Over TLS, the browsers are told to use HTTPS only.
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("Content-Security-Policy", contentSecurityPolicy)
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("Referrer-Policy", "same-origin")
+		if r.TLS != nil {
+			header.Set("Strict-Transport-Security", "max-age=31536000")
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
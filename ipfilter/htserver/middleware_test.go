@@ -0,0 +1,168 @@
+package htserver_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"github.com/dkarczmarski/gomisc/ipfilter/audit"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/htserver"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type panicBackend struct{}
+
+func (panicBackend) Allow(_ context.Context, _ string) error  { panic("backend failure") }
+func (panicBackend) Revoke(_ context.Context, _ string) error { return nil }
+
+// captureLog returns the log output written until the end of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+	return &buf
+}
+
+func TestRequestID(t *testing.T) {
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(nopBackend{}),
+	)
+	users := auth.NewUsers([]auth.User{{Username: "alice", Password: "123"}})
+	trail := audit.NewTrail()
+	mux := htserver.NewServeMux(service, htserver.WithUsers(users), htserver.WithAuditTrail(trail))
+
+	for _, tt := range []struct {
+		name       string
+		requestID  string
+		expectedID string
+	}{
+		{
+			name:       "passed by a proxy",
+			requestID:  "f3a1-42.proxy_1",
+			expectedID: "f3a1-42.proxy_1",
+		},
+		{
+			name:      "generated",
+			requestID: "",
+		},
+		{
+			name:      "invalid replaced",
+			requestID: "id\nuser=\"admin\"",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/me", nil)
+			r.SetBasicAuth("alice", "123")
+			if len(tt.requestID) > 0 {
+				r.Header.Set("X-Request-ID", tt.requestID)
+			}
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			id := w.Header().Get("X-Request-ID")
+			if len(tt.expectedID) > 0 && id != tt.expectedID {
+				t.Fatalf("request id: actual: %v expected: %v", id, tt.expectedID)
+			}
+			if len(id) == 0 || id == tt.requestID && len(tt.expectedID) == 0 {
+				t.Fatalf("request id not generated: %q", id)
+			}
+
+			if event := trail.List()[0]; event.RequestID != id {
+				t.Errorf("audit event request id: actual: %v expected: %v", event.RequestID, id)
+			}
+			expectedLog := "http: id=" + id + ` user="alice" addr=192.0.2.1 method=POST path="/api/v1/me" route="POST /api/v1/me" status=`
+			if !strings.Contains(logs.String(), expectedLog) {
+				t.Errorf("access log not found: %v", logs.String())
+			}
+		})
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	mux := newTestMux()
+
+	for _, tt := range []struct {
+		name         string
+		tls          bool
+		expectedHSTS string
+	}{
+		{
+			name:         "http",
+			expectedHSTS: "",
+		},
+		{
+			name:         "https",
+			tls:          true,
+			expectedHSTS: "max-age=31536000",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/login", nil)
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			header := w.Header()
+			if !strings.Contains(header.Get("Content-Security-Policy"), "frame-ancestors 'none'") {
+				t.Errorf("unexpected Content-Security-Policy: %v", header.Get("Content-Security-Policy"))
+			}
+			if header.Get("X-Frame-Options") != "DENY" || header.Get("X-Content-Type-Options") != "nosniff" {
+				t.Errorf("unexpected headers: %v", header)
+			}
+			if header.Get("Strict-Transport-Security") != tt.expectedHSTS {
+				t.Errorf("Strict-Transport-Security: actual: %v expected: %v", header.Get("Strict-Transport-Security"), tt.expectedHSTS)
+			}
+		})
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	logs := captureLog(t)
+
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(panicBackend{}),
+	)
+	users := auth.NewUsers([]auth.User{{Username: "alice", Password: "123"}})
+	mux := htserver.NewServeMux(service, htserver.WithUsers(users))
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/me", nil)
+	r.SetBasicAuth("alice", "123")
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status: actual: %v expected: %v", w.Code, http.StatusInternalServerError)
+	}
+	id := w.Header().Get("X-Request-ID")
+	if !strings.Contains(logs.String(), "http: id="+id+" panic: backend failure") {
+		t.Errorf("panic not logged: %v", logs.String())
+	}
+	if !strings.Contains(logs.String(), "status=500") {
+		t.Errorf("access log not found: %v", logs.String())
+	}
+
+	// the server keeps working
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status: actual: %v expected: %v", w.Code, http.StatusOK)
+	}
+}
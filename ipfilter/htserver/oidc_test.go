@@ -0,0 +1,100 @@
+package htserver_test
+
+import (
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth/oidctest"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/htserver"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestOIDCLogin(t *testing.T) {
+	issuer, err := oidctest.NewIssuer("ipfilter", "secret")
+	noError(t, err)
+	defer issuer.Close()
+
+	for _, tt := range []struct {
+		name                string
+		claims              map[string]any
+		expectedAuditStatus int
+	}{
+		{
+			name:                "role of the group",
+			claims:              map[string]any{"sub": "alice", "groups": []string{"ipfilter-admins"}},
+			expectedAuditStatus: http.StatusOK,
+		},
+		{
+			name:                "default role without a mapped group",
+			claims:              map[string]any{"sub": "bob", "groups": []string{"dev"}},
+			expectedAuditStatus: http.StatusForbidden,
+		},
+		{
+			name:                "no role of the local user of the same name",
+			claims:              map[string]any{"sub": "admin", "preferred_username": "admin"},
+			expectedAuditStatus: http.StatusForbidden,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			service := firewall.NewService(
+				firewall.WithTimeFunc(time.Now),
+				firewall.WithBackend(nopBackend{}),
+			)
+			oidc := auth.NewOIDC(issuer.URL, issuer.ClientID, issuer.ClientSecret, "https://ipfilter.example.com/login/oidc/callback",
+				auth.WithOIDCGroupRoles(map[string]auth.Role{"ipfilter-admins": auth.RoleAdmin}))
+
+			mux := htserver.NewServeMux(service,
+				htserver.WithRoles(auth.NewRoles(map[string]auth.Role{"admin": auth.RoleAdmin}, auth.RoleSelfService)),
+				htserver.WithOIDC(oidc),
+			)
+
+			serve := func(r *http.Request) *http.Response {
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, r)
+				return w.Result()
+			}
+
+			// the browser is sent to the identity provider
+			resp := serve(httptest.NewRequest(http.MethodGet, "/login/oidc", nil))
+			if resp.StatusCode != http.StatusFound {
+				t.Fatalf("status: actual: %v expected: %v", resp.StatusCode, http.StatusFound)
+			}
+			stateCookies := resp.Cookies()
+
+			callbackURL, err := issuer.Authorize(resp.Header.Get("Location"), tt.claims)
+			noError(t, err)
+			callback, err := url.Parse(callbackURL)
+			noError(t, err)
+
+			// the identity provider redirects back with the code
+			r := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+			for _, cookie := range stateCookies {
+				r.AddCookie(cookie)
+			}
+			resp = serve(r)
+			if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/" {
+				t.Fatalf("status: actual: %v %v expected: %v /", resp.StatusCode, resp.Header.Get("Location"), http.StatusSeeOther)
+			}
+
+			var sessionCookie *http.Cookie
+			for _, cookie := range resp.Cookies() {
+				if cookie.Name == auth.SessionCookieName {
+					sessionCookie = cookie
+				}
+			}
+			if sessionCookie == nil {
+				t.Fatalf("no session cookie")
+			}
+
+			// only the admins can read the audit trail
+			r = httptest.NewRequest(http.MethodGet, "/api/v1/audit", nil)
+			r.AddCookie(sessionCookie)
+			if resp := serve(r); resp.StatusCode != tt.expectedAuditStatus {
+				t.Errorf("audit status: actual: %v expected: %v", resp.StatusCode, tt.expectedAuditStatus)
+			}
+		})
+	}
+}
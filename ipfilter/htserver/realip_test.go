@@ -0,0 +1,71 @@
+package htserver_test
+
+import (
+	"encoding/json"
+	"github.com/dkarczmarski/gomisc/ipfilter/audit"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/htserver"
+	"github.com/dkarczmarski/gomisc/ipfilter/realip"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRealIP(t *testing.T) {
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(nopBackend{}),
+	)
+	users := auth.NewUsers([]auth.User{{Username: "alice", Password: "123"}})
+	trail := audit.NewTrail()
+
+	mux := htserver.NewServeMux(service,
+		htserver.WithUsers(users),
+		htserver.WithAuditTrail(trail),
+		htserver.WithRealIP(realip.NewResolver([]netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")})),
+	)
+
+	for _, tt := range []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		expectedIP   string
+	}{
+		{
+			name:         "trusted proxy",
+			remoteAddr:   "10.0.0.1:1234",
+			forwardedFor: "198.51.100.1, 192.0.2.1",
+			expectedIP:   "192.0.2.1",
+		},
+		{
+			name:         "untrusted proxy",
+			remoteAddr:   "10.0.0.2:1234",
+			forwardedFor: "192.0.2.1",
+			expectedIP:   "10.0.0.2",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/me", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			r.SetBasicAuth("alice", "123")
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			var resp htserver.EntryResponse
+			noError(t, json.NewDecoder(w.Body).Decode(&resp))
+			if w.Code != http.StatusCreated || resp.IP != tt.expectedIP {
+				t.Fatalf("status: %v ip: actual: %v expected: %v", w.Code, resp.IP, tt.expectedIP)
+			}
+
+			// the audit trail records the client too
+			if event := trail.List()[0]; event.Action != "entry.add" || event.RemoteAddr != tt.expectedIP {
+				t.Errorf("unexpected event: %+v", event)
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package htserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxReasonLength limits the reason of an access request.
+const maxReasonLength = 256
+
+// The actions of the signed links.
+const (
+	ActionApprove = "approve"
+	ActionReject  = "reject"
+)
+
+// AccessRequestResponse is the JSON representation of an access request.
+type AccessRequestResponse struct {
+	ID         string    `json:"id"`
+	IP         string    `json:"ip"`
+	Owner      string    `json:"owner,omitempty"`
+	Reason     string    `json:"reason"`
+	TTLSeconds int64     `json:"ttl_seconds,omitempty"`
+	Label      string    `json:"label,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type AccessRequestsResponse struct {
+	Requests []AccessRequestResponse `json:"requests"`
+}
+
+// CreateAccessRequest is the body of POST /api/v1/requests. The caller's IP is requested when IP is empty.
+type CreateAccessRequest struct {
+	IP         string `json:"ip,omitempty"`
+	Reason     string `json:"reason"`
+	TTLSeconds int64  `json:"ttl_seconds,omitempty"`
+	Label      string `json:"label,omitempty"`
+}
+
+func newAccessRequestResponse(request firewall.AccessRequest) AccessRequestResponse {
+	return AccessRequestResponse{
+		ID:         request.ID,
+		IP:         request.IP,
+		Owner:      request.Owner,
+		Reason:     request.Reason,
+		TTLSeconds: int64(request.TTL / time.Second),
+		Label:      request.Label,
+		CreatedAt:  request.CreatedAt,
+		ExpiresAt:  request.ExpiresAt,
+	}
+}
+
+// visibleRequests returns the access requests the user can see: all for admins, otherwise only the user's own.
+func visibleRequests(user *auth.User, requests []firewall.AccessRequest) []firewall.AccessRequest {
+	if user.HasRole(auth.RoleAdmin) {
+		return requests
+	}
+
+	visible := make([]firewall.AccessRequest, 0, len(requests))
+	for _, request := range requests {
+		if user != nil && request.Owner == user.Username {
+			visible = append(visible, request)
+		}
+	}
+	return visible
+}
+
+// checkReason returns the trimmed reason of an access request.
+func checkReason(reason string) (string, error) {
+	reason = strings.TrimSpace(reason)
+	switch {
+	case len(reason) == 0:
+		return "", errors.New("enter the reason")
+	case len(reason) > maxReasonLength:
+		return "", fmt.Errorf("reason longer than %d characters", maxReasonLength)
+	}
+	return reason, nil
+}
+
+// HandleCreateRequest requests access for the 'ip' field, the caller's IP when it is empty,
+// for the 'ttl' duration, e.g. 8h, with the 'reason'.
+func HandleCreateRequest(w http.ResponseWriter, r *http.Request, service Firewall) {
+	ip := strings.TrimSpace(r.FormValue("ip"))
+	if len(ip) == 0 {
+		var err error
+		if ip, err = remoteIP(r); err != nil {
+			log.Println(err)
+			redirectWithFlash(w, r, flashError, "Your IP address cannot be determined")
+			return
+		}
+	}
+
+	log.Printf("ip: %v", ip)
+
+	reason, err := checkReason(r.FormValue("reason"))
+	if err != nil {
+		redirectWithFlash(w, r, flashError, err.Error())
+		return
+	}
+	label, err := formLabel(r)
+	if err != nil {
+		redirectWithFlash(w, r, flashError, err.Error())
+		return
+	}
+	ttl, err := time.ParseDuration(r.FormValue("ttl"))
+	if err != nil || ttl <= 0 {
+		redirectWithFlash(w, r, flashError, "Incorrect duration")
+		return
+	}
+
+	if _, err := service.RequestIPCtx(r.Context(), ip, reason,
+		firewall.WithTTL(ttl), firewall.WithOwner(username(r)), firewall.WithLabel(label)); err != nil {
+		log.Println(fmt.Errorf("service.RequestIPCtx(): %w", err))
+		redirectWithFlash(w, r, flashError, errorMessage(err))
+		return
+	}
+
+	redirectWithFlash(w, r, flashSuccess, "Access for "+ip+" requested")
+}
+
+// HandleApproveRequest approves the access request of the 'id' field.
+func HandleApproveRequest(w http.ResponseWriter, r *http.Request, service Firewall) {
+	id := r.FormValue("id")
+	if len(id) == 0 {
+		log.Println("no param: id")
+		redirectWithFlash(w, r, flashError, "No request selected")
+		return
+	}
+
+	entry, err := service.ApproveRequestCtx(r.Context(), id, username(r))
+	if err != nil {
+		log.Println(fmt.Errorf("service.ApproveRequestCtx(): %w", err))
+		redirectWithFlash(w, r, flashError, errorMessage(err))
+		return
+	}
+
+	redirectWithFlash(w, r, flashSuccess, entry.IP+" approved")
+}
+
+// HandleRejectRequest rejects the access request of the 'id' field.
+func HandleRejectRequest(w http.ResponseWriter, r *http.Request, service Firewall) {
+	id := r.FormValue("id")
+	if len(id) == 0 {
+		log.Println("no param: id")
+		redirectWithFlash(w, r, flashError, "No request selected")
+		return
+	}
+
+	request, err := service.RejectRequestCtx(r.Context(), id, username(r))
+	if err != nil {
+		log.Println(fmt.Errorf("service.RejectRequestCtx(): %w", err))
+		redirectWithFlash(w, r, flashError, errorMessage(err))
+		return
+	}
+
+	redirectWithFlash(w, r, flashSuccess, request.IP+" rejected")
+}
+
+func HandleAPIListRequests(w http.ResponseWriter, r *http.Request, service Firewall) {
+	requests := visibleRequests(auth.UserFromContext(r.Context()), service.Requests())
+
+	resp := AccessRequestsResponse{
+		Requests: make([]AccessRequestResponse, len(requests)),
+	}
+	for i, request := range requests {
+		resp.Requests[i] = newAccessRequestResponse(request)
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func HandleAPICreateRequest(w http.ResponseWriter, r *http.Request, service Firewall) {
+	var req CreateAccessRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	reason, err := checkReason(req.Reason)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	ttl, err := ttlFromSeconds(req.TTLSeconds)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	if len(req.Label) > maxLabelLength {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", fmt.Sprintf("label longer than %d characters", maxLabelLength))
+		return
+	}
+
+	ip := req.IP
+	if len(ip) == 0 {
+		if ip, err = remoteIP(r); err != nil {
+			writeServiceError(w, err)
+			return
+		}
+	}
+
+	log.Printf("ip: %v", ip)
+
+	request, err := service.RequestIPCtx(r.Context(), ip, reason, firewall.WithTTL(ttl),
+		firewall.WithOwner(username(r)), firewall.WithLabel(req.Label))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newAccessRequestResponse(request))
+}
+
+func HandleAPIApproveRequest(w http.ResponseWriter, r *http.Request, service Firewall) {
+	entry, err := service.ApproveRequestCtx(r.Context(), r.PathValue("id"), username(r))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newEntryResponse(entry, service.DefaultTTL()))
+}
+
+func HandleAPIRejectRequest(w http.ResponseWriter, r *http.Request, service Firewall) {
+	if _, err := service.RejectRequestCtx(r.Context(), r.PathValue("id"), username(r)); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ApprovalLinks signs the links approving or rejecting the access requests, sent in the notifications.
+// The signature only selects the action: the link is opened by a logged-in admin, who is recorded
+// as the user deciding the request. A link works until its request is decided or rejected after the timeout.
+type ApprovalLinks struct {
+	baseURL string
+	key     []byte
+}
+
+// NewApprovalLinks creates the links to the web UI at baseURL, e.g. https://ipfilter.example.com.
+// They are signed with a random key, so they are invalid after a restart, as the requests are.
+func NewApprovalLinks(baseURL string) *ApprovalLinks {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Errorf("rand.Read(): %w", err))
+	}
+
+	return &ApprovalLinks{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		key:     key,
+	}
+}
+
+// URL returns the link to the page confirming the action, ActionApprove or ActionReject, of the request.
+func (l *ApprovalLinks) URL(id, action string) string {
+	return l.baseURL + "/requests/" + url.PathEscape(id) + "/" + action + "?sig=" + l.sign(id, action)
+}
+
+func (l *ApprovalLinks) sign(id, action string) string {
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write([]byte(action + ":" + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (l *ApprovalLinks) verify(id, action, sig string) bool {
+	return hmac.Equal([]byte(sig), []byte(l.sign(id, action)))
+}
+
+// HandleRequestLink shows the access request of a signed link with a button taking the action.
+// Nothing is changed on GET, as the chat apps open the links to preview them.
+func HandleRequestLink(w http.ResponseWriter, r *http.Request, service Firewall, links *ApprovalLinks, templates *Templates) {
+	id, action, sig := r.PathValue("id"), r.PathValue("action"), r.FormValue("sig")
+	if !checkLink(w, links, id, action, sig, templates) {
+		return
+	}
+
+	request, err := service.FindRequest(id)
+	if err != nil {
+		renderLinkError(w, err, templates)
+		return
+	}
+
+	templates.Render(w, http.StatusOK, "request.html", map[string]interface{}{
+		"Request":   request,
+		"Action":    action,
+		"Signature": sig,
+		"CSRFToken": csrfToken(w, r),
+	})
+}
+
+// HandleRequestLinkAction approves or rejects the access request of a signed link.
+func HandleRequestLinkAction(w http.ResponseWriter, r *http.Request, service Firewall, links *ApprovalLinks, templates *Templates) {
+	id, action, sig := r.PathValue("id"), r.PathValue("action"), r.FormValue("sig")
+	if !checkLink(w, links, id, action, sig, templates) {
+		return
+	}
+
+	var (
+		request firewall.AccessRequest
+		err     error
+	)
+	if action == ActionApprove {
+		request, err = service.FindRequest(id)
+		if err == nil {
+			_, err = service.ApproveRequestCtx(r.Context(), id, username(r))
+		}
+	} else {
+		request, err = service.RejectRequestCtx(r.Context(), id, username(r))
+	}
+	if err != nil {
+		log.Println(fmt.Errorf("%v request %v: %w", action, id, err))
+		renderLinkError(w, err, templates)
+		return
+	}
+
+	templates.Render(w, http.StatusOK, "request.html", map[string]interface{}{
+		"Request": request,
+		"Action":  action,
+		"Done":    true,
+	})
+}
+
+// checkLink renders the error page for an unknown action or an invalid signature.
+func checkLink(w http.ResponseWriter, links *ApprovalLinks, id, action, sig string, templates *Templates) bool {
+	if (action != ActionApprove && action != ActionReject) || !links.verify(id, action, sig) {
+		log.Printf("invalid link: %v %v", action, id)
+		templates.Render(w, http.StatusForbidden, "request.html", map[string]interface{}{
+			"Error": "The link is invalid.",
+		})
+		return false
+	}
+	return true
+}
+
+func renderLinkError(w http.ResponseWriter, err error, templates *Templates) {
+	message := errorMessage(err)
+	if errors.Is(err, firewall.ErrRequestNotFound) {
+		message = "The request has already been approved or rejected, or it has timed out."
+	}
+	templates.Render(w, errorStatus(err), "request.html", map[string]interface{}{
+		"Error": message,
+	})
+}
@@ -0,0 +1,372 @@
+package htserver_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/dkarczmarski/gomisc/ipfilter/audit"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/htserver"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newRequestTestMux(links *htserver.ApprovalLinks, trail *audit.Trail) (*firewall.Service, *htserver.ServeMux) {
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(nopBackend{}),
+	)
+	users := auth.NewUsers([]auth.User{
+		{Username: "admin", Password: "123"},
+		{Username: "alice", Password: "123"},
+		{Username: "bob", Password: "123"},
+	})
+	roles := auth.NewRoles(map[string]auth.Role{
+		"admin": auth.RoleAdmin,
+	}, auth.RoleRequester)
+
+	return service, htserver.NewServeMux(service,
+		htserver.WithUsers(users),
+		htserver.WithRoles(roles),
+		htserver.WithApprovalLinks(links),
+		htserver.WithAuditTrail(trail),
+	)
+}
+
+func TestAccessRequests(t *testing.T) {
+	service, mux := newRequestTestMux(nil, audit.NewTrail())
+
+	var id string
+
+	// the steps share the state of the service
+	for _, tt := range []struct {
+		name             string
+		user             string
+		method           string
+		path             string
+		body             string
+		expectedStatus   int
+		expectedRequests []string
+		expectedEntries  []string
+	}{
+		{
+			name:           "requester cannot add own ip",
+			user:           "alice",
+			method:         http.MethodPost,
+			path:           "/api/v1/me",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "requester requests own ip",
+			user:           "alice",
+			method:         http.MethodPost,
+			path:           "/api/v1/requests",
+			body:           `{"reason": "on call", "ttl_seconds": 7200}`,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "requester requests without a reason",
+			user:           "bob",
+			method:         http.MethodPost,
+			path:           "/api/v1/requests",
+			body:           `{"ip": "10.0.0.2"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "requester requests an invalid ip",
+			user:           "bob",
+			method:         http.MethodPost,
+			path:           "/api/v1/requests",
+			body:           `{"ip": "abc", "reason": "deploy"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "requester requests an overflowing ttl",
+			user:           "bob",
+			method:         http.MethodPost,
+			path:           "/api/v1/requests",
+			body:           `{"ip": "10.0.0.2", "reason": "deploy", "ttl_seconds": 18446744074}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "another requester requests any ip",
+			user:           "bob",
+			method:         http.MethodPost,
+			path:           "/api/v1/requests",
+			body:           `{"ip": "10.0.0.2", "reason": "deploy"}`,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:             "requester sees only own requests",
+			user:             "alice",
+			method:           http.MethodGet,
+			path:             "/api/v1/requests",
+			expectedStatus:   http.StatusOK,
+			expectedRequests: []string{"192.0.2.1"},
+		},
+		{
+			name:             "admin sees all requests",
+			user:             "admin",
+			method:           http.MethodGet,
+			path:             "/api/v1/requests",
+			expectedStatus:   http.StatusOK,
+			expectedRequests: []string{"192.0.2.1", "10.0.0.2"},
+		},
+		{
+			name:           "requester cannot approve",
+			user:           "alice",
+			method:         http.MethodPost,
+			path:           "/api/v1/requests/{alice}/approve",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "admin approves",
+			user:           "admin",
+			method:         http.MethodPost,
+			path:           "/api/v1/requests/{alice}/approve",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "admin approves again",
+			user:           "admin",
+			method:         http.MethodPost,
+			path:           "/api/v1/requests/{alice}/approve",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "admin rejects an unknown request",
+			user:           "admin",
+			method:         http.MethodPost,
+			path:           "/api/v1/requests/abc/reject",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:            "requester sees the approved entry",
+			user:            "alice",
+			method:          http.MethodGet,
+			path:            "/api/v1/entries",
+			expectedStatus:  http.StatusOK,
+			expectedEntries: []string{"192.0.2.1"},
+		},
+		{
+			name:             "requester sees no requests",
+			user:             "alice",
+			method:           http.MethodGet,
+			path:             "/api/v1/requests",
+			expectedStatus:   http.StatusOK,
+			expectedRequests: []string{},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := strings.ReplaceAll(tt.path, "{alice}", id)
+			r := httptest.NewRequest(tt.method, path, strings.NewReader(tt.body))
+			r.SetBasicAuth(tt.user, "123")
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("status: actual: %v expected: %v body: %v", w.Code, tt.expectedStatus, w.Body)
+			}
+
+			if tt.expectedRequests != nil {
+				var resp htserver.AccessRequestsResponse
+				noError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+				actual := make([]string, 0, len(resp.Requests))
+				for _, request := range resp.Requests {
+					actual = append(actual, request.IP)
+					if request.Owner == "alice" {
+						id = request.ID
+					}
+				}
+				if strings.Join(actual, ",") != strings.Join(tt.expectedRequests, ",") {
+					t.Errorf("requests: actual: %v expected: %v", actual, tt.expectedRequests)
+				}
+			}
+
+			if tt.expectedEntries != nil {
+				var resp htserver.EntriesResponse
+				noError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+				actual := make([]string, 0, len(resp.Entries))
+				for _, entry := range resp.Entries {
+					actual = append(actual, entry.IP)
+				}
+				if strings.Join(actual, ",") != strings.Join(tt.expectedEntries, ",") {
+					t.Errorf("entries: actual: %v expected: %v", actual, tt.expectedEntries)
+				}
+			}
+		})
+	}
+
+	entry, err := service.Find("192.0.2.1")
+	noError(t, err)
+	if entry.Owner != "alice" {
+		t.Errorf("owner: actual: %v expected: alice", entry.Owner)
+	}
+}
+
+func TestApprovalLinks(t *testing.T) {
+	links := htserver.NewApprovalLinks("http://ipfilter.test/")
+	trail := audit.NewTrail()
+	service, mux := newRequestTestMux(links, trail)
+
+	approved, err := service.RequestIPCtx(context.Background(), "10.0.0.1", "deploy", firewall.WithOwner("alice"))
+	noError(t, err)
+	rejected, err := service.RequestIPCtx(context.Background(), "10.0.0.2", "deploy", firewall.WithOwner("bob"))
+	noError(t, err)
+
+	for _, tt := range []struct {
+		name           string
+		user           string
+		method         string
+		link           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "anonymous is sent to the login",
+			method:         http.MethodGet,
+			link:           links.URL(approved.ID, htserver.ActionApprove),
+			expectedStatus: http.StatusSeeOther,
+			expectedBody:   `/login?next=%2Frequests%2F` + approved.ID,
+		},
+		{
+			name:           "anonymous cannot approve",
+			method:         http.MethodPost,
+			link:           links.URL(approved.ID, htserver.ActionApprove),
+			expectedStatus: http.StatusSeeOther,
+		},
+		{
+			name:           "requester cannot open the link",
+			user:           "alice",
+			method:         http.MethodGet,
+			link:           links.URL(approved.ID, htserver.ActionApprove),
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "requester cannot approve",
+			user:           "alice",
+			method:         http.MethodPost,
+			link:           links.URL(approved.ID, htserver.ActionApprove),
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "show the request",
+			user:           "admin",
+			method:         http.MethodGet,
+			link:           links.URL(approved.ID, htserver.ActionApprove),
+			expectedStatus: http.StatusOK,
+			expectedBody:   `value="approve"`,
+		},
+		{
+			name:           "invalid signature",
+			user:           "admin",
+			method:         http.MethodGet,
+			link:           links.URL(approved.ID, htserver.ActionApprove) + "x",
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "The link is invalid.",
+		},
+		{
+			name:           "signature of another action",
+			user:           "admin",
+			method:         http.MethodPost,
+			link:           strings.Replace(links.URL(approved.ID, htserver.ActionReject), "/reject?", "/approve?", 1),
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "The link is invalid.",
+		},
+		{
+			name:           "signature of another request",
+			user:           "admin",
+			method:         http.MethodPost,
+			link:           strings.Replace(links.URL(approved.ID, htserver.ActionReject), approved.ID, rejected.ID, 1),
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "The link is invalid.",
+		},
+		{
+			name:           "approve",
+			user:           "admin",
+			method:         http.MethodPost,
+			link:           links.URL(approved.ID, htserver.ActionApprove),
+			expectedStatus: http.StatusOK,
+			expectedBody:   "The request has been approved.",
+		},
+		{
+			name:           "approve again",
+			user:           "admin",
+			method:         http.MethodPost,
+			link:           links.URL(approved.ID, htserver.ActionApprove),
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "already been approved or rejected",
+		},
+		{
+			name:           "reject",
+			user:           "admin",
+			method:         http.MethodPost,
+			link:           links.URL(rejected.ID, htserver.ActionReject),
+			expectedStatus: http.StatusOK,
+			expectedBody:   "The request has been rejected.",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			link, err := url.Parse(tt.link)
+			noError(t, err)
+
+			var body string
+			if tt.method == http.MethodPost {
+				form := link.Query()
+				form.Set(htserver.CSRFFieldName, csrfToken)
+				body = form.Encode()
+				link.RawQuery = ""
+			}
+
+			r := httptest.NewRequest(tt.method, link.String(), strings.NewReader(body))
+			if len(tt.user) > 0 {
+				r.SetBasicAuth(tt.user, "123")
+			}
+			if len(body) > 0 {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				r.AddCookie(&http.Cookie{Name: "ipfilter_csrf", Value: csrfToken})
+			}
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("status: actual: %v expected: %v body: %v", w.Code, tt.expectedStatus, w.Body)
+			}
+			if !strings.Contains(w.Body.String(), tt.expectedBody) {
+				t.Errorf("body: actual: %v expected to contain: %v", w.Body, tt.expectedBody)
+			}
+		})
+	}
+
+	if !service.Contains("10.0.0.1") {
+		t.Error("approved ip not allowed")
+	}
+	if service.Contains("10.0.0.2") {
+		t.Error("rejected ip allowed")
+	}
+	if requests := service.Requests(); len(requests) != 0 {
+		t.Errorf("requests: actual: %v expected: none", requests)
+	}
+
+	// the admin opening the link decides the request
+	decided := 0
+	for _, event := range trail.List() {
+		if event.Action == "request.approve" || event.Action == "request.reject" {
+			decided++
+			if event.User != "admin" {
+				t.Errorf("%v: user: actual: %q expected: admin", event.Action, event.User)
+			}
+		}
+	}
+	if decided != 2 {
+		t.Errorf("decided audit events: actual: %v expected: 2", decided)
+	}
+}
@@ -0,0 +1,112 @@
+package htserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/audit"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"net/http"
+	"time"
+)
+
+var errForbidden = errors.New("forbidden")
+
+// requireRole calls forbidden instead of the next handler when the user has not the role.
+func requireRole(role auth.Role, trail *audit.Trail, forbidden func(w http.ResponseWriter, r *http.Request, err error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user := auth.UserFromContext(r.Context()); !user.HasRole(role) {
+				err := fmt.Errorf("%v %v requires role %v: %w", r.Method, r.URL.Path, role, errForbidden)
+				recordEvent(trail, r, "access", r.URL.Path, err)
+				forbidden(w, r, err)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func formForbidden(w http.ResponseWriter, _ *http.Request, _ error) {
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
+
+func apiForbidden(w http.ResponseWriter, _ *http.Request, err error) {
+	writeJSONError(w, http.StatusForbidden, "forbidden", err.Error())
+}
+
+// username returns the name of the request's user.
+func username(r *http.Request) string {
+	if user := auth.UserFromContext(r.Context()); user != nil {
+		return user.Username
+	}
+	return ""
+}
+
+// ownedFirewall lets users without the operator role change only their own entries.
+type ownedFirewall struct {
+	Firewall
+}
+
+// AddIPCtx adds a new entry, but renews an existing one only for its owner.
+func (f ownedFirewall) AddIPCtx(ctx context.Context, ip string, opts ...firewall.EntryOption) error {
+	if err := f.authorize(ctx, ip); err != nil && !errors.Is(err, firewall.ErrIPNotFound) {
+		return err
+	}
+	return f.Firewall.AddIPCtx(ctx, ip, opts...)
+}
+
+func (f ownedFirewall) DeleteIPCtx(ctx context.Context, ip string) error {
+	if err := f.authorize(ctx, ip); err != nil {
+		return err
+	}
+	return f.Firewall.DeleteIPCtx(ctx, ip)
+}
+
+func (f ownedFirewall) RenewIPCtx(ctx context.Context, ip string) error {
+	if err := f.authorize(ctx, ip); err != nil {
+		return err
+	}
+	return f.Firewall.RenewIPCtx(ctx, ip)
+}
+
+func (f ownedFirewall) ExtendIPCtx(ctx context.Context, ip string, duration time.Duration) error {
+	if err := f.authorize(ctx, ip); err != nil {
+		return err
+	}
+	return f.Firewall.ExtendIPCtx(ctx, ip, duration)
+}
+
+func (f ownedFirewall) authorize(ctx context.Context, ip string) error {
+	user := auth.UserFromContext(ctx)
+	if user.HasRole(auth.RoleOperator) {
+		return nil
+	}
+
+	entry, err := f.Find(ip)
+	if err != nil {
+		return err
+	}
+	if user == nil || entry.Owner != user.Username {
+		return fmt.Errorf("ip %v is not owned by the user: %w", ip, errForbidden)
+	}
+
+	return nil
+}
+
+// visibleEntries returns the entries the user can see: all for operators, otherwise only the user's own.
+func visibleEntries(user *auth.User, entries []firewall.IPEntry) []firewall.IPEntry {
+	if user.HasRole(auth.RoleOperator) {
+		return entries
+	}
+
+	visible := make([]firewall.IPEntry, 0, len(entries))
+	for _, entry := range entries {
+		if user != nil && entry.Owner == user.Username {
+			visible = append(visible, entry)
+		}
+	}
+	return visible
+}
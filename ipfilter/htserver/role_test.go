@@ -0,0 +1,210 @@
+package htserver_test
+
+import (
+	"encoding/json"
+	"github.com/dkarczmarski/gomisc/ipfilter/audit"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/htserver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoles(t *testing.T) {
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(nopBackend{}),
+	)
+	users := auth.NewUsers([]auth.User{
+		{Username: "admin", Password: "123"},
+		{Username: "op", Password: "123"},
+		{Username: "alice", Password: "123"},
+		{Username: "bob", Password: "123"},
+	})
+	roles := auth.NewRoles(map[string]auth.Role{
+		"admin": auth.RoleAdmin,
+		"op":    auth.RoleOperator,
+	}, auth.RoleSelfService)
+	trail := audit.NewTrail()
+
+	mux := htserver.NewServeMux(service,
+		htserver.WithUsers(users),
+		htserver.WithRoles(roles),
+		htserver.WithAuditTrail(trail),
+	)
+
+	// the steps share the state of the service
+	for _, tt := range []struct {
+		name            string
+		user            string
+		method          string
+		path            string
+		body            string
+		expectedStatus  int
+		expectedEntries []string
+	}{
+		{
+			name:           "self-service adds own ip",
+			user:           "alice",
+			method:         http.MethodPost,
+			path:           "/api/v1/me",
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "self-service cannot add another user's ip",
+			user:           "bob",
+			method:         http.MethodPost,
+			path:           "/api/v1/me",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "self-service cannot add any ip",
+			user:           "alice",
+			method:         http.MethodPost,
+			path:           "/api/v1/entries",
+			body:           `{"ip": "10.0.0.1"}`,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "operator adds any ip",
+			user:           "op",
+			method:         http.MethodPost,
+			path:           "/api/v1/entries",
+			body:           `{"ip": "10.0.0.1"}`,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:            "self-service sees only own entries",
+			user:            "alice",
+			method:          http.MethodGet,
+			path:            "/api/v1/entries",
+			expectedStatus:  http.StatusOK,
+			expectedEntries: []string{"192.0.2.1"},
+		},
+		{
+			name:            "another self-service user sees nothing",
+			user:            "bob",
+			method:          http.MethodGet,
+			path:            "/api/v1/entries",
+			expectedStatus:  http.StatusOK,
+			expectedEntries: []string{},
+		},
+		{
+			name:            "operator sees all entries",
+			user:            "op",
+			method:          http.MethodGet,
+			path:            "/api/v1/entries",
+			expectedStatus:  http.StatusOK,
+			expectedEntries: []string{"192.0.2.1", "10.0.0.1"},
+		},
+		{
+			name:           "self-service cannot delete another user's entry",
+			user:           "bob",
+			method:         http.MethodDelete,
+			path:           "/api/v1/entries/192.0.2.1",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "self-service cannot renew another user's entry",
+			user:           "alice",
+			method:         http.MethodPost,
+			path:           "/api/v1/entries/10.0.0.1/renew",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "self-service renews own entry",
+			user:           "alice",
+			method:         http.MethodPost,
+			path:           "/api/v1/entries/192.0.2.1/renew",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "self-service deletes own entry",
+			user:           "alice",
+			method:         http.MethodDelete,
+			path:           "/api/v1/entries/192.0.2.1",
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "operator deletes any entry",
+			user:           "op",
+			method:         http.MethodDelete,
+			path:           "/api/v1/entries/10.0.0.1",
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "operator cannot list sessions",
+			user:           "op",
+			method:         http.MethodGet,
+			path:           "/api/v1/sessions",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "admin lists sessions",
+			user:           "admin",
+			method:         http.MethodGet,
+			path:           "/api/v1/sessions",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "operator cannot read audit",
+			user:           "op",
+			method:         http.MethodGet,
+			path:           "/api/v1/audit",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "admin reads audit",
+			user:           "admin",
+			method:         http.MethodGet,
+			path:           "/api/v1/audit",
+			expectedStatus: http.StatusOK,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r.SetBasicAuth(tt.user, "123")
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("status: actual: %v expected: %v body: %v", w.Code, tt.expectedStatus, w.Body)
+			}
+
+			if tt.expectedEntries != nil {
+				var resp htserver.EntriesResponse
+				noError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+				actual := make([]string, 0, len(resp.Entries))
+				for _, entry := range resp.Entries {
+					actual = append(actual, entry.IP)
+				}
+				if strings.Join(actual, ",") != strings.Join(tt.expectedEntries, ",") {
+					t.Errorf("entries: actual: %v expected: %v", actual, tt.expectedEntries)
+				}
+			}
+		})
+	}
+
+	var denied int
+	for _, event := range trail.List() {
+		if event.Result == audit.ResultDenied {
+			denied++
+		}
+	}
+	if denied != 6 {
+		t.Errorf("denied audit events: actual: %v expected: 6", denied)
+	}
+}
+
+func noError(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,90 +1,414 @@
 package htserver
 
 import (
+	"errors"
+	"github.com/dkarczmarski/gomisc/ipfilter/audit"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
 	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
-	"html/template"
+	"github.com/dkarczmarski/gomisc/ipfilter/metrics"
+	"github.com/dkarczmarski/gomisc/ipfilter/realip"
 	"log"
-	"net"
 	"net/http"
+	"net/url"
+	"time"
 )
 
 type ServeMux struct {
-	mux *http.ServeMux
+	handler http.Handler
 }
 
-func NewServeMux(service *firewall.Service) *ServeMux {
-	mux := http.NewServeMux()
+type config struct {
+	users         *auth.Users
+	sessions      *auth.Sessions
+	authenticator auth.Authenticator
+	roles         *auth.Roles
+	lockout       *auth.Lockout
+	totp          *auth.TOTP
+	oidc          *auth.OIDC
+	apiTokens     *auth.APITokens
+	realIP        *realip.Resolver
+	templates     *Templates
+	trail         *audit.Trail
+	metrics       *metrics.Registry
+	approvalLinks *ApprovalLinks
+}
 
-	mux.HandleFunc("POST /api/me/add", func(w http.ResponseWriter, r *http.Request) {
-		user := HandleBasicAuth(w, r, createAuthFunc(users))
-		if user == nil {
-			log.Println("User not authorized. Redirect to /login")
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
+// WithUsers sets the users allowed to log in with basic auth. The users can be replaced later by Users.Set.
+func WithUsers(users *auth.Users) func(*config) {
+	return func(c *config) {
+		c.users = users
+	}
+}
 
-		HandleAddMe(w, r, service)
-	})
+// WithSessions sets the store of the login sessions.
+func WithSessions(sessions *auth.Sessions) func(*config) {
+	return func(c *config) {
+		c.sessions = sessions
+	}
+}
 
-	mux.HandleFunc("POST /api/me/delete", func(w http.ResponseWriter, r *http.Request) {
-		user := HandleBasicAuth(w, r, createAuthFunc(users))
-		if user == nil {
-			log.Println("User not authorized. Redirect to /login")
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
+// WithAuthenticator sets the authenticator of the requests. By default, basic auth of the users is used.
+// The session cookie is always checked first.
+func WithAuthenticator(authenticator auth.Authenticator) func(*config) {
+	return func(c *config) {
+		c.authenticator = authenticator
+	}
+}
 
-		HandleDeleteMe(w, r, service)
-	})
+// WithRoles sets the roles of the users. By default, all users have the self-service role.
+func WithRoles(roles *auth.Roles) func(*config) {
+	return func(c *config) {
+		c.roles = roles
+	}
+}
 
-	mux.HandleFunc("POST /api/ip/add", func(w http.ResponseWriter, r *http.Request) {
-		user := HandleBasicAuth(w, r, createAuthFunc(users))
-		if user == nil {
-			log.Println("User not authorized. Redirect to /login")
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
+// WithLockout sets the tracking of the failed login attempts. It should be shared with the basic authenticator.
+// By default, a lockout recording to the audit trail is used.
+func WithLockout(lockout *auth.Lockout) func(*config) {
+	return func(c *config) {
+		c.lockout = lockout
+	}
+}
 
-		HandleAddIP(w, r, service)
-	})
+// WithTOTP enables the TOTP second factor. It should be shared with the basic authenticator.
+func WithTOTP(totp *auth.TOTP) func(*config) {
+	return func(c *config) {
+		c.totp = totp
+	}
+}
+
+// WithOIDC enables the single sign-on login with an OpenID Connect identity provider.
+func WithOIDC(oidc *auth.OIDC) func(*config) {
+	return func(c *config) {
+		c.oidc = oidc
+	}
+}
 
-	mux.HandleFunc("POST /api/ip/delete", func(w http.ResponseWriter, r *http.Request) {
-		user := HandleBasicAuth(w, r, createAuthFunc(users))
-		if user == nil {
-			log.Println("User not authorized. Redirect to /login")
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
+// WithAPITokens sets the store of the personal API tokens. By default, the tokens are kept in memory only.
+func WithAPITokens(apiTokens *auth.APITokens) func(*config) {
+	return func(c *config) {
+		c.apiTokens = apiTokens
+	}
+}
+
+// WithRealIP sets the resolver of the client IP of the requests coming through reverse proxies.
+// By default, the address of the connection is used.
+func WithRealIP(resolver *realip.Resolver) func(*config) {
+	return func(c *config) {
+		c.realIP = resolver
+	}
+}
+
+// WithTemplates sets the templates and the static files of the web UI. By default, the embedded ones are used.
+func WithTemplates(templates *Templates) func(*config) {
+	return func(c *config) {
+		c.templates = templates
+	}
+}
+
+// WithAuditTrail sets the audit trail of the user actions.
+func WithAuditTrail(trail *audit.Trail) func(*config) {
+	return func(c *config) {
+		c.trail = trail
+	}
+}
+
+// WithMetrics serves the metrics at /metrics. The service should register its metrics
+// in the same registry (see firewall.WithMetrics).
+func WithMetrics(registry *metrics.Registry) func(*config) {
+	return func(c *config) {
+		c.metrics = registry
+	}
+}
+
+// WithApprovalLinks serves the pages of the signed links approving or rejecting the access requests.
+// The same links should be sent in the notifications.
+func WithApprovalLinks(links *ApprovalLinks) func(*config) {
+	return func(c *config) {
+		c.approvalLinks = links
+	}
+}
+
+func NewServeMux(service *firewall.Service, opts ...func(*config)) *ServeMux {
+	cnf := config{
+		users: auth.NewUsers(nil),
+	}
+	for _, ops := range opts {
+		ops(&cnf)
+	}
+	if cnf.sessions == nil {
+		cnf.sessions = auth.NewSessions()
+	}
+	if cnf.roles == nil {
+		cnf.roles = auth.NewRoles(nil, auth.RoleSelfService)
+	}
+	if cnf.trail == nil {
+		cnf.trail = audit.NewTrail()
+	}
+	if cnf.lockout == nil {
+		lockoutOpts := []auth.LockoutOption{auth.WithLockFunc(RecordLockout(cnf.trail))}
+		if cnf.metrics != nil {
+			lockoutOpts = append(lockoutOpts, auth.WithFailureFunc(CountLoginFailures(cnf.metrics)))
 		}
+		cnf.lockout = auth.NewLockout(lockoutOpts...)
+	}
+	if cnf.apiTokens == nil {
+		// without a file, the store cannot fail
+		cnf.apiTokens, _ = auth.NewAPITokens()
+	}
+	if cnf.templates == nil {
+		templates, err := NewTemplates("")
+		if err != nil {
+			// the embedded templates are checked by the tests
+			panic(err)
+		}
+		cnf.templates = templates
+	}
+	if cnf.authenticator == nil {
+		cnf.authenticator = auth.NewBasicAuthenticator(cnf.users.Authenticate,
+			auth.WithLockout(cnf.lockout), auth.WithTOTP(cnf.totp))
+	}
+	users, sessions, lockout, totp, apiTokens, templates, trail := cnf.users, cnf.sessions, cnf.lockout, cnf.totp, cnf.apiTokens, cnf.templates, cnf.trail
+	authenticator := recordUser(cnf.roles.Authenticator(auth.Chain(sessions, apiTokens, cnf.authenticator)))
+
+	var fw Firewall = auditedFirewall{Firewall: ownedFirewall{Firewall: service}, trail: trail}
 
-		HandleDeleteIP(w, r, service)
+	requireUser := auth.Middleware(authenticator, unauthorized)
+	requireAPIUser := auth.Middleware(authenticator, apiUnauthorized)
+
+	// form protects the state-changing routes of the HTML UI.
+	// The scope limits the users authenticated by an API token.
+	form := func(role auth.Role, scope string, handler http.HandlerFunc) http.Handler {
+		return requireUser(csrfProtect(requireRole(role, trail, formForbidden)(requireScope(scope, trail, formForbidden)(handler))))
+	}
+	formFirewall := func(role auth.Role, scope string, handler func(w http.ResponseWriter, r *http.Request, service Firewall)) http.Handler {
+		return form(role, scope, func(w http.ResponseWriter, r *http.Request) {
+			handler(w, r, fw)
+		})
+	}
+
+	api := func(role auth.Role, scope string, handler http.HandlerFunc) http.Handler {
+		return apiOriginProtect(requireAPIUser(requireRole(role, trail, apiForbidden)(requireScope(scope, trail, apiForbidden)(handler))))
+	}
+	apiFirewall := func(role auth.Role, scope string, handler func(w http.ResponseWriter, r *http.Request, service Firewall)) http.Handler {
+		return api(role, scope, func(w http.ResponseWriter, r *http.Request) {
+			handler(w, r, fw)
+		})
+	}
+
+	startedAt := time.Now()
+
+	mux := http.NewServeMux()
+
+	mux.Handle("GET /static/", templates.StaticHandler())
+
+	// the probes of a supervisor or a load balancer are not authenticated
+	mux.HandleFunc("GET /healthz", HandleHealthz)
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		HandleReadyz(w, r, service)
 	})
+	mux.Handle("GET /status", api(auth.RoleOperator, auth.ScopeStatusRead, func(w http.ResponseWriter, r *http.Request) {
+		HandleAPIStatus(w, r, service, startedAt)
+	}))
+	if cnf.metrics != nil {
+		mux.Handle("GET /metrics", api(auth.RoleOperator, auth.ScopeStatusRead, cnf.metrics.Handler().ServeHTTP))
+	}
 
-	mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
-		user := HandleBasicAuth(w, r, createAuthFunc(users))
-		log.Printf("user: %+v", user)
-		if user == nil {
-			return
-		}
+	// the links are sent to the chats, so they only select the action: an admin still has to log in
+	if links := cnf.approvalLinks; links != nil {
+		mux.Handle("GET /requests/{id}/{action}", requireUser(requireRole(auth.RoleAdmin, trail, formForbidden)(
+			requireScope(auth.ScopeRequestsWrite, trail, formForbidden)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				HandleRequestLink(w, r, fw, links, templates)
+			})))))
+		mux.Handle("POST /requests/{id}/{action}", formFirewall(auth.RoleAdmin, auth.ScopeRequestsWrite, func(w http.ResponseWriter, r *http.Request, service Firewall) {
+			HandleRequestLinkAction(w, r, service, links, templates)
+		}))
+	}
 
-		templ := template.Must(template.ParseFiles("templates/index.html"))
+	login := &loginHandler{
+		users:     users,
+		roles:     cnf.roles,
+		sessions:  sessions,
+		lockout:   lockout,
+		totp:      totp,
+		oidc:      cnf.oidc,
+		templates: templates,
+		trail:     trail,
+	}
+	mux.HandleFunc("GET /login", login.handleForm)
+	mux.Handle("POST /login", csrfProtect(http.HandlerFunc(login.handleLogin)))
+	if cnf.oidc != nil {
+		mux.HandleFunc("GET /login/oidc", login.handleOIDC)
+		mux.HandleFunc("GET /login/oidc/callback", login.handleOIDCCallback)
+	}
+	mux.Handle("POST /logout", csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleLogout(w, r, sessions, trail)
+	})))
 
-		host, _, _ := net.SplitHostPort(r.RemoteAddr)
-		entries := service.List()
+	// self-service users can change only their own entries, which is checked by ownedFirewall
+	mux.Handle("POST /api/me/add", formFirewall(auth.RoleSelfService, auth.ScopeMeAdd, HandleAddMe))
+	mux.Handle("POST /api/me/delete", formFirewall(auth.RoleSelfService, auth.ScopeMeDelete, HandleDeleteMe))
+	mux.Handle("POST /api/ip/add", formFirewall(auth.RoleOperator, auth.ScopeEntriesWrite, HandleAddIP))
+	mux.Handle("POST /api/ip/delete", formFirewall(auth.RoleSelfService, auth.ScopeEntriesWrite, HandleDeleteIP))
+	mux.Handle("POST /api/ip/extend", formFirewall(auth.RoleSelfService, auth.ScopeEntriesWrite, HandleExtendIP))
+	mux.Handle("POST /api/requests/create", formFirewall(auth.RoleRequester, auth.ScopeRequestsWrite, HandleCreateRequest))
+	mux.Handle("POST /api/requests/approve", formFirewall(auth.RoleAdmin, auth.ScopeRequestsWrite, HandleApproveRequest))
+	mux.Handle("POST /api/requests/reject", formFirewall(auth.RoleAdmin, auth.ScopeRequestsWrite, HandleRejectRequest))
+	mux.Handle("POST /api/sessions/revoke", form(auth.RoleAdmin, auth.ScopeAll, func(w http.ResponseWriter, r *http.Request) {
+		HandleRevokeSession(w, r, sessions, trail)
+	}))
+	mux.Handle("POST /api/lockouts/unlock", form(auth.RoleAdmin, auth.ScopeAll, func(w http.ResponseWriter, r *http.Request) {
+		HandleUnlock(w, r, lockout, trail)
+	}))
 
-		if err := templ.Execute(w, map[string]interface{}{
-			"MyIP":    host,
-			"User":    user,
-			"Entries": entries,
-		}); err != nil {
-			log.Fatal(err)
+	if totp != nil {
+		mux.Handle("POST /api/totp/enroll", form(auth.RoleSelfService, auth.ScopeAll, func(w http.ResponseWriter, r *http.Request) {
+			HandleTOTPEnroll(w, r, totp, templates, trail)
+		}))
+		mux.Handle("POST /api/totp/confirm", form(auth.RoleSelfService, auth.ScopeAll, func(w http.ResponseWriter, r *http.Request) {
+			HandleTOTPConfirm(w, r, totp, templates, trail)
+		}))
+		mux.Handle("POST /api/totp/disable", form(auth.RoleSelfService, auth.ScopeAll, func(w http.ResponseWriter, r *http.Request) {
+			HandleTOTPDisable(w, r, totp, trail)
+		}))
+		mux.Handle("POST /api/totp/reset", form(auth.RoleAdmin, auth.ScopeAll, func(w http.ResponseWriter, r *http.Request) {
+			HandleTOTPReset(w, r, totp, trail)
+		}))
+		mux.Handle("DELETE /api/v1/totp/{username}", api(auth.RoleAdmin, auth.ScopeAll, func(w http.ResponseWriter, r *http.Request) {
+			HandleAPIResetTOTP(w, r, totp, trail)
+		}))
+	}
+
+	// requesters see their approved entries
+	mux.Handle("GET /api/v1/entries", apiFirewall(auth.RoleRequester, auth.ScopeEntriesRead, HandleAPIListEntries))
+	mux.Handle("POST /api/v1/entries", apiFirewall(auth.RoleOperator, auth.ScopeEntriesWrite, HandleAPIAddEntry))
+	mux.Handle("DELETE /api/v1/entries/{ip}", apiFirewall(auth.RoleSelfService, auth.ScopeEntriesWrite, HandleAPIDeleteEntry))
+	mux.Handle("POST /api/v1/entries/{ip}/renew", apiFirewall(auth.RoleSelfService, auth.ScopeEntriesWrite, HandleAPIRenewEntry))
+	mux.Handle("GET /api/v1/events", api(auth.RoleRequester, auth.ScopeEntriesRead, func(w http.ResponseWriter, r *http.Request) {
+		HandleAPIEvents(w, r, service)
+	}))
+	mux.Handle("GET /api/v1/me", apiFirewall(auth.RoleSelfService, auth.ScopeMeRead, HandleAPIGetMe))
+	mux.Handle("POST /api/v1/me", apiFirewall(auth.RoleSelfService, auth.ScopeMeAdd, HandleAPIAddMe))
+	mux.Handle("DELETE /api/v1/me", apiFirewall(auth.RoleSelfService, auth.ScopeMeDelete, HandleAPIDeleteMe))
+	mux.Handle("GET /api/v1/requests", apiFirewall(auth.RoleRequester, auth.ScopeRequestsRead, HandleAPIListRequests))
+	mux.Handle("POST /api/v1/requests", apiFirewall(auth.RoleRequester, auth.ScopeRequestsWrite, HandleAPICreateRequest))
+	mux.Handle("POST /api/v1/requests/{id}/approve", apiFirewall(auth.RoleAdmin, auth.ScopeRequestsWrite, HandleAPIApproveRequest))
+	mux.Handle("POST /api/v1/requests/{id}/reject", apiFirewall(auth.RoleAdmin, auth.ScopeRequestsWrite, HandleAPIRejectRequest))
+	mux.Handle("GET /api/v1/sessions", api(auth.RoleAdmin, auth.ScopeAll, func(w http.ResponseWriter, r *http.Request) {
+		HandleAPIListSessions(w, r, sessions)
+	}))
+	mux.Handle("DELETE /api/v1/sessions/{id}", api(auth.RoleAdmin, auth.ScopeAll, func(w http.ResponseWriter, r *http.Request) {
+		HandleAPIRevokeSession(w, r, sessions, trail)
+	}))
+	mux.Handle("GET /api/v1/lockouts", api(auth.RoleAdmin, auth.ScopeAll, func(w http.ResponseWriter, r *http.Request) {
+		HandleAPIListLockouts(w, r, lockout)
+	}))
+	mux.Handle("DELETE /api/v1/lockouts/{kind}/{key}", api(auth.RoleAdmin, auth.ScopeAll, func(w http.ResponseWriter, r *http.Request) {
+		HandleAPIUnlock(w, r, lockout, trail)
+	}))
+	mux.Handle("GET /api/v1/audit", api(auth.RoleAdmin, auth.ScopeAll, func(w http.ResponseWriter, r *http.Request) {
+		HandleAPIListAudit(w, r, trail)
+	}))
+
+	mux.Handle("POST /api/tokens/create", form(auth.RoleSelfService, auth.ScopeAll, func(w http.ResponseWriter, r *http.Request) {
+		HandleCreateAPIToken(w, r, apiTokens, templates, trail)
+	}))
+	mux.Handle("POST /api/tokens/revoke", form(auth.RoleSelfService, auth.ScopeAll, func(w http.ResponseWriter, r *http.Request) {
+		HandleRevokeAPIToken(w, r, apiTokens, trail)
+	}))
+	mux.Handle("GET /api/v1/tokens", api(auth.RoleSelfService, auth.ScopeAll, func(w http.ResponseWriter, r *http.Request) {
+		HandleAPIListAPITokens(w, r, apiTokens)
+	}))
+	mux.Handle("POST /api/v1/tokens", api(auth.RoleSelfService, auth.ScopeAll, func(w http.ResponseWriter, r *http.Request) {
+		HandleAPICreateAPIToken(w, r, apiTokens, trail)
+	}))
+	mux.Handle("DELETE /api/v1/tokens/{id}", api(auth.RoleSelfService, auth.ScopeAll, func(w http.ResponseWriter, r *http.Request) {
+		HandleAPIRevokeAPIToken(w, r, apiTokens, trail)
+	}))
+
+	mux.HandleFunc("GET /api/openapi.json", HandleOpenAPI)
+
+	mux.Handle("GET /", requireUser(requireScope(auth.ScopeAll, trail, formForbidden)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := auth.UserFromContext(r.Context())
+		log.Printf("user: %+v", user)
+
+		host := realip.FromRequest(r)
+		entries := visibleEntries(user, service.List())
+		session, hasSession := sessions.Current(r)
+
+		data := map[string]interface{}{
+			"MyIP":          host,
+			"User":          user,
+			"Entries":       entries,
+			"DefaultTTL":    service.DefaultTTL(),
+			"IsSelfService": user.HasRole(auth.RoleSelfService),
+			"IsOperator":    user.HasRole(auth.RoleOperator),
+			"IsAdmin":       user.HasRole(auth.RoleAdmin),
+			"HasSession":    hasSession,
+			"SessionID":     session.ID,
+			"CSRFToken":     csrfToken(w, r),
+			"Flash":         popFlash(w, r),
+			"APITokens":     visibleAPITokens(user, apiTokens),
+			"Scopes":        auth.Scopes,
+			"Requests":      visibleRequests(user, service.Requests()),
+		}
+		if totp != nil {
+			data["TOTP"] = true
+			data["TOTPEnabled"] = totp.Enabled(user.Username)
+			data["RecoveryCodesLeft"] = totp.RecoveryCodesLeft(user.Username)
+		}
+		if user.HasRole(auth.RoleAdmin) {
+			data["Sessions"] = sessions.List()
+			data["Lockouts"] = lockout.List()
+			if totp != nil {
+				data["TOTPUsers"] = totp.Users()
+			}
+			data["AuditEvents"] = limitEvents(trail.List(), 50)
 		}
-	})
+
+		templates.Render(w, http.StatusOK, "index.html", data)
+	}))))
+
+	// the access log is inside realIP to log the client IP, and outside recoverPanic to log the panics
+	handler := accessLog(recoverPanic(templates)(mux))
+	handler = securityHeaders(cnf.realIP.Middleware(handler))
 
 	return &ServeMux{
-		mux: mux,
+		handler: requestID(handler),
+	}
+}
+
+func limitEvents(events []audit.Event, n int) []audit.Event {
+	if len(events) > n {
+		return events[:n]
 	}
+	return events
+}
+
+// unauthorized sends the browser to the login page.
+func unauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, auth.ErrInvalidAuthHeader):
+		log.Printf("user not authorized: %v", err)
+		http.Error(w, "Invalid authorization header", http.StatusBadRequest)
+		return
+	case errors.Is(err, auth.ErrLockedOut):
+		log.Printf("user not authorized: %v", err)
+		setRetryAfter(w, err)
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	// the page is shown after the login, e.g. a link from a notification
+	location := "/login"
+	if r.Method == http.MethodGet && r.URL.Path != "/" {
+		location += "?next=" + url.QueryEscape(r.URL.RequestURI())
+	}
+
+	log.Printf("user not authorized: %v. Redirect to %v", err, location)
+	http.Redirect(w, r, location, http.StatusSeeOther)
 }
 
 func (srv *ServeMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	srv.mux.ServeHTTP(w, r)
+	srv.handler.ServeHTTP(w, r)
 }
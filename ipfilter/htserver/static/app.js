@@ -0,0 +1,12 @@
+// app.js asks for a confirmation before submitting the forms or the buttons with a data-confirm message.
+(function () {
+    "use strict";
+
+    document.addEventListener("submit", function (event) {
+        const submitter = event.submitter;
+        const message = (submitter && submitter.dataset.confirm) || event.target.dataset.confirm;
+        if (message && !window.confirm(message)) {
+            event.preventDefault();
+        }
+    });
+})();
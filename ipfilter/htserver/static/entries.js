@@ -0,0 +1,182 @@
+// entries.js keeps the entries table up to date with the events of /api/v1/events,
+// counts down the time left to the expiry of the entries, and filters and sorts the rows.
+(function () {
+    "use strict";
+
+    const table = document.getElementById("entries");
+    const rowTemplate = document.getElementById("entry-row");
+    if (!table || !rowTemplate) {
+        return;
+    }
+    const tbody = table.tBodies[0];
+    const filterInput = document.getElementById("entries-filter");
+    const sortSelect = document.getElementById("entries-sort");
+    const selectAll = document.getElementById("entries-all");
+
+    function pad(n) {
+        return String(n).padStart(2, "0");
+    }
+
+    // formatTime formats a time like the server does: 2006-01-02 15:04:05.
+    function formatTime(value) {
+        const t = new Date(value);
+        return t.getFullYear() + "-" + pad(t.getMonth() + 1) + "-" + pad(t.getDate()) + " " +
+            pad(t.getHours()) + ":" + pad(t.getMinutes()) + ":" + pad(t.getSeconds());
+    }
+
+    function formatCountdown(expiresAt) {
+        const seconds = Math.floor((Date.parse(expiresAt) - Date.now()) / 1000);
+        if (seconds <= 0) {
+            return "expired";
+        }
+        const h = Math.floor(seconds / 3600);
+        const m = Math.floor(seconds % 3600 / 60);
+        const s = seconds % 60;
+        if (h > 0) {
+            return "in " + h + "h" + pad(m) + "m" + pad(s) + "s";
+        }
+        if (m > 0) {
+            return "in " + m + "m" + pad(s) + "s";
+        }
+        return "in " + s + "s";
+    }
+
+    function field(row, name) {
+        return row.querySelector("[data-field=" + name + "]");
+    }
+
+    function findRow(ip) {
+        for (const row of tbody.rows) {
+            if (row.dataset.ip === ip) {
+                return row;
+            }
+        }
+        return null;
+    }
+
+    function fillRow(row, entry) {
+        row.dataset.ip = entry.ip;
+        row.dataset.created = entry.created_at;
+        field(row, "ip").textContent = entry.ip;
+        field(row, "label").textContent = entry.label || "";
+        field(row, "created").textContent = formatTime(entry.created_at);
+        field(row, "updated").textContent = "@" + formatTime(entry.updated_at);
+        field(row, "expires").dataset.expires = entry.expires_at;
+        field(row, "owner").textContent = entry.owner || "";
+        for (const input of row.querySelectorAll("input[name=ip]")) {
+            input.value = entry.ip;
+        }
+        // the requesters cannot change the entries, so the forms are missing
+        const deleteForm = row.querySelector("form[action='/api/ip/delete']");
+        if (deleteForm) {
+            deleteForm.dataset.confirm = "Delete " + entry.ip + "?";
+        }
+    }
+
+    function newRow(entry) {
+        const row = rowTemplate.content.firstElementChild.cloneNode(true);
+        fillRow(row, entry);
+        return row;
+    }
+
+    function matches(row, filter) {
+        if (!filter) {
+            return true;
+        }
+        return ["ip", "owner", "label"].some(function (name) {
+            return field(row, name).textContent.toLowerCase().includes(filter);
+        });
+    }
+
+    function compareRows(sort) {
+        const desc = sort.startsWith("-");
+        const key = sort.replace(/^-/, "");
+        return function (a, b) {
+            const valueA = key === "expires" ? Date.parse(field(a, "expires").dataset.expires) : Date.parse(a.dataset.created);
+            const valueB = key === "expires" ? Date.parse(field(b, "expires").dataset.expires) : Date.parse(b.dataset.created);
+            return desc ? valueB - valueA : valueA - valueB;
+        };
+    }
+
+    function update() {
+        const rows = Array.from(tbody.rows).sort(compareRows(sortSelect ? sortSelect.value : "created"));
+        const filter = filterInput ? filterInput.value.trim().toLowerCase() : "";
+
+        let index = 0;
+        for (const row of rows) {
+            // appending an attached row moves it
+            tbody.appendChild(row);
+            row.hidden = !matches(row, filter);
+            if (!row.hidden) {
+                field(row, "index").textContent = index++;
+            }
+        }
+        tick();
+    }
+
+    function tick() {
+        for (const cell of tbody.querySelectorAll("[data-expires]")) {
+            cell.textContent = formatCountdown(cell.dataset.expires);
+        }
+    }
+
+    function onEntry(handler) {
+        return function (event) {
+            handler(JSON.parse(event.data));
+            update();
+        };
+    }
+
+    const upsert = onEntry(function (entry) {
+        const row = findRow(entry.ip);
+        if (row) {
+            fillRow(row, entry);
+        } else {
+            tbody.appendChild(newRow(entry));
+        }
+    });
+    const remove = onEntry(function (entry) {
+        const row = findRow(entry.ip);
+        if (row) {
+            row.remove();
+        }
+    });
+
+    if (filterInput) {
+        filterInput.addEventListener("input", update);
+    }
+    if (sortSelect) {
+        sortSelect.addEventListener("change", update);
+    }
+    if (selectAll) {
+        // selects only the rows left by the filter
+        selectAll.addEventListener("change", function () {
+            for (const row of tbody.rows) {
+                row.querySelector("input[type=checkbox]").checked = selectAll.checked && !row.hidden;
+            }
+        });
+    }
+
+    update();
+    setInterval(tick, 1000);
+
+    if (!window.EventSource) {
+        return;
+    }
+    // EventSource reconnects by itself, and every connection starts with all entries
+    const source = new EventSource(table.dataset.events);
+    source.addEventListener("entries", onEntry(function (data) {
+        const checked = new Set(Array.from(tbody.querySelectorAll("input[type=checkbox]:checked"), function (input) {
+            return input.value;
+        }));
+        tbody.replaceChildren.apply(tbody, data.entries.map(function (entry) {
+            const row = newRow(entry);
+            row.querySelector("input[type=checkbox]").checked = checked.has(entry.ip);
+            return row;
+        }));
+    }));
+    source.addEventListener("add", upsert);
+    source.addEventListener("renew", upsert);
+    source.addEventListener("delete", remove);
+    source.addEventListener("expire", remove);
+})();
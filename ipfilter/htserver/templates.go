@@ -0,0 +1,130 @@
+package htserver
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+)
+
+// assets are the HTML templates and the static files of the web UI.
+//
+//go:embed templates static
+var assets embed.FS
+
+// Templates renders the pages of the web UI. The embedded templates are parsed once.
+// In the development mode, they are parsed from the disk on every request.
+type Templates struct {
+	fsys      fs.FS
+	dev       bool
+	templates map[string]*template.Template
+}
+
+// NewTemplates parses the embedded templates. With a non-empty devDir the templates and the
+// static files are read from devDir/templates and devDir/static instead, e.g. './htserver'.
+func NewTemplates(devDir string) (*Templates, error) {
+	t := &Templates{
+		fsys: assets,
+	}
+	if len(devDir) > 0 {
+		t.fsys = os.DirFS(devDir)
+		t.dev = true
+		return t, nil
+	}
+
+	templates, err := parseTemplates(t.fsys)
+	if err != nil {
+		return nil, err
+	}
+	t.templates = templates
+
+	return t, nil
+}
+
+func parseTemplates(fsys fs.FS) (map[string]*template.Template, error) {
+	names, err := fs.Glob(fsys, "templates/*.html")
+	if err != nil {
+		return nil, fmt.Errorf("fs.Glob(): %w", err)
+	}
+
+	templates := make(map[string]*template.Template, len(names))
+	for _, name := range names {
+		templ, err := template.ParseFS(fsys, name)
+		if err != nil {
+			return nil, fmt.Errorf("template.ParseFS(): %w", err)
+		}
+		templates[path.Base(name)] = templ
+	}
+
+	return templates, nil
+}
+
+func (t *Templates) lookup(name string) (*template.Template, error) {
+	if t.dev {
+		templ, err := template.ParseFS(t.fsys, "templates/"+name)
+		if err != nil {
+			return nil, fmt.Errorf("template.ParseFS(): %w", err)
+		}
+		return templ, nil
+	}
+
+	templ, ok := t.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("template %v not found", name)
+	}
+	return templ, nil
+}
+
+// Render writes the page with the status. The page is rendered to a buffer first,
+// so a template error results in the error page instead of a partial one.
+func (t *Templates) Render(w http.ResponseWriter, status int, name string, data map[string]interface{}) {
+	var buf bytes.Buffer
+	templ, err := t.lookup(name)
+	if err == nil {
+		err = templ.Execute(&buf, data)
+	}
+	if err != nil {
+		log.Printf("render %v: %v", name, err)
+		t.renderError(w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = buf.WriteTo(w)
+}
+
+func (t *Templates) renderError(w http.ResponseWriter, status int) {
+	var buf bytes.Buffer
+	templ, err := t.lookup("error.html")
+	if err == nil {
+		err = templ.Execute(&buf, map[string]interface{}{
+			"Status":     status,
+			"StatusText": http.StatusText(status),
+		})
+	}
+	if err != nil {
+		log.Printf("render error.html: %v", err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = buf.WriteTo(w)
+}
+
+// StaticHandler serves the static files of the web UI under /static/.
+func (t *Templates) StaticHandler() http.Handler {
+	static, err := fs.Sub(t.fsys, "static")
+	if err != nil {
+		// fs.Sub fails only for an invalid path
+		panic(err)
+	}
+	return http.StripPrefix("/static/", http.FileServerFS(static))
+}
@@ -0,0 +1,128 @@
+package htserver_test
+
+import (
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/htserver"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTemplates(t *testing.T) {
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(nopBackend{}),
+	)
+	users := auth.NewUsers([]auth.User{{Username: "alice", Password: "123"}})
+	mux := htserver.NewServeMux(service, htserver.WithUsers(users))
+
+	for _, tt := range []struct {
+		name                string
+		path                string
+		basicAuth           bool
+		expectedStatus      int
+		expectedContentType string
+		expectedBody        string
+	}{
+		{
+			name:                "login page",
+			path:                "/login",
+			expectedStatus:      http.StatusOK,
+			expectedContentType: "text/html; charset=utf-8",
+			expectedBody:        `<form action="/login" method="post"`,
+		},
+		{
+			name:                "index page",
+			path:                "/",
+			basicAuth:           true,
+			expectedStatus:      http.StatusOK,
+			expectedContentType: "text/html; charset=utf-8",
+			expectedBody:        "alice",
+		},
+		{
+			name:                "static file",
+			path:                "/static/style.css",
+			expectedStatus:      http.StatusOK,
+			expectedContentType: "text/css; charset=utf-8",
+			expectedBody:        "body",
+		},
+		{
+			name:           "missing static file",
+			path:           "/static/missing.css",
+			expectedStatus: http.StatusNotFound,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.basicAuth {
+				r.SetBasicAuth("alice", "123")
+			}
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("status: actual: %v expected: %v", w.Code, tt.expectedStatus)
+			}
+			if len(tt.expectedContentType) > 0 && w.Header().Get("Content-Type") != tt.expectedContentType {
+				t.Errorf("content type: actual: %v expected: %v", w.Header().Get("Content-Type"), tt.expectedContentType)
+			}
+			if !strings.Contains(w.Body.String(), tt.expectedBody) {
+				t.Errorf("body does not contain %q: %v", tt.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestTemplatesDevDir(t *testing.T) {
+	dir := t.TempDir()
+	noError(t, os.Mkdir(filepath.Join(dir, "templates"), 0o755))
+	noError(t, os.Mkdir(filepath.Join(dir, "static"), 0o755))
+	noError(t, os.WriteFile(filepath.Join(dir, "templates", "login.html"), []byte("login {{.Error}}"), 0o644))
+	noError(t, os.WriteFile(filepath.Join(dir, "templates", "error.html"), []byte("error {{.Status}}"), 0o644))
+
+	templates, err := htserver.NewTemplates(dir)
+	noError(t, err)
+
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(nopBackend{}),
+	)
+	users := auth.NewUsers([]auth.User{{Username: "alice", Password: "123"}})
+	mux := htserver.NewServeMux(service, htserver.WithUsers(users), htserver.WithTemplates(templates))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.SetBasicAuth("alice", "123")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get("/login"); w.Code != http.StatusOK || w.Body.String() != "login " {
+		t.Fatalf("unexpected response: %v %q", w.Code, w.Body.String())
+	}
+
+	// the changes are visible without a restart
+	noError(t, os.WriteFile(filepath.Join(dir, "templates", "login.html"), []byte("changed"), 0o644))
+	if w := get("/login"); w.Body.String() != "changed" {
+		t.Fatalf("unexpected body: %q", w.Body.String())
+	}
+
+	// a broken template results in the error page instead of a crash
+	noError(t, os.WriteFile(filepath.Join(dir, "templates", "index.html"), []byte("{{.Broken"), 0o644))
+	if w := get("/"); w.Code != http.StatusInternalServerError || w.Body.String() != "error 500" {
+		t.Fatalf("unexpected response: %v %q", w.Code, w.Body.String())
+	}
+
+	// without the error page, a plain text error is sent
+	noError(t, os.Remove(filepath.Join(dir, "templates", "error.html")))
+	if w := get("/"); w.Code != http.StatusInternalServerError || !strings.HasPrefix(w.Body.String(), "Internal Server Error") {
+		t.Fatalf("unexpected response: %v %q", w.Code, w.Body.String())
+	}
+}
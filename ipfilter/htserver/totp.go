@@ -0,0 +1,109 @@
+package htserver
+
+import (
+	"errors"
+	"github.com/dkarczmarski/gomisc/ipfilter/audit"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"log"
+	"net/http"
+)
+
+// HandleTOTPEnroll starts the enrollment of the user's second factor and shows its secret.
+func HandleTOTPEnroll(w http.ResponseWriter, r *http.Request, totp *auth.TOTP, templates *Templates, trail *audit.Trail) {
+	enrollment, err := totp.Enroll(username(r))
+	recordEvent(trail, r, "totp.enroll", username(r), err)
+	if err != nil {
+		redirectWithFlash(w, r, flashError, "Two-factor authentication is already enabled")
+		return
+	}
+
+	renderTOTP(w, r, templates, http.StatusOK, map[string]interface{}{
+		"Enrollment": enrollment,
+	})
+}
+
+// HandleTOTPConfirm enables the pending second factor and shows the recovery codes.
+func HandleTOTPConfirm(w http.ResponseWriter, r *http.Request, totp *auth.TOTP, templates *Templates, trail *audit.Trail) {
+	codes, err := totp.Confirm(username(r), r.FormValue("code"))
+	recordEvent(trail, r, "totp.enable", username(r), err)
+	if err != nil {
+		enrollment, ok := totp.Pending(username(r))
+		if !ok {
+			redirectWithFlash(w, r, flashError, "The enrollment has expired. Try again")
+			return
+		}
+		renderTOTP(w, r, templates, http.StatusUnprocessableEntity, map[string]interface{}{
+			"Enrollment": enrollment,
+			"Error":      "Incorrect authentication code",
+		})
+		return
+	}
+
+	renderTOTP(w, r, templates, http.StatusOK, map[string]interface{}{
+		"RecoveryCodes": codes,
+	})
+}
+
+// HandleTOTPDisable removes the user's second factor. It requires a current code or a recovery code.
+func HandleTOTPDisable(w http.ResponseWriter, r *http.Request, totp *auth.TOTP, trail *audit.Trail) {
+	err := totp.Verify(username(r), r.FormValue("code"))
+	if err == nil {
+		err = totp.Disable(username(r))
+	}
+	recordEvent(trail, r, "totp.disable", username(r), err)
+	if err != nil {
+		redirectWithFlash(w, r, flashError, "Incorrect authentication code")
+		return
+	}
+
+	redirectWithFlash(w, r, flashSuccess, "Two-factor authentication disabled")
+}
+
+// HandleTOTPReset removes the second factor of another user, e.g. one who lost the device and the recovery codes.
+func HandleTOTPReset(w http.ResponseWriter, r *http.Request, totp *auth.TOTP, trail *audit.Trail) {
+	user := r.FormValue("username")
+	if len(user) == 0 {
+		log.Println("no param: username")
+		redirectWithFlash(w, r, flashError, "No user selected")
+		return
+	}
+
+	err := totp.Disable(user)
+	recordEvent(trail, r, "totp.reset", user, err)
+	if err != nil {
+		redirectWithFlash(w, r, flashError, user+" has no two-factor authentication")
+		return
+	}
+
+	redirectWithFlash(w, r, flashSuccess, "Two-factor authentication of "+user+" reset")
+}
+
+func HandleAPIResetTOTP(w http.ResponseWriter, r *http.Request, totp *auth.TOTP, trail *audit.Trail) {
+	user := r.PathValue("username")
+	err := totp.Disable(user)
+	recordEvent(trail, r, "totp.reset", user, err)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "totp_not_enrolled", err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifyLoginTOTP checks the second factor on the login page. It returns the message for the user.
+func verifyLoginTOTP(totp *auth.TOTP, username, code string) (string, error) {
+	err := totp.Verify(username, code)
+	switch {
+	case errors.Is(err, auth.ErrTOTPRequired):
+		return "Enter the authentication code", err
+	case err != nil:
+		return "Incorrect authentication code", err
+	}
+	return "", nil
+}
+
+func renderTOTP(w http.ResponseWriter, r *http.Request, templates *Templates, status int, data map[string]interface{}) {
+	data["CSRFToken"] = csrfToken(w, r)
+
+	templates.Render(w, status, "totp.html", data)
+}
@@ -0,0 +1,113 @@
+package htserver_test
+
+import (
+	"encoding/json"
+	"github.com/dkarczmarski/gomisc/ipfilter/auth"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/htserver"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	fixedTime := &firewall.FixedTime{}
+	fixedTime.SetDateTime("2001-01-01 10:00:00")
+
+	service := firewall.NewService(
+		firewall.WithTimeFunc(time.Now),
+		firewall.WithBackend(nopBackend{}),
+	)
+	users := auth.NewUsers([]auth.User{{Username: "alice", Password: "123"}})
+	totp, err := auth.NewTOTP(auth.WithTOTPTimeFunc(fixedTime.TimeFunc()))
+	noError(t, err)
+
+	enrollment, err := totp.Enroll("alice")
+	noError(t, err)
+	code := func() string {
+		code, err := auth.TOTPCode(enrollment.Secret, fixedTime.TimeFunc()())
+		noError(t, err)
+		return code
+	}
+	_, err = totp.Confirm("alice", code())
+	noError(t, err)
+
+	mux := htserver.NewServeMux(service,
+		htserver.WithUsers(users),
+		htserver.WithTOTP(totp),
+	)
+
+	// the steps share the state of the second factor
+	for _, tt := range []struct {
+		name           string
+		at             string
+		method         string
+		code           func() string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{
+			name:           "safe method without code",
+			at:             "2001-01-01 10:00:30",
+			method:         http.MethodGet,
+			code:           func() string { return "" },
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "state change without code",
+			at:             "2001-01-01 10:00:30",
+			method:         http.MethodPost,
+			code:           func() string { return "" },
+			expectedStatus: http.StatusUnauthorized,
+			expectedCode:   "totp_required",
+		},
+		{
+			name:           "state change with incorrect code",
+			at:             "2001-01-01 10:00:30",
+			method:         http.MethodPost,
+			code:           func() string { return "000000" },
+			expectedStatus: http.StatusUnauthorized,
+			expectedCode:   "incorrect_totp",
+		},
+		{
+			name:           "state change with valid code",
+			at:             "2001-01-01 10:00:30",
+			method:         http.MethodPost,
+			code:           code,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "reused code",
+			at:             "2001-01-01 10:00:40",
+			method:         http.MethodDelete,
+			code:           code,
+			expectedStatus: http.StatusUnauthorized,
+			expectedCode:   "incorrect_totp",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fixedTime.SetDateTime(tt.at)
+
+			r := httptest.NewRequest(tt.method, "/api/v1/me", nil)
+			r.SetBasicAuth("alice", "123")
+			if code := tt.code(); len(code) > 0 {
+				r.Header.Set(auth.TOTPHeaderName, code)
+			}
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("status: actual: %v expected: %v body: %v", w.Code, tt.expectedStatus, w.Body)
+			}
+			if len(tt.expectedCode) > 0 {
+				var resp htserver.ErrorResponse
+				noError(t, json.NewDecoder(w.Body).Decode(&resp))
+				if resp.Error.Code != tt.expectedCode {
+					t.Errorf("code: actual: %v expected: %v", resp.Error.Code, tt.expectedCode)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,341 @@
+// Package httpbackend provides a firewall backend which drives an external
+// firewall (e.g. a router) through its HTTP API.
+package httpbackend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	ErrUnexpectedStatus = errors.New("unexpected status")
+	ErrResponseTooLarge = errors.New("response too large")
+)
+
+// maxResponseSize limits the read response body, e.g. of a list of a misconfigured endpoint.
+const maxResponseSize = 4 << 20
+
+// Endpoint describes a single HTTP call. URL, header values and Body are
+// text/template templates executed with TemplateData, e.g.
+// 'https://router/api/alias/{{ .IP | urlquery }}'.
+type Endpoint struct {
+	Method  string            `json:"method,omitempty" yaml:"method"`
+	URL     string            `json:"url" yaml:"url"`
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers"`
+	Body    string            `json:"body,omitempty" yaml:"body"`
+	// ExpectedStatus is the status code treated as success.
+	// When it is 0 then any 2xx status is accepted.
+	ExpectedStatus int `json:"expected_status,omitempty" yaml:"expected_status"`
+}
+
+// TemplateData is passed to the endpoint templates.
+type TemplateData struct {
+	Action string
+	IP     string
+}
+
+type config struct {
+	client      *http.Client
+	list        *Endpoint
+	listIPField string
+	retries     int
+	retryDelay  time.Duration
+}
+
+func WithHTTPClient(client *http.Client) func(*config) {
+	return func(c *config) {
+		c.client = client
+	}
+}
+
+// WithListEndpoint sets the endpoint returning currently allowed addresses.
+// The response must be a JSON array of strings or, when ipField is set,
+// a JSON array of objects with the address stored in ipField.
+func WithListEndpoint(endpoint Endpoint, ipField string) func(*config) {
+	return func(c *config) {
+		c.list = &endpoint
+		c.listIPField = ipField
+	}
+}
+
+// WithRetries sets how many times a failed call is retried. The delay
+// doubles after every attempt.
+func WithRetries(retries int, delay time.Duration) func(*config) {
+	return func(c *config) {
+		c.retries = retries
+		c.retryDelay = delay
+	}
+}
+
+type endpoint struct {
+	method         string
+	url            *template.Template
+	headers        map[string]*template.Template
+	body           *template.Template
+	expectedStatus int
+}
+
+// Backend implements firewall.Backend by calling the configured endpoints.
+type Backend struct {
+	client      *http.Client
+	allow       *endpoint
+	revoke      *endpoint
+	list        *endpoint
+	listIPField string
+	retries     int
+	retryDelay  time.Duration
+}
+
+func New(allow, revoke Endpoint, opts ...func(*config)) (*Backend, error) {
+	cnf := config{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		retryDelay: time.Second,
+	}
+	for _, ops := range opts {
+		ops(&cnf)
+	}
+
+	b := &Backend{
+		client:      cnf.client,
+		listIPField: cnf.listIPField,
+		retries:     cnf.retries,
+		retryDelay:  cnf.retryDelay,
+	}
+
+	var err error
+	if b.allow, err = parseEndpoint("allow", allow); err != nil {
+		return nil, err
+	}
+	if b.revoke, err = parseEndpoint("revoke", revoke); err != nil {
+		return nil, err
+	}
+	if cnf.list != nil {
+		if b.list, err = parseEndpoint("list", *cnf.list); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func parseEndpoint(name string, e Endpoint) (*endpoint, error) {
+	parse := func(field, text string) (*template.Template, error) {
+		t, err := template.New(name + "." + field).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("%v endpoint: parse %v template: %w", name, field, err)
+		}
+		return t, nil
+	}
+
+	if len(e.URL) == 0 {
+		return nil, fmt.Errorf("%v endpoint: no url", name)
+	}
+
+	method := e.Method
+	if len(method) == 0 {
+		method = http.MethodPost
+	}
+
+	result := &endpoint{
+		method:         strings.ToUpper(method),
+		headers:        make(map[string]*template.Template, len(e.Headers)),
+		expectedStatus: e.ExpectedStatus,
+	}
+
+	var err error
+	if result.url, err = parse("url", e.URL); err != nil {
+		return nil, err
+	}
+	if result.body, err = parse("body", e.Body); err != nil {
+		return nil, err
+	}
+	for key, value := range e.Headers {
+		if result.headers[key], err = parse("header "+key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+func (b *Backend) Allow(ctx context.Context, ip string) error {
+	_, err := b.call(ctx, b.allow, TemplateData{Action: "allow", IP: ip})
+	return err
+}
+
+func (b *Backend) Revoke(ctx context.Context, ip string) error {
+	_, err := b.call(ctx, b.revoke, TemplateData{Action: "revoke", IP: ip})
+	return err
+}
+
+// List returns the addresses currently allowed by the external firewall.
+func (b *Backend) List(ctx context.Context) ([]string, error) {
+	if b.list == nil {
+		return nil, fmt.Errorf("list endpoint is not configured: %w", firewall.ErrListNotSupported)
+	}
+
+	body, err := b.call(ctx, b.list, TemplateData{Action: "list"})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b.listIPField) == 0 {
+		var ips []string
+		if err := json.Unmarshal(body, &ips); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal(): %w", err)
+		}
+		return ips, nil
+	}
+
+	var items []map[string]any
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal(): %w", err)
+	}
+
+	ips := make([]string, 0, len(items))
+	for _, item := range items {
+		ip, ok := item[b.listIPField].(string)
+		if !ok {
+			return nil, fmt.Errorf("list item has no string field %q", b.listIPField)
+		}
+		ips = append(ips, ip)
+	}
+
+	return ips, nil
+}
+
+func (b *Backend) call(ctx context.Context, e *endpoint, data TemplateData) ([]byte, error) {
+	delay := b.retryDelay
+
+	for attempt := 0; ; attempt++ {
+		body, retryable, err := b.callOnce(ctx, e, data)
+		if err == nil {
+			return body, nil
+		}
+		if !retryable || attempt >= b.retries {
+			return nil, fmt.Errorf("%v %v: %w", data.Action, data.IP, err)
+		}
+
+		log.Printf("httpbackend: %v %v: %v, retrying in %v", data.Action, data.IP, err, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%v %v: %w", data.Action, data.IP, ctx.Err())
+		}
+		delay *= 2
+	}
+}
+
+func (b *Backend) callOnce(ctx context.Context, e *endpoint, data TemplateData) ([]byte, bool, error) {
+	reqURL, err := execute(e.url, data)
+	if err != nil {
+		return nil, false, err
+	}
+	reqBody, err := execute(e.body, data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, e.method, reqURL, strings.NewReader(reqBody))
+	if err != nil {
+		return nil, false, fmt.Errorf("http.NewRequestWithContext(): %w", err)
+	}
+	for key, t := range e.headers {
+		value, err := execute(t, data)
+		if err != nil {
+			return nil, false, err
+		}
+		req.Header.Set(key, value)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, ctx.Err() == nil, fmt.Errorf("client.Do(): %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, true, fmt.Errorf("io.ReadAll(): %w", err)
+	}
+	if len(respBody) > maxResponseSize {
+		return nil, false, fmt.Errorf("%w: over %d bytes", ErrResponseTooLarge, maxResponseSize)
+	}
+
+	if !statusOK(e.expectedStatus, resp.StatusCode) {
+		retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retryable, fmt.Errorf("%w: %v: %s", ErrUnexpectedStatus, resp.Status, bytes.TrimSpace(respBody))
+	}
+
+	return respBody, false, nil
+}
+
+func statusOK(expected, actual int) bool {
+	if expected == 0 {
+		return actual >= 200 && actual < 300
+	}
+	return expected == actual
+}
+
+func execute(t *template.Template, data TemplateData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("execute template %v: %w", t.Name(), err)
+	}
+	return buf.String(), nil
+}
+
+// Config is the JSON description of the backend.
+type Config struct {
+	Allow       Endpoint  `json:"allow" yaml:"allow"`
+	Revoke      Endpoint  `json:"revoke" yaml:"revoke"`
+	List        *Endpoint `json:"list,omitempty" yaml:"list"`
+	ListIPField string    `json:"list_ip_field,omitempty" yaml:"list_ip_field"`
+	Retries     int       `json:"retries,omitempty" yaml:"retries"`
+	RetryDelay  string    `json:"retry_delay,omitempty" yaml:"retry_delay"`
+	Timeout     string    `json:"timeout,omitempty" yaml:"timeout"`
+}
+
+func NewFromConfig(cnf Config) (*Backend, error) {
+	opts := []func(*config){
+		WithRetries(cnf.Retries, time.Second),
+	}
+
+	if len(cnf.RetryDelay) > 0 {
+		delay, err := time.ParseDuration(cnf.RetryDelay)
+		if err != nil {
+			return nil, fmt.Errorf("retry_delay: %w", err)
+		}
+		opts = append(opts, WithRetries(cnf.Retries, delay))
+	}
+	if len(cnf.Timeout) > 0 {
+		timeout, err := time.ParseDuration(cnf.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("timeout: %w", err)
+		}
+		opts = append(opts, WithHTTPClient(&http.Client{Timeout: timeout}))
+	}
+	if cnf.List != nil {
+		opts = append(opts, WithListEndpoint(*cnf.List, cnf.ListIPField))
+	}
+
+	return New(cnf.Allow, cnf.Revoke, opts...)
+}
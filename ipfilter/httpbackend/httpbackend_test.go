@@ -0,0 +1,261 @@
+package httpbackend_test
+
+import (
+	"context"
+	"errors"
+	"github.com/dkarczmarski/gomisc/ipfilter/httpbackend"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordedRequest struct {
+	Method string
+	Path   string
+	Auth   string
+	Body   string
+}
+
+type standIn struct {
+	mu       sync.Mutex
+	requests []recordedRequest
+	statuses []int
+	listBody string
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = append(s.requests, recordedRequest{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Auth:   r.Header.Get("Authorization"),
+		Body:   string(body),
+	})
+
+	status := http.StatusOK
+	if len(s.statuses) > 0 {
+		status, s.statuses = s.statuses[0], s.statuses[1:]
+	}
+	w.WriteHeader(status)
+
+	if r.Method == http.MethodGet {
+		_, _ = io.WriteString(w, s.listBody)
+	}
+}
+
+func newBackend(t *testing.T, url string, opts ...func(*httpbackend.Config)) *httpbackend.Backend {
+	t.Helper()
+
+	cnf := httpbackend.Config{
+		Allow: httpbackend.Endpoint{
+			Method:  http.MethodPost,
+			URL:     url + "/api/alias/{{ .IP | urlquery }}",
+			Headers: map[string]string{"Authorization": "Bearer secret"},
+			Body:    `{"action":{{ json .Action }},"address":{{ json .IP }}}`,
+		},
+		Revoke: httpbackend.Endpoint{
+			Method:         http.MethodDelete,
+			URL:            url + "/api/alias/{{ .IP }}",
+			ExpectedStatus: http.StatusNoContent,
+		},
+		List: &httpbackend.Endpoint{
+			Method: http.MethodGet,
+			URL:    url + "/api/alias",
+		},
+		Retries:    2,
+		RetryDelay: "1ms",
+	}
+	for _, opt := range opts {
+		opt(&cnf)
+	}
+
+	backend, err := httpbackend.NewFromConfig(cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestBackend_AllowRevoke(t *testing.T) {
+	for _, tt := range []struct {
+		name             string
+		statuses         []int
+		testFunc         func(backend *httpbackend.Backend) error
+		expectedErr      func(err error) bool
+		expectedRequests []recordedRequest
+	}{
+		{
+			name: "allow",
+			testFunc: func(backend *httpbackend.Backend) error {
+				return backend.Allow(context.Background(), "1.2.3.4")
+			},
+			expectedErr: noError,
+			expectedRequests: []recordedRequest{
+				{
+					Method: http.MethodPost,
+					Path:   "/api/alias/1.2.3.4",
+					Auth:   "Bearer secret",
+					Body:   `{"action":"allow","address":"1.2.3.4"}`,
+				},
+			},
+		},
+		{
+			name: "revoke",
+			testFunc: func(backend *httpbackend.Backend) error {
+				return backend.Revoke(context.Background(), "1.2.3.4")
+			},
+			statuses:    []int{http.StatusNoContent},
+			expectedErr: noError,
+			expectedRequests: []recordedRequest{
+				{Method: http.MethodDelete, Path: "/api/alias/1.2.3.4"},
+			},
+		},
+		{
+			name: "revoke with unexpected status",
+			testFunc: func(backend *httpbackend.Backend) error {
+				return backend.Revoke(context.Background(), "1.2.3.4")
+			},
+			statuses: []int{http.StatusOK},
+			expectedErr: func(err error) bool {
+				return errors.Is(err, httpbackend.ErrUnexpectedStatus)
+			},
+			expectedRequests: []recordedRequest{
+				{Method: http.MethodDelete, Path: "/api/alias/1.2.3.4"},
+			},
+		},
+		{
+			name: "allow is retried on server error",
+			testFunc: func(backend *httpbackend.Backend) error {
+				return backend.Allow(context.Background(), "1.2.3.4")
+			},
+			statuses:    []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK},
+			expectedErr: noError,
+			expectedRequests: []recordedRequest{
+				{Method: http.MethodPost, Path: "/api/alias/1.2.3.4", Auth: "Bearer secret", Body: `{"action":"allow","address":"1.2.3.4"}`},
+				{Method: http.MethodPost, Path: "/api/alias/1.2.3.4", Auth: "Bearer secret", Body: `{"action":"allow","address":"1.2.3.4"}`},
+				{Method: http.MethodPost, Path: "/api/alias/1.2.3.4", Auth: "Bearer secret", Body: `{"action":"allow","address":"1.2.3.4"}`},
+			},
+		},
+		{
+			name: "allow fails when retries are exhausted",
+			testFunc: func(backend *httpbackend.Backend) error {
+				return backend.Allow(context.Background(), "1.2.3.4")
+			},
+			statuses: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+			expectedErr: func(err error) bool {
+				return errors.Is(err, httpbackend.ErrUnexpectedStatus)
+			},
+			expectedRequests: []recordedRequest{
+				{Method: http.MethodPost, Path: "/api/alias/1.2.3.4", Auth: "Bearer secret", Body: `{"action":"allow","address":"1.2.3.4"}`},
+				{Method: http.MethodPost, Path: "/api/alias/1.2.3.4", Auth: "Bearer secret", Body: `{"action":"allow","address":"1.2.3.4"}`},
+				{Method: http.MethodPost, Path: "/api/alias/1.2.3.4", Auth: "Bearer secret", Body: `{"action":"allow","address":"1.2.3.4"}`},
+			},
+		},
+		{
+			name: "client error is not retried",
+			testFunc: func(backend *httpbackend.Backend) error {
+				return backend.Allow(context.Background(), "1.2.3.4")
+			},
+			statuses: []int{http.StatusBadRequest},
+			expectedErr: func(err error) bool {
+				return errors.Is(err, httpbackend.ErrUnexpectedStatus)
+			},
+			expectedRequests: []recordedRequest{
+				{Method: http.MethodPost, Path: "/api/alias/1.2.3.4", Auth: "Bearer secret", Body: `{"action":"allow","address":"1.2.3.4"}`},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &standIn{statuses: tt.statuses}
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			err := tt.testFunc(newBackend(t, server.URL))
+			if !tt.expectedErr(err) {
+				t.Errorf("expected error is not satisfied: %v", err)
+			}
+			if !reflect.DeepEqual(handler.requests, tt.expectedRequests) {
+				t.Errorf("requests\nactual:   %+v\nexpected: %+v", handler.requests, tt.expectedRequests)
+			}
+		})
+	}
+}
+
+func TestBackend_List(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		listBody    string
+		listIPField string
+		expectedIPs []string
+		expectedErr bool
+	}{
+		{
+			name:        "array of strings",
+			listBody:    `["1.2.3.4","2.2.8.8"]`,
+			expectedIPs: []string{"1.2.3.4", "2.2.8.8"},
+		},
+		{
+			name:        "array of objects",
+			listBody:    `[{"address":"1.2.3.4","descr":"ipfilter"}]`,
+			listIPField: "address",
+			expectedIPs: []string{"1.2.3.4"},
+		},
+		{
+			name:        "array of objects without the field",
+			listBody:    `[{"descr":"ipfilter"}]`,
+			listIPField: "address",
+			expectedErr: true,
+		},
+		{
+			name:        "too large",
+			listBody:    `["` + strings.Repeat("1", 5<<20) + `"]`,
+			expectedErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(&standIn{listBody: tt.listBody})
+			defer server.Close()
+
+			backend := newBackend(t, server.URL, func(cnf *httpbackend.Config) {
+				cnf.ListIPField = tt.listIPField
+			})
+
+			ips, err := backend.List(context.Background())
+			if (err != nil) != tt.expectedErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(ips, tt.expectedIPs) {
+				t.Errorf("actual: %v, expected: %v", ips, tt.expectedIPs)
+			}
+		})
+	}
+}
+
+func TestBackend_RetryStopsOnContextCancel(t *testing.T) {
+	server := httptest.NewServer(&standIn{statuses: []int{http.StatusServiceUnavailable}})
+	defer server.Close()
+
+	backend := newBackend(t, server.URL, func(cnf *httpbackend.Config) {
+		cnf.RetryDelay = "1h"
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := backend.Allow(ctx, "1.2.3.4"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got: %v", err)
+	}
+}
+
+func noError(err error) bool {
+	return err == nil
+}
@@ -0,0 +1,302 @@
+// Package metrics provides counters, histograms and gauges exposed in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of the histogram buckets, in seconds, suited to the latency of calls.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// Registry holds the metrics in the order of their registration.
+type Registry struct {
+	mu      sync.Mutex
+	names   map[string]bool
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		names: make(map[string]bool),
+	}
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %v registered twice", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("metrics: write: %w", err)
+	}
+	return nil
+}
+
+// Handler serves the metrics to a Prometheus scraper.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := r.WriteText(w); err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+// desc is the name, the help and the label names of a metric.
+type desc struct {
+	name       string
+	help       string
+	labelNames []string
+}
+
+func (d desc) writeHeader(w io.Writer, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, metricType)
+}
+
+// key joins the label values into a map key. It panics when their number is wrong, like a wrong call.
+func (d desc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labelNames) {
+		panic(fmt.Sprintf("metrics: %v: %d label values for %d labels", d.name, len(labelValues), len(d.labelNames)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// labels formats the labels of a sample, with an extra one, e.g. 'le' of the buckets, when it is not empty.
+func (d desc) labels(labelValues []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range d.labelNames {
+		pairs = append(pairs, name+`="`+escapeLabel(labelValues[i])+`"`)
+	}
+	if len(extraName) > 0 {
+		pairs = append(pairs, extraName+`="`+escapeLabel(extraValue)+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter is a value which only goes up, e.g. the number of the added entries.
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+// Counter registers a counter. Its samples are set by the label values in the order of labelNames.
+func (r *Registry) Counter(name, help string, labelNames ...string) *Counter {
+	c := &Counter{
+		desc:   desc{name: name, help: help, labelNames: labelNames},
+		values: make(map[string]*counterValue),
+	}
+	if len(labelNames) == 0 {
+		// a counter without labels is exposed before the first increment
+		c.values[""] = &counterValue{}
+	}
+	r.register(name, c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter by a non-negative value.
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic(fmt.Sprintf("metrics: %v: counter decreased", c.name))
+	}
+	key := c.key(labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.values[key]
+	if !ok {
+		v = &counterValue{labelValues: append([]string(nil), labelValues...)}
+		c.values[key] = v
+	}
+	v.value += value
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeHeader(w, "counter")
+	for _, key := range sortedKeys(c.values) {
+		v := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labels(v.labelValues, "", ""), formatFloat(v.value))
+	}
+}
+
+// Histogram counts the observed values, e.g. durations, in buckets.
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	// counts of the values in every bucket, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram registers a histogram with the upper bounds of its buckets, e.g. DefaultBuckets.
+func (r *Registry) Histogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	h := &Histogram{
+		desc:    desc{name: name, help: help, labelNames: labelNames},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+	if len(labelNames) == 0 {
+		h.values[""] = &histogramValue{counts: make([]uint64, len(buckets))}
+	}
+	r.register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{
+			labelValues: append([]string(nil), labelValues...),
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = v
+	}
+
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		v.counts[i]++
+	}
+	v.count++
+	v.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.writeHeader(w, "histogram")
+	for _, key := range sortedKeys(h.values) {
+		v := h.values[key]
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += v.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(v.labelValues, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(v.labelValues, "le", "+Inf"), v.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labels(v.labelValues, "", ""), formatFloat(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labels(v.labelValues, "", ""), v.count)
+	}
+}
+
+// gaugeFunc is a value read when the metrics are written, e.g. the number of the active entries.
+type gaugeFunc struct {
+	desc
+	collect func(set func(value float64, labelValues ...string))
+}
+
+// GaugeFunc registers a gauge whose samples are set by collect on every write.
+func (r *Registry) GaugeFunc(name, help string, collect func(set func(value float64, labelValues ...string)), labelNames ...string) {
+	r.register(name, &gaugeFunc{
+		desc:    desc{name: name, help: help, labelNames: labelNames},
+		collect: collect,
+	})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	samples := make(map[string]*counterValue)
+	g.collect(func(value float64, labelValues ...string) {
+		samples[g.key(labelValues)] = &counterValue{labelValues: labelValues, value: value}
+	})
+
+	g.writeHeader(w, "gauge")
+	for _, key := range sortedKeys(samples) {
+		v := samples[key]
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labels(v.labelValues, "", ""), formatFloat(v.value))
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
@@ -0,0 +1,113 @@
+package metrics_test
+
+import (
+	"bytes"
+	"github.com/dkarczmarski/gomisc/ipfilter/metrics"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	registry := metrics.NewRegistry()
+
+	added := registry.Counter("test_added_total", "Added entries.")
+	failures := registry.Counter("test_failures_total", "Failed calls\nby operation.", "operation")
+	duration := registry.Histogram("test_duration_seconds", "Call duration.", []float64{1, 0.1}, "operation")
+	registry.GaugeFunc("test_entries", "Active entries.", func(set func(value float64, labelValues ...string)) {
+		set(2, `bob "b\"`)
+		set(1, "alice")
+	}, "owner")
+	registry.Counter("test_unused_total", "Labeled counter without samples.", "kind")
+
+	added.Inc()
+	added.Add(2)
+	failures.Inc("revoke")
+	failures.Inc("allow")
+	failures.Inc("allow")
+	duration.Observe(0.05, "allow")
+	duration.Observe(0.1, "allow")
+	duration.Observe(0.5, "allow")
+	duration.Observe(3, "allow")
+
+	var buf bytes.Buffer
+	if err := registry.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_added_total Added entries.
+# TYPE test_added_total counter
+test_added_total 3
+# HELP test_failures_total Failed calls\nby operation.
+# TYPE test_failures_total counter
+test_failures_total{operation="allow"} 2
+test_failures_total{operation="revoke"} 1
+# HELP test_duration_seconds Call duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{operation="allow",le="0.1"} 2
+test_duration_seconds_bucket{operation="allow",le="1"} 3
+test_duration_seconds_bucket{operation="allow",le="+Inf"} 4
+test_duration_seconds_sum{operation="allow"} 3.65
+test_duration_seconds_count{operation="allow"} 4
+# HELP test_entries Active entries.
+# TYPE test_entries gauge
+test_entries{owner="alice"} 1
+test_entries{owner="bob \"b\\\""} 2
+# HELP test_unused_total Labeled counter without samples.
+# TYPE test_unused_total counter
+`
+	if buf.String() != expected {
+		t.Errorf("actual:\n%v\nexpected:\n%v", buf.String(), expected)
+	}
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.Counter("test_total", "Test.").Inc()
+
+	w := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("unexpected response: %v %v", w.Code, w.Header().Get("Content-Type"))
+	}
+	if expected := "# HELP test_total Test.\n# TYPE test_total counter\ntest_total 1\n"; w.Body.String() != expected {
+		t.Errorf("body: actual: %q expected: %q", w.Body.String(), expected)
+	}
+}
+
+func TestRegistry_Panics(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		f    func(registry *metrics.Registry)
+	}{
+		{
+			name: "registered twice",
+			f: func(registry *metrics.Registry) {
+				registry.Counter("test_total", "Test.")
+				registry.Counter("test_total", "Test.")
+			},
+		},
+		{
+			name: "wrong label values",
+			f: func(registry *metrics.Registry) {
+				registry.Counter("test_total", "Test.", "operation").Inc()
+			},
+		},
+		{
+			name: "counter decreased",
+			f: func(registry *metrics.Registry) {
+				registry.Counter("test_total", "Test.").Add(-1)
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected panic")
+				}
+			}()
+			tt.f(metrics.NewRegistry())
+		})
+	}
+}
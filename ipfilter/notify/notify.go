@@ -0,0 +1,298 @@
+// Package notify sends the changes of the firewall registry to webhooks and chats.
+package notify
+
+import (
+	"context"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetries = 5
+	defaultBackoff = time.Second
+	maxBackoff     = time.Minute
+	// queueSize is the number of the messages waiting for a channel, the next ones are dropped.
+	queueSize = 100
+)
+
+// Message is a change of the registry.
+type Message struct {
+	Event firewall.EventType
+	Entry firewall.IPEntry
+	// ExpiresAt is the expiry of the entry, counted with the default TTL of the service.
+	ExpiresAt time.Time
+	Time      time.Time
+	// Request is set for the events of the access requests: EventRequest, EventApprove and EventReject.
+	Request *firewall.AccessRequest
+	// ApproveURL and RejectURL are the links deciding the request of EventRequest, set by WithLinks.
+	ApproveURL string
+	RejectURL  string
+}
+
+func (m Message) verb() string {
+	switch m.Event {
+	case firewall.EventAdd:
+		return "allowed"
+	case firewall.EventRenew:
+		return "renewed"
+	case firewall.EventDelete:
+		return "deleted"
+	case firewall.EventExpire:
+		return "expired"
+	case firewall.EventRequest:
+		return "requested"
+	case firewall.EventApprove:
+		return "approved"
+	case firewall.EventReject:
+		return "rejected"
+	}
+	return string(m.Event)
+}
+
+// Text describes the message in a line for the chats, e.g. '1.2.3.4 (home) allowed by alice until 2001-01-01T11:00:00Z'.
+func (m Message) Text() string {
+	var sb strings.Builder
+	sb.WriteString(m.Entry.IP)
+	if len(m.Entry.Label) > 0 {
+		sb.WriteString(" (" + m.Entry.Label + ")")
+	}
+	sb.WriteString(" " + m.verb())
+	if m.Request != nil {
+		m.writeRequest(&sb)
+		return sb.String()
+	}
+	if len(m.Entry.Owner) > 0 {
+		if m.Event == firewall.EventAdd || m.Event == firewall.EventRenew {
+			sb.WriteString(" by ")
+		} else {
+			sb.WriteString(", owner ")
+		}
+		sb.WriteString(m.Entry.Owner)
+	}
+	if m.Event == firewall.EventAdd || m.Event == firewall.EventRenew {
+		sb.WriteString(" until " + m.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	return sb.String()
+}
+
+// writeRequest describes the access request, e.g. 'requested by alice for 2h0m0s: deploy'
+// or 'approved by admin, owner alice'.
+func (m Message) writeRequest(sb *strings.Builder) {
+	if m.Event == firewall.EventRequest {
+		sb.WriteString(" by " + m.Request.Owner)
+		if m.Request.TTL > 0 {
+			sb.WriteString(" for " + m.Request.TTL.String())
+		}
+		sb.WriteString(": " + m.Request.Reason)
+		return
+	}
+
+	if len(m.Request.DecidedBy) > 0 {
+		sb.WriteString(" by " + m.Request.DecidedBy)
+	} else {
+		sb.WriteString(" after the timeout")
+	}
+	if len(m.Request.Owner) > 0 {
+		sb.WriteString(", owner " + m.Request.Owner)
+	}
+}
+
+// Sender delivers the messages to an external service.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Filter selects the messages of a channel. An empty list matches everything.
+type Filter struct {
+	Events []firewall.EventType
+	Owners []string
+}
+
+func (f Filter) Match(msg Message) bool {
+	if len(f.Events) > 0 && !slices.Contains(f.Events, msg.Event) {
+		return false
+	}
+	if len(f.Owners) > 0 && !slices.Contains(f.Owners, msg.Entry.Owner) {
+		return false
+	}
+	return true
+}
+
+// Channel is a named destination of the messages.
+type Channel struct {
+	Name   string
+	Sender Sender
+	Filter Filter
+}
+
+type config struct {
+	retries  int
+	backoff  time.Duration
+	timeFunc func() time.Time
+	linkFunc func(id, action string) string
+}
+
+type Option func(*config)
+
+// WithRetries sets the number of the retries of a failed delivery and the delay before the first one.
+// The delay is doubled for every next retry, up to a minute.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *config) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+func WithTimeFunc(timeFunc func() time.Time) Option {
+	return func(c *config) {
+		c.timeFunc = timeFunc
+	}
+}
+
+// WithLinks adds the links approving and rejecting the access requests to the messages of EventRequest.
+// The linkFunc returns the link of the request id and the action, "approve" or "reject".
+func WithLinks(linkFunc func(id, action string) string) Option {
+	return func(c *config) {
+		c.linkFunc = linkFunc
+	}
+}
+
+// Notifier sends the messages to the channels. Every channel has its own queue,
+// so a slow or failing one does not delay the others.
+type Notifier struct {
+	channels []Channel
+	retries  int
+	backoff  time.Duration
+	timeFunc func() time.Time
+	linkFunc func(id, action string) string
+}
+
+func New(channels []Channel, opts ...Option) *Notifier {
+	cnf := config{
+		retries:  defaultRetries,
+		backoff:  defaultBackoff,
+		timeFunc: time.Now,
+	}
+	for _, opt := range opts {
+		opt(&cnf)
+	}
+
+	return &Notifier{
+		channels: channels,
+		retries:  cnf.retries,
+		backoff:  cnf.backoff,
+		timeFunc: cnf.timeFunc,
+		linkFunc: cnf.linkFunc,
+	}
+}
+
+// RunTask sends the changes of the service registry until ctx is done.
+// The messages waiting for a retry are dropped then.
+func RunTask(ctx context.Context, wg *sync.WaitGroup, notifier *Notifier, service *firewall.Service) {
+	queues := make([]chan Message, len(notifier.channels))
+	for i, channel := range notifier.channels {
+		queues[i] = make(chan Message, queueSize)
+
+		wg.Add(1)
+		go func(channel Channel, queue <-chan Message) {
+			defer wg.Done()
+			notifier.runChannel(ctx, channel, queue)
+		}(channel, queues[i])
+	}
+
+	// subscribed before returning, so no change made after is missed
+	events, cancel := service.Subscribe()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-ctx.Done():
+				cancel()
+				return
+			case event, ok := <-events:
+				if !ok {
+					log.Printf("notify: events dropped, subscribing again")
+					events, cancel = service.Subscribe()
+					continue
+				}
+				notifier.dispatch(notifier.message(event, service.DefaultTTL()), queues)
+			}
+		}
+	}()
+}
+
+func (n *Notifier) message(event firewall.Event, defaultTTL time.Duration) Message {
+	msg := Message{
+		Event:     event.Type,
+		Entry:     event.Entry,
+		ExpiresAt: event.Entry.ExpiresAt(defaultTTL),
+		Time:      n.timeFunc(),
+		Request:   event.Request,
+	}
+	if event.Type == firewall.EventRequest && event.Request != nil && n.linkFunc != nil {
+		msg.ApproveURL = n.linkFunc(event.Request.ID, "approve")
+		msg.RejectURL = n.linkFunc(event.Request.ID, "reject")
+	}
+	return msg
+}
+
+// dispatch queues the message for the channels with a matching filter.
+func (n *Notifier) dispatch(msg Message, queues []chan Message) {
+	for i, channel := range n.channels {
+		if !channel.Filter.Match(msg) {
+			continue
+		}
+
+		select {
+		case queues[i] <- msg:
+		default:
+			log.Printf("notify: %v: queue full, %v %v dropped", channel.Name, msg.Event, msg.Entry.IP)
+		}
+	}
+}
+
+func (n *Notifier) runChannel(ctx context.Context, channel Channel, queue <-chan Message) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-queue:
+			n.deliver(ctx, channel, msg)
+		}
+	}
+}
+
+// deliver sends the message, retrying the temporary failures with a growing delay.
+func (n *Notifier) deliver(ctx context.Context, channel Channel, msg Message) {
+	backoff := n.backoff
+	for attempt := 0; ; attempt++ {
+		err := func() error {
+			sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+			defer cancel()
+			return channel.Sender.Send(sendCtx, msg)
+		}()
+		if err == nil {
+			return
+		}
+
+		if !retryable(err) || attempt >= n.retries {
+			log.Printf("notify: %v: %v %v not sent: %v", channel.Name, msg.Event, msg.Entry.IP, err)
+			return
+		}
+		log.Printf("notify: %v: %v %v: %v, retrying in %v", channel.Name, msg.Event, msg.Entry.IP, err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
@@ -0,0 +1,472 @@
+package notify_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"github.com/dkarczmarski/gomisc/ipfilter/notify"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type nopBackend struct{}
+
+func (nopBackend) Allow(_ context.Context, _ string) error  { return nil }
+func (nopBackend) Revoke(_ context.Context, _ string) error { return nil }
+
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+// newServer starts a server which records the requests and responds with the statuses in turn,
+// the last one repeated.
+func newServer(t *testing.T, statuses ...int) (*httptest.Server, <-chan request) {
+	t.Helper()
+
+	requests := make(chan request, 10)
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{header: r.Header, body: body}
+
+		mu.Lock()
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, requests
+}
+
+func receive(t *testing.T, requests <-chan request) request {
+	t.Helper()
+
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not received")
+		return request{}
+	}
+}
+
+var testMessage = notify.Message{
+	Event: firewall.EventAdd,
+	Entry: firewall.IPEntry{
+		IP:        "1.2.3.4",
+		CreatedAt: firewall.MustParseDateTime("2001-01-01 10:00:00"),
+		UpdatedAt: firewall.MustParseDateTime("2001-01-01 10:00:00"),
+		TTL:       time.Hour,
+		Owner:     "alice",
+		Label:     "home",
+	},
+	ExpiresAt: firewall.MustParseDateTime("2001-01-01 11:00:00"),
+	Time:      firewall.MustParseDateTime("2001-01-01 10:00:00"),
+}
+
+func TestMessage_Text(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		event    firewall.EventType
+		owner    string
+		label    string
+		request  *firewall.AccessRequest
+		expected string
+	}{
+		{
+			name:     "add",
+			event:    firewall.EventAdd,
+			owner:    "alice",
+			label:    "home",
+			expected: "1.2.3.4 (home) allowed by alice until 2001-01-01T11:00:00Z",
+		},
+		{
+			name:     "renew without owner",
+			event:    firewall.EventRenew,
+			expected: "1.2.3.4 renewed until 2001-01-01T11:00:00Z",
+		},
+		{
+			name:     "delete",
+			event:    firewall.EventDelete,
+			owner:    "alice",
+			expected: "1.2.3.4 deleted, owner alice",
+		},
+		{
+			name:     "expire",
+			event:    firewall.EventExpire,
+			label:    "ci",
+			expected: "1.2.3.4 (ci) expired",
+		},
+		{
+			name:     "request",
+			event:    firewall.EventRequest,
+			owner:    "alice",
+			request:  &firewall.AccessRequest{Owner: "alice", Reason: "on call", TTL: 2 * time.Hour},
+			expected: "1.2.3.4 requested by alice for 2h0m0s: on call",
+		},
+		{
+			name:     "request with the default ttl",
+			event:    firewall.EventRequest,
+			owner:    "alice",
+			label:    "home",
+			request:  &firewall.AccessRequest{Owner: "alice", Reason: "on call"},
+			expected: "1.2.3.4 (home) requested by alice: on call",
+		},
+		{
+			name:     "approve",
+			event:    firewall.EventApprove,
+			owner:    "alice",
+			request:  &firewall.AccessRequest{Owner: "alice", Reason: "on call", DecidedBy: "admin"},
+			expected: "1.2.3.4 approved by admin, owner alice",
+		},
+		{
+			name:     "reject after the timeout",
+			event:    firewall.EventReject,
+			owner:    "alice",
+			request:  &firewall.AccessRequest{Owner: "alice", Reason: "on call"},
+			expected: "1.2.3.4 rejected after the timeout, owner alice",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := testMessage
+			msg.Event = tt.event
+			msg.Entry.Owner = tt.owner
+			msg.Entry.Label = tt.label
+			msg.Request = tt.request
+
+			if actual := msg.Text(); actual != tt.expected {
+				t.Errorf("actual: %q expected: %q", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFilter_Match(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		filter   notify.Filter
+		expected bool
+	}{
+		{name: "empty", filter: notify.Filter{}, expected: true},
+		{
+			name:     "event matches",
+			filter:   notify.Filter{Events: []firewall.EventType{firewall.EventAdd, firewall.EventDelete}},
+			expected: true,
+		},
+		{
+			name:     "event does not match",
+			filter:   notify.Filter{Events: []firewall.EventType{firewall.EventExpire}},
+			expected: false,
+		},
+		{
+			name:     "owner does not match",
+			filter:   notify.Filter{Events: []firewall.EventType{firewall.EventAdd}, Owners: []string{"bob"}},
+			expected: false,
+		},
+		{name: "owner matches", filter: notify.Filter{Owners: []string{"bob", "alice"}}, expected: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := tt.filter.Match(testMessage); actual != tt.expected {
+				t.Errorf("actual: %v expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWebhook_Send(t *testing.T) {
+	server, requests := newServer(t, http.StatusNoContent)
+
+	if err := notify.NewWebhook(server.URL, "s3cret").Send(context.Background(), testMessage); err != nil {
+		t.Fatal(err)
+	}
+	r := receive(t, requests)
+
+	if !hmac.Equal([]byte(r.header.Get(notify.SignatureHeader)), []byte(notify.Sign("s3cret", r.body))) {
+		t.Errorf("invalid signature: %v", r.header.Get(notify.SignatureHeader))
+	}
+	if event := r.header.Get(notify.EventHeader); event != "add" {
+		t.Errorf("unexpected event header: %v", event)
+	}
+
+	var payload notify.WebhookPayload
+	if err := json.Unmarshal(r.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	expected := notify.WebhookPayload{
+		Event: "add",
+		Time:  firewall.MustParseDateTime("2001-01-01 10:00:00"),
+		Text:  "1.2.3.4 (home) allowed by alice until 2001-01-01T11:00:00Z",
+		Entry: notify.WebhookEntry{
+			IP:         "1.2.3.4",
+			CreatedAt:  firewall.MustParseDateTime("2001-01-01 10:00:00"),
+			UpdatedAt:  firewall.MustParseDateTime("2001-01-01 10:00:00"),
+			ExpiresAt:  firewall.MustParseDateTime("2001-01-01 11:00:00"),
+			TTLSeconds: 3600,
+			Owner:      "alice",
+			Label:      "home",
+		},
+	}
+	if payload != expected {
+		t.Errorf("actual: %+v expected: %+v", payload, expected)
+	}
+}
+
+func TestWebhook_Send_WithoutSecret(t *testing.T) {
+	server, requests := newServer(t, http.StatusOK)
+
+	if err := notify.NewWebhook(server.URL, "").Send(context.Background(), testMessage); err != nil {
+		t.Fatal(err)
+	}
+	if signature := receive(t, requests).header.Get(notify.SignatureHeader); len(signature) > 0 {
+		t.Errorf("unexpected signature: %v", signature)
+	}
+}
+
+func TestSlack_Send(t *testing.T) {
+	server, requests := newServer(t, http.StatusOK)
+
+	if err := notify.NewSlack(server.URL).Send(context.Background(), testMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"text":"1.2.3.4 (home) allowed by alice until 2001-01-01T11:00:00Z"}`
+	if actual := string(receive(t, requests).body); actual != expected {
+		t.Errorf("actual: %v expected: %v", actual, expected)
+	}
+}
+
+func TestSlack_SendEscaped(t *testing.T) {
+	server, requests := newServer(t, http.StatusOK)
+
+	msg := testMessage
+	msg.Entry.Label = "<!channel> & <http://evil.test|home>"
+	if err := notify.NewSlack(server.URL).Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	var body struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(receive(t, requests).body, &body); err != nil {
+		t.Fatal(err)
+	}
+	expected := "1.2.3.4 (&lt;!channel&gt; &amp; &lt;http://evil.test|home&gt;) allowed by alice until 2001-01-01T11:00:00Z"
+	if body.Text != expected {
+		t.Errorf("actual: %v expected: %v", body.Text, expected)
+	}
+}
+
+func TestNtfy_Send(t *testing.T) {
+	server, requests := newServer(t, http.StatusOK)
+
+	msg := testMessage
+	msg.Event = firewall.EventExpire
+	if err := notify.NewNtfy(server.URL, "tk_123").Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	r := receive(t, requests)
+
+	for key, expected := range map[string]string{
+		"Title":         "ipfilter: 1.2.3.4 expired",
+		"Tags":          "hourglass",
+		"Authorization": "Bearer tk_123",
+	} {
+		if actual := r.header.Get(key); actual != expected {
+			t.Errorf("%v: actual: %q expected: %q", key, actual, expected)
+		}
+	}
+	if actual, expected := string(r.body), "1.2.3.4 (home) expired, owner alice"; actual != expected {
+		t.Errorf("actual: %q expected: %q", actual, expected)
+	}
+}
+
+func TestSend_Status(t *testing.T) {
+	server, _ := newServer(t, http.StatusBadRequest)
+
+	err := notify.NewSlack(server.URL).Send(context.Background(), testMessage)
+	statusErr, ok := err.(*notify.StatusError)
+	if !ok || statusErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRunTask(t *testing.T) {
+	for _, tt := range []struct {
+		name             string
+		statuses         []int
+		expectedAttempts int
+	}{
+		{name: "delivered", statuses: []int{http.StatusOK}, expectedAttempts: 1},
+		{
+			name:             "retried",
+			statuses:         []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK},
+			expectedAttempts: 3,
+		},
+		{name: "gave up", statuses: []int{http.StatusBadGateway}, expectedAttempts: 3},
+		{name: "not retried", statuses: []int{http.StatusBadRequest}, expectedAttempts: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newServer(t, tt.statuses...)
+
+			var fixedTime firewall.FixedTime
+			fixedTime.SetDateTime("2001-01-01 10:00:00")
+			service := firewall.NewService(
+				firewall.WithTimeFunc(fixedTime.TimeFunc()),
+				firewall.WithBackend(nopBackend{}),
+				firewall.WithDefaultTTL(time.Hour),
+			)
+			notifier := notify.New(
+				[]notify.Channel{
+					{
+						Name:   "bob only",
+						Sender: notify.NewSlack(server.URL),
+						Filter: notify.Filter{Owners: []string{"bob"}},
+					},
+					{
+						Name:   "adds",
+						Sender: notify.NewWebhook(server.URL, ""),
+						Filter: notify.Filter{Events: []firewall.EventType{firewall.EventAdd}},
+					},
+				},
+				notify.WithRetries(2, time.Millisecond),
+				notify.WithTimeFunc(fixedTime.TimeFunc()),
+			)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			var wg sync.WaitGroup
+			notify.RunTask(ctx, &wg, notifier, service)
+			t.Cleanup(func() {
+				cancel()
+				wg.Wait()
+			})
+
+			if err := service.AddIP("1.2.3.4", firewall.WithOwner("alice")); err != nil {
+				t.Fatal(err)
+			}
+			if err := service.DeleteIP("1.2.3.4"); err != nil {
+				t.Fatal(err)
+			}
+
+			for range tt.expectedAttempts {
+				r := receive(t, requests)
+
+				var payload notify.WebhookPayload
+				if err := json.Unmarshal(r.body, &payload); err != nil {
+					t.Fatal(err)
+				}
+				if payload.Event != "add" || payload.Entry.IP != "1.2.3.4" || payload.Entry.Owner != "alice" ||
+					!payload.Entry.ExpiresAt.Equal(firewall.MustParseDateTime("2001-01-01 11:00:00")) {
+					t.Errorf("unexpected payload: %s", r.body)
+				}
+			}
+
+			select {
+			case r := <-requests:
+				t.Errorf("unexpected request: %s", r.body)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestRunTask_Links(t *testing.T) {
+	server, requests := newServer(t, http.StatusOK)
+
+	var fixedTime firewall.FixedTime
+	fixedTime.SetDateTime("2001-01-01 10:00:00")
+	service := firewall.NewService(
+		firewall.WithTimeFunc(fixedTime.TimeFunc()),
+		firewall.WithBackend(nopBackend{}),
+		firewall.WithApprovalTimeout(time.Hour),
+	)
+	notifier := notify.New(
+		[]notify.Channel{{Name: "ntfy", Sender: notify.NewNtfy(server.URL, "")}},
+		notify.WithTimeFunc(fixedTime.TimeFunc()),
+		notify.WithLinks(func(id, action string) string {
+			return "https://ipfilter.test/requests/" + id + "/" + action
+		}),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	notify.RunTask(ctx, &wg, notifier, service)
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	request, err := service.RequestIPCtx(context.Background(), "1.2.3.4", "on call", firewall.WithOwner("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.RejectRequestCtx(context.Background(), request.ID, "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []map[string]string{
+		{
+			"Title": "ipfilter: 1.2.3.4 requested",
+			"Tags":  "raising_hand",
+			"Actions": "view, Approve, https://ipfilter.test/requests/" + request.ID + "/approve; " +
+				"view, Reject, https://ipfilter.test/requests/" + request.ID + "/reject",
+		},
+		{
+			"Title":   "ipfilter: 1.2.3.4 rejected",
+			"Tags":    "no_entry",
+			"Actions": "",
+		},
+	} {
+		r := receive(t, requests)
+		for key, value := range expected {
+			if actual := r.header.Get(key); actual != value {
+				t.Errorf("%v: actual: %q expected: %q", key, actual, value)
+			}
+		}
+	}
+}
+
+func TestWebhook_Send_Request(t *testing.T) {
+	server, requests := newServer(t, http.StatusOK)
+
+	msg := testMessage
+	msg.Event = firewall.EventRequest
+	msg.Request = &firewall.AccessRequest{
+		ID:        "abc",
+		Owner:     "alice",
+		Reason:    "on call",
+		ExpiresAt: firewall.MustParseDateTime("2001-01-02 10:00:00"),
+	}
+	msg.ApproveURL = "https://ipfilter.test/requests/abc/approve"
+	msg.RejectURL = "https://ipfilter.test/requests/abc/reject"
+	if err := notify.NewWebhook(server.URL, "").Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload notify.WebhookPayload
+	if err := json.Unmarshal(receive(t, requests).body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	expected := notify.WebhookRequest{
+		ID:         "abc",
+		Reason:     "on call",
+		ExpiresAt:  firewall.MustParseDateTime("2001-01-02 10:00:00"),
+		ApproveURL: "https://ipfilter.test/requests/abc/approve",
+		RejectURL:  "https://ipfilter.test/requests/abc/reject",
+	}
+	if payload.Request == nil || *payload.Request != expected {
+		t.Errorf("actual: %+v expected: %+v", payload.Request, expected)
+	}
+	if payload.Text != "1.2.3.4 (home) requested by alice: on call" {
+		t.Errorf("unexpected text: %v", payload.Text)
+	}
+}
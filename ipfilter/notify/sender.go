@@ -0,0 +1,237 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/firewall"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 of the webhook body, as 'sha256=<hex>'.
+	SignatureHeader = "X-Ipfilter-Signature-256"
+	// EventHeader carries the event type of the webhook.
+	EventHeader = "X-Ipfilter-Event"
+)
+
+// sendTimeout limits a single delivery attempt.
+const sendTimeout = 10 * time.Second
+
+// StatusError is returned for a response with a status other than 2xx.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.StatusCode)
+}
+
+// retryable reports whether a failed delivery may succeed later: a network error,
+// a server error or too many requests.
+func retryable(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+	return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+}
+
+var httpClient = &http.Client{Timeout: sendTimeout}
+
+func post(ctx context.Context, url string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext(): %w", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("post: %w", err)
+	}
+	defer resp.Body.Close()
+	// read to reuse the connection
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// WebhookPayload is the JSON body of the generic webhook.
+type WebhookPayload struct {
+	Event string       `json:"event"`
+	Time  time.Time    `json:"time"`
+	Text  string       `json:"text"`
+	Entry WebhookEntry `json:"entry"`
+	// Request is set for the events of the access requests.
+	Request *WebhookRequest `json:"request,omitempty"`
+}
+
+// WebhookEntry is the entry of the event, with the names of the JSON API.
+type WebhookEntry struct {
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	TTLSeconds int64     `json:"ttl_seconds,omitempty"`
+	Owner      string    `json:"owner,omitempty"`
+	Label      string    `json:"label,omitempty"`
+}
+
+// WebhookRequest is the access request of the event. The links are set for the request event only.
+type WebhookRequest struct {
+	ID         string    `json:"id"`
+	Reason     string    `json:"reason"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	DecidedBy  string    `json:"decided_by,omitempty"`
+	ApproveURL string    `json:"approve_url,omitempty"`
+	RejectURL  string    `json:"reject_url,omitempty"`
+}
+
+// Webhook posts the messages as JSON. The body is signed with HMAC-SHA256 when the secret is set.
+type Webhook struct {
+	url    string
+	secret string
+}
+
+func NewWebhook(url, secret string) *Webhook {
+	return &Webhook{
+		url:    url,
+		secret: secret,
+	}
+}
+
+func (s *Webhook) Send(ctx context.Context, msg Message) error {
+	payload := WebhookPayload{
+		Event: string(msg.Event),
+		Time:  msg.Time,
+		Text:  msg.Text(),
+		Entry: WebhookEntry{
+			IP:         msg.Entry.IP,
+			CreatedAt:  msg.Entry.CreatedAt,
+			UpdatedAt:  msg.Entry.UpdatedAt,
+			ExpiresAt:  msg.ExpiresAt,
+			TTLSeconds: int64(msg.Entry.TTL / time.Second),
+			Owner:      msg.Entry.Owner,
+			Label:      msg.Entry.Label,
+		},
+	}
+	if msg.Request != nil {
+		payload.Request = &WebhookRequest{
+			ID:         msg.Request.ID,
+			Reason:     msg.Request.Reason,
+			ExpiresAt:  msg.Request.ExpiresAt,
+			DecidedBy:  msg.Request.DecidedBy,
+			ApproveURL: msg.ApproveURL,
+			RejectURL:  msg.RejectURL,
+		}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("json.Marshal(): %w", err)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set(EventHeader, string(msg.Event))
+	if len(s.secret) > 0 {
+		header.Set(SignatureHeader, Sign(s.secret, body))
+	}
+
+	return post(ctx, s.url, body, header)
+}
+
+// Sign returns the signature of the webhook body, to be compared by the receiver with hmac.Equal.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Slack posts the messages to a Slack or Mattermost incoming webhook.
+type Slack struct {
+	url string
+}
+
+func NewSlack(url string) *Slack {
+	return &Slack{
+		url: url,
+	}
+}
+
+// slackEscaper escapes the control characters of the Slack and Mattermost markup, so a label or a reason
+// cannot add links or mentions, e.g. '<!channel>'.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func (s *Slack) Send(ctx context.Context, msg Message) error {
+	text := slackEscaper.Replace(msg.Text())
+	if len(msg.ApproveURL) > 0 {
+		text += "\n<" + msg.ApproveURL + "|approve> | <" + msg.RejectURL + "|reject>"
+	}
+
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return fmt.Errorf("json.Marshal(): %w", err)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+
+	return post(ctx, s.url, body, header)
+}
+
+// Ntfy publishes the messages to an ntfy topic, e.g. https://ntfy.sh/my-topic.
+type Ntfy struct {
+	url   string
+	token string
+}
+
+// NewNtfy creates the sender to the topic URL. The token is sent as a bearer token when it is set.
+func NewNtfy(url, token string) *Ntfy {
+	return &Ntfy{
+		url:   url,
+		token: token,
+	}
+}
+
+// ntfyTags are the tags of the events, shown by ntfy as emojis.
+var ntfyTags = map[firewall.EventType]string{
+	firewall.EventAdd:     "unlock",
+	firewall.EventRenew:   "repeat",
+	firewall.EventDelete:  "lock",
+	firewall.EventExpire:  "hourglass",
+	firewall.EventRequest: "raising_hand",
+	firewall.EventApprove: "white_check_mark",
+	firewall.EventReject:  "no_entry",
+}
+
+func (s *Ntfy) Send(ctx context.Context, msg Message) error {
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Title", "ipfilter: "+msg.Entry.IP+" "+msg.verb())
+	if tag, ok := ntfyTags[msg.Event]; ok {
+		header.Set("Tags", tag)
+	}
+	if len(msg.ApproveURL) > 0 {
+		header.Set("Actions", "view, Approve, "+msg.ApproveURL+"; view, Reject, "+msg.RejectURL)
+	}
+	if len(s.token) > 0 {
+		header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	return post(ctx, s.url, []byte(msg.Text()), header)
+}
@@ -0,0 +1,277 @@
+// Package proxy provides a TCP (L4) gatekeeper proxy which lets through
+// only the connections from addresses present in the firewall registry.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registry is the live allowlist consulted for every accepted connection.
+type Registry interface {
+	Contains(ip string) bool
+}
+
+// Rule forwards connections accepted on Listen to Backend.
+type Rule struct {
+	Listen  string
+	Backend string
+}
+
+// ParseRule parses a rule in the form 'listen=backend', e.g. ':15432=127.0.0.1:5432'.
+func ParseRule(value string) (Rule, error) {
+	listen, backend, ok := strings.Cut(value, "=")
+	if !ok || len(listen) == 0 || len(backend) == 0 {
+		return Rule{}, fmt.Errorf("invalid proxy rule %q: expected listen=backend", value)
+	}
+
+	return Rule{
+		Listen:  listen,
+		Backend: backend,
+	}, nil
+}
+
+type config struct {
+	dropOnRevoke bool
+	dialTimeout  time.Duration
+}
+
+// WithDropOnRevoke makes the gatekeeper close established connections
+// when their address is removed from the registry.
+func WithDropOnRevoke() func(*config) {
+	return func(c *config) {
+		c.dropOnRevoke = true
+	}
+}
+
+func WithDialTimeout(timeout time.Duration) func(*config) {
+	return func(c *config) {
+		c.dialTimeout = timeout
+	}
+}
+
+// Gatekeeper accepts TCP connections for the configured rules and splices
+// the allowed ones to their backends. It implements firewall.Backend, so
+// it is notified about revoked addresses by the firewall service.
+type Gatekeeper struct {
+	rules        []Rule
+	dropOnRevoke bool
+	dialTimeout  time.Duration
+
+	mu    sync.Mutex
+	conns map[netip.Addr]map[net.Conn]func()
+}
+
+func NewGatekeeper(rules []Rule, opts ...func(*config)) *Gatekeeper {
+	cnf := config{
+		dialTimeout: 10 * time.Second,
+	}
+	for _, ops := range opts {
+		ops(&cnf)
+	}
+
+	return &Gatekeeper{
+		rules:        rules,
+		dropOnRevoke: cnf.dropOnRevoke,
+		dialTimeout:  cnf.dialTimeout,
+		conns:        make(map[netip.Addr]map[net.Conn]func()),
+	}
+}
+
+// Allow does nothing, as the registry is checked on every accepted connection.
+func (g *Gatekeeper) Allow(_ context.Context, _ string) error {
+	return nil
+}
+
+// Revoke closes established connections from ip when the gatekeeper
+// is configured to drop them.
+func (g *Gatekeeper) Revoke(_ context.Context, ip string) error {
+	if !g.dropOnRevoke {
+		return nil
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return fmt.Errorf("netip.ParseAddr(): %w", err)
+	}
+
+	g.mu.Lock()
+	conns := g.conns[addr.Unmap()]
+	delete(g.conns, addr.Unmap())
+	g.mu.Unlock()
+
+	for conn, closeFunc := range conns {
+		log.Printf("proxy: dropping connection from %v", conn.RemoteAddr())
+		closeFunc()
+	}
+
+	return nil
+}
+
+// Serve listens on all rules and blocks until ctx is done or a listener fails.
+func (g *Gatekeeper) Serve(ctx context.Context, registry Registry) error {
+	listeners := make([]net.Listener, 0, len(g.rules))
+	closeAll := func() {
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+	}
+
+	var lc net.ListenConfig
+	for _, rule := range g.rules {
+		l, err := lc.Listen(ctx, "tcp", rule.Listen)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("listen %v: %w", rule.Listen, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(listeners))
+	for i, l := range listeners {
+		wg.Add(1)
+		go func(l net.Listener, rule Rule) {
+			defer wg.Done()
+			errCh <- g.acceptLoop(ctx, l, rule, registry)
+		}(l, g.rules[i])
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errCh:
+	}
+	closeAll()
+	wg.Wait()
+
+	return err
+}
+
+func (g *Gatekeeper) acceptLoop(ctx context.Context, l net.Listener, rule Rule, registry Registry) error {
+	log.Printf("proxy: listening on %v, forwarding to %v", l.Addr(), rule.Backend)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("accept on %v: %w", rule.Listen, err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.handle(ctx, conn, rule, registry)
+		}()
+	}
+}
+
+func (g *Gatekeeper) handle(ctx context.Context, conn net.Conn, rule Rule, registry Registry) {
+	defer conn.Close()
+
+	addrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		log.Println(fmt.Errorf("netip.ParseAddrPort(): %w", err))
+		return
+	}
+	addr := addrPort.Addr().Unmap()
+
+	if !registry.Contains(addr.String()) {
+		log.Printf("proxy: rejected connection from %v to %v", addr, rule.Listen)
+		return
+	}
+
+	dialer := net.Dialer{Timeout: g.dialTimeout}
+	backendConn, err := dialer.DialContext(ctx, "tcp", rule.Backend)
+	if err != nil {
+		log.Println(fmt.Errorf("proxy: dial backend %v: %w", rule.Backend, err))
+		return
+	}
+	defer backendConn.Close()
+
+	closeBoth := func() {
+		_ = conn.Close()
+		_ = backendConn.Close()
+	}
+
+	g.track(addr, conn, closeBoth)
+	defer g.untrack(addr, conn)
+
+	// the registry may have been changed between the check and tracking the connection
+	if !registry.Contains(addr.String()) {
+		return
+	}
+
+	log.Printf("proxy: accepted connection from %v to %v", addr, rule.Backend)
+
+	// close both ends when the proxy is shutting down
+	stop := context.AfterFunc(ctx, closeBoth)
+	defer stop()
+
+	splice(conn, backendConn)
+}
+
+func (g *Gatekeeper) track(addr netip.Addr, conn net.Conn, closeFunc func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	conns, ok := g.conns[addr]
+	if !ok {
+		conns = make(map[net.Conn]func())
+		g.conns[addr] = conns
+	}
+	conns[conn] = closeFunc
+}
+
+func (g *Gatekeeper) untrack(addr netip.Addr, conn net.Conn) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	conns := g.conns[addr]
+	delete(conns, conn)
+	if len(conns) == 0 {
+		delete(g.conns, addr)
+	}
+}
+
+// splice copies data in both directions until both sides are done.
+// When one side is closed then the other side is closed too,
+// so that dropping a client connection also ends the backend one.
+func splice(client, backend net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(backend, client)
+		closeWrite(backend)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(client, backend)
+		closeWrite(client)
+	}()
+
+	wg.Wait()
+}
+
+func closeWrite(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
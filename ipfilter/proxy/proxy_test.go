@@ -0,0 +1,221 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/dkarczmarski/gomisc/ipfilter/proxy"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type registryStub struct {
+	mu  sync.Mutex
+	ips map[string]bool
+}
+
+func (r *registryStub) Contains(ip string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ips[ip]
+}
+
+func TestParseRule(t *testing.T) {
+	for _, tt := range []struct {
+		value        string
+		expectedRule proxy.Rule
+		expectedErr  bool
+	}{
+		{
+			value:        ":15432=127.0.0.1:5432",
+			expectedRule: proxy.Rule{Listen: ":15432", Backend: "127.0.0.1:5432"},
+		},
+		{value: ":15432", expectedErr: true},
+		{value: "=127.0.0.1:5432", expectedErr: true},
+		{value: ":15432=", expectedErr: true},
+	} {
+		t.Run(tt.value, func(t *testing.T) {
+			rule, err := proxy.ParseRule(tt.value)
+			if (err != nil) != tt.expectedErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rule != tt.expectedRule {
+				t.Errorf("actual: %+v, expected: %+v", rule, tt.expectedRule)
+			}
+		})
+	}
+}
+
+func TestGatekeeper(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		allowed      bool
+		dropOnRevoke bool
+		revoke       bool
+		expectedEcho bool
+		expectedDrop bool
+	}{
+		{
+			name:         "allowed address is spliced to the backend",
+			allowed:      true,
+			expectedEcho: true,
+		},
+		{
+			name:         "not allowed address is rejected",
+			allowed:      false,
+			expectedDrop: true,
+		},
+		{
+			name:         "revoked address is dropped",
+			allowed:      true,
+			dropOnRevoke: true,
+			revoke:       true,
+			expectedEcho: true,
+			expectedDrop: true,
+		},
+		{
+			name:         "revoked address is kept without drop on revoke",
+			allowed:      true,
+			revoke:       true,
+			expectedEcho: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			backendAddr := runEchoServer(t)
+			listenAddr := freeAddr(t)
+
+			gatekeeper := newGatekeeper(listenAddr, backendAddr, tt.dropOnRevoke)
+			registry := &registryStub{ips: map[string]bool{"127.0.0.1": tt.allowed}}
+
+			var wg sync.WaitGroup
+			proxy.RunGatekeeperTask(ctx, &wg, gatekeeper, registry, make(chan error, 1))
+			defer wg.Wait()
+			defer cancel()
+
+			conn := dial(t, listenAddr)
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			_, _ = conn.Write([]byte("ping\n"))
+			line, err := reader.ReadString('\n')
+			if tt.expectedEcho != (err == nil && line == "ping\n") {
+				t.Fatalf("echo: line=%q err=%v", line, err)
+			}
+
+			if tt.revoke {
+				if err := gatekeeper.Revoke(ctx, "127.0.0.1"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if tt.expectedDrop {
+				_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+				if _, err := reader.ReadString('\n'); !errors.Is(err, io.EOF) && !isConnReset(err) {
+					t.Errorf("expected closed connection, got: %v", err)
+				}
+			} else {
+				_, _ = conn.Write([]byte("pong\n"))
+				if line, err := reader.ReadString('\n'); err != nil || line != "pong\n" {
+					t.Errorf("expected open connection: line=%q err=%v", line, err)
+				}
+			}
+		})
+	}
+}
+
+func newGatekeeper(listenAddr, backendAddr string, dropOnRevoke bool) *proxy.Gatekeeper {
+	rules := []proxy.Rule{{Listen: listenAddr, Backend: backendAddr}}
+	if dropOnRevoke {
+		return proxy.NewGatekeeper(rules, proxy.WithDropOnRevoke())
+	}
+	return proxy.NewGatekeeper(rules)
+}
+
+func runEchoServer(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	// the gatekeeper listens asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func isConnReset(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+func TestRunGatekeeperTask_PortInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 1)
+	proxy.RunGatekeeperTask(context.Background(), &wg, newGatekeeper(l.Addr().String(), runEchoServer(t), false),
+		&registryStub{}, errs)
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("expected error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error for the port in use")
+	}
+	wg.Wait()
+}
@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// RunGatekeeperTask serves the proxy until the context is done. A failure of the proxy, e.g. a port
+// in use, is sent to errs, so the process does not keep running without it.
+func RunGatekeeperTask(ctx context.Context, wg *sync.WaitGroup, gatekeeper *Gatekeeper, registry Registry, errs chan<- error) {
+	wg.Add(1)
+	go runGatekeeperTask(ctx, wg, gatekeeper, registry, errs)
+}
+
+func runGatekeeperTask(ctx context.Context, wg *sync.WaitGroup, gatekeeper *Gatekeeper, registry Registry, errs chan<- error) {
+	defer wg.Done()
+
+	if err := gatekeeper.Serve(ctx, registry); err != nil {
+		errs <- fmt.Errorf("proxy: %w", err)
+	}
+
+	log.Println("proxy is shut down")
+}
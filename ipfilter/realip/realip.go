@@ -0,0 +1,210 @@
+// Package realip resolves the IP address of the client of a request which
+// can come through trusted reverse proxies.
+package realip
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// The headers in which the reverse proxies pass the client address.
+const (
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderXRealIP       = "X-Real-IP"
+	// HeaderForwarded is the RFC 7239 header, e.g. 'Forwarded: for=192.0.2.43, for="[2001:db8::17]:4711"'.
+	HeaderForwarded = "Forwarded"
+)
+
+// Headers are the supported headers.
+var Headers = []string{HeaderXForwardedFor, HeaderXRealIP, HeaderForwarded}
+
+type config struct {
+	header          string
+	trustUnixSocket bool
+}
+
+type Option func(*config)
+
+// WithHeader sets the header set by the proxies: X-Forwarded-For (the default), X-Real-IP or Forwarded.
+// Only one header is used, so a client cannot add another one which the proxies pass unchanged.
+func WithHeader(header string) Option {
+	return func(c *config) {
+		c.header = header
+	}
+}
+
+// WithTrustUnixSocket trusts the header of the connections over a unix socket, e.g. from a local proxy.
+// They are not trusted by default, as any local process with access to the socket can set it.
+func WithTrustUnixSocket(trust bool) Option {
+	return func(c *config) {
+		c.trustUnixSocket = trust
+	}
+}
+
+// Resolver takes the client address from the header only when the request comes from a trusted proxy.
+// Then the address is the right-most hop of the header which is not a trusted proxy, as the hops
+// on its left can be set by the client. A nil Resolver uses the address of the connection.
+type Resolver struct {
+	trustedProxies  []netip.Prefix
+	header          string
+	trustUnixSocket bool
+}
+
+// NewResolver creates a resolver trusting the proxies.
+func NewResolver(trustedProxies []netip.Prefix, opts ...Option) *Resolver {
+	cnf := config{
+		header: HeaderXForwardedFor,
+	}
+	for _, opt := range opts {
+		opt(&cnf)
+	}
+
+	return &Resolver{
+		trustedProxies:  trustedProxies,
+		header:          cnf.header,
+		trustUnixSocket: cnf.trustUnixSocket,
+	}
+}
+
+// ClientIP returns the address of the client. It is the host of r.RemoteAddr
+// when the request does not come from a trusted proxy or has no valid header.
+func (res *Resolver) ClientIP(r *http.Request) string {
+	peer := remoteHost(r)
+	if res == nil {
+		return peer
+	}
+
+	peerAddr, err := netip.ParseAddr(peer)
+	switch {
+	case err != nil && !res.trustUnixSocket:
+		// a connection without an IP address comes over a unix socket
+		return peer
+	case err == nil && !res.trusted(peerAddr):
+		return peer
+	}
+
+	var hops []string
+	if strings.EqualFold(res.header, HeaderForwarded) {
+		hops = forwardedHops(r.Header.Values(HeaderForwarded))
+	} else {
+		hops = listHops(r.Header.Values(res.header))
+	}
+
+	clientIP := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHop(hops[i])
+		if !ok {
+			// an obfuscated or invalid hop hides the addresses on its left
+			break
+		}
+		clientIP = addr.String()
+		if !res.trusted(addr) {
+			break
+		}
+	}
+
+	return clientIP
+}
+
+// Middleware resolves the client address once for the request. It is returned by FromRequest.
+func (res *Resolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, res.ClientIP(r))))
+	})
+}
+
+func (res *Resolver) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range res.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type clientIPKey struct{}
+
+// FromRequest returns the client address resolved by Middleware, or else the host of r.RemoteAddr.
+// For a connection over a unix socket, it can be not an IP address.
+func FromRequest(r *http.Request) string {
+	if clientIP := FromContext(r.Context()); len(clientIP) > 0 {
+		return clientIP
+	}
+	return remoteHost(r)
+}
+
+// FromContext returns the client address resolved by Middleware or an empty string.
+func FromContext(ctx context.Context) string {
+	clientIP, _ := ctx.Value(clientIPKey{}).(string)
+	return clientIP
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// listHops splits the comma-separated lists of the header lines.
+func listHops(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// forwardedHops returns the 'for' parameters of the Forwarded elements. An element without it
+// gives an empty hop.
+func forwardedHops(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			hop := ""
+			for _, pair := range splitQuoted(element, ';') {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					hop = strings.Trim(value, `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// splitQuoted splits s by the separator outside the quoted strings.
+func splitQuoted(s string, sep rune) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseHop parses an address with an optional port, e.g. '192.0.2.1', '192.0.2.1:80', '[2001:db8::1]:80'.
+func parseHop(hop string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(hop); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")); err == nil {
+		return addr.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,187 @@
+package realip_test
+
+import (
+	"github.com/dkarczmarski/gomisc/ipfilter/realip"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestResolver_ClientIP(t *testing.T) {
+	trustedProxies := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fd00::/8"),
+	}
+
+	for _, tt := range []struct {
+		name       string
+		resolver   *realip.Resolver
+		remoteAddr string
+		headers    map[string][]string
+		expected   string
+	}{
+		{
+			name:       "nil resolver",
+			resolver:   nil,
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"192.0.2.1"}},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "no trusted proxies",
+			resolver:   realip.NewResolver(nil),
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"192.0.2.1"}},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "untrusted peer",
+			resolver:   realip.NewResolver(trustedProxies),
+			remoteAddr: "192.0.2.9:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"192.0.2.1"}},
+			expected:   "192.0.2.9",
+		},
+		{
+			name:       "trusted peer without header",
+			resolver:   realip.NewResolver(trustedProxies),
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "x-forwarded-for",
+			resolver:   realip.NewResolver(trustedProxies),
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"192.0.2.1"}},
+			expected:   "192.0.2.1",
+		},
+		{
+			name:       "x-forwarded-for spoofed by the client",
+			resolver:   realip.NewResolver(trustedProxies),
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.1, 192.0.2.1"}},
+			expected:   "192.0.2.1",
+		},
+		{
+			name:       "x-forwarded-for through trusted proxies in many lines",
+			resolver:   realip.NewResolver(trustedProxies),
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.1, 192.0.2.1", "10.0.0.2, 10.0.0.3"}},
+			expected:   "192.0.2.1",
+		},
+		{
+			name:       "x-forwarded-for of trusted proxies only",
+			resolver:   realip.NewResolver(trustedProxies),
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			expected:   "10.0.0.3",
+		},
+		{
+			name:       "x-forwarded-for with invalid hop",
+			resolver:   realip.NewResolver(trustedProxies),
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"192.0.2.1, garbage, 10.0.0.2"}},
+			expected:   "10.0.0.2",
+		},
+		{
+			name:       "x-forwarded-for with ipv6 and ipv4-mapped addresses",
+			resolver:   realip.NewResolver(trustedProxies),
+			remoteAddr: "[fd00::1]:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"2001:db8::1, ::ffff:10.0.0.2"}},
+			expected:   "2001:db8::1",
+		},
+		{
+			name:       "other header is ignored",
+			resolver:   realip.NewResolver(trustedProxies),
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Real-IP": {"192.0.2.1"}},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "x-real-ip",
+			resolver:   realip.NewResolver(trustedProxies, realip.WithHeader(realip.HeaderXRealIP)),
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Real-IP": {"192.0.2.1"}, "X-Forwarded-For": {"198.51.100.1"}},
+			expected:   "192.0.2.1",
+		},
+		{
+			name:       "forwarded",
+			resolver:   realip.NewResolver(trustedProxies, realip.WithHeader(realip.HeaderForwarded)),
+			remoteAddr: "10.0.0.1:1234",
+			headers: map[string][]string{"Forwarded": {
+				`for=198.51.100.1;proto=http, for="192.0.2.1:4711";by=10.0.0.2`,
+				`For="[fd00::2]:80";host="a,b;c"`,
+			}},
+			expected: "192.0.2.1",
+		},
+		{
+			name:       "forwarded ipv6",
+			resolver:   realip.NewResolver(trustedProxies, realip.WithHeader(realip.HeaderForwarded)),
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"Forwarded": {`for="[2001:db8:cafe::17]:4711"`}},
+			expected:   "2001:db8:cafe::17",
+		},
+		{
+			name:       "forwarded obfuscated",
+			resolver:   realip.NewResolver(trustedProxies, realip.WithHeader(realip.HeaderForwarded)),
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"Forwarded": {`for=192.0.2.1, for=_hidden, proto=https`}},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "unix socket",
+			resolver:   realip.NewResolver(trustedProxies),
+			remoteAddr: "@",
+			headers:    map[string][]string{"X-Forwarded-For": {"192.0.2.1"}},
+			expected:   "@",
+		},
+		{
+			name:       "trusted unix socket",
+			resolver:   realip.NewResolver(nil, realip.WithTrustUnixSocket(true)),
+			remoteAddr: "@",
+			headers:    map[string][]string{"X-Forwarded-For": {"192.0.2.1"}},
+			expected:   "192.0.2.1",
+		},
+		{
+			name:       "trusted unix socket without header",
+			resolver:   realip.NewResolver(trustedProxies, realip.WithTrustUnixSocket(true)),
+			remoteAddr: "@",
+			expected:   "@",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for name, values := range tt.headers {
+				for _, value := range values {
+					r.Header.Add(name, value)
+				}
+			}
+
+			if actual := tt.resolver.ClientIP(r); actual != tt.expected {
+				t.Errorf("actual: %v expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestResolver_Middleware(t *testing.T) {
+	resolver := realip.NewResolver([]netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")})
+
+	var actual string
+	handler := resolver.Middleware(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		actual = realip.FromRequest(r)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "192.0.2.1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if actual != "192.0.2.1" {
+		t.Errorf("actual: %v expected: %v", actual, "192.0.2.1")
+	}
+	if fallback := realip.FromRequest(r); fallback != "10.0.0.1" {
+		t.Errorf("fallback: actual: %v expected: %v", fallback, "10.0.0.1")
+	}
+}
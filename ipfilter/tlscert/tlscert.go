@@ -0,0 +1,226 @@
+// Package tlscert provides the TLS certificate of the server, reloaded when
+// its files change, and the generation of a self-signed certificate.
+package tlscert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Certificate is a certificate and its private key loaded from PEM files.
+// It can be reloaded when the files change, e.g. after a renewal.
+type Certificate struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.RWMutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func Load(certFile, keyFile string) (*Certificate, error) {
+	c := &Certificate{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Certificate) CertFile() string {
+	return c.certFile
+}
+
+// GetCertificate returns the current certificate. It is meant for tls.Config.GetCertificate.
+func (c *Certificate) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.cert, nil
+}
+
+// Fingerprint returns the SHA-256 digest of the current certificate, e.g. to be compared by the users
+// of a self-signed certificate.
+func (c *Certificate) Fingerprint() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	digest := sha256.Sum256(c.cert.Certificate[0])
+	return strings.ToUpper(hex.EncodeToString(digest[:]))
+}
+
+// Reload reads the files again when the modification time of any of them has changed.
+// It reports whether the certificate has been reloaded. On error the previous certificate is kept.
+func (c *Certificate) Reload() (bool, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return false, fmt.Errorf("os.Stat(): %w", err)
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("os.Stat(): %w", err)
+	}
+
+	c.mu.RLock()
+	unchanged := c.cert != nil && certInfo.ModTime().Equal(c.certModTime) && keyInfo.ModTime().Equal(c.keyModTime)
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("tls.LoadX509KeyPair(): %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cert = &cert
+	c.certModTime = certInfo.ModTime()
+	c.keyModTime = keyInfo.ModTime()
+
+	return true, nil
+}
+
+func RunWatchTask(ctx context.Context, wg *sync.WaitGroup, cert *Certificate, interval time.Duration) {
+	wg.Add(1)
+	go runWatchTask(ctx, wg, cert, interval)
+}
+
+func runWatchTask(ctx context.Context, wg *sync.WaitGroup, cert *Certificate, interval time.Duration) {
+	defer wg.Done()
+
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+
+		reloaded, err := cert.Reload()
+		if err != nil {
+			log.Printf("tls: %v", err)
+			continue
+		}
+		if reloaded {
+			log.Printf("tls: reloaded %v, fingerprint %v", cert.CertFile(), cert.Fingerprint())
+		}
+	}
+}
+
+// GenerateSelfSigned writes a self-signed certificate for the hosts (names or IP addresses)
+// and its private key, unless the certificate file already exists. It reports whether the files were written.
+func GenerateSelfSigned(certFile, keyFile string, hosts []string, validFor time.Duration) (bool, error) {
+	if _, err := os.Stat(certFile); err == nil {
+		return false, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("os.Stat(): %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return false, fmt.Errorf("ecdsa.GenerateKey(): %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return false, fmt.Errorf("rand.Int(): %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "ipfilter", Organization: []string{"ipfilter self-signed"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return false, fmt.Errorf("x509.CreateCertificate(): %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return false, fmt.Errorf("x509.MarshalPKCS8PrivateKey(): %w", err)
+	}
+
+	// the key is written first, so a certificate file always has its key
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return false, fmt.Errorf("os.WriteFile(): %w", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return false, fmt.Errorf("os.WriteFile(): %w", err)
+	}
+
+	return true, nil
+}
+
+// NewServerConfig returns the TLS configuration serving the certificate. With a CA file, the client
+// certificates signed by the CA are verified, and required when requireClientCert is set.
+func NewServerConfig(cert *Certificate, clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cert.GetCertificate,
+	}
+
+	if len(clientCAFile) > 0 {
+		pool, err := LoadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// LoadCertPool reads the PEM encoded certificates of a CA.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile(): %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%v: no PEM certificate found", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,184 @@
+package tlscert_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/dkarczmarski/gomisc/ipfilter/tlscert"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func noError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGenerateSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	created, err := tlscert.GenerateSelfSigned(certFile, keyFile, []string{"localhost", "127.0.0.1"}, time.Hour)
+	noError(t, err)
+	if !created {
+		t.Fatalf("expected a new certificate")
+	}
+
+	cert, err := tlscert.Load(certFile, keyFile)
+	noError(t, err)
+	fingerprint := cert.Fingerprint()
+
+	leaf, err := tls.LoadX509KeyPair(certFile, keyFile)
+	noError(t, err)
+	parsed, err := x509.ParseCertificate(leaf.Certificate[0])
+	noError(t, err)
+	if err := parsed.VerifyHostname("localhost"); err != nil {
+		t.Errorf("VerifyHostname(): %v", err)
+	}
+	if err := parsed.VerifyHostname("127.0.0.1"); err != nil {
+		t.Errorf("VerifyHostname(): %v", err)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("key file: %v %v", info, err)
+	}
+
+	// an existing certificate is kept
+	created, err = tlscert.GenerateSelfSigned(certFile, keyFile, []string{"localhost"}, time.Hour)
+	noError(t, err)
+	if created {
+		t.Fatalf("expected the existing certificate to be kept")
+	}
+
+	reloaded, err := cert.Reload()
+	noError(t, err)
+	if reloaded {
+		t.Fatalf("reloaded unchanged files")
+	}
+
+	// a renewed certificate is reloaded
+	noError(t, os.Remove(certFile))
+	_, err = tlscert.GenerateSelfSigned(certFile, keyFile, []string{"localhost"}, time.Hour)
+	noError(t, err)
+	future := time.Now().Add(time.Minute)
+	noError(t, os.Chtimes(certFile, future, future))
+
+	reloaded, err = cert.Reload()
+	noError(t, err)
+	if !reloaded || cert.Fingerprint() == fingerprint {
+		t.Fatalf("reloaded: %v fingerprint: %v", reloaded, cert.Fingerprint())
+	}
+}
+
+func TestNewServerConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	_, err := tlscert.GenerateSelfSigned(certFile, keyFile, []string{"127.0.0.1"}, time.Hour)
+	noError(t, err)
+	cert, err := tlscert.Load(certFile, keyFile)
+	noError(t, err)
+
+	serverCAs, err := tlscert.LoadCertPool(certFile)
+	noError(t, err)
+
+	clientCAFile := filepath.Join(dir, "client-ca.pem")
+	clientCert := newClientCert(t, clientCAFile)
+
+	for _, tt := range []struct {
+		name              string
+		requireClientCert bool
+		clientCerts       []tls.Certificate
+		expectedErr       bool
+		expectedBody      string
+	}{
+		{
+			name:         "optional client certificate without one",
+			expectedBody: "verified: false",
+		},
+		{
+			name:         "optional client certificate",
+			clientCerts:  []tls.Certificate{clientCert},
+			expectedBody: "verified: true",
+		},
+		{
+			name:              "required client certificate without one",
+			requireClientCert: true,
+			expectedErr:       true,
+		},
+		{
+			name:              "required client certificate",
+			requireClientCert: true,
+			clientCerts:       []tls.Certificate{clientCert},
+			expectedBody:      "verified: true",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := tlscert.NewServerConfig(cert, clientCAFile, tt.requireClientCert)
+			noError(t, err)
+
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "verified: %v", len(r.TLS.VerifiedChains) > 0)
+			}))
+			// StartTLS would serve its own certificate
+			server.Listener = tls.NewListener(server.Listener, tlsConfig)
+			server.Start()
+			defer server.Close()
+
+			httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				RootCAs:      serverCAs,
+				Certificates: tt.clientCerts,
+			}}}
+			resp, err := httpClient.Get("https://" + server.Listener.Addr().String())
+			if tt.expectedErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			noError(t, err)
+			defer resp.Body.Close()
+
+			body := make([]byte, 64)
+			n, _ := resp.Body.Read(body)
+			if string(body[:n]) != tt.expectedBody {
+				t.Errorf("actual: %v expected: %v", string(body[:n]), tt.expectedBody)
+			}
+		})
+	}
+}
+
+// newClientCert creates a self-signed client certificate, written to caFile as its own CA.
+func newClientCert(t *testing.T, caFile string) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	noError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "alice"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	noError(t, err)
+	noError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
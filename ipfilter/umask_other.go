@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// umask does nothing where the files have no unix permissions.
+func umask(_ int) int {
+	return 0
+}
@@ -0,0 +1,10 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// umask sets the mask of the permissions of the created files and returns the previous one.
+func umask(mask int) int {
+	return syscall.Umask(mask)
+}